@@ -43,8 +43,11 @@ interface DbConfig {
 }
 
 interface SchemaInfo {
+  schemas: string[]
   tables: Array<{
+    schema: string
     name: string
+    kind: string
     columns: Array<{
       name: string
       type: string
@@ -108,7 +111,6 @@ export default function AiSqlTool() {
   const [queryExecuted, setQueryExecuted] = useState(false)
   const [queryHeaders, setQueryHeaders] = useState<string[]>([])
   const [queryRows, setQueryRows] = useState<string[][]>([])
-  const [queryHasTabs, setQueryHasTabs] = useState(false)
 
   // Schema selected table
   const [selectedTable, setSelectedTable] = useState<string | null>(null)
@@ -333,25 +335,24 @@ export default function AiSqlTool() {
         // 解析查询结果为表格数据
         const output = data.output || 'Query executed successfully (no results)'
         setQueryResult(output)
-        setQueryHasTabs(data.hasTabs || false)
-
-        // 解析表头和数据行
-        if (data.header && data.rows) {
-          if (data.hasTabs) {
-            // Tab-separated format (multiple columns)
-            const headers = data.header.split('\t')
-            const rows = data.rows.map((row: string) => row.split('\t'))
-            setQueryHeaders(headers)
-            setQueryRows(rows)
-          } else {
-            // Single column format (like SHOW TABLES)
-            setQueryHeaders([data.header])
-            setQueryRows(data.rows.map((row: string) => [row]))
-          }
+
+        // 解析列和数据行，NULL 显示为 NULL，JSON 值显示为文本
+        if (data.columns && data.rows) {
+          setQueryHeaders(data.columns.map((col: { name: string }) => col.name))
+          setQueryRows(data.rows.map((row: unknown[]) =>
+            row.map((value) => {
+              if (value === null) return 'NULL'
+              if (typeof value === 'object') return JSON.stringify(value)
+              return String(value)
+            })
+          ))
         } else {
           setQueryHeaders([])
           setQueryRows([])
         }
+        if (data.truncated) {
+          toast.warning(`Result truncated to ${data.rowCount} rows`)
+        }
 
         setQueryExecuted(true)
         toast.success(`Query executed - ${data.rowCount || 0} rows returned`)
@@ -382,6 +383,10 @@ export default function AiSqlTool() {
     }
   }
 
+  // Tables are named with their schema when several schemas are shown
+  const tableLabel = (table: SchemaInfo['tables'][number]) =>
+    schema && schema.schemas.length > 1 ? `${table.schema}.${table.name}` : table.name
+
   // Clear all
   const clearAll = () => {
     setNaturalInput('')
@@ -391,7 +396,6 @@ export default function AiSqlTool() {
     setQueryExecuted(false)
     setQueryHeaders([])
     setQueryRows([])
-    setQueryHasTabs(false)
   }
 
   // Load from history
@@ -403,7 +407,6 @@ export default function AiSqlTool() {
     setQueryExecuted(false)
     setQueryHeaders([])
     setQueryRows([])
-    setQueryHasTabs(false)
     // Restore database config
     if (item.dbConfig) {
       const savedConfig = { ...item.dbConfig, password: '' }
@@ -539,13 +542,13 @@ export default function AiSqlTool() {
                 <div className="schema-table-list">
                   {schema.tables.map((table) => (
                     <div
-                      key={table.name}
-                      className={`schema-table-item ${selectedTable === table.name ? 'active' : ''}`}
-                      onClick={() => setSelectedTable(table.name)}
+                      key={tableLabel(table)}
+                      className={`schema-table-item ${selectedTable === tableLabel(table) ? 'active' : ''}`}
+                      onClick={() => setSelectedTable(tableLabel(table))}
                     >
                       <div className="schema-table-item-name">
                         <Table size={12} />
-                        {table.name}
+                        {tableLabel(table)}
                       </div>
                       <span className="schema-table-item-count">{table.columns.length}</span>
                     </div>
@@ -567,7 +570,7 @@ export default function AiSqlTool() {
                       </div>
                       <div className="schema-detail-wrapper">
                         {(() => {
-                          const table = schema.tables.find(t => t.name === selectedTable)
+                          const table = schema.tables.find(t => tableLabel(t) === selectedTable)
                           if (!table) return null
                           return (
                             <table className="data-table">
@@ -710,7 +713,7 @@ export default function AiSqlTool() {
                 {queryError ? <X size={14} /> : <Check size={14} />}
                 <span>{queryError ? t.aisql.queryError : t.aisql.queryResult}</span>
               </div>
-              <button className="panel-btn" onClick={() => { setQueryResult(''); setQueryError(''); setQueryExecuted(false); setQueryHeaders([]); setQueryRows([]); setQueryHasTabs(false); }}>
+              <button className="panel-btn" onClick={() => { setQueryResult(''); setQueryError(''); setQueryExecuted(false); setQueryHeaders([]); setQueryRows([]); }}>
                 <X size={14} />
               </button>
             </div>
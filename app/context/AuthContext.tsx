@@ -1,6 +1,6 @@
 'use client';
 
-import { createContext, useContext, useEffect, useState } from 'react';
+import { createContext, useCallback, useContext, useEffect, useRef, useState } from 'react';
 import { useRouter, usePathname } from 'next/navigation';
 
 interface User {
@@ -8,12 +8,21 @@ interface User {
   username: string;
 }
 
+interface AuthResponse {
+  token: string;
+  refresh_token: string;
+  expires_in: number;
+  user: User;
+}
+
 interface AuthContextType {
   user: User | null;
   token: string | null;
-  login: (username: string, password: string) => Promise<void>;
+  // login resolves to a challenge token when a second factor is required
+  login: (username: string, password: string) => Promise<string | null>;
+  loginTwoFactor: (challengeToken: string, code: string) => Promise<void>;
   register: (username: string, password: string) => Promise<void>;
-  logout: () => void;
+  logout: () => Promise<void>;
   isLoading: boolean;
 }
 
@@ -21,46 +30,203 @@ const AuthContext = createContext<AuthContextType | undefined>(undefined);
 
 const API_BASE = process.env.NEXT_PUBLIC_API_URL || 'http://localhost:3001/api';
 
+const TOKEN_KEY = 'token';
+const REFRESH_TOKEN_KEY = 'refresh_token';
+const EXPIRES_AT_KEY = 'token_expires_at';
+
+// Access tokens are refreshed this long before they expire
+const REFRESH_MARGIN_MS = 60 * 1000;
+
+function storedExpiry(): number {
+  return Number(localStorage.getItem(EXPIRES_AT_KEY)) || 0;
+}
+
+function storeSession(data: AuthResponse) {
+  localStorage.setItem(TOKEN_KEY, data.token);
+  localStorage.setItem(REFRESH_TOKEN_KEY, data.refresh_token);
+  localStorage.setItem(EXPIRES_AT_KEY, String(Date.now() + data.expires_in * 1000));
+}
+
+function clearStoredSession() {
+  localStorage.removeItem(TOKEN_KEY);
+  localStorage.removeItem(REFRESH_TOKEN_KEY);
+  localStorage.removeItem(EXPIRES_AT_KEY);
+}
+
+// withRefreshLock runs fn while no other tab is refreshing. A refresh token
+// can be used once: a second use revokes the whole session.
+async function withRefreshLock<T>(fn: () => Promise<T>): Promise<T> {
+  if (typeof navigator !== 'undefined' && navigator.locks) {
+    return navigator.locks.request('auth-refresh', fn);
+  }
+  return fn();
+}
+
 export function AuthProvider({ children }: { children: React.ReactNode }) {
   const [user, setUser] = useState<User | null>(null);
   const [token, setToken] = useState<string | null>(null);
   const [isLoading, setIsLoading] = useState(true);
   const router = useRouter();
   const pathname = usePathname();
+  const refreshTimer = useRef<ReturnType<typeof setTimeout> | null>(null);
+  const refreshing = useRef<Promise<string | null> | null>(null);
 
-  useEffect(() => {
-    // Check for token in localStorage
-    const storedToken = localStorage.getItem('token');
-    if (storedToken) {
-      setToken(storedToken);
-      // Verify token and get user
-      fetch(`${API_BASE}/auth/me`, {
-        headers: {
-          Authorization: `Bearer ${storedToken}`,
-        },
+  const clearSession = useCallback(() => {
+    if (refreshTimer.current) {
+      clearTimeout(refreshTimer.current);
+      refreshTimer.current = null;
+    }
+    setToken(null);
+    setUser(null);
+    clearStoredSession();
+  }, []);
+
+  // The timer calls refresh through a ref, since refresh reschedules it
+  const refreshRef = useRef<() => Promise<string | null>>(async () => null);
+
+  const scheduleRefresh = useCallback(() => {
+    if (refreshTimer.current) {
+      clearTimeout(refreshTimer.current);
+    }
+    const delay = Math.max(storedExpiry() - Date.now() - REFRESH_MARGIN_MS, 5 * 1000);
+    refreshTimer.current = setTimeout(() => {
+      refreshRef.current();
+    }, delay);
+  }, []);
+
+  // refresh exchanges the stored refresh token for a new access token,
+  // unless another tab already did. It resolves to null when the session
+  // has ended.
+  const refresh = useCallback((): Promise<string | null> => {
+    if (!refreshing.current) {
+      refreshing.current = withRefreshLock(async () => {
+        if (storedExpiry() - Date.now() > REFRESH_MARGIN_MS) {
+          return localStorage.getItem(TOKEN_KEY);
+        }
+        const refreshToken = localStorage.getItem(REFRESH_TOKEN_KEY);
+        if (!refreshToken) {
+          return null;
+        }
+        const res = await fetch(`${API_BASE}/auth/refresh`, {
+          method: 'POST',
+          headers: {
+            'Content-Type': 'application/json',
+          },
+          body: JSON.stringify({ refresh_token: refreshToken }),
+        });
+        if (!res.ok) {
+          return null;
+        }
+        const data: AuthResponse = await res.json();
+        storeSession(data);
+        setUser(data.user);
+        return data.token;
       })
-        .then((res) => {
-          if (res.ok) {
-            return res.json();
+        .catch(() => null)
+        .then((newToken) => {
+          if (newToken) {
+            setToken(newToken);
+            scheduleRefresh();
+          } else {
+            clearSession();
+            router.push('/login');
           }
-          throw new Error('Invalid token');
-        })
-        .then((userData) => {
-          setUser(userData);
-        })
-        .catch(() => {
-          setToken(null);
-          setUser(null);
-          localStorage.removeItem('token');
-          router.push('/login');
+          return newToken;
         })
         .finally(() => {
-          setIsLoading(false);
+          refreshing.current = null;
         });
-    } else {
+    }
+    return refreshing.current;
+  }, [clearSession, router, scheduleRefresh]);
+
+  useEffect(() => {
+    refreshRef.current = refresh;
+  }, [refresh]);
+
+  const startSession = (data: AuthResponse) => {
+    storeSession(data);
+    setToken(data.token);
+    setUser(data.user);
+    scheduleRefresh();
+  };
+
+  useEffect(() => {
+    const storedToken = localStorage.getItem(TOKEN_KEY);
+    if (!storedToken) {
       setIsLoading(false);
+      return;
     }
-  }, [router]);
+
+    const fetchUser = (accessToken: string) =>
+      fetch(`${API_BASE}/auth/me`, {
+        headers: {
+          Authorization: `Bearer ${accessToken}`,
+        },
+      });
+
+    (async () => {
+      try {
+        let accessToken: string | null = storedToken;
+        if (storedExpiry() - Date.now() <= REFRESH_MARGIN_MS) {
+          accessToken = await refresh();
+        }
+        if (!accessToken) {
+          return;
+        }
+        let res = await fetchUser(accessToken);
+        if (res.status === 401) {
+          // The access token may have been revoked while the refresh token
+          // is still good, or the clock may be off
+          localStorage.removeItem(EXPIRES_AT_KEY);
+          accessToken = await refresh();
+          if (!accessToken) {
+            return;
+          }
+          res = await fetchUser(accessToken);
+        }
+        if (!res.ok) {
+          throw new Error('Invalid token');
+        }
+        setToken(accessToken);
+        setUser(await res.json());
+        scheduleRefresh();
+      } catch {
+        clearSession();
+        router.push('/login');
+      } finally {
+        setIsLoading(false);
+      }
+    })();
+
+    return () => {
+      if (refreshTimer.current) {
+        clearTimeout(refreshTimer.current);
+      }
+    };
+  }, [router, refresh, scheduleRefresh, clearSession]);
+
+  // Other tabs rotate the shared tokens and end the session for all tabs
+  useEffect(() => {
+    const onStorage = (e: StorageEvent) => {
+      if (e.key !== TOKEN_KEY) {
+        return;
+      }
+      if (e.newValue) {
+        setToken(e.newValue);
+        scheduleRefresh();
+      } else {
+        if (refreshTimer.current) {
+          clearTimeout(refreshTimer.current);
+          refreshTimer.current = null;
+        }
+        setToken(null);
+        setUser(null);
+      }
+    };
+    window.addEventListener('storage', onStorage);
+    return () => window.removeEventListener('storage', onStorage);
+  }, [scheduleRefresh]);
 
   const login = async (username: string, password: string) => {
     const res = await fetch(`${API_BASE}/auth/login`, {
@@ -76,10 +242,30 @@ export function AuthProvider({ children }: { children: React.ReactNode }) {
     if (!res.ok) {
       throw new Error(data.error || 'Login failed');
     }
+    if (data.two_factor_required) {
+      return data.challenge_token as string;
+    }
 
-    setToken(data.token);
-    setUser(data.user);
-    localStorage.setItem('token', data.token);
+    startSession(data);
+    return null;
+  };
+
+  const loginTwoFactor = async (challengeToken: string, code: string) => {
+    const res = await fetch(`${API_BASE}/auth/login/2fa`, {
+      method: 'POST',
+      headers: {
+        'Content-Type': 'application/json',
+      },
+      body: JSON.stringify({ challenge_token: challengeToken, code }),
+    });
+
+    const data = await res.json();
+
+    if (!res.ok) {
+      throw new Error(data.error || 'Verification failed');
+    }
+
+    startSession(data);
   };
 
   const register = async (username: string, password: string) => {
@@ -97,16 +283,27 @@ export function AuthProvider({ children }: { children: React.ReactNode }) {
       throw new Error(data.error || 'Registration failed');
     }
 
-    setToken(data.token);
-    setUser(data.user);
-    localStorage.setItem('token', data.token);
+    startSession(data);
   };
 
-  const logout = () => {
-    setToken(null);
-    setUser(null);
-    localStorage.removeItem('token');
+  const logout = async () => {
+    // Revoke the session on the server, so that neither token can be used
+    // again; the local session ends even if that fails
+    const accessToken = token;
+    clearSession();
     router.push('/login');
+    if (accessToken) {
+      try {
+        await fetch(`${API_BASE}/auth/logout`, {
+          method: 'POST',
+          headers: {
+            Authorization: `Bearer ${accessToken}`,
+          },
+        });
+      } catch (err) {
+        console.error('Failed to revoke session', err);
+      }
+    }
   };
 
   // Protected route check
@@ -120,7 +317,7 @@ export function AuthProvider({ children }: { children: React.ReactNode }) {
   }, [user, isLoading, pathname, router]);
 
   return (
-    <AuthContext.Provider value={{ user, token, login, register, logout, isLoading }}>
+    <AuthContext.Provider value={{ user, token, login, loginTwoFactor, register, logout, isLoading }}>
       {!isLoading && children}
     </AuthContext.Provider>
   );
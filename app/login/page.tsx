@@ -4,7 +4,7 @@ import { useState } from 'react';
 import Link from 'next/link';
 import { useRouter } from 'next/navigation';
 import { useAuth } from '@/app/context/AuthContext';
-import { Mail, Lock, AlertCircle } from 'lucide-react';
+import { Mail, Lock, KeyRound, AlertCircle } from 'lucide-react';
 import Layout from '@/app/components/Layout';
 import { AuthCard } from '@/app/components/ui/AuthCard';
 import { Input } from '@/app/components/ui/Input';
@@ -16,7 +16,11 @@ export default function LoginPage() {
   const [password, setPassword] = useState('');
   const [error, setError] = useState('');
   const [loading, setLoading] = useState(false);
-  const { login } = useAuth();
+  // challengeToken is set once the password was accepted and a second
+  // factor is required
+  const [challengeToken, setChallengeToken] = useState<string | null>(null);
+  const [code, setCode] = useState('');
+  const { login, loginTwoFactor } = useAuth();
   const router = useRouter();
 
   const handleSubmit = async (e: React.FormEvent) => {
@@ -25,7 +29,12 @@ export default function LoginPage() {
     setLoading(true);
 
     try {
-      await login(username, password);
+      const challenge = await login(username, password);
+      if (challenge) {
+        setChallengeToken(challenge);
+        setPassword('');
+        return;
+      }
       router.push('/');
     } catch (err: any) {
       setError(err.message || 'Failed to login');
@@ -34,6 +43,78 @@ export default function LoginPage() {
     }
   };
 
+  const handleTwoFactorSubmit = async (e: React.FormEvent) => {
+    e.preventDefault();
+    if (!challengeToken) return;
+    setError('');
+    setLoading(true);
+
+    try {
+      await loginTwoFactor(challengeToken, code.trim());
+      router.push('/');
+    } catch (err: any) {
+      setError(err.message || 'Failed to verify code');
+      setCode('');
+    } finally {
+      setLoading(false);
+    }
+  };
+
+  const restart = () => {
+    setChallengeToken(null);
+    setCode('');
+    setError('');
+  };
+
+  if (challengeToken) {
+    return (
+      <Layout>
+        <AuthCard
+          title="Two-factor authentication"
+          subtitle="Enter the code from your authenticator app, or one of your recovery codes"
+          footer={
+            <p>
+              Code expired?{' '}
+              <a href="#" onClick={(e) => { e.preventDefault(); restart(); }}>Sign in again</a>
+            </p>
+          }
+        >
+          {error && (
+            <div className="error-message">
+              <AlertCircle size={16} />
+              <span>{error}</span>
+            </div>
+          )}
+
+          <form className="auth-form" onSubmit={handleTwoFactorSubmit}>
+            <Input
+              id="code"
+              label="Verification code"
+              type="text"
+              inputMode="text"
+              autoComplete="one-time-code"
+              autoFocus
+              placeholder="123456"
+              value={code}
+              onChange={(e) => setCode(e.target.value)}
+              required
+              icon={<KeyRound size={18} />}
+            />
+
+            <LoadingButton
+              type="submit"
+              className="submit-btn"
+              isLoading={loading}
+              loadingText="Verifying..."
+            >
+              Verify
+            </LoadingButton>
+          </form>
+        </AuthCard>
+      </Layout>
+    );
+  }
+
   return (
     <Layout>
       <AuthCard
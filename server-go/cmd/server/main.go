@@ -2,19 +2,31 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/magenta9/ai-web-tools/server/internal/audit"
+	"github.com/magenta9/ai-web-tools/server/internal/auth"
 	"github.com/magenta9/ai-web-tools/server/internal/config"
+	"github.com/magenta9/ai-web-tools/server/internal/dbfile"
+	"github.com/magenta9/ai-web-tools/server/internal/dbpool"
 	"github.com/magenta9/ai-web-tools/server/internal/handler"
+	"github.com/magenta9/ai-web-tools/server/internal/llm"
 	"github.com/magenta9/ai-web-tools/server/internal/middleware"
 	"github.com/magenta9/ai-web-tools/server/internal/migration"
+	"github.com/magenta9/ai-web-tools/server/internal/model"
 	"github.com/magenta9/ai-web-tools/server/internal/repository"
+	"github.com/magenta9/ai-web-tools/server/internal/secrets"
 )
 
 func main() {
@@ -22,13 +34,44 @@ func main() {
 	migrateCmd := flag.NewFlagSet("migrate", flag.ExitOnError)
 	migrateAction := migrateCmd.String("action", "up", "Migration action: up, status, version")
 
+	configCmd := flag.NewFlagSet("config", flag.ExitOnError)
+	configFile := configCmd.String("file", "", "Config file to check (default: CONFIG_FILE or config/config.yaml)")
+
 	if len(os.Args) > 1 && os.Args[1] == "migrate" {
 		migrateCmd.Parse(os.Args[2:])
 		runMigrationCommand(*migrateAction)
 		return
 	}
 
-	cfg := config.Load()
+	adminCmd := flag.NewFlagSet("admin", flag.ExitOnError)
+	adminUsername := adminCmd.String("username", "", "User to promote to admin")
+
+	if len(os.Args) > 1 && os.Args[1] == "admin" {
+		if len(os.Args) < 3 || os.Args[2] != "bootstrap" {
+			log.Fatalf("Usage: %s admin bootstrap -username name", os.Args[0])
+		}
+		adminCmd.Parse(os.Args[3:])
+		runAdminBootstrap(*adminUsername)
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		if len(os.Args) < 3 || os.Args[2] != "check" {
+			log.Fatalf("Usage: %s config check [-file path]", os.Args[0])
+		}
+		configCmd.Parse(os.Args[3:])
+		runConfigCheck(*configFile)
+		return
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Invalid config:\n%v", err)
+	}
+	cfg.LogDiagnostics()
 
 	// Run auto migrations if enabled
 	if cfg.MigrationAuto {
@@ -46,28 +89,86 @@ func main() {
 		defer repo.Close()
 	}
 
+	tokens, err := auth.NewTokenManager(cfg)
+	if err != nil {
+		log.Fatalf("Failed to load JWT keys: %v", err)
+	}
+	var authStore middleware.AuthStore
+	var workspaceStore middleware.WorkspaceStore
+	var auditLog *audit.Logger
+	if repo != nil {
+		authStore = repo
+		workspaceStore = repo
+		auditLog = audit.NewLogger(repo, cfg.AuditMaxSQLLength)
+	}
+	authMW := middleware.AuthMiddleware(tokens, authStore)
+	workspaceMW := middleware.Workspace(workspaceStore)
+
+	// LLM provider instances
+	providers := llm.NewRegistry(cfg)
+
 	// Handlers
-	ollamaH := handler.NewOllamaHandler(cfg)
-	modelH := handler.NewModelHandler(cfg)
-	dbH := handler.NewDBHandler()
+	ollamaH := handler.NewOllamaHandler(cfg, providers)
+	modelH := handler.NewModelHandler(providers)
+	// Saved connections need the database and a master key
+	var connCipher *secrets.Cipher
+	if repo != nil && cfg.ConnectionKey != "" {
+		key, err := cfg.ConnectionKeyBytes()
+		if err == nil {
+			connCipher, err = secrets.NewCipher(key)
+		}
+		if err != nil {
+			log.Fatalf("Invalid connection key: %v", err)
+		}
+	}
+	dbFiles := dbfile.New(cfg.TargetFileDirs, cfg.TargetUploadDir, int64(cfg.TargetFileMaxBytes),
+		cfg.TargetUploadMaxFiles, int64(cfg.TargetUploadMaxTotal))
+	dbPools := dbpool.New(dbpool.Options{
+		MaxPerUser:          cfg.TargetPoolMaxPerUser,
+		IdleTimeout:         cfg.TargetPoolIdleTimeout,
+		HealthCheckInterval: cfg.TargetPoolHealthCheck,
+		MaxOpenConns:        cfg.TargetPoolMaxConns,
+		Open:                dbFiles.Open,
+	})
+	dbH := handler.NewDBHandler(cfg, auditLog, repo, connCipher, dbPools, dbFiles)
 	var historyH *handler.HistoryHandler
 	var promptH *handler.PromptHandler
 	var authH *handler.AuthHandler
+	var oidcH *handler.OIDCHandler
+	var apiKeyH *handler.APIKeyHandler
+	var adminH *handler.AdminHandler
+	var workspaceH *handler.WorkspaceHandler
+	var chatH *handler.ChatHandler
 
 	if repo != nil {
-		historyH = handler.NewHistoryHandler(repo)
-		promptH = handler.NewPromptHandler(repo)
-		authH = handler.NewAuthHandler(repo, cfg)
+		go pruneAuthRecords(repo, cfg.LoginFailureWindow)
+		if cfg.AuditRetention > 0 {
+			go pruneAuditLog(repo, cfg.AuditRetention)
+		}
+
+		apiKeyH = handler.NewAPIKeyHandler(repo)
+		adminH = handler.NewAdminHandler(repo, auditLog)
+		historyH = handler.NewHistoryHandler(repo, auditLog)
+		promptH = handler.NewPromptHandler(repo, auditLog)
+		workspaceH = handler.NewWorkspaceHandler(repo)
+		chatH = handler.NewChatHandler(repo)
+		authH = handler.NewAuthHandler(repo, cfg, tokens, auditLog, dbPools, dbFiles)
+		if cfg.OIDCEnabled() {
+			oidcH = handler.NewOIDCHandler(authH, auth.NewOIDCClient(cfg))
+		}
 	}
 
 	// Router
 	gin.SetMode(gin.ReleaseMode)
 	r := gin.New()
+	if err := r.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		log.Fatalf("Invalid trusted proxies: %v", err)
+	}
 	r.Use(gin.Recovery())
 	r.Use(cors.New(cors.Config{
 		AllowAllOrigins:  true,
 		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization", "X-API-Key", model.WorkspaceHeader},
 		ExposeHeaders:    []string{"Content-Length"},
 		MaxAge:           12 * time.Hour,
 	}))
@@ -78,6 +179,12 @@ func main() {
 		c.Next()
 	})
 
+	// Public keys for services that verify our tokens
+	r.GET("/.well-known/jwks.json", func(c *gin.Context) {
+		c.Header("Cache-Control", "public, max-age=300")
+		c.JSON(200, tokens.JWKS())
+	})
+
 	// Routes
 	api := r.Group("/api")
 	{
@@ -93,21 +200,49 @@ func main() {
 		if authH != nil {
 			auth := api.Group("/auth")
 			{
+				auth.GET("/registration", authH.RegistrationInfo)
 				auth.POST("/register", authH.Register)
 				auth.POST("/login", authH.Login)
-				auth.GET("/me", middleware.AuthMiddleware(), authH.Me)
+				auth.POST("/login/2fa", authH.LoginTwoFactor)
+				auth.POST("/refresh", authH.Refresh)
+				auth.GET("/me", authMW, authH.Me)
+				auth.POST("/logout", authMW, authH.Logout)
+				auth.POST("/logout-all", authMW, middleware.SessionOnly(), authH.LogoutAll)
+				auth.PUT("/password", authMW, middleware.SessionOnly(), authH.ChangePassword)
+				auth.DELETE("/account", authMW, middleware.SessionOnly(), authH.DeleteAccount)
+				auth.GET("/export", authMW, middleware.SessionOnly(), authH.Export)
+
+				twoFactor := auth.Group("/2fa", authMW, middleware.SessionOnly())
+				twoFactor.GET("", authH.TwoFactorStatus)
+				twoFactor.POST("/setup", authH.SetupTwoFactor)
+				twoFactor.POST("/enable", authH.EnableTwoFactor)
+				twoFactor.POST("/disable", authH.DisableTwoFactor)
+				twoFactor.POST("/recovery-codes", authH.RegenerateRecoveryCodes)
+
+				if oidcH != nil {
+					auth.GET("/oidc/login", oidcH.Login)
+					auth.GET("/oidc/callback", oidcH.Callback)
+					auth.POST("/oidc/link", authMW, middleware.SessionOnly(), oidcH.Link)
+					auth.GET("/identities", authMW, middleware.SessionOnly(), oidcH.ListIdentities)
+					auth.DELETE("/identities/:id", authMW, middleware.SessionOnly(), oidcH.Unlink)
+				}
 			}
 		}
 
+		// Public prompts (only if DB available)
+		if promptH != nil {
+			api.GET("/public/prompts", promptH.ListPublic)
+		}
+
 		// Models (unified across all providers)
 		api.GET("/models", modelH.GetAllModels)
 		api.GET("/models/:provider", modelH.GetModelsByProvider)
 
-		// Protected Routes
-		protected := api.Group("/", middleware.AuthMiddleware())
+		// Protected Routes, in the personal scope or the selected workspace
+		protected := api.Group("/", authMW, workspaceMW)
 
 		// Ollama
-		ollama := protected.Group("/ollama")
+		ollama := protected.Group("/ollama", middleware.RequireScope(model.ScopeOllama), middleware.RequirePermission(model.PermUseLLM))
 		{
 			ollama.GET("/models", ollamaH.GetModels)
 			ollama.POST("/generate", ollamaH.Generate)
@@ -116,41 +251,175 @@ func main() {
 		}
 
 		// Database
-		db := protected.Group("/db")
+		db := protected.Group("/db", middleware.RequireScope(model.ScopeDB), middleware.RequirePermission(model.PermQueryDB))
 		{
 			db.POST("/connect", dbH.Connect)
 			db.POST("/databases", dbH.GetDatabases)
 			db.POST("/schema", dbH.GetSchema)
 			db.POST("/execute", dbH.Execute)
+			db.POST("/export", dbH.Export)
+			db.GET("/files", dbH.ListFiles)
+			db.POST("/files", dbH.UploadFile)
+			db.DELETE("/files/:id", dbH.DeleteFile)
+
+			if connCipher != nil {
+				canWrite := middleware.WorkspaceWriter()
+				db.POST("/connections", canWrite, dbH.CreateConnection)
+				db.GET("/connections", dbH.ListConnections)
+				db.GET("/connections/:id", dbH.GetConnection)
+				db.PUT("/connections/:id", canWrite, dbH.UpdateConnection)
+				db.DELETE("/connections/:id", canWrite, dbH.DeleteConnection)
+				db.POST("/write", canWrite, dbH.PreviewWrite)
+				db.POST("/write/confirm", canWrite, dbH.ConfirmWrite)
+			}
 		}
 
 		// History (only if DB available)
 		if historyH != nil {
-			protected.POST("/history", historyH.Save)
-			protected.GET("/history", historyH.Get)
-			protected.DELETE("/history/:id", historyH.Delete)
-			protected.DELETE("/history", historyH.Clear)
+			history := protected.Group("/history", middleware.RequireScope(model.ScopeHistory))
+			{
+				history.POST("", historyH.Save)
+				history.GET("", historyH.Get)
+				history.DELETE("/:id", historyH.Delete)
+				history.DELETE("", historyH.Clear)
+			}
 		}
 
 		// Prompts (only if DB available)
 		if promptH != nil {
-			prompts := protected.Group("/prompts")
+			prompts := protected.Group("/prompts", middleware.RequireScope(model.ScopePrompts))
 			{
-				prompts.POST("", promptH.Create)
+				canEdit := middleware.RequirePermission(model.PermEditPrompts)
+				canWrite := middleware.WorkspaceWriter()
+				prompts.POST("", canEdit, canWrite, promptH.Create)
 				prompts.GET("", promptH.List)
 				prompts.GET("/tags", promptH.GetTags)
 				prompts.GET("/:id", promptH.Get)
-				prompts.PUT("/:id", promptH.Update)
-				prompts.DELETE("/:id", promptH.Delete)
+				prompts.PUT("/:id", canEdit, canWrite, promptH.Update)
+				prompts.DELETE("/:id", canEdit, canWrite, promptH.Delete)
 				prompts.POST("/:id/use", promptH.IncrementUse)
 			}
 		}
+
+		// Chat sessions (only if DB available)
+		if chatH != nil {
+			chats := protected.Group("/chat/sessions", middleware.RequireScope(model.ScopeHistory))
+			{
+				canWrite := middleware.WorkspaceWriter()
+				chats.POST("", canWrite, chatH.Create)
+				chats.GET("", chatH.List)
+				chats.GET("/:id", chatH.Get)
+				chats.POST("/:id/messages", canWrite, chatH.AddMessages)
+				chats.DELETE("/:id", canWrite, chatH.Delete)
+			}
+		}
+
+		// Workspaces (only if DB available)
+		if workspaceH != nil {
+			workspaces := protected.Group("/workspaces", middleware.SessionOnly())
+			{
+				workspaces.POST("", workspaceH.Create)
+				workspaces.GET("", workspaceH.List)
+				workspaces.GET("/:id", workspaceH.Get)
+				workspaces.PUT("/:id", workspaceH.Rename)
+				workspaces.DELETE("/:id", workspaceH.Delete)
+				workspaces.GET("/:id/members", workspaceH.ListMembers)
+				workspaces.PUT("/:id/members/:userId", workspaceH.UpdateMemberRole)
+				workspaces.DELETE("/:id/members/:userId", workspaceH.RemoveMember)
+				workspaces.POST("/:id/invitations", workspaceH.Invite)
+				workspaces.GET("/:id/invitations", workspaceH.ListInvitations)
+				workspaces.DELETE("/:id/invitations/:invitationId", workspaceH.RevokeInvitation)
+				workspaces.GET("/:id/audit", workspaceH.Audit)
+			}
+
+			invitations := protected.Group("/workspace-invitations", middleware.SessionOnly())
+			{
+				invitations.GET("", workspaceH.MyInvitations)
+				invitations.POST("/:id/accept", workspaceH.AcceptInvitation)
+				invitations.POST("/:id/decline", workspaceH.DeclineInvitation)
+			}
+		}
+
+		// Admin (only if DB available)
+		if adminH != nil {
+			admin := protected.Group("/admin", middleware.SessionOnly(), middleware.RequirePermission(model.PermManageUsers))
+			{
+				admin.GET("/users", adminH.ListUsers)
+				admin.PUT("/users/:id/role", adminH.UpdateRole)
+				admin.POST("/unlock", adminH.Unlock)
+				admin.POST("/invites", adminH.CreateInvite)
+				admin.GET("/invites", adminH.ListInvites)
+				admin.DELETE("/invites/:id", adminH.RevokeInvite)
+				admin.GET("/audit", adminH.ListAudit)
+				admin.GET("/audit/export", adminH.ExportAudit)
+				if connCipher != nil {
+					admin.GET("/connections", adminH.ListConnections)
+					admin.PUT("/connections/:id/writes", adminH.SetConnectionWrites)
+				}
+			}
+		}
+
+		// API keys (only if DB available)
+		if apiKeyH != nil {
+			keys := protected.Group("/api-keys", middleware.SessionOnly())
+			{
+				keys.POST("", apiKeyH.Create)
+				keys.GET("", apiKeyH.List)
+				keys.DELETE("/:id", apiKeyH.Revoke)
+			}
+		}
 	}
 
 	log.Printf("Server running on http://localhost:%s", cfg.APIPort)
-	log.Printf("Ollama host: %s", cfg.OllamaHost)
-	if err := r.Run(":" + cfg.APIPort); err != nil {
-		log.Fatal(err)
+	for _, inst := range providers.Instances() {
+		log.Printf("LLM provider %s (%s): %s", inst.Config.Name, inst.Config.Type, inst.Config.BaseURL)
+	}
+	srv := &http.Server{Addr: ":" + cfg.APIPort, Handler: r}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	<-ctx.Done()
+	log.Println("Shutting down...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Warning: server shutdown: %v", err)
+	}
+	dbPools.Close()
+}
+
+// pruneAuthRecords periodically deletes expired login failure records,
+// abandoned single sign-on logins and unconfirmed database writes
+func pruneAuthRecords(repo *repository.Repository, window time.Duration) {
+	for range time.Tick(time.Hour) {
+		if err := repo.PruneThrottle(context.Background(), window); err != nil {
+			log.Printf("Warning: failed to prune auth throttle: %v", err)
+		}
+		if err := repo.PruneOIDCStates(context.Background(), time.Hour); err != nil {
+			log.Printf("Warning: failed to prune OIDC login states: %v", err)
+		}
+		if err := repo.PruneDBWriteConfirmations(context.Background()); err != nil {
+			log.Printf("Warning: failed to prune write confirmations: %v", err)
+		}
+	}
+}
+
+// pruneAuditLog deletes audit log entries older than retention, at startup
+// and then daily
+func pruneAuditLog(repo *repository.Repository, retention time.Duration) {
+	for {
+		deleted, err := repo.PruneAuditLog(context.Background(), retention)
+		if err != nil {
+			log.Printf("Warning: failed to prune audit log: %v", err)
+		} else if deleted > 0 {
+			log.Printf("Pruned %d audit log entries older than %s", deleted, retention)
+		}
+		time.Sleep(24 * time.Hour)
 	}
 }
 
@@ -168,7 +437,10 @@ func runAutoMigrations(cfg *config.Config) error {
 }
 
 func runMigrationCommand(action string) {
-	cfg := config.Load()
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
 
 	migrator, err := migration.NewMigratorFromDSN(cfg.GetDSN())
 	if err != nil {
@@ -206,6 +478,68 @@ func runMigrationCommand(action string) {
 	}
 }
 
+func runConfigCheck(path string) {
+	cfg, err := config.LoadFile(path)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+
+	source := "environment and defaults"
+	if cfg.File != "" {
+		source = cfg.File
+	}
+	fmt.Printf("# Effective configuration (source: %s, secrets redacted)\n", source)
+
+	out, err := cfg.Redacted().YAML()
+	if err != nil {
+		log.Fatalf("Failed to render config: %v", err)
+	}
+	fmt.Print(out)
+
+	for _, w := range cfg.Warnings() {
+		fmt.Printf("\nWarning: %s", w)
+	}
+	if err := cfg.Validate(); err != nil {
+		fmt.Printf("\nConfig is invalid:\n%v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println("\nConfig is valid")
+}
+
+// runAdminBootstrap promotes the first admin. It refuses to run once any
+// admin exists; later role changes go through the admin API.
+func runAdminBootstrap(username string) {
+	if username == "" {
+		log.Fatal("-username is required")
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+
+	repo, err := repository.New(cfg)
+	if err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+	defer repo.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	promoted, err := repo.PromoteFirstAdmin(ctx, username)
+	if errors.Is(err, pgx.ErrNoRows) {
+		log.Fatalf("User %q not found; register it first", username)
+	}
+	if err != nil {
+		log.Fatalf("Failed to promote user: %v", err)
+	}
+	if !promoted {
+		log.Fatal("An admin already exists; use the admin API to change roles")
+	}
+	fmt.Printf("User %q is now an admin\n", username)
+}
+
 func getVersion() string {
 	// This would typically be set at build time
 	return "1.0.0"
@@ -0,0 +1,95 @@
+// Package audit records security-relevant and data-access events in the
+// append-only audit log.
+package audit
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/magenta9/ai-web-tools/server/internal/model"
+)
+
+// writeTimeout bounds how long a request waits for its audit entry
+const writeTimeout = 5 * time.Second
+
+// maxUserAgentLength matches the user_agent column
+const maxUserAgentLength = 500
+
+// Store persists audit events; the repository implements it
+type Store interface {
+	InsertAuditEvent(ctx context.Context, e *model.AuditEvent) error
+}
+
+// Logger writes audit events for requests. A nil Logger, used when no
+// database is available, discards them.
+type Logger struct {
+	store        Store
+	maxSQLLength int
+}
+
+func NewLogger(store Store, maxSQLLength int) *Logger {
+	return &Logger{store: store, maxSQLLength: maxSQLLength}
+}
+
+// Log records e for the request. The actor and API key are taken from the
+// auth middleware unless e sets ActorID, and the client IP and user agent
+// from the request. Failures to write are logged but do not fail the
+// request.
+func (l *Logger) Log(c *gin.Context, e model.AuditEvent) {
+	if l == nil {
+		return
+	}
+
+	if e.ActorID == nil {
+		if userID, ok := c.Get("user_id"); ok {
+			id := userID.(int)
+			e.ActorID = &id
+		}
+	}
+	if keyID, ok := c.Get("api_key_id"); ok {
+		id := keyID.(int64)
+		e.APIKeyID = &id
+	}
+	e.IP = c.ClientIP()
+	e.UserAgent = truncate(c.Request.UserAgent(), maxUserAgentLength)
+	if e.Outcome == "" {
+		e.Outcome = model.OutcomeSuccess
+	}
+
+	// Record the event even if the client has gone away
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(c.Request.Context()), writeTimeout)
+	defer cancel()
+	if err := l.store.InsertAuditEvent(ctx, &e); err != nil {
+		log.Printf("Warning: failed to write audit event %s: %v", e.Action, err)
+	}
+}
+
+// SQL shortens query text to the configured maximum length for recording
+func (l *Logger) SQL(query string) string {
+	if l == nil {
+		return query
+	}
+	return truncate(query, l.maxSQLLength)
+}
+
+// Outcome returns OutcomeSuccess for a nil error and OutcomeFailure
+// otherwise
+func Outcome(err error) string {
+	if err != nil {
+		return model.OutcomeFailure
+	}
+	return model.OutcomeSuccess
+}
+
+// truncate cuts s to at most n bytes without splitting a UTF-8 sequence
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && s[n]&0xC0 == 0x80 {
+		n--
+	}
+	return s[:n]
+}
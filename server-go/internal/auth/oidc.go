@@ -0,0 +1,150 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/magenta9/ai-web-tools/server/internal/config"
+	"golang.org/x/oauth2"
+)
+
+// OIDCClaims are the ID token claims used to sign a user in
+type OIDCClaims struct {
+	Issuer            string
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	PreferredUsername string
+	Name              string
+	Groups            []string
+}
+
+// OIDCClient runs the authorization code flow with PKCE against the
+// configured OpenID Connect provider. Discovery happens on first use, so the
+// server starts even while the provider is unreachable.
+type OIDCClient struct {
+	cfg        *config.Config
+	httpClient *http.Client
+
+	mu       sync.Mutex
+	oauth    *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+func NewOIDCClient(cfg *config.Config) *OIDCClient {
+	return &OIDCClient{
+		cfg:        cfg,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// discover fetches the provider's discovery document. The ID token verifier
+// it creates fetches and caches the provider's JWKS, refetching when a
+// token names an unknown key.
+func (o *OIDCClient) discover() (*oauth2.Config, *oidc.IDTokenVerifier, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.oauth != nil {
+		return o.oauth, o.verifier, nil
+	}
+
+	// Key set fetches outlive any single request, so they must not use a
+	// request context
+	ctx := oidc.ClientContext(context.Background(), o.httpClient)
+	provider, err := oidc.NewProvider(ctx, o.cfg.OIDCIssuer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("oidc discovery: %w", err)
+	}
+
+	o.oauth = &oauth2.Config{
+		ClientID:     o.cfg.OIDCClientID,
+		ClientSecret: o.cfg.OIDCClientSecret,
+		RedirectURL:  o.cfg.OIDCRedirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       o.cfg.OIDCScopes,
+	}
+	o.verifier = provider.Verifier(&oidc.Config{ClientID: o.cfg.OIDCClientID})
+	return o.oauth, o.verifier, nil
+}
+
+// AuthCodeURL returns the provider URL to send the browser to. verifier is
+// the PKCE code verifier, which must be kept until the callback.
+func (o *OIDCClient) AuthCodeURL(state, nonce, verifier string) (string, error) {
+	oauth, _, err := o.discover()
+	if err != nil {
+		return "", err
+	}
+	return oauth.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier)), nil
+}
+
+// Exchange redeems an authorization code and validates the returned ID
+// token: signature against the provider's JWKS, issuer, audience, expiry
+// and nonce
+func (o *OIDCClient) Exchange(ctx context.Context, code, verifier, nonce string) (*OIDCClaims, error) {
+	oauth, idVerifier, err := o.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, o.httpClient)
+	token, err := oauth.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return nil, fmt.Errorf("exchange code: %w", err)
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, errors.New("token response has no id_token")
+	}
+
+	idToken, err := idVerifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, fmt.Errorf("verify id token: %w", err)
+	}
+	if idToken.Nonce != nonce {
+		return nil, errors.New("id token nonce does not match")
+	}
+
+	var raw map[string]any
+	if err := idToken.Claims(&raw); err != nil {
+		return nil, fmt.Errorf("decode id token claims: %w", err)
+	}
+
+	claims := &OIDCClaims{
+		Issuer:  idToken.Issuer,
+		Subject: idToken.Subject,
+		Groups:  stringList(raw[o.cfg.OIDCGroupsClaim]),
+	}
+	claims.Email, _ = raw["email"].(string)
+	claims.EmailVerified, _ = raw["email_verified"].(bool)
+	claims.PreferredUsername, _ = raw["preferred_username"].(string)
+	claims.Name, _ = raw["name"].(string)
+	return claims, nil
+}
+
+// NewPKCEVerifier returns a random PKCE code verifier (RFC 7636)
+func NewPKCEVerifier() string {
+	return oauth2.GenerateVerifier()
+}
+
+// stringList reads a claim that may be a single string or a list of strings
+func stringList(v any) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []any:
+		list := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
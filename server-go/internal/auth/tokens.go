@@ -0,0 +1,217 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/magenta9/ai-web-tools/server/internal/config"
+)
+
+// signingKey is a key identified by kid. Private is nil for
+// verification-only keys.
+type signingKey struct {
+	id      string
+	method  jwt.SigningMethod
+	private any
+	public  any
+}
+
+// TokenManager signs and verifies the server's JWTs. It is the single place
+// that knows the configured keys; both the auth handler and the middleware
+// use it.
+type TokenManager struct {
+	current *signingKey
+	keys    map[string]*signingKey
+	ttl     time.Duration
+}
+
+// NewTokenManager loads the signing key and any verification keys from cfg
+func NewTokenManager(cfg *config.Config) (*TokenManager, error) {
+	current, err := loadSigningKey(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &TokenManager{
+		current: current,
+		keys:    map[string]*signingKey{current.id: current},
+		ttl:     cfg.AccessTokenTTL,
+	}
+
+	for _, k := range cfg.JWTVerificationKeys {
+		vk, err := loadVerificationKey(k)
+		if err != nil {
+			return nil, fmt.Errorf("jwt verification key %q: %w", k.ID, err)
+		}
+		m.keys[vk.id] = vk
+	}
+
+	return m, nil
+}
+
+func loadSigningKey(cfg *config.Config) (*signingKey, error) {
+	switch cfg.JWTAlgorithm {
+	case "", "HS256":
+		secret := []byte(cfg.JWTSecret)
+		return &signingKey{id: cfg.JWTKeyID, method: jwt.SigningMethodHS256, private: secret, public: secret}, nil
+
+	case "RS256", "EdDSA":
+		data, err := os.ReadFile(cfg.JWTPrivateKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("read jwt private key: %w", err)
+		}
+		if cfg.JWTAlgorithm == "RS256" {
+			key, err := jwt.ParseRSAPrivateKeyFromPEM(data)
+			if err != nil {
+				return nil, fmt.Errorf("parse jwt private key: %w", err)
+			}
+			return &signingKey{id: cfg.JWTKeyID, method: jwt.SigningMethodRS256, private: key, public: &key.PublicKey}, nil
+		}
+		key, err := jwt.ParseEdPrivateKeyFromPEM(data)
+		if err != nil {
+			return nil, fmt.Errorf("parse jwt private key: %w", err)
+		}
+		edKey := key.(ed25519.PrivateKey)
+		return &signingKey{id: cfg.JWTKeyID, method: jwt.SigningMethodEdDSA, private: edKey, public: edKey.Public()}, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported jwt algorithm %q", cfg.JWTAlgorithm)
+	}
+}
+
+func loadVerificationKey(k config.JWTKey) (*signingKey, error) {
+	if k.Algorithm == "HS256" {
+		return &signingKey{id: k.ID, method: jwt.SigningMethodHS256, public: []byte(k.Secret)}, nil
+	}
+
+	data, err := os.ReadFile(k.PublicKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	switch k.Algorithm {
+	case "RS256":
+		key, err := jwt.ParseRSAPublicKeyFromPEM(data)
+		if err != nil {
+			return nil, err
+		}
+		return &signingKey{id: k.ID, method: jwt.SigningMethodRS256, public: key}, nil
+	case "EdDSA":
+		key, err := jwt.ParseEdPublicKeyFromPEM(data)
+		if err != nil {
+			return nil, err
+		}
+		return &signingKey{id: k.ID, method: jwt.SigningMethodEdDSA, public: key}, nil
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q", k.Algorithm)
+	}
+}
+
+// Sign issues a token for the user with the given extra claims
+func (m *TokenManager) Sign(userID int, extra jwt.MapClaims) (string, error) {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"user_id": userID,
+		"sub":     strconv.Itoa(userID),
+		"iat":     now.Unix(),
+		"exp":     now.Add(m.ttl).Unix(),
+	}
+	for k, v := range extra {
+		claims[k] = v
+	}
+
+	token := jwt.NewWithClaims(m.current.method, claims)
+	token.Header["kid"] = m.current.id
+	return token.SignedString(m.current.private)
+}
+
+// ChallengeTokenType is the "typ" claim of the short-lived token that a
+// password login returns when the user has two-factor authentication
+// enabled. It only grants access to the second login step.
+const ChallengeTokenType = "2fa-challenge"
+
+// ChallengeTTL is the lifetime of two-factor challenge tokens
+const ChallengeTTL = 5 * time.Minute
+
+// SignChallenge issues a two-factor challenge token for the user
+func (m *TokenManager) SignChallenge(userID int) (string, error) {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"user_id": userID,
+		"sub":     strconv.Itoa(userID),
+		"typ":     ChallengeTokenType,
+		"iat":     now.Unix(),
+		"exp":     now.Add(ChallengeTTL).Unix(),
+	}
+
+	token := jwt.NewWithClaims(m.current.method, claims)
+	token.Header["kid"] = m.current.id
+	return token.SignedString(m.current.private)
+}
+
+// ParseChallenge verifies a two-factor challenge token and returns its user
+func (m *TokenManager) ParseChallenge(tokenString string) (int, error) {
+	claims, err := m.Parse(tokenString)
+	if err != nil {
+		return 0, err
+	}
+	if claims["typ"] != ChallengeTokenType {
+		return 0, errors.New("not a challenge token")
+	}
+	userID, ok := claims["user_id"].(float64)
+	if !ok {
+		return 0, errors.New("invalid user ID in token")
+	}
+	return int(userID), nil
+}
+
+// TTL returns the lifetime of issued access tokens
+func (m *TokenManager) TTL() time.Duration {
+	return m.ttl
+}
+
+// Parse verifies a token against the key named by its kid header. Tokens
+// without a kid were issued before key IDs existed and are checked against
+// the current key.
+func (m *TokenManager) Parse(tokenString string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		key := m.current
+		if kid, ok := token.Header["kid"].(string); ok {
+			if key, ok = m.keys[kid]; !ok {
+				return nil, fmt.Errorf("unknown key id %q", kid)
+			}
+		}
+		if token.Method.Alg() != key.method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return key.public, nil
+	}, jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, errors.New("invalid token claims")
+	}
+	return claims, nil
+}
+
+// publicKeys returns the asymmetric verification keys, keyed by kid
+func (m *TokenManager) publicKeys() map[string]crypto.PublicKey {
+	keys := make(map[string]crypto.PublicKey)
+	for id, k := range m.keys {
+		switch k.public.(type) {
+		case *rsa.PublicKey, ed25519.PublicKey:
+			keys[id] = k.public
+		}
+	}
+	return keys
+}
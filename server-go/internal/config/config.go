@@ -1,60 +1,377 @@
 package config
 
 import (
+	"fmt"
+	"log"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
 )
 
+// Run modes
+const (
+	ModeDevelopment = "development"
+	ModeProduction  = "production"
+)
+
+// Registration modes
+const (
+	RegistrationOpen   = "open"
+	RegistrationInvite = "invite"
+	RegistrationClosed = "closed"
+)
+
+// Development defaults that must not be used in production
+const (
+	defaultJWTSecret  = "default-dev-secret"
+	defaultDBPassword = "webtools123"
+)
+
+// Config holds the effective server configuration. Values come from the
+// built-in defaults, then the YAML config file, then environment variables.
 type Config struct {
-	APIPort    string
-	DBHost     string
-	DBPort     string
-	DBUser     string
-	DBPassword string
-	DBName     string
+	// File is the config file the values were read from, if any
+	File string `yaml:"-"`
+	// envErrs are the environment variables that could not be parsed,
+	// reported by Validate
+	envErrs []error
+
+	Mode       string `yaml:"mode"`
+	APIPort    string `yaml:"api_port"`
+	DBHost     string `yaml:"db_host"`
+	DBPort     string `yaml:"db_port"`
+	DBUser     string `yaml:"db_user"`
+	DBPassword string `yaml:"db_password"`
+	DBName     string `yaml:"db_name"`
 
 	// Ollama configuration
-	OllamaHost   string
-	OllamaAPIKey string
+	OllamaHost   string `yaml:"ollama_host"`
+	OllamaAPIKey string `yaml:"ollama_api_key"`
 
 	// Alternative LLM providers
-	OpenAIAPIKey     string
-	OpenAIBaseURL    string
-	AnthropicAPIKey  string
-	AnthropicBaseURL string
+	OpenAIAPIKey     string `yaml:"openai_api_key"`
+	OpenAIBaseURL    string `yaml:"openai_base_url"`
+	AnthropicAPIKey  string `yaml:"anthropic_api_key"`
+	AnthropicBaseURL string `yaml:"anthropic_base_url"`
+
+	// Named provider instances, defined inline, loaded from ProvidersFile
+	// or derived from the single-host settings above
+	ProvidersFile   string           `yaml:"providers_file"`
+	DefaultProvider string           `yaml:"default_provider"`
+	Providers       []ProviderConfig `yaml:"providers"`
 
 	// Migration settings
-	MigrationAuto bool
-	SchemaVersion int
+	MigrationAuto bool `yaml:"migration_auto"`
+	SchemaVersion int  `yaml:"schema_version"`
 
 	// Auth
-	JWTSecret string
+	JWTSecret string `yaml:"jwt_secret"`
+	// JWTAlgorithm selects the signing algorithm: HS256 (default), RS256 or EdDSA
+	JWTAlgorithm string `yaml:"jwt_algorithm"`
+	// JWTKeyID is the kid of the current signing key
+	JWTKeyID string `yaml:"jwt_key_id"`
+	// JWTPrivateKeyFile is the PEM private key used for RS256 and EdDSA
+	JWTPrivateKeyFile string `yaml:"jwt_private_key_file"`
+	// JWTVerificationKeys are retired keys that are still accepted
+	JWTVerificationKeys []JWTKey `yaml:"jwt_verification_keys"`
+
+	// Session lifetimes
+	AccessTokenTTL  time.Duration `yaml:"access_token_ttl"`
+	RefreshTokenTTL time.Duration `yaml:"refresh_token_ttl"`
+
+	// Brute-force protection. A username or client IP that reaches its
+	// failure limit within LoginFailureWindow is locked for LoginLockout.
+	LoginMaxFailures   int           `yaml:"login_max_failures"`
+	LoginMaxIPFailures int           `yaml:"login_max_ip_failures"`
+	LoginFailureWindow time.Duration `yaml:"login_failure_window"`
+	LoginLockout       time.Duration `yaml:"login_lockout"`
+	// RegistrationMode is open, invite (an invite code is required) or
+	// closed. Single sign-on only provisions users when it is open.
+	RegistrationMode string `yaml:"registration_mode"`
+	// RegistrationEmailDomains, when set, limits new accounts, including
+	// ones created by single sign-on, to emails in these domains
+	RegistrationEmailDomains []string `yaml:"registration_email_domains"`
+
+	// RegisterMaxPerIP limits sign-ups from one IP per LoginFailureWindow
+	RegisterMaxPerIP int `yaml:"register_max_per_ip"`
+	// TrustedProxies are the proxy addresses whose X-Forwarded-For header
+	// is believed when determining the client IP
+	TrustedProxies []string `yaml:"trusted_proxies"`
+
+	// Single sign-on with an OpenID Connect provider, enabled when
+	// OIDCIssuer is set
+	OIDCIssuer       string   `yaml:"oidc_issuer"`
+	OIDCClientID     string   `yaml:"oidc_client_id"`
+	OIDCClientSecret string   `yaml:"oidc_client_secret"`
+	OIDCRedirectURL  string   `yaml:"oidc_redirect_url"`
+	OIDCScopes       []string `yaml:"oidc_scopes"`
+	// OIDCPostLoginURL is the frontend page that receives the tokens in the
+	// URL fragment after login; without it the callback responds with JSON
+	OIDCPostLoginURL string `yaml:"oidc_post_login_url"`
+	// OIDCGroupsClaim names the ID token claim that lists the user's groups
+	OIDCGroupsClaim string `yaml:"oidc_groups_claim"`
+	// OIDCRoleMapping maps groups to roles. When set, the role is updated
+	// on every SSO login; users in no mapped group get OIDCDefaultRole.
+	OIDCRoleMapping map[string]string `yaml:"oidc_role_mapping"`
+	OIDCDefaultRole string            `yaml:"oidc_default_role"`
+
+	// AuditRetention is how long audit log entries are kept; 0 keeps them
+	// forever
+	AuditRetention time.Duration `yaml:"audit_retention"`
+	// AuditMaxSQLLength truncates the SQL text recorded for queries
+	AuditMaxSQLLength int `yaml:"audit_max_sql_length"`
+
+	// ConnectionKey is the base64-encoded 256-bit master key that encrypts
+	// saved database connection passwords. Saved connections are disabled
+	// without it.
+	ConnectionKey string `yaml:"connection_key"`
+
+	// Target database pools used by the DB tool. Each user keeps at most
+	// TargetPoolMaxPerUser pools, one per connection, closed after
+	// TargetPoolIdleTimeout without use.
+	TargetPoolMaxPerUser  int           `yaml:"target_pool_max_per_user"`
+	TargetPoolMaxConns    int           `yaml:"target_pool_max_conns"`
+	TargetPoolIdleTimeout time.Duration `yaml:"target_pool_idle_timeout"`
+	// TargetPoolHealthCheck is how long a pool may go without a ping
+	// before it is checked on reuse
+	TargetPoolHealthCheck time.Duration `yaml:"target_pool_health_check"`
+
+	// Limits on /api/db/execute: queries are cancelled after QueryTimeout,
+	// and results stop at QueryMaxRows rows or QueryMaxBytes bytes of
+	// values, whichever comes first
+	QueryTimeout  time.Duration `yaml:"query_timeout"`
+	QueryMaxRows  int           `yaml:"query_max_rows"`
+	QueryMaxBytes int           `yaml:"query_max_bytes"`
+	// Streamed results are not buffered, so they have their own, larger
+	// limits; QueryStreamMaxRows 0 streams every row
+	QueryStreamTimeout time.Duration `yaml:"query_stream_timeout"`
+	QueryStreamMaxRows int           `yaml:"query_stream_max_rows"`
+
+	// Database files the DB tool opens with SQLite or DuckDB: files under
+	// the absolute directories in TargetFileDirs, and files users upload to
+	// TargetUploadDir, which is off when empty. Uploads, and data files
+	// DuckDB loads into memory, may be at most TargetFileMaxBytes. Each
+	// user may keep at most TargetUploadMaxFiles uploads of
+	// TargetUploadMaxTotal bytes together; 0 is no limit.
+	TargetFileDirs       []string `yaml:"target_file_dirs"`
+	TargetUploadDir      string   `yaml:"target_upload_dir"`
+	TargetFileMaxBytes   int      `yaml:"target_file_max_bytes"`
+	TargetUploadMaxFiles int      `yaml:"target_upload_max_files"`
+	TargetUploadMaxTotal int      `yaml:"target_upload_max_total_bytes"`
 }
 
-func Load() *Config {
+// JWTKey is a verification-only key identified by kid. HS256 keys use
+// Secret; RS256 and EdDSA keys use a PEM public key file.
+type JWTKey struct {
+	ID            string `yaml:"id"`
+	Algorithm     string `yaml:"algorithm"`
+	Secret        string `yaml:"secret"`
+	PublicKeyFile string `yaml:"public_key_file"`
+}
+
+// Load reads the config file named by CONFIG_FILE (or found in the default
+// locations) and applies environment overrides.
+func Load() (*Config, error) {
+	return LoadFile("")
+}
+
+// LoadFile is like Load but reads the given config file path
+func LoadFile(path string) (*Config, error) {
 	godotenv.Load()
 
+	cfg := defaults()
+
+	if path == "" {
+		path = findConfigFile()
+	}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read config file %s: %w", path, err)
+		}
+		if err := yaml.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("parse config file %s: %w", path, err)
+		}
+		cfg.File = path
+	}
+
+	cfg.applyEnv()
+
+	if err := cfg.loadProviders(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func defaults() *Config {
 	return &Config{
-		APIPort:         getEnv("API_PORT", "3001"),
-		JWTSecret:       getEnv("JWT_SECRET", "default-dev-secret"),
-		DBHost:          getEnv("DB_HOST", "localhost"),
-		DBPort:          getEnv("DB_PORT", "5432"),
-		DBUser:          getEnv("DB_USER", "webtools"),
-		DBPassword:      getEnv("DB_PASSWORD", "webtools123"),
-		DBName:          getEnv("DB_NAME", "webtools"),
-		OllamaHost:      getEnv("OLLAMA_HOST", "http://localhost:11434"),
-		OllamaAPIKey:    getEnv("OLLAMA_API_KEY", ""),
-		OpenAIAPIKey:    getEnv("OPENAI_API_KEY", ""),
-		OpenAIBaseURL:   getEnv("OPENAI_BASE_URL", "https://api.openai.com/v1"),
-		AnthropicAPIKey:  getEnv("ANTHROPIC_API_KEY", ""),
-		AnthropicBaseURL: getEnv("ANTHROPIC_BASE_URL", "https://api.anthropic.com"),
-		MigrationAuto:   getEnvBool("DB_MIGRATION_AUTO", true),
-		SchemaVersion:   getEnvInt("DB_SCHEMA_VERSION", 3),
+		Mode:                  ModeDevelopment,
+		APIPort:               "3001",
+		JWTSecret:             defaultJWTSecret,
+		JWTAlgorithm:          "HS256",
+		JWTKeyID:              "default",
+		AccessTokenTTL:        15 * time.Minute,
+		RefreshTokenTTL:       30 * 24 * time.Hour,
+		LoginMaxFailures:      5,
+		LoginMaxIPFailures:    20,
+		LoginFailureWindow:    15 * time.Minute,
+		LoginLockout:          15 * time.Minute,
+		RegisterMaxPerIP:      10,
+		RegistrationMode:      RegistrationOpen,
+		OIDCScopes:            []string{"openid", "profile", "email"},
+		OIDCGroupsClaim:       "groups",
+		OIDCDefaultRole:       "member",
+		AuditRetention:        90 * 24 * time.Hour,
+		AuditMaxSQLLength:     4000,
+		TargetPoolMaxPerUser:  5,
+		TargetPoolMaxConns:    5,
+		TargetPoolIdleTimeout: 10 * time.Minute,
+		TargetPoolHealthCheck: time.Minute,
+		QueryTimeout:          30 * time.Second,
+		QueryMaxRows:          1000,
+		QueryMaxBytes:         10 << 20,
+		QueryStreamTimeout:    10 * time.Minute,
+		QueryStreamMaxRows:    1000000,
+		TargetFileMaxBytes:    100 << 20,
+		TargetUploadMaxFiles:  20,
+		TargetUploadMaxTotal:  1 << 30,
+		DBHost:                "localhost",
+		DBPort:                "5432",
+		DBUser:                "webtools",
+		DBPassword:            defaultDBPassword,
+		DBName:                "webtools",
+		OllamaHost:            "http://localhost:11434",
+		OpenAIBaseURL:         "https://api.openai.com/v1",
+		AnthropicBaseURL:      "https://api.anthropic.com",
+		MigrationAuto:         true,
+		SchemaVersion:         3,
 	}
 }
 
+// applyEnv overrides file and default values with environment variables
+func (c *Config) applyEnv() {
+	c.Mode = getEnv("APP_ENV", c.Mode)
+	c.APIPort = getEnv("API_PORT", c.APIPort)
+	c.JWTSecret = getEnv("JWT_SECRET", c.JWTSecret)
+	c.JWTAlgorithm = getEnv("JWT_ALGORITHM", c.JWTAlgorithm)
+	c.JWTKeyID = getEnv("JWT_KEY_ID", c.JWTKeyID)
+	c.JWTPrivateKeyFile = getEnv("JWT_PRIVATE_KEY_FILE", c.JWTPrivateKeyFile)
+	c.AccessTokenTTL = c.getEnvDuration("ACCESS_TOKEN_TTL", c.AccessTokenTTL)
+	c.RefreshTokenTTL = c.getEnvDuration("REFRESH_TOKEN_TTL", c.RefreshTokenTTL)
+	c.LoginMaxFailures = c.getEnvInt("LOGIN_MAX_FAILURES", c.LoginMaxFailures)
+	c.LoginMaxIPFailures = c.getEnvInt("LOGIN_MAX_IP_FAILURES", c.LoginMaxIPFailures)
+	c.LoginFailureWindow = c.getEnvDuration("LOGIN_FAILURE_WINDOW", c.LoginFailureWindow)
+	c.LoginLockout = c.getEnvDuration("LOGIN_LOCKOUT", c.LoginLockout)
+	c.RegisterMaxPerIP = c.getEnvInt("REGISTER_MAX_PER_IP", c.RegisterMaxPerIP)
+	c.RegistrationMode = getEnv("REGISTRATION_MODE", c.RegistrationMode)
+	if v := os.Getenv("REGISTRATION_EMAIL_DOMAINS"); v != "" {
+		c.RegistrationEmailDomains = splitList(v)
+	}
+	if v := os.Getenv("TRUSTED_PROXIES"); v != "" {
+		c.TrustedProxies = splitList(v)
+	}
+	c.OIDCIssuer = getEnv("OIDC_ISSUER", c.OIDCIssuer)
+	c.OIDCClientID = getEnv("OIDC_CLIENT_ID", c.OIDCClientID)
+	c.OIDCClientSecret = getEnv("OIDC_CLIENT_SECRET", c.OIDCClientSecret)
+	c.OIDCRedirectURL = getEnv("OIDC_REDIRECT_URL", c.OIDCRedirectURL)
+	c.OIDCPostLoginURL = getEnv("OIDC_POST_LOGIN_URL", c.OIDCPostLoginURL)
+	c.OIDCGroupsClaim = getEnv("OIDC_GROUPS_CLAIM", c.OIDCGroupsClaim)
+	c.OIDCDefaultRole = getEnv("OIDC_DEFAULT_ROLE", c.OIDCDefaultRole)
+	if v := os.Getenv("OIDC_SCOPES"); v != "" {
+		c.OIDCScopes = splitList(v)
+	}
+	// OIDC_ROLE_MAPPING is a list of group=role pairs
+	if v := os.Getenv("OIDC_ROLE_MAPPING"); v != "" {
+		c.OIDCRoleMapping = map[string]string{}
+		for _, pair := range splitList(v) {
+			group, role, _ := strings.Cut(pair, "=")
+			c.OIDCRoleMapping[strings.TrimSpace(group)] = strings.TrimSpace(role)
+		}
+	}
+	c.AuditRetention = c.getEnvDuration("AUDIT_RETENTION", c.AuditRetention)
+	c.AuditMaxSQLLength = c.getEnvInt("AUDIT_MAX_SQL_LENGTH", c.AuditMaxSQLLength)
+	c.ConnectionKey = getEnv("CONNECTION_KEY", c.ConnectionKey)
+	c.TargetPoolMaxPerUser = c.getEnvInt("TARGET_POOL_MAX_PER_USER", c.TargetPoolMaxPerUser)
+	c.TargetPoolMaxConns = c.getEnvInt("TARGET_POOL_MAX_CONNS", c.TargetPoolMaxConns)
+	c.TargetPoolIdleTimeout = c.getEnvDuration("TARGET_POOL_IDLE_TIMEOUT", c.TargetPoolIdleTimeout)
+	c.TargetPoolHealthCheck = c.getEnvDuration("TARGET_POOL_HEALTH_CHECK", c.TargetPoolHealthCheck)
+	c.QueryTimeout = c.getEnvDuration("QUERY_TIMEOUT", c.QueryTimeout)
+	c.QueryMaxRows = c.getEnvInt("QUERY_MAX_ROWS", c.QueryMaxRows)
+	c.QueryMaxBytes = c.getEnvInt("QUERY_MAX_BYTES", c.QueryMaxBytes)
+	c.QueryStreamTimeout = c.getEnvDuration("QUERY_STREAM_TIMEOUT", c.QueryStreamTimeout)
+	c.QueryStreamMaxRows = c.getEnvInt("QUERY_STREAM_MAX_ROWS", c.QueryStreamMaxRows)
+	if v := os.Getenv("TARGET_FILE_DIRS"); v != "" {
+		c.TargetFileDirs = splitList(v)
+	}
+	c.TargetUploadDir = getEnv("TARGET_UPLOAD_DIR", c.TargetUploadDir)
+	c.TargetFileMaxBytes = c.getEnvInt("TARGET_FILE_MAX_BYTES", c.TargetFileMaxBytes)
+	c.TargetUploadMaxFiles = c.getEnvInt("TARGET_UPLOAD_MAX_FILES", c.TargetUploadMaxFiles)
+	c.TargetUploadMaxTotal = c.getEnvInt("TARGET_UPLOAD_MAX_TOTAL_BYTES", c.TargetUploadMaxTotal)
+	c.DBHost = getEnv("DB_HOST", c.DBHost)
+	c.DBPort = getEnv("DB_PORT", c.DBPort)
+	c.DBUser = getEnv("DB_USER", c.DBUser)
+	c.DBPassword = getEnv("DB_PASSWORD", c.DBPassword)
+	c.DBName = getEnv("DB_NAME", c.DBName)
+	c.OllamaHost = getEnv("OLLAMA_HOST", c.OllamaHost)
+	c.OllamaAPIKey = getEnv("OLLAMA_API_KEY", c.OllamaAPIKey)
+	c.OpenAIAPIKey = getEnv("OPENAI_API_KEY", c.OpenAIAPIKey)
+	c.OpenAIBaseURL = getEnv("OPENAI_BASE_URL", c.OpenAIBaseURL)
+	c.AnthropicAPIKey = getEnv("ANTHROPIC_API_KEY", c.AnthropicAPIKey)
+	c.AnthropicBaseURL = getEnv("ANTHROPIC_BASE_URL", c.AnthropicBaseURL)
+	c.MigrationAuto = c.getEnvBool("DB_MIGRATION_AUTO", c.MigrationAuto)
+	c.SchemaVersion = c.getEnvInt("DB_SCHEMA_VERSION", c.SchemaVersion)
+	c.ProvidersFile = getEnv("LLM_PROVIDERS_FILE", c.ProvidersFile)
+	c.DefaultProvider = getEnv("LLM_DEFAULT_PROVIDER", c.DefaultProvider)
+}
+
+// findConfigFile returns CONFIG_FILE or the first config file found in the
+// default locations
+func findConfigFile() string {
+	if p := os.Getenv("CONFIG_FILE"); p != "" {
+		return p
+	}
+
+	// Try multiple possible paths
+	for _, p := range []string{
+		"config/config.yaml",
+		"../config/config.yaml",
+		"server-go/config/config.yaml",
+		"/app/config/config.yaml", // Docker path
+	} {
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+	}
+	return ""
+}
+
+// IsProduction reports whether the server runs in production mode
+func (c *Config) IsProduction() bool {
+	return c.Mode == ModeProduction
+}
+
+// LogDiagnostics logs where the configuration came from and any warnings
+func (c *Config) LogDiagnostics() {
+	source := "environment and defaults"
+	if c.File != "" {
+		source = c.File
+	}
+	log.Printf("Config loaded from %s (mode: %s)", source, c.Mode)
+	for _, w := range c.Warnings() {
+		log.Printf("Config warning: %s", w)
+	}
+}
+
+// OIDCEnabled reports whether single sign-on is configured
+func (c *Config) OIDCEnabled() bool {
+	return c.OIDCIssuer != ""
+}
+
 // GetDSN returns the PostgreSQL connection string
 func (c *Config) GetDSN() string {
 	return "postgres://" + c.DBUser + ":" + c.DBPassword + "@" + c.DBHost + ":" + c.DBPort + "/" + c.DBName + "?sslmode=disable"
@@ -67,22 +384,46 @@ func getEnv(key, fallback string) string {
 	return fallback
 }
 
-func getEnvBool(key string, fallback bool) bool {
+func (c *Config) getEnvBool(key string, fallback bool) bool {
 	if v := os.Getenv(key); v != "" {
 		b, err := strconv.ParseBool(v)
 		if err == nil {
 			return b
 		}
+		c.envErrs = append(c.envErrs, fmt.Errorf("%s: %q is not a boolean", key, v))
 	}
 	return fallback
 }
 
-func getEnvInt(key string, fallback int) int {
+func (c *Config) getEnvInt(key string, fallback int) int {
 	if v := os.Getenv(key); v != "" {
 		i, err := strconv.Atoi(v)
 		if err == nil {
 			return i
 		}
+		c.envErrs = append(c.envErrs, fmt.Errorf("%s: %q is not an integer", key, v))
+	}
+	return fallback
+}
+
+// splitList splits a comma-separated value, dropping empty items
+func splitList(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func (c *Config) getEnvDuration(key string, fallback time.Duration) time.Duration {
+	if v := os.Getenv(key); v != "" {
+		d, err := time.ParseDuration(v)
+		if err == nil {
+			return d
+		}
+		c.envErrs = append(c.envErrs, fmt.Errorf("%s: %q is not a duration such as 15m or 1h30m", key, v))
 	}
 	return fallback
 }
@@ -0,0 +1,54 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// loadEmpty loads the defaults and environment through an empty config file
+func loadEmpty(t *testing.T) *Config {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestMalformedEnvIsReported(t *testing.T) {
+	t.Setenv("ACCESS_TOKEN_TTL", "15")
+	t.Setenv("QUERY_MAX_ROWS", "1e5")
+	t.Setenv("DB_MIGRATION_AUTO", "sometimes")
+
+	err := loadEmpty(t).Validate()
+	if err == nil {
+		t.Fatal("Validate accepted malformed environment variables")
+	}
+	for _, key := range []string{"ACCESS_TOKEN_TTL", "QUERY_MAX_ROWS", "DB_MIGRATION_AUTO"} {
+		if !strings.Contains(err.Error(), key) {
+			t.Errorf("Validate error does not mention %s: %v", key, err)
+		}
+	}
+}
+
+func TestWellFormedEnvIsApplied(t *testing.T) {
+	t.Setenv("ACCESS_TOKEN_TTL", "20m")
+	t.Setenv("QUERY_MAX_ROWS", "500")
+	t.Setenv("DB_MIGRATION_AUTO", "false")
+
+	cfg := loadEmpty(t)
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	if cfg.AccessTokenTTL != 20*time.Minute || cfg.QueryMaxRows != 500 || cfg.MigrationAuto {
+		t.Errorf("environment not applied: ttl %v, max rows %d, migration auto %v",
+			cfg.AccessTokenTTL, cfg.QueryMaxRows, cfg.MigrationAuto)
+	}
+}
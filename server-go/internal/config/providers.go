@@ -0,0 +1,149 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Provider types supported by the llm package
+const (
+	ProviderTypeOllama    = "ollama"
+	ProviderTypeOpenAI    = "openai"
+	ProviderTypeAnthropic = "anthropic"
+)
+
+// ProviderConfig describes one named LLM provider instance
+type ProviderConfig struct {
+	Name         string   `json:"name" yaml:"name"`
+	Type         string   `json:"type" yaml:"type"`
+	BaseURL      string   `json:"base_url" yaml:"base_url"`
+	APIKey       string   `json:"api_key" yaml:"api_key"`
+	DefaultModel string   `json:"default_model" yaml:"default_model"`
+	Timeout      int      `json:"timeout" yaml:"timeout"` // seconds
+	Models       []string `json:"models,omitempty" yaml:"models,omitempty"`
+}
+
+// providersFile represents the providers.json structure
+type providersFile struct {
+	Default   string           `json:"default"`
+	Providers []ProviderConfig `json:"providers"`
+}
+
+// loadProviders fills c.Providers from the config file, the providers
+// file, or the legacy single-host settings, in that order of preference.
+func (c *Config) loadProviders() error {
+	if len(c.Providers) > 0 {
+		if err := validateProviders(c.Providers); err != nil {
+			return fmt.Errorf("providers: %w", err)
+		}
+		expandProviderKeys(c.Providers)
+		return nil
+	}
+
+	path := c.ProvidersFile
+	if path == "" {
+		// Try multiple possible paths
+		for _, p := range []string{
+			"config/providers.json",
+			"../config/providers.json",
+			"server-go/config/providers.json",
+			"/app/config/providers.json", // Docker path
+		} {
+			if _, err := os.Stat(p); err == nil {
+				path = p
+				break
+			}
+		}
+	}
+
+	if path == "" {
+		c.Providers = c.legacyProviders()
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read providers file %s: %w", path, err)
+	}
+
+	var pf providersFile
+	if err := json.Unmarshal(data, &pf); err != nil {
+		return fmt.Errorf("parse providers file %s: %w", path, err)
+	}
+	if err := validateProviders(pf.Providers); err != nil {
+		return fmt.Errorf("providers file %s: %w", path, err)
+	}
+
+	expandProviderKeys(pf.Providers)
+
+	c.Providers = pf.Providers
+	if c.DefaultProvider == "" {
+		c.DefaultProvider = pf.Default
+	}
+	return nil
+}
+
+// legacyProviders maps OLLAMA_HOST, OPENAI_* and ANTHROPIC_* to instances
+// named after their type.
+func (c *Config) legacyProviders() []ProviderConfig {
+	providers := []ProviderConfig{{
+		Name:    ProviderTypeOllama,
+		Type:    ProviderTypeOllama,
+		BaseURL: c.OllamaHost,
+		APIKey:  c.OllamaAPIKey,
+	}}
+	if c.OpenAIAPIKey != "" {
+		providers = append(providers, ProviderConfig{
+			Name:    ProviderTypeOpenAI,
+			Type:    ProviderTypeOpenAI,
+			BaseURL: c.OpenAIBaseURL,
+			APIKey:  c.OpenAIAPIKey,
+		})
+	}
+	if c.AnthropicAPIKey != "" {
+		providers = append(providers, ProviderConfig{
+			Name:    ProviderTypeAnthropic,
+			Type:    ProviderTypeAnthropic,
+			BaseURL: c.AnthropicBaseURL,
+			APIKey:  c.AnthropicAPIKey,
+		})
+	}
+	return providers
+}
+
+// expandProviderKeys allows keys to be referenced as ${ENV_VAR} instead of
+// stored in the file
+func expandProviderKeys(providers []ProviderConfig) {
+	for i := range providers {
+		providers[i].APIKey = os.ExpandEnv(providers[i].APIKey)
+	}
+}
+
+func validateProviders(providers []ProviderConfig) error {
+	if len(providers) == 0 {
+		return fmt.Errorf("no providers defined")
+	}
+
+	seen := make(map[string]bool)
+	for _, p := range providers {
+		if p.Name == "" {
+			return fmt.Errorf("provider name is required")
+		}
+		if strings.Contains(p.Name, "/") {
+			return fmt.Errorf("provider name %q must not contain '/'", p.Name)
+		}
+		if seen[p.Name] {
+			return fmt.Errorf("duplicate provider name %q", p.Name)
+		}
+		seen[p.Name] = true
+
+		switch p.Type {
+		case ProviderTypeOllama, ProviderTypeOpenAI, ProviderTypeAnthropic:
+		default:
+			return fmt.Errorf("provider %q: unknown type %q", p.Name, p.Type)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,333 @@
+package config
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strconv"
+
+	"github.com/magenta9/ai-web-tools/server/internal/model"
+	"gopkg.in/yaml.v3"
+)
+
+const redacted = "[REDACTED]"
+
+// Validate checks formats and refuses insecure defaults in production.
+// All problems are reported together.
+func (c *Config) Validate() error {
+	errs := slices.Clone(c.envErrs)
+
+	switch c.Mode {
+	case ModeDevelopment, ModeProduction:
+	default:
+		errs = append(errs, fmt.Errorf("mode: must be %q or %q, got %q", ModeDevelopment, ModeProduction, c.Mode))
+	}
+
+	if err := validatePort(c.APIPort); err != nil {
+		errs = append(errs, fmt.Errorf("api_port: %w", err))
+	}
+	if err := validatePort(c.DBPort); err != nil {
+		errs = append(errs, fmt.Errorf("db_port: %w", err))
+	}
+	if c.DBHost == "" {
+		errs = append(errs, errors.New("db_host: must not be empty"))
+	}
+	errs = append(errs, c.validateJWT()...)
+	switch c.RegistrationMode {
+	case RegistrationOpen, RegistrationInvite, RegistrationClosed:
+	default:
+		errs = append(errs, fmt.Errorf("registration_mode: must be open, invite or closed, got %q", c.RegistrationMode))
+	}
+	errs = append(errs, c.validateThrottle()...)
+	errs = append(errs, c.validateOIDC()...)
+	if c.AuditRetention < 0 {
+		errs = append(errs, errors.New("audit_retention: must not be negative"))
+	}
+	if c.AuditMaxSQLLength <= 0 {
+		errs = append(errs, errors.New("audit_max_sql_length: must be positive"))
+	}
+	if c.ConnectionKey != "" {
+		if _, err := c.ConnectionKeyBytes(); err != nil {
+			errs = append(errs, fmt.Errorf("connection_key: %w", err))
+		}
+	}
+	if c.TargetPoolMaxPerUser <= 0 {
+		errs = append(errs, errors.New("target_pool_max_per_user: must be positive"))
+	}
+	if c.TargetPoolMaxConns <= 0 {
+		errs = append(errs, errors.New("target_pool_max_conns: must be positive"))
+	}
+	if c.TargetPoolIdleTimeout <= 0 {
+		errs = append(errs, errors.New("target_pool_idle_timeout: must be positive"))
+	}
+	if c.TargetPoolHealthCheck < 0 {
+		errs = append(errs, errors.New("target_pool_health_check: must not be negative"))
+	}
+	if c.QueryTimeout <= 0 {
+		errs = append(errs, errors.New("query_timeout: must be positive"))
+	}
+	if c.QueryMaxRows <= 0 {
+		errs = append(errs, errors.New("query_max_rows: must be positive"))
+	}
+	if c.QueryMaxBytes <= 0 {
+		errs = append(errs, errors.New("query_max_bytes: must be positive"))
+	}
+	if c.QueryStreamTimeout <= 0 {
+		errs = append(errs, errors.New("query_stream_timeout: must be positive"))
+	}
+	if c.QueryStreamMaxRows < 0 {
+		errs = append(errs, errors.New("query_stream_max_rows: must not be negative"))
+	}
+	for _, dir := range c.TargetFileDirs {
+		if !filepath.IsAbs(dir) {
+			errs = append(errs, fmt.Errorf("target_file_dirs: %q must be an absolute path", dir))
+		}
+	}
+	if c.TargetFileMaxBytes <= 0 {
+		errs = append(errs, errors.New("target_file_max_bytes: must be positive"))
+	}
+	if c.TargetUploadMaxFiles < 0 {
+		errs = append(errs, errors.New("target_upload_max_files: must not be negative"))
+	}
+	if c.TargetUploadMaxTotal < 0 {
+		errs = append(errs, errors.New("target_upload_max_total_bytes: must not be negative"))
+	}
+
+	for _, u := range []struct{ name, value string }{
+		{"ollama_host", c.OllamaHost},
+		{"openai_base_url", c.OpenAIBaseURL},
+		{"anthropic_base_url", c.AnthropicBaseURL},
+	} {
+		if err := validateURL(u.value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", u.name, err))
+		}
+	}
+	for _, p := range c.Providers {
+		if p.BaseURL == "" {
+			continue
+		}
+		if err := validateURL(p.BaseURL); err != nil {
+			errs = append(errs, fmt.Errorf("providers.%s.base_url: %w", p.Name, err))
+		}
+	}
+
+	if c.IsProduction() {
+		if c.JWTAlgorithm == "HS256" {
+			if c.JWTSecret == defaultJWTSecret {
+				errs = append(errs, errors.New("jwt_secret: the development default is not allowed in production"))
+			} else if len(c.JWTSecret) < 32 {
+				errs = append(errs, errors.New("jwt_secret: must be at least 32 characters in production"))
+			}
+		}
+		if c.DBPassword == defaultDBPassword {
+			errs = append(errs, errors.New("db_password: the development default is not allowed in production"))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (c *Config) validateJWT() []error {
+	var errs []error
+
+	switch c.JWTAlgorithm {
+	case "HS256":
+		if c.JWTSecret == "" {
+			errs = append(errs, errors.New("jwt_secret: must not be empty"))
+		}
+	case "RS256", "EdDSA":
+		if c.JWTPrivateKeyFile == "" {
+			errs = append(errs, fmt.Errorf("jwt_private_key_file: required for %s", c.JWTAlgorithm))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("jwt_algorithm: must be HS256, RS256 or EdDSA, got %q", c.JWTAlgorithm))
+	}
+	if c.AccessTokenTTL <= 0 || c.RefreshTokenTTL <= 0 {
+		errs = append(errs, errors.New("access_token_ttl and refresh_token_ttl must be positive"))
+	} else if c.RefreshTokenTTL < c.AccessTokenTTL {
+		errs = append(errs, errors.New("refresh_token_ttl must not be shorter than access_token_ttl"))
+	}
+	if c.JWTKeyID == "" {
+		errs = append(errs, errors.New("jwt_key_id: must not be empty"))
+	}
+
+	seen := map[string]bool{c.JWTKeyID: true}
+	for _, k := range c.JWTVerificationKeys {
+		if k.ID == "" || seen[k.ID] {
+			errs = append(errs, fmt.Errorf("jwt_verification_keys: missing or duplicate id %q", k.ID))
+		}
+		seen[k.ID] = true
+
+		switch k.Algorithm {
+		case "HS256":
+			if k.Secret == "" {
+				errs = append(errs, fmt.Errorf("jwt_verification_keys.%s: secret is required", k.ID))
+			}
+		case "RS256", "EdDSA":
+			if k.PublicKeyFile == "" {
+				errs = append(errs, fmt.Errorf("jwt_verification_keys.%s: public_key_file is required", k.ID))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("jwt_verification_keys.%s: unknown algorithm %q", k.ID, k.Algorithm))
+		}
+	}
+	return errs
+}
+
+func (c *Config) validateThrottle() []error {
+	var errs []error
+	for _, v := range []struct {
+		name  string
+		value int
+	}{
+		{"login_max_failures", c.LoginMaxFailures},
+		{"login_max_ip_failures", c.LoginMaxIPFailures},
+		{"register_max_per_ip", c.RegisterMaxPerIP},
+	} {
+		if v.value <= 0 {
+			errs = append(errs, fmt.Errorf("%s: must be positive", v.name))
+		}
+	}
+	if c.LoginFailureWindow <= 0 || c.LoginLockout <= 0 {
+		errs = append(errs, errors.New("login_failure_window and login_lockout must be positive"))
+	}
+	for _, p := range c.TrustedProxies {
+		if net.ParseIP(p) == nil {
+			if _, _, err := net.ParseCIDR(p); err != nil {
+				errs = append(errs, fmt.Errorf("trusted_proxies: %q is not an IP address or CIDR", p))
+			}
+		}
+	}
+	return errs
+}
+
+func (c *Config) validateOIDC() []error {
+	if !c.OIDCEnabled() {
+		return nil
+	}
+
+	var errs []error
+	for _, u := range []struct{ name, value string }{
+		{"oidc_issuer", c.OIDCIssuer},
+		{"oidc_redirect_url", c.OIDCRedirectURL},
+	} {
+		if err := validateURL(u.value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", u.name, err))
+		}
+	}
+	if c.OIDCPostLoginURL != "" {
+		if err := validateURL(c.OIDCPostLoginURL); err != nil {
+			errs = append(errs, fmt.Errorf("oidc_post_login_url: %w", err))
+		}
+	}
+	if c.OIDCClientID == "" {
+		errs = append(errs, errors.New("oidc_client_id: required when oidc_issuer is set"))
+	}
+	if !slices.Contains(c.OIDCScopes, "openid") {
+		errs = append(errs, errors.New("oidc_scopes: must include openid"))
+	}
+	if !model.IsValidRole(c.OIDCDefaultRole) {
+		errs = append(errs, fmt.Errorf("oidc_default_role: unknown role %q", c.OIDCDefaultRole))
+	}
+	for _, group := range slices.Sorted(maps.Keys(c.OIDCRoleMapping)) {
+		if role := c.OIDCRoleMapping[group]; !model.IsValidRole(role) {
+			errs = append(errs, fmt.Errorf("oidc_role_mapping.%s: unknown role %q", group, role))
+		}
+	}
+	return errs
+}
+
+// Warnings returns non-fatal problems worth reporting at startup
+func (c *Config) Warnings() []string {
+	var warnings []string
+	if c.IsProduction() {
+		return warnings
+	}
+	if c.JWTAlgorithm == "HS256" && c.JWTSecret == defaultJWTSecret {
+		warnings = append(warnings, "jwt_secret is the development default; set JWT_SECRET before exposing the server")
+	}
+	if c.DBPassword == defaultDBPassword {
+		warnings = append(warnings, "db_password is the development default")
+	}
+	return warnings
+}
+
+// ConnectionKeyBytes decodes ConnectionKey
+func (c *Config) ConnectionKeyBytes() ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(c.ConnectionKey)
+	if err != nil {
+		return nil, errors.New("must be base64")
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("must decode to 32 bytes, got %d", len(key))
+	}
+	return key, nil
+}
+
+// Redacted returns a copy of the config with secrets masked
+func (c *Config) Redacted() *Config {
+	r := *c
+	r.DBPassword = redact(c.DBPassword)
+	r.JWTSecret = redact(c.JWTSecret)
+	r.OllamaAPIKey = redact(c.OllamaAPIKey)
+	r.OpenAIAPIKey = redact(c.OpenAIAPIKey)
+	r.AnthropicAPIKey = redact(c.AnthropicAPIKey)
+	r.OIDCClientSecret = redact(c.OIDCClientSecret)
+	r.ConnectionKey = redact(c.ConnectionKey)
+
+	r.JWTVerificationKeys = make([]JWTKey, len(c.JWTVerificationKeys))
+	copy(r.JWTVerificationKeys, c.JWTVerificationKeys)
+	for i := range r.JWTVerificationKeys {
+		r.JWTVerificationKeys[i].Secret = redact(r.JWTVerificationKeys[i].Secret)
+	}
+
+	r.Providers = make([]ProviderConfig, len(c.Providers))
+	copy(r.Providers, c.Providers)
+	for i := range r.Providers {
+		r.Providers[i].APIKey = redact(r.Providers[i].APIKey)
+	}
+	return &r
+}
+
+// YAML renders the config in config file format
+func (c *Config) YAML() (string, error) {
+	out, err := yaml.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return redacted
+}
+
+func validatePort(port string) error {
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	return nil
+}
+
+func validateURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("invalid URL %q: %w", raw, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid URL %q: scheme must be http or https", raw)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("invalid URL %q: missing host", raw)
+	}
+	return nil
+}
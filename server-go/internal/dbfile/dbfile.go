@@ -0,0 +1,290 @@
+// Package dbfile gives the DB tool the database files it opens with SQLite
+// and DuckDB, and the Parquet, CSV and JSON files DuckDB reads: files users
+// upload, kept apart per user, and files under directories the server
+// allows.
+package dbfile
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotFound        = errors.New("dbfile: file not found")
+	ErrNotAllowed      = errors.New("dbfile: file is not in an allowed directory")
+	ErrUnsupported     = errors.New("dbfile: unsupported file type")
+	ErrTooLarge        = errors.New("dbfile: file is too large")
+	ErrUploadsDisabled = errors.New("dbfile: uploads are disabled")
+	ErrQuotaExceeded   = errors.New("dbfile: upload quota exceeded")
+)
+
+// File kinds, by extension
+const (
+	KindSQLite = "sqlite"
+	KindDuckDB = "duckdb"
+	// KindData files are loaded into an in-memory DuckDB database
+	KindData = "data"
+)
+
+var kinds = map[string]string{
+	".sqlite":  KindSQLite,
+	".sqlite3": KindSQLite,
+	".db":      KindSQLite,
+	".db3":     KindSQLite,
+	".duckdb":  KindDuckDB,
+	".ddb":     KindDuckDB,
+	".parquet": KindData,
+	".csv":     KindData,
+	".tsv":     KindData,
+	".json":    KindData,
+	".jsonl":   KindData,
+	".ndjson":  KindData,
+}
+
+// Kind returns the kind of file at path, or "" if no driver opens it
+func Kind(path string) string {
+	return kinds[strings.ToLower(filepath.Ext(path))]
+}
+
+// Opens reports whether driver opens files of the kind at path
+func Opens(driver, path string) bool {
+	switch Kind(path) {
+	case KindSQLite:
+		return driver == "sqlite"
+	case KindDuckDB, KindData:
+		return driver == "duckdb"
+	}
+	return false
+}
+
+// File is an uploaded file
+type File struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	Size       int64     `json:"size"`
+	UploadedAt time.Time `json:"uploaded_at"`
+}
+
+// Store finds the files the DB tool may open
+type Store struct {
+	dirs      []string
+	uploadDir string
+	maxBytes  int64
+	// maxFiles and maxTotalBytes bound each user's uploads together; 0 is
+	// no limit
+	maxFiles      int
+	maxTotalBytes int64
+}
+
+// New returns a Store for files under dirs and uploads kept in uploadDir,
+// at most maxBytes each and, per user, at most maxFiles files of
+// maxTotalBytes together, where 0 is no limit. Uploads are disabled if
+// uploadDir is empty.
+func New(dirs []string, uploadDir string, maxBytes int64, maxFiles int, maxTotalBytes int64) *Store {
+	s := &Store{uploadDir: uploadDir, maxBytes: maxBytes, maxFiles: maxFiles, maxTotalBytes: maxTotalBytes}
+	for _, dir := range dirs {
+		// Symlinks are resolved so that paths compare as the kernel sees them
+		if real, err := filepath.EvalSymlinks(dir); err == nil {
+			dir = real
+		}
+		s.dirs = append(s.dirs, filepath.Clean(dir))
+	}
+	return s
+}
+
+// UploadsEnabled reports whether users may upload files
+func (s *Store) UploadsEnabled() bool {
+	return s.uploadDir != ""
+}
+
+var (
+	uploadIDPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+	unsafeNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+)
+
+func (s *Store) userDir(userID int) string {
+	return filepath.Join(s.uploadDir, strconv.Itoa(userID))
+}
+
+// Resolve returns the path of the file ref names for the user: the ID of
+// one of the user's uploads, or an absolute path under an allowed
+// directory
+func (s *Store) Resolve(userID int, ref string) (string, error) {
+	if uploadIDPattern.MatchString(ref) {
+		if !s.UploadsEnabled() {
+			return "", ErrNotFound
+		}
+		entries, err := os.ReadDir(filepath.Join(s.userDir(userID), ref))
+		if err != nil || len(entries) != 1 {
+			return "", ErrNotFound
+		}
+		return filepath.Join(s.userDir(userID), ref, entries[0].Name()), nil
+	}
+
+	if !filepath.IsAbs(ref) {
+		return "", ErrNotAllowed
+	}
+	path, err := filepath.EvalSymlinks(filepath.Clean(ref))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	if !s.allowed(path) {
+		return "", ErrNotAllowed
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "", ErrNotFound
+	}
+	return path, nil
+}
+
+func (s *Store) allowed(path string) bool {
+	for _, dir := range s.dirs {
+		rel, err := filepath.Rel(dir, path)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Save stores an upload for the user under a new ID. name keeps its
+// extension, which decides how the file is opened. It fails with
+// ErrQuotaExceeded if the user's uploads would exceed the quota.
+func (s *Store) Save(userID int, name string, r io.Reader) (*File, error) {
+	if !s.UploadsEnabled() {
+		return nil, ErrUploadsDisabled
+	}
+	name = unsafeNameChars.ReplaceAllString(filepath.Base(name), "_")
+	if Kind(name) == "" {
+		return nil, ErrUnsupported
+	}
+	if len(name) > 100 {
+		name = name[len(name)-100:]
+	}
+
+	files, used, err := s.usage(userID)
+	if err != nil {
+		return nil, err
+	}
+	if s.maxFiles > 0 && files >= s.maxFiles || s.maxTotalBytes > 0 && used >= s.maxTotalBytes {
+		return nil, ErrQuotaExceeded
+	}
+	limit, limitErr := s.maxBytes, ErrTooLarge
+	if left := s.maxTotalBytes - used; s.maxTotalBytes > 0 && left < limit {
+		limit, limitErr = left, ErrQuotaExceeded
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	id := hex.EncodeToString(b)
+	dir := filepath.Join(s.userDir(userID), id)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err == nil {
+		var n int64
+		n, err = io.Copy(f, io.LimitReader(r, limit+1))
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil && n > limit {
+			err = limitErr
+		}
+		// Uploads running at the same time each saw room for themselves
+		if err == nil {
+			if files, used, err = s.usage(userID); err == nil &&
+				(s.maxFiles > 0 && files > s.maxFiles || s.maxTotalBytes > 0 && used > s.maxTotalBytes) {
+				err = ErrQuotaExceeded
+			}
+		}
+		if err == nil {
+			return &File{ID: id, Name: name, Size: n, UploadedAt: time.Now()}, nil
+		}
+	}
+	os.RemoveAll(dir)
+	return nil, err
+}
+
+// List returns the user's uploads, newest first
+func (s *Store) List(userID int) ([]File, error) {
+	files := []File{}
+	if !s.UploadsEnabled() {
+		return files, nil
+	}
+	entries, err := os.ReadDir(s.userDir(userID))
+	if errors.Is(err, os.ErrNotExist) {
+		return files, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || !uploadIDPattern.MatchString(entry.Name()) {
+			continue
+		}
+		path, err := s.Resolve(userID, entry.Name())
+		if err != nil {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		files = append(files, File{ID: entry.Name(), Name: filepath.Base(path), Size: info.Size(), UploadedAt: info.ModTime()})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].UploadedAt.After(files[j].UploadedAt) })
+	return files, nil
+}
+
+// usage returns how many files the user has uploaded and their total size
+func (s *Store) usage(userID int) (int, int64, error) {
+	files, err := s.List(userID)
+	if err != nil {
+		return 0, 0, err
+	}
+	var total int64
+	for _, f := range files {
+		total += f.Size
+	}
+	return len(files), total, nil
+}
+
+// Delete removes one of the user's uploads
+func (s *Store) Delete(userID int, id string) error {
+	if !s.UploadsEnabled() || !uploadIDPattern.MatchString(id) {
+		return ErrNotFound
+	}
+	dir := filepath.Join(s.userDir(userID), id)
+	if _, err := os.Stat(dir); err != nil {
+		return ErrNotFound
+	}
+	return os.RemoveAll(dir)
+}
+
+// DeleteUser removes all of the user's uploads
+func (s *Store) DeleteUser(userID int) error {
+	if !s.UploadsEnabled() {
+		return nil
+	}
+	return os.RemoveAll(s.userDir(userID))
+}
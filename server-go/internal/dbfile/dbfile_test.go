@@ -0,0 +1,118 @@
+package dbfile
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	root := t.TempDir()
+	data := filepath.Join(root, "data")
+	sibling := filepath.Join(root, "data-other")
+	for _, dir := range []string{data, sibling, filepath.Join(data, "dir.sqlite")} {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, path := range []string{filepath.Join(data, "a.sqlite"), filepath.Join(sibling, "b.sqlite")} {
+		if err := os.WriteFile(path, nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		filepath.Join(data, "inside.sqlite"):  filepath.Join(data, "a.sqlite"),
+		filepath.Join(data, "outside.sqlite"): filepath.Join(sibling, "b.sqlite"),
+		filepath.Join(root, "via-link"):       data,
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, link); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fifo := filepath.Join(data, "pipe.sqlite")
+	if err := syscall.Mkfifo(fifo, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The allowed directory is itself given through a symlink
+	s := New([]string{filepath.Join(root, "via-link")}, "", 1<<20, 0, 0)
+	tests := []struct {
+		ref  string
+		want string
+		err  error
+	}{
+		{filepath.Join(data, "a.sqlite"), filepath.Join(data, "a.sqlite"), nil},
+		{filepath.Join(root, "via-link", "a.sqlite"), filepath.Join(data, "a.sqlite"), nil},
+		{filepath.Join(data, "inside.sqlite"), filepath.Join(data, "a.sqlite"), nil},
+		{filepath.Join(data, "x", "..", "a.sqlite"), filepath.Join(data, "a.sqlite"), nil},
+		{filepath.Join(data, "outside.sqlite"), "", ErrNotAllowed},
+		{data + "/../data-other/b.sqlite", "", ErrNotAllowed},
+		{filepath.Join(sibling, "b.sqlite"), "", ErrNotAllowed},
+		{"data/a.sqlite", "", ErrNotAllowed},
+		{filepath.Join(data, "missing.sqlite"), "", ErrNotFound},
+		{filepath.Join(data, "dir.sqlite"), "", ErrNotFound},
+		{fifo, "", ErrNotFound},
+		{data, "", ErrNotFound},
+	}
+	for _, tt := range tests {
+		got, err := s.Resolve(1, tt.ref)
+		if !errors.Is(err, tt.err) || got != tt.want {
+			t.Errorf("Resolve(%q) = %q, %v; want %q, %v", tt.ref, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+// Uploads are found by ID only for the user who uploaded them
+func TestResolveUpload(t *testing.T) {
+	s := New(nil, t.TempDir(), 1<<20, 0, 0)
+	f, err := s.Save(1, "../../orders.sqlite", strings.NewReader("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, err := s.Resolve(1, f.ID)
+	if err != nil || filepath.Base(path) != "orders.sqlite" {
+		t.Errorf("Resolve own upload = %q, %v", path, err)
+	}
+	if _, err := s.Resolve(2, f.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Resolve another user's upload: %v", err)
+	}
+	if _, err := s.Resolve(1, strings.Repeat("0", 32)); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Resolve unknown upload: %v", err)
+	}
+}
+
+func TestSaveQuota(t *testing.T) {
+	// 10 bytes a file, 2 files and 15 bytes a user
+	s := New(nil, t.TempDir(), 10, 2, 15)
+	save := func(userID, size int) error {
+		_, err := s.Save(userID, "t.csv", strings.NewReader(strings.Repeat("x", size)))
+		return err
+	}
+
+	if err := save(1, 11); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("file over the size limit: %v", err)
+	}
+	if err := save(1, 8); err != nil {
+		t.Fatalf("first file: %v", err)
+	}
+	if err := save(1, 8); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("file over the total: %v", err)
+	}
+	if err := save(1, 7); err != nil {
+		t.Fatalf("file up to the total: %v", err)
+	}
+	if err := save(1, 0); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("file over the count: %v", err)
+	}
+	// Failed uploads leave nothing behind, and other users have their own
+	if files, err := s.List(1); err != nil || len(files) != 2 {
+		t.Errorf("List = %v, %v; want 2 files", files, err)
+	}
+	if err := save(2, 10); err != nil {
+		t.Errorf("another user's file: %v", err)
+	}
+}
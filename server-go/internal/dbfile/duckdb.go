@@ -0,0 +1,122 @@
+//go:build duckdb
+
+package dbfile
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/marcboeker/go-duckdb"
+)
+
+// DuckDBEnabled reports whether the server was built with DuckDB, which
+// needs cgo and the duckdb build tag
+const DuckDBEnabled = true
+
+// dataReaders are the DuckDB functions that load each kind of data file
+var dataReaders = map[string]string{
+	".parquet": "read_parquet",
+	".csv":     "read_csv",
+	".tsv":     "read_csv",
+	".json":    "read_json",
+	".jsonl":   "read_json",
+	".ndjson":  "read_json",
+}
+
+// openDuckDB opens a DuckDB database file read-only, or loads a data file
+// into a table of an in-memory database. Either way DuckDB is then kept
+// from reading other files or the network, and its settings are locked,
+// so queries can only see what was opened.
+func openDuckDB(path string) (*sql.DB, error) {
+	// The DSN is parsed as a URL
+	if strings.ContainsAny(path, "?#") {
+		return nil, errors.New("dbfile: DuckDB file paths may not contain ? or #")
+	}
+	if Kind(path) == KindDuckDB {
+		connector, err := duckdb.NewConnector(path+"?access_mode=read_only&enable_external_access=false&lock_configuration=true", nil)
+		if err != nil {
+			return nil, err
+		}
+		return sql.OpenDB(connector), nil
+	}
+
+	connector, err := duckdb.NewConnector("", nil)
+	if err != nil {
+		return nil, err
+	}
+	db := sql.OpenDB(connector)
+	load := fmt.Sprintf("CREATE TABLE %s AS SELECT * FROM %s('%s')",
+		quoteIdent(TableName(path)), dataReaders[strings.ToLower(filepath.Ext(path))], strings.ReplaceAll(path, "'", "''"))
+	for _, stmt := range []string{load, "SET enable_external_access = false", "SET lock_configuration = true"} {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+var tableNameUnsafe = regexp.MustCompile(`[^a-z0-9_]+`)
+
+// TableName returns the table a data file is loaded into: its name without
+// the extension, lower-cased, with other characters replaced by _
+func TableName(path string) string {
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	name = tableNameUnsafe.ReplaceAllString(strings.ToLower(name), "_")
+	if name == "" || name[0] >= '0' && name[0] <= '9' {
+		name = "t_" + name
+	}
+	return name
+}
+
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// Value converts the driver-specific types of a scanned value to standard
+// ones: DuckDB decimals to their exact digits as a json.Number, and maps,
+// including those in lists and structs, to string-keyed maps
+func Value(v any) any {
+	switch v := v.(type) {
+	case duckdb.Decimal:
+		return json.Number(decimalString(v))
+	case duckdb.Map:
+		m := make(map[string]any, len(v))
+		for key, value := range v {
+			m[fmt.Sprint(Value(key))] = Value(value)
+		}
+		return m
+	case []any:
+		for i := range v {
+			v[i] = Value(v[i])
+		}
+		return v
+	case map[string]any:
+		for key, value := range v {
+			v[key] = Value(value)
+		}
+		return v
+	}
+	return v
+}
+
+func decimalString(d duckdb.Decimal) string {
+	digits := d.Value.String()
+	sign := ""
+	if strings.HasPrefix(digits, "-") {
+		sign, digits = "-", digits[1:]
+	}
+	scale := int(d.Scale)
+	if scale == 0 {
+		return sign + digits
+	}
+	if len(digits) <= scale {
+		digits = strings.Repeat("0", scale-len(digits)+1) + digits
+	}
+	return sign + digits[:len(digits)-scale] + "." + digits[len(digits)-scale:]
+}
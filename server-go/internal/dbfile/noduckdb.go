@@ -0,0 +1,25 @@
+//go:build !duckdb
+
+package dbfile
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// DuckDBEnabled reports whether the server was built with DuckDB, which
+// needs cgo and the duckdb build tag
+const DuckDBEnabled = false
+
+// ErrNoDuckDB is returned when opening a DuckDB file without DuckDB
+var ErrNoDuckDB = errors.New("dbfile: this server was built without DuckDB support")
+
+func openDuckDB(string) (*sql.DB, error) {
+	return nil, ErrNoDuckDB
+}
+
+// Value converts the driver-specific types of a scanned value to standard
+// ones
+func Value(v any) any {
+	return v
+}
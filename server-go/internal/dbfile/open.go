@@ -0,0 +1,33 @@
+package dbfile
+
+import (
+	"database/sql"
+	"net/url"
+	"os"
+
+	_ "modernc.org/sqlite"
+)
+
+// Open opens a pool like sql.Open. For the sqlite and duckdb drivers dsn
+// is a path from Resolve, and the file is opened read-only. It is meant as
+// the opener of a dbpool.Manager.
+func (s *Store) Open(driver, dsn string) (*sql.DB, error) {
+	switch driver {
+	case "sqlite":
+		u := url.URL{Scheme: "file", Path: dsn, RawQuery: "mode=ro&_pragma=query_only(1)&_pragma=busy_timeout(5000)"}
+		return sql.Open("sqlite", u.String())
+	case "duckdb":
+		if Kind(dsn) == KindData {
+			// Data files are loaded into memory
+			info, err := os.Stat(dsn)
+			if err != nil {
+				return nil, err
+			}
+			if info.Size() > s.maxBytes {
+				return nil, ErrTooLarge
+			}
+		}
+		return openDuckDB(dsn)
+	}
+	return sql.Open(driver, dsn)
+}
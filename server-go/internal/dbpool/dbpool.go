@@ -0,0 +1,275 @@
+// Package dbpool keeps connection pools to the target databases queried by
+// the DB tool, so that requests reuse connections instead of dialing and
+// authenticating every time.
+package dbpool
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Options bounds the pools a Manager keeps
+type Options struct {
+	// MaxPerUser is how many pools one user may hold; opening another
+	// closes the user's least recently used pool
+	MaxPerUser int
+	// IdleTimeout closes pools that have not been used for this long
+	IdleTimeout time.Duration
+	// HealthCheckInterval is how often a pool is pinged before reuse
+	HealthCheckInterval time.Duration
+	// MaxOpenConns limits the connections of each pool
+	MaxOpenConns int
+	// Open opens a pool for drivers that need setup; nil uses sql.Open
+	Open func(driver, dsn string) (*sql.DB, error)
+}
+
+// ErrClosed is returned by Get after Close
+var ErrClosed = errors.New("dbpool: manager is closed")
+
+type pool struct {
+	key         string
+	userID      int
+	db          *sql.DB
+	lastUsed    time.Time
+	lastChecked time.Time
+}
+
+// Manager owns one *sql.DB per user and connection identity
+type Manager struct {
+	opts Options
+	open func(driver, dsn string) (*sql.DB, error)
+
+	mu     sync.Mutex
+	pools  map[string]*pool
+	closed bool
+	stop   chan struct{}
+}
+
+// New returns a Manager and starts its idle eviction
+func New(opts Options) *Manager {
+	m := &Manager{
+		opts:  opts,
+		open:  opts.Open,
+		pools: map[string]*pool{},
+		stop:  make(chan struct{}),
+	}
+	if m.open == nil {
+		m.open = sql.Open
+	}
+	go m.evictLoop()
+	return m
+}
+
+// poolKey identifies a pool by user and connection identity. The DSN holds
+// the password, so only its hash is kept.
+func poolKey(userID int, driver, dsn string) string {
+	sum := sha256.Sum256([]byte(driver + "\x00" + dsn))
+	return hex.EncodeToString(sum[:]) + ":" + strconv.Itoa(userID)
+}
+
+// Get returns the user's pool for the driver and DSN, opening and pinging
+// it if needed. Pools unused for longer than HealthCheckInterval are
+// pinged again and replaced if the ping fails. Callers must not close the
+// returned *sql.DB.
+func (m *Manager) Get(ctx context.Context, userID int, driver, dsn string) (*sql.DB, error) {
+	key := poolKey(userID, driver, dsn)
+
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil, ErrClosed
+	}
+	p, ok := m.pools[key]
+	if ok {
+		p.lastUsed = time.Now()
+		needsCheck := time.Since(p.lastChecked) >= m.opts.HealthCheckInterval
+		m.mu.Unlock()
+
+		if !needsCheck {
+			return p.db, nil
+		}
+		if err := p.db.PingContext(ctx); err == nil {
+			m.mu.Lock()
+			p.lastChecked = time.Now()
+			m.mu.Unlock()
+			return p.db, nil
+		} else if ctx.Err() != nil {
+			return nil, err
+		}
+		m.remove(p)
+	} else {
+		m.mu.Unlock()
+	}
+
+	return m.add(ctx, key, userID, driver, dsn)
+}
+
+// add opens and pings a new pool and stores it, making room among the
+// user's pools first
+func (m *Manager) add(ctx context.Context, key string, userID int, driver, dsn string) (*sql.DB, error) {
+	db, err := m.open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(m.opts.MaxOpenConns)
+	db.SetMaxIdleConns(m.opts.MaxOpenConns)
+	db.SetConnMaxIdleTime(m.opts.IdleTimeout)
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		db.Close()
+		return nil, ErrClosed
+	}
+	// Another request may have opened the same pool meanwhile
+	if existing, ok := m.pools[key]; ok {
+		existing.lastUsed = time.Now()
+		m.mu.Unlock()
+		db.Close()
+		return existing.db, nil
+	}
+
+	var evicted []*pool
+	for m.countLocked(userID) >= m.opts.MaxPerUser {
+		lru := m.lruLocked(userID)
+		delete(m.pools, lru.key)
+		evicted = append(evicted, lru)
+	}
+	now := time.Now()
+	m.pools[key] = &pool{key: key, userID: userID, db: db, lastUsed: now, lastChecked: now}
+	m.mu.Unlock()
+
+	closeAll(evicted)
+	return db, nil
+}
+
+func (m *Manager) countLocked(userID int) int {
+	n := 0
+	for _, p := range m.pools {
+		if p.userID == userID {
+			n++
+		}
+	}
+	return n
+}
+
+func (m *Manager) lruLocked(userID int) *pool {
+	var lru *pool
+	for _, p := range m.pools {
+		if p.userID == userID && (lru == nil || p.lastUsed.Before(lru.lastUsed)) {
+			lru = p
+		}
+	}
+	return lru
+}
+
+// remove closes p unless it was already replaced
+func (m *Manager) remove(p *pool) {
+	m.mu.Lock()
+	if m.pools[p.key] == p {
+		delete(m.pools, p.key)
+	}
+	m.mu.Unlock()
+	p.db.Close()
+}
+
+// CloseUser closes every pool of the user, for example on logout
+func (m *Manager) CloseUser(userID int) {
+	m.mu.Lock()
+	var closing []*pool
+	for key, p := range m.pools {
+		if p.userID == userID {
+			delete(m.pools, key)
+			closing = append(closing, p)
+		}
+	}
+	m.mu.Unlock()
+	closeAll(closing)
+}
+
+// CloseDSN closes the user's pool for the driver and DSN if one is open,
+// for example once the file it opens is deleted
+func (m *Manager) CloseDSN(userID int, driver, dsn string) {
+	m.mu.Lock()
+	p, ok := m.pools[poolKey(userID, driver, dsn)]
+	m.mu.Unlock()
+	if ok {
+		m.remove(p)
+	}
+}
+
+// Close closes every pool and stops eviction. Later calls to Get fail.
+func (m *Manager) Close() {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return
+	}
+	m.closed = true
+	close(m.stop)
+	closing := make([]*pool, 0, len(m.pools))
+	for _, p := range m.pools {
+		closing = append(closing, p)
+	}
+	m.pools = map[string]*pool{}
+	m.mu.Unlock()
+	closeAll(closing)
+}
+
+// Len returns the number of open pools
+func (m *Manager) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.pools)
+}
+
+func (m *Manager) evictLoop() {
+	ticker := time.NewTicker(max(m.opts.IdleTimeout/4, time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			m.evictIdle()
+		}
+	}
+}
+
+// evictIdle closes pools unused for longer than IdleTimeout
+func (m *Manager) evictIdle() {
+	m.mu.Lock()
+	var idle []*pool
+	for key, p := range m.pools {
+		if time.Since(p.lastUsed) >= m.opts.IdleTimeout {
+			delete(m.pools, key)
+			idle = append(idle, p)
+		}
+	}
+	m.mu.Unlock()
+	if len(idle) > 0 {
+		log.Printf("Closed %d idle target database pools", len(idle))
+	}
+	closeAll(idle)
+}
+
+// closeAll closes pools outside the lock; sql.DB.Close waits for
+// connections in use to be returned
+func closeAll(pools []*pool) {
+	for _, p := range pools {
+		if err := p.db.Close(); err != nil {
+			log.Printf("Warning: failed to close target database pool: %v", err)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package dbpool
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer stands in for the target databases. Each pool it opens can be
+// taken down on its own.
+type fakeServer struct {
+	mu     sync.Mutex
+	opened []*fakeConnector
+	// refused DSNs open pools that are down
+	refused map[string]bool
+}
+
+func (s *fakeServer) open(_, dsn string) (*sql.DB, error) {
+	s.mu.Lock()
+	c := &fakeConnector{down: s.refused[dsn]}
+	s.opened = append(s.opened, c)
+	s.mu.Unlock()
+	return sql.OpenDB(c), nil
+}
+
+func (s *fakeServer) refuse(dsn string) {
+	s.mu.Lock()
+	s.refused[dsn] = true
+	s.mu.Unlock()
+}
+
+// pool returns the i-th connector opened
+func (s *fakeServer) pool(i int) *fakeConnector {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.opened[i]
+}
+
+func (s *fakeServer) opens() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.opened)
+}
+
+type fakeConnector struct {
+	mu   sync.Mutex
+	down bool
+}
+
+func (c *fakeConnector) setDown() {
+	c.mu.Lock()
+	c.down = true
+	c.mu.Unlock()
+}
+
+func (c *fakeConnector) isDown() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.down
+}
+
+var errDown = errors.New("connection refused")
+
+func (c *fakeConnector) Connect(context.Context) (driver.Conn, error) {
+	if c.isDown() {
+		return nil, errDown
+	}
+	return &fakeConn{c}, nil
+}
+
+func (c *fakeConnector) Driver() driver.Driver { return nil }
+
+type fakeConn struct{ c *fakeConnector }
+
+func (c *fakeConn) Ping(context.Context) error {
+	if c.c.isDown() {
+		return errDown
+	}
+	return nil
+}
+
+func (c *fakeConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (c *fakeConn) Close() error                        { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+
+func newTestManager(t *testing.T, opts Options) (*Manager, *fakeServer) {
+	t.Helper()
+	s := &fakeServer{refused: map[string]bool{}}
+	opts.Open = s.open
+	if opts.IdleTimeout == 0 {
+		opts.IdleTimeout = time.Hour
+	}
+	if opts.HealthCheckInterval == 0 {
+		opts.HealthCheckInterval = time.Hour
+	}
+	m := New(opts)
+	t.Cleanup(m.Close)
+	return m, s
+}
+
+func get(t *testing.T, m *Manager, userID int, dsn string) *sql.DB {
+	t.Helper()
+	db, err := m.Get(context.Background(), userID, "fake", dsn)
+	if err != nil {
+		t.Fatalf("Get(%d, %s): %v", userID, dsn, err)
+	}
+	return db
+}
+
+// isClosed reports whether db was closed by the manager
+func isClosed(db *sql.DB) bool {
+	err := db.Ping()
+	return err != nil && err.Error() == "sql: database is closed"
+}
+
+func TestGetReusesPool(t *testing.T) {
+	m, s := newTestManager(t, Options{MaxPerUser: 2})
+	a := get(t, m, 1, "a")
+	if again := get(t, m, 1, "a"); again != a {
+		t.Error("the same user and DSN got a new pool")
+	}
+	// Pools are not shared between users
+	if other := get(t, m, 2, "a"); other == a {
+		t.Error("another user got the same pool")
+	}
+	if n := s.opens(); n != 2 {
+		t.Errorf("opened %d pools, want 2", n)
+	}
+}
+
+// Opening a pool beyond MaxPerUser closes the user's least recently used
+// one
+func TestGetEvictsLeastRecentlyUsed(t *testing.T) {
+	m, _ := newTestManager(t, Options{MaxPerUser: 2})
+	a := get(t, m, 1, "a")
+	b := get(t, m, 1, "b")
+	other := get(t, m, 2, "a")
+	time.Sleep(time.Millisecond)
+	get(t, m, 1, "a")
+	c := get(t, m, 1, "c")
+
+	if !isClosed(b) {
+		t.Error("the least recently used pool is still open")
+	}
+	for name, db := range map[string]*sql.DB{"recently used": a, "new": c, "other user's": other} {
+		if isClosed(db) {
+			t.Errorf("the %s pool was closed", name)
+		}
+	}
+	if n := m.Len(); n != 3 {
+		t.Errorf("Len = %d, want 3", n)
+	}
+}
+
+// A pool that fails its health check is replaced with a new one
+func TestGetReplacesFailedPool(t *testing.T) {
+	m, s := newTestManager(t, Options{MaxPerUser: 2, HealthCheckInterval: time.Nanosecond})
+	first := get(t, m, 1, "a")
+	s.pool(0).setDown()
+
+	second := get(t, m, 1, "a")
+	if second == first {
+		t.Fatal("the failed pool was reused")
+	}
+	if !isClosed(first) {
+		t.Error("the failed pool was not closed")
+	}
+	if n := m.Len(); n != 1 {
+		t.Errorf("Len = %d, want 1", n)
+	}
+
+	// A pool whose first ping fails is not kept
+	s.refuse("b")
+	if _, err := m.Get(context.Background(), 1, "fake", "b"); !errors.Is(err, errDown) {
+		t.Errorf("Get an unreachable DSN = %v, want errDown", err)
+	}
+	if n := m.Len(); n != 1 {
+		t.Errorf("Len = %d, want 1", n)
+	}
+}
+
+func TestEvictIdle(t *testing.T) {
+	m, _ := newTestManager(t, Options{MaxPerUser: 2, IdleTimeout: time.Minute})
+	idle := get(t, m, 1, "a")
+	busy := get(t, m, 1, "b")
+	m.mu.Lock()
+	m.pools[poolKey(1, "fake", "a")].lastUsed = time.Now().Add(-2 * time.Minute)
+	m.mu.Unlock()
+
+	m.evictIdle()
+	if !isClosed(idle) {
+		t.Error("the idle pool is still open")
+	}
+	if isClosed(busy) {
+		t.Error("a pool in use was closed")
+	}
+	if again := get(t, m, 1, "a"); again == idle {
+		t.Error("Get returned the evicted pool")
+	}
+}
+
+func TestCloseUser(t *testing.T) {
+	m, _ := newTestManager(t, Options{MaxPerUser: 2})
+	a := get(t, m, 1, "a")
+	b := get(t, m, 1, "b")
+	other := get(t, m, 2, "a")
+
+	m.CloseUser(1)
+	if !isClosed(a) || !isClosed(b) {
+		t.Error("the user's pools are still open")
+	}
+	if isClosed(other) {
+		t.Error("another user's pool was closed")
+	}
+	if n := m.Len(); n != 1 {
+		t.Errorf("Len = %d, want 1", n)
+	}
+}
+
+func TestCloseDSN(t *testing.T) {
+	m, _ := newTestManager(t, Options{MaxPerUser: 2})
+	a := get(t, m, 1, "a")
+	b := get(t, m, 1, "b")
+	other := get(t, m, 2, "a")
+
+	m.CloseDSN(1, "fake", "a")
+	m.CloseDSN(1, "fake", "missing")
+	if !isClosed(a) {
+		t.Error("the pool is still open")
+	}
+	if isClosed(b) || isClosed(other) {
+		t.Error("other pools were closed")
+	}
+}
+
+func TestGetAfterClose(t *testing.T) {
+	m, _ := newTestManager(t, Options{MaxPerUser: 2})
+	a := get(t, m, 1, "a")
+
+	m.Close()
+	if !isClosed(a) {
+		t.Error("Close left a pool open")
+	}
+	if _, err := m.Get(context.Background(), 1, "fake", "a"); !errors.Is(err, ErrClosed) {
+		t.Errorf("Get after Close = %v, want ErrClosed", err)
+	}
+	if n := m.Len(); n != 0 {
+		t.Errorf("Len = %d, want 0", n)
+	}
+	// Closing again is harmless
+	m.Close()
+}
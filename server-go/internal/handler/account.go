@@ -0,0 +1,274 @@
+package handler
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/magenta9/ai-web-tools/server/internal/model"
+	"github.com/magenta9/ai-web-tools/server/internal/repository"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ChangePassword sets a new password after checking the current one, and
+// signs out every other session. Users signed up through single sign-on
+// set their first password the same way, confirming as confirmIdentity
+// describes.
+func (h *AuthHandler) ChangePassword(c *gin.Context) {
+	user, ok := h.currentUser(c)
+	if !ok {
+		return
+	}
+
+	var req model.ChangePasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Users signed up through single sign-on set their first password
+	firstPassword := user.PasswordHash == ""
+	if !h.confirmIdentity(c, user, req.CurrentPassword, req.Code, model.ActionPasswordChange, "Current password is incorrect") {
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	if err := h.Repo.UpdatePassword(ctx, user.ID, string(hashedPassword)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update password"})
+		return
+	}
+
+	var details map[string]any
+	if firstPassword {
+		details = map[string]any{"first_password": true}
+	}
+	h.auditUser(c, model.ActionPasswordChange, model.OutcomeSuccess, user.ID, details)
+
+	if err := h.Repo.RevokeOtherSessions(ctx, user.ID, c.GetString("session_id")); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke sessions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// DeleteAccount permanently deletes the user and everything they own
+func (h *AuthHandler) DeleteAccount(c *gin.Context) {
+	user, ok := h.currentUser(c)
+	if !ok {
+		return
+	}
+
+	var req model.DeleteAccountRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !h.confirmIdentity(c, user, req.Password, req.Code, model.ActionAccountDelete, "Password is incorrect") {
+		return
+	}
+
+	err := h.Repo.DeleteUser(c.Request.Context(), user.ID)
+	if errors.Is(err, repository.ErrLastAdmin) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Promote another admin before deleting this account"})
+		return
+	}
+	if errors.Is(err, repository.ErrLastOwner) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Hand over or delete your workspaces before deleting this account"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete account"})
+		return
+	}
+	h.Pools.CloseUser(user.ID)
+	if err := h.Files.DeleteUser(user.ID); err != nil {
+		log.Printf("Warning: failed to delete uploaded files of user %d: %v", user.ID, err)
+	}
+	h.auditUser(c, model.ActionAccountDelete, model.OutcomeSuccess, user.ID, map[string]any{"username": user.Username})
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// Export streams a zip archive with one JSON file per kind of data the user
+// owns. Large tables are written row by row rather than buffered.
+func (h *AuthHandler) Export(c *gin.Context) {
+	user, ok := h.currentUser(c)
+	if !ok {
+		return
+	}
+
+	ctx := c.Request.Context()
+	filename := fmt.Sprintf("webtools-export-%s-%s.zip", user.Username, time.Now().Format("20060102"))
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	c.Status(http.StatusOK)
+
+	zw := zip.NewWriter(c.Writer)
+	err := func() error {
+		if err := writeZipJSON(zw, "user.json", user); err != nil {
+			return err
+		}
+
+		sessions, err := h.Repo.ListSessions(ctx, user.ID)
+		if err != nil {
+			return err
+		}
+		if err := writeZipJSON(zw, "sessions.json", sessions); err != nil {
+			return err
+		}
+
+		keys, err := h.Repo.ListAPIKeys(ctx, user.ID)
+		if err != nil {
+			return err
+		}
+		if err := writeZipJSON(zw, "api_keys.json", keys); err != nil {
+			return err
+		}
+
+		prompts, err := h.Repo.GetOwnedPrompts(ctx, user.ID)
+		if err != nil {
+			return err
+		}
+		if err := writeZipJSON(zw, "prompts.json", prompts); err != nil {
+			return err
+		}
+
+		identities, err := h.Repo.ListIdentities(ctx, user.ID)
+		if err != nil {
+			return err
+		}
+		if err := writeZipJSON(zw, "identities.json", identities); err != nil {
+			return err
+		}
+
+		workspaces, err := h.Repo.ListWorkspaces(ctx, user.ID)
+		if err != nil {
+			return err
+		}
+		if err := writeZipJSON(zw, "workspaces.json", workspaces); err != nil {
+			return err
+		}
+
+		// Saved passwords are left out; only whether one is set is shown
+		conns, err := h.Repo.GetOwnedDBConnections(ctx, user.ID)
+		if err != nil {
+			return err
+		}
+		if err := writeZipJSON(zw, "db_connections.json", conns); err != nil {
+			return err
+		}
+
+		history, err := newZipJSONArray(zw, "tool_history.json")
+		if err != nil {
+			return err
+		}
+		if err := h.Repo.ForEachHistory(ctx, user.ID, func(e *model.ToolHistory) error {
+			return history.write(e)
+		}); err != nil {
+			return err
+		}
+		if err := history.close(); err != nil {
+			return err
+		}
+
+		chats, err := newZipJSONArray(zw, "chat_sessions.json")
+		if err != nil {
+			return err
+		}
+		if err := h.Repo.ForEachChatSession(ctx, user.ID, func(s *model.ChatSession) error {
+			return chats.write(s)
+		}); err != nil {
+			return err
+		}
+		return chats.close()
+	}()
+	if err != nil {
+		// Headers are already sent; a truncated archive fails to open,
+		// which is the best signal left
+		log.Printf("Export for user %d failed: %v", user.ID, err)
+		return
+	}
+
+	if err := zw.Close(); err != nil {
+		log.Printf("Export for user %d failed: %v", user.ID, err)
+	}
+}
+
+// currentUser loads the authenticated user, writing an error response if
+// that fails
+func (h *AuthHandler) currentUser(c *gin.Context) (*model.User, bool) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return nil, false
+	}
+
+	user, err := h.Repo.GetUserByID(userID.(int))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
+		return nil, false
+	}
+	return user, true
+}
+
+func writeZipJSON(zw *zip.Writer, name string, v any) error {
+	w, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// zipJSONArray writes a JSON array into a zip entry one element at a time
+type zipJSONArray struct {
+	w     io.Writer
+	count int
+}
+
+func newZipJSONArray(zw *zip.Writer, name string) (*zipJSONArray, error) {
+	w, err := zw.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(w, "["); err != nil {
+		return nil, err
+	}
+	return &zipJSONArray{w: w}, nil
+}
+
+func (a *zipJSONArray) write(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	sep := ",\n"
+	if a.count == 0 {
+		sep = "\n"
+	}
+	a.count++
+	if _, err := io.WriteString(a.w, sep); err != nil {
+		return err
+	}
+	_, err = a.w.Write(data)
+	return err
+}
+
+func (a *zipJSONArray) close() error {
+	_, err := io.WriteString(a.w, "\n]\n")
+	return err
+}
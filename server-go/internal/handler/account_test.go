@@ -0,0 +1,187 @@
+package handler
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/magenta9/ai-web-tools/server/internal/config"
+	"github.com/magenta9/ai-web-tools/server/internal/dbfile"
+	"github.com/magenta9/ai-web-tools/server/internal/dbpool"
+	"github.com/magenta9/ai-web-tools/server/internal/model"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password checks behind an access token share the login lockout
+func TestPasswordChecksAreThrottled(t *testing.T) {
+	repo := testRepository(t)
+	alice := testUser(t, repo)
+	hash, err := bcrypt.GenerateFromPassword([]byte("s3cret-pass"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := repo.UpdatePassword(ctx, alice.ID, string(hash)); err != nil {
+		t.Fatal(err)
+	}
+	key := loginUserKey(alice.Username)
+	t.Cleanup(func() { repo.ClearThrottle(context.Background(), key) })
+
+	h := NewAuthHandler(repo, &config.Config{
+		LoginMaxFailures:   5,
+		LoginFailureWindow: time.Minute,
+		LoginLockout:       time.Minute,
+	}, nil, nil, nil, nil)
+	r := testRouter()
+	r.PUT("/password", h.ChangePassword)
+	r.DELETE("/account", h.DeleteAccount)
+	r.POST("/2fa/disable", h.DisableTwoFactor)
+
+	code, resp := doJSON(t, r, alice, "PUT", "/password", map[string]any{"current_password": "guess-1", "new_password": "changed-pass"})
+	if code != 401 {
+		t.Fatalf("wrong password: %d %v", code, resp)
+	}
+	// The next attempt has to wait, even with the right password
+	for _, tt := range []struct {
+		method, path string
+		body         map[string]any
+	}{
+		{"PUT", "/password", map[string]any{"current_password": "s3cret-pass", "new_password": "changed-pass"}},
+		{"DELETE", "/account", map[string]any{"password": "guess-2"}},
+		{"POST", "/2fa/disable", map[string]any{"password": "guess-3", "code": "123456"}},
+	} {
+		if code, resp := doJSON(t, r, alice, tt.method, tt.path, tt.body); code != 429 {
+			t.Errorf("%s %s right after a failure: %d %v", tt.method, tt.path, code, resp)
+		}
+	}
+
+	th, err := repo.GetThrottle(ctx, key, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if th.Failures != 1 {
+		t.Errorf("failures = %d, want 1", th.Failures)
+	}
+}
+
+// Users signed up through single sign-on have no password. They confirm
+// sensitive actions with a recent sign-on instead.
+func TestPasswordlessUserActions(t *testing.T) {
+	repo := testRepository(t)
+	alice := testUser(t, repo)
+	ctx := context.Background()
+	if err := repo.UpdatePassword(ctx, alice.ID, ""); err != nil {
+		t.Fatal(err)
+	}
+	session := &model.Session{ID: fmt.Sprintf("test-%d", alice.ID), UserID: alice.ID}
+	if err := repo.CreateSession(ctx, session); err != nil {
+		t.Fatal(err)
+	}
+
+	h := NewAuthHandler(repo, &config.Config{
+		LoginMaxFailures:   5,
+		LoginFailureWindow: time.Minute,
+		LoginLockout:       time.Minute,
+	}, nil, nil, dbpool.New(dbpool.Options{}), &dbfile.Store{})
+	routes := func(sessionID string) http.Handler {
+		r := testRouter()
+		r.Use(func(c *gin.Context) { c.Set("session_id", sessionID) })
+		r.PUT("/password", h.ChangePassword)
+		r.DELETE("/account", h.DeleteAccount)
+		return r
+	}
+	fresh, stale := routes(session.ID), routes("no-such-session")
+
+	if code, resp := doJSON(t, stale, alice, "DELETE", "/account", map[string]any{}); code != 401 {
+		t.Errorf("delete without a recent sign-on: %d %v", code, resp)
+	}
+	if code, resp := doJSON(t, stale, alice, "PUT", "/password", map[string]any{"new_password": "first-pass"}); code != 401 {
+		t.Errorf("first password without a recent sign-on: %d %v", code, resp)
+	}
+	if code, resp := doJSON(t, fresh, alice, "PUT", "/password", map[string]any{"new_password": "first-pass"}); code != 200 {
+		t.Fatalf("first password: %d %v", code, resp)
+	}
+
+	// From now on the password is needed
+	if code, resp := doJSON(t, fresh, alice, "PUT", "/password", map[string]any{"new_password": "second-pass"}); code != 400 {
+		t.Errorf("change without the current password: %d %v", code, resp)
+	}
+	if code, resp := doJSON(t, fresh, alice, "DELETE", "/account", map[string]any{"password": "first-pass"}); code != 200 {
+		t.Errorf("delete with the password: %d %v", code, resp)
+	}
+}
+
+// The export covers the user's connections, without their passwords, and
+// the workspaces the user belongs to
+func TestExportIncludesConnectionsAndWorkspaces(t *testing.T) {
+	repo := testRepository(t)
+	alice := testUser(t, repo)
+	ctx := context.Background()
+
+	ws := &model.Workspace{Name: "analytics"}
+	if err := repo.CreateWorkspace(ctx, ws, alice.ID); err != nil {
+		t.Fatal(err)
+	}
+	conn := &model.DBConnection{Name: "warehouse", Type: "postgres", Host: "db.internal", Port: 5432, User: "reader"}
+	var err error
+	if conn.ID, err = repo.NextDBConnectionID(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.CreateDBConnection(ctx, conn, []byte("encrypted-secret"), model.Caller{UserID: alice.ID}); err != nil {
+		t.Fatal(err)
+	}
+
+	h := NewAuthHandler(repo, &config.Config{}, nil, nil, nil, nil)
+	r := testRouter()
+	r.GET("/export", h.Export)
+	req := httptest.NewRequest("GET", "/export", nil)
+	req.Header.Set(testUserHeader, strconv.Itoa(alice.ID))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("export: %d %s", w.Code, w.Body.String())
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name] = string(b)
+	}
+	for _, name := range []string{"identities.json", "workspaces.json", "db_connections.json"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("%s is missing from the export", name)
+		}
+	}
+	if !strings.Contains(files["workspaces.json"], `"analytics"`) {
+		t.Errorf("workspaces.json = %s", files["workspaces.json"])
+	}
+	conns := files["db_connections.json"]
+	if !strings.Contains(conns, `"warehouse"`) || !strings.Contains(conns, `"has_password":true`) {
+		t.Errorf("db_connections.json = %s", conns)
+	}
+	if strings.Contains(conns, "encrypted-secret") || strings.Contains(conns, base64.StdEncoding.EncodeToString([]byte("encrypted-secret"))) {
+		t.Error("the export contains the connection's password")
+	}
+}
@@ -0,0 +1,105 @@
+package handler
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/magenta9/ai-web-tools/server/internal/audit"
+	"github.com/magenta9/ai-web-tools/server/internal/model"
+	"github.com/magenta9/ai-web-tools/server/internal/repository"
+)
+
+// AdminHandler serves user management for admins
+type AdminHandler struct {
+	repo  *repository.Repository
+	audit *audit.Logger
+}
+
+func NewAdminHandler(repo *repository.Repository, auditLog *audit.Logger) *AdminHandler {
+	return &AdminHandler{repo: repo, audit: auditLog}
+}
+
+func (h *AdminHandler) ListUsers(c *gin.Context) {
+	users, err := h.repo.ListUsers(c.Request.Context())
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true, "users": users})
+}
+
+func (h *AdminHandler) UpdateRole(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id <= 0 {
+		c.JSON(400, gin.H{"success": false, "error": "invalid id"})
+		return
+	}
+
+	var req model.UpdateRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil || !model.IsValidRole(req.Role) {
+		c.JSON(400, gin.H{"success": false, "error": "role must be one of admin, member, viewer"})
+		return
+	}
+
+	err = h.repo.UpdateUserRole(c.Request.Context(), id, req.Role)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		c.JSON(404, gin.H{"success": false, "error": "user not found"})
+		return
+	case errors.Is(err, repository.ErrLastAdmin):
+		c.JSON(409, gin.H{"success": false, "error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+	h.audit.Log(c, model.AuditEvent{
+		Action:     model.ActionRoleChange,
+		TargetType: "user",
+		TargetID:   strconv.Itoa(id),
+		Details:    map[string]any{"role": req.Role},
+	})
+
+	c.JSON(200, gin.H{"success": true})
+}
+
+// Unlock clears the login failures and lockout of a username and/or an IP.
+// For an existing user the lockout of their second factor is cleared too.
+func (h *AdminHandler) Unlock(c *gin.Context) {
+	var req model.UnlockRequest
+	if err := c.ShouldBindJSON(&req); err != nil || (req.Username == "" && req.IP == "") {
+		c.JSON(400, gin.H{"success": false, "error": "username or ip is required"})
+		return
+	}
+
+	var keys []string
+	if req.Username != "" {
+		keys = append(keys, loginUserKey(req.Username))
+		user, err := h.repo.GetUserByUsername(req.Username)
+		switch {
+		case err == nil:
+			keys = append(keys, twoFactorUserKey(user.ID))
+		case !errors.Is(err, pgx.ErrNoRows):
+			c.JSON(500, gin.H{"success": false, "error": err.Error()})
+			return
+		}
+	}
+	if req.IP != "" {
+		keys = append(keys, loginIPKey(req.IP), registerIPKey(req.IP))
+	}
+
+	cleared, err := h.repo.ClearThrottle(c.Request.Context(), keys...)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+	h.audit.Log(c, model.AuditEvent{
+		Action:  model.ActionUnlock,
+		Details: map[string]any{"username": req.Username, "ip": req.IP, "cleared": cleared},
+	})
+
+	c.JSON(200, gin.H{"success": true, "cleared": cleared})
+}
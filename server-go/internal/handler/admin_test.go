@@ -0,0 +1,44 @@
+package handler
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Unlocking a username also lifts the lockout of the user's second factor
+func TestUnlockClearsTwoFactorLockout(t *testing.T) {
+	repo := testRepository(t)
+	alice := testUser(t, repo)
+	ctx := context.Background()
+	keys := []string{loginUserKey(alice.Username), twoFactorUserKey(alice.ID)}
+	for _, key := range keys {
+		if _, err := repo.IncrementThrottle(ctx, key, time.Minute, 1, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() { repo.ClearThrottle(context.Background(), keys...) })
+
+	h := NewAdminHandler(repo, nil)
+	r := testRouter()
+	r.POST("/unlock", h.Unlock)
+	code, resp := doJSON(t, r, alice, "POST", "/unlock", map[string]any{"username": alice.Username})
+	if code != 200 || resp["cleared"] != float64(2) {
+		t.Fatalf("unlock: %d %v", code, resp)
+	}
+	for _, key := range keys {
+		th, err := repo.GetThrottle(ctx, key, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if th.LockedFor > 0 || th.Failures > 0 {
+			t.Errorf("%s is still locked: %+v", key, th)
+		}
+	}
+
+	// Usernames that do not exist can be locked and unlocked too
+	code, resp = doJSON(t, r, alice, "POST", "/unlock", map[string]any{"username": "no_such_user_" + alice.Username})
+	if code != 200 {
+		t.Errorf("unlock unknown user: %d %v", code, resp)
+	}
+}
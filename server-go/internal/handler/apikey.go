@@ -0,0 +1,109 @@
+package handler
+
+import (
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/magenta9/ai-web-tools/server/internal/auth"
+	"github.com/magenta9/ai-web-tools/server/internal/model"
+	"github.com/magenta9/ai-web-tools/server/internal/repository"
+)
+
+type APIKeyHandler struct {
+	repo *repository.Repository
+}
+
+func NewAPIKeyHandler(repo *repository.Repository) *APIKeyHandler {
+	return &APIKeyHandler{repo: repo}
+}
+
+// Create issues a new key. The full key is returned only in this response.
+func (h *APIKeyHandler) Create(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(401, gin.H{"success": false, "error": "Unauthorized"})
+		return
+	}
+
+	var req model.CreateAPIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"success": false, "error": "name and at least one scope are required"})
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !slices.Contains(model.APIKeyScopes, scope) {
+			c.JSON(400, gin.H{"success": false, "error": "unknown scope: " + scope})
+			return
+		}
+	}
+	if req.ExpiresAt != nil && req.ExpiresAt.Before(time.Now()) {
+		c.JSON(400, gin.H{"success": false, "error": "expires_at must be in the future"})
+		return
+	}
+
+	secret, _, err := auth.NewOpaqueToken()
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "failed to generate key"})
+		return
+	}
+	key := model.APIKeyPrefix + secret
+
+	apiKey := &model.APIKey{
+		UserID:    userID.(int),
+		Name:      req.Name,
+		Prefix:    key[:len(model.APIKeyPrefix)+8],
+		KeyHash:   auth.HashToken(key),
+		Scopes:    req.Scopes,
+		ExpiresAt: req.ExpiresAt,
+	}
+	if err := h.repo.CreateAPIKey(c.Request.Context(), apiKey); err != nil {
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+
+	c.JSON(201, gin.H{"success": true, "key": key, "api_key": apiKey})
+}
+
+func (h *APIKeyHandler) List(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(401, gin.H{"success": false, "error": "Unauthorized"})
+		return
+	}
+
+	keys, err := h.repo.ListAPIKeys(c.Request.Context(), userID.(int))
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true, "api_keys": keys})
+}
+
+func (h *APIKeyHandler) Revoke(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(401, gin.H{"success": false, "error": "Unauthorized"})
+		return
+	}
+
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || id <= 0 {
+		c.JSON(400, gin.H{"success": false, "error": "invalid id"})
+		return
+	}
+
+	found, err := h.repo.RevokeAPIKey(c.Request.Context(), id, userID.(int))
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+	if !found {
+		c.JSON(404, gin.H{"success": false, "error": "API key not found"})
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true})
+}
@@ -0,0 +1,125 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/magenta9/ai-web-tools/server/internal/model"
+)
+
+// ListAudit returns a page of audit log entries, newest first. Pass the
+// returned next_before_id as before_id to get the next page.
+func (h *AdminHandler) ListAudit(c *gin.Context) {
+	filter, ok := bindAuditFilter(c)
+	if !ok {
+		return
+	}
+
+	events, err := h.repo.ListAuditEvents(c.Request.Context(), filter)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+
+	resp := gin.H{"success": true, "events": events}
+	if len(events) > 0 && len(events) == filter.Limit {
+		resp["next_before_id"] = events[len(events)-1].ID
+	}
+	c.JSON(200, resp)
+}
+
+// ExportAudit streams the matching audit log entries as JSON Lines, oldest
+// first. The export itself is recorded too.
+func (h *AdminHandler) ExportAudit(c *gin.Context) {
+	filter, ok := bindAuditFilter(c)
+	if !ok {
+		return
+	}
+	h.audit.Log(c, model.AuditEvent{
+		Action:  model.ActionAuditExport,
+		Details: map[string]any{"query": c.Request.URL.RawQuery},
+	})
+
+	filename := fmt.Sprintf("audit-%s.jsonl", time.Now().Format("20060102-150405"))
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	c.Status(200)
+
+	enc := json.NewEncoder(c.Writer)
+	err := h.repo.ForEachAuditEvent(c.Request.Context(), filter, func(e *model.AuditEvent) error {
+		return enc.Encode(e)
+	})
+	if err != nil {
+		// Headers are already sent; the file simply ends early
+		log.Printf("Audit export failed: %v", err)
+	}
+}
+
+// bindAuditFilter reads the audit filter from the query string, writing an
+// error response if it is invalid
+func bindAuditFilter(c *gin.Context) (model.AuditFilter, bool) {
+	f := model.AuditFilter{
+		Action:     c.Query("action"),
+		TargetType: c.Query("target_type"),
+		TargetID:   c.Query("target_id"),
+		Outcome:    c.Query("outcome"),
+		IP:         c.Query("ip"),
+	}
+
+	for _, p := range []struct {
+		name string
+		dst  *int
+	}{
+		{"actor_id", &f.ActorID},
+		{"limit", &f.Limit},
+	} {
+		if v := c.Query(p.name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				c.JSON(400, gin.H{"success": false, "error": "invalid " + p.name})
+				return f, false
+			}
+			*p.dst = n
+		}
+	}
+	if v := c.Query("before_id"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			c.JSON(400, gin.H{"success": false, "error": "invalid before_id"})
+			return f, false
+		}
+		f.BeforeID = n
+	}
+
+	for _, p := range []struct {
+		name string
+		dst  **time.Time
+	}{
+		{"since", &f.Since},
+		{"until", &f.Until},
+	} {
+		if v := c.Query(p.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				c.JSON(400, gin.H{"success": false, "error": p.name + " must be an RFC 3339 time"})
+				return f, false
+			}
+			*p.dst = &t
+		}
+	}
+
+	switch f.Outcome {
+	case "", model.OutcomeSuccess, model.OutcomeFailure, model.OutcomeDenied:
+	default:
+		c.JSON(400, gin.H{"success": false, "error": "outcome must be success, failure or denied"})
+		return f, false
+	}
+	if f.Limit <= 0 || f.Limit > 1000 {
+		f.Limit = 100
+	}
+	return f, true
+}
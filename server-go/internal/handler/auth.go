@@ -1,24 +1,64 @@
 package handler
 
 import (
+	"errors"
+	"log"
 	"net/http"
-	"time"
+	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/magenta9/ai-web-tools/server/internal/audit"
+	"github.com/magenta9/ai-web-tools/server/internal/auth"
 	"github.com/magenta9/ai-web-tools/server/internal/config"
+	"github.com/magenta9/ai-web-tools/server/internal/dbfile"
+	"github.com/magenta9/ai-web-tools/server/internal/dbpool"
 	"github.com/magenta9/ai-web-tools/server/internal/model"
 	"github.com/magenta9/ai-web-tools/server/internal/repository"
 	"golang.org/x/crypto/bcrypt"
 )
 
 type AuthHandler struct {
-	Repo *repository.Repository
+	Repo   *repository.Repository
 	Config *config.Config
+	Tokens *auth.TokenManager
+	Audit  *audit.Logger
+	// Pools holds the user's target database pools, closed on logout
+	Pools *dbpool.Manager
+	// Files holds the user's uploaded database files, removed with the
+	// account
+	Files *dbfile.Store
 }
 
-func NewAuthHandler(repo *repository.Repository, cfg *config.Config) *AuthHandler {
-	return &AuthHandler{Repo: repo, Config: cfg}
+func NewAuthHandler(repo *repository.Repository, cfg *config.Config, tokens *auth.TokenManager, auditLog *audit.Logger, pools *dbpool.Manager, files *dbfile.Store) *AuthHandler {
+	return &AuthHandler{Repo: repo, Config: cfg, Tokens: tokens, Audit: auditLog, Pools: pools, Files: files}
+}
+
+// auditUser records an auth event performed by, or on behalf of, the user
+func (h *AuthHandler) auditUser(c *gin.Context, action, outcome string, userID int, details map[string]any) {
+	h.Audit.Log(c, model.AuditEvent{
+		ActorID:    &userID,
+		Action:     action,
+		TargetType: "user",
+		TargetID:   strconv.Itoa(userID),
+		Outcome:    outcome,
+		Details:    details,
+	})
+}
+
+// auditLogin records a login attempt for the username as typed. The actor
+// is set only when the username exists.
+func (h *AuthHandler) auditLogin(c *gin.Context, action, outcome, username string, user *model.User, reason string) {
+	e := model.AuditEvent{Action: action, TargetType: "username", TargetID: username, Outcome: outcome}
+	if user != nil {
+		e.ActorID = &user.ID
+	}
+	if reason != "" {
+		e.Details = map[string]any{"reason": reason}
+	}
+	h.Audit.Log(c, e)
 }
 
 func (h *AuthHandler) Register(c *gin.Context) {
@@ -28,6 +68,26 @@ func (h *AuthHandler) Register(c *gin.Context) {
 		return
 	}
 
+	if h.Config.RegistrationMode == config.RegistrationClosed {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Registration is closed"})
+		return
+	}
+	if h.Config.RegistrationMode == config.RegistrationInvite && req.InviteCode == "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "An invite code is required"})
+		return
+	}
+	if len(h.Config.RegistrationEmailDomains) > 0 && !emailDomainAllowed(h.Config, req.Email) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "An email address in an allowed domain is required"})
+		return
+	}
+
+	// Every attempt counts towards the per-IP sign-up limit
+	ipKey := registerIPKey(c.ClientIP())
+	if !h.checkThrottle(c, ipKey, false) {
+		return
+	}
+	h.recordFailure(c, ipKey, h.Config.RegisterMaxPerIP)
+
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
@@ -37,25 +97,60 @@ func (h *AuthHandler) Register(c *gin.Context) {
 	user := &model.User{
 		Username:     req.Username,
 		PasswordHash: string(hashedPassword),
+		Email:        req.Email,
 	}
 
-	if err := h.Repo.CreateUser(user); err != nil {
+	// An invite code given in open mode is still checked and counted
+	if req.InviteCode != "" {
+		err = h.Repo.CreateUserWithInvite(c.Request.Context(), user, auth.HashToken(strings.TrimSpace(req.InviteCode)))
+	} else {
+		err = h.Repo.CreateUser(user)
+	}
+	if errors.Is(err, repository.ErrInvalidInvite) {
+		h.auditLogin(c, model.ActionRegister, model.OutcomeDenied, req.Username, nil, "invalid invite code")
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid or expired invite code"})
+		return
+	}
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
 		return
 	}
+	h.auditUser(c, model.ActionRegister, model.OutcomeSuccess, user.ID, map[string]any{"invite": req.InviteCode != ""})
 
-	token, err := h.generateToken(user.ID)
+	resp, err := h.startSession(c, user)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
 		return
 	}
 
-	c.JSON(http.StatusCreated, model.AuthResponse{
-		Token: token,
-		User:  *user,
+	c.JSON(http.StatusCreated, resp)
+}
+
+// RegistrationInfo tells the frontend which registration fields to show
+func (h *AuthHandler) RegistrationInfo(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"mode":          h.Config.RegistrationMode,
+		"email_domains": h.Config.RegistrationEmailDomains,
+		"sso":           h.Config.OIDCEnabled(),
 	})
 }
 
+// emailDomainAllowed reports whether email is in one of the registration
+// email domains
+func emailDomainAllowed(cfg *config.Config, email string) bool {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+	domain := email[at+1:]
+	for _, allowed := range cfg.RegistrationEmailDomains {
+		if strings.EqualFold(domain, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
 func (h *AuthHandler) Login(c *gin.Context) {
 	var req model.LoginRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -63,27 +158,58 @@ func (h *AuthHandler) Login(c *gin.Context) {
 		return
 	}
 
-	user, err := h.Repo.GetUserByUsername(req.Username)
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+	ipKey := loginIPKey(c.ClientIP())
+	userKey := loginUserKey(req.Username)
+	if !h.checkThrottle(c, ipKey, false) || !h.checkThrottle(c, userKey, true) {
+		h.auditLogin(c, model.ActionLogin, model.OutcomeDenied, req.Username, nil, "throttled")
 		return
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)); err != nil {
+	// Unknown users and wrong passwords take the same time and get the
+	// same response, so logins cannot be used to discover usernames
+	user, err := h.Repo.GetUserByUsername(req.Username)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
+		return
+	}
+	// Users provisioned through single sign-on have no password
+	hasPassword := user != nil && user.PasswordHash != ""
+	hash := dummyPasswordHash
+	if hasPassword {
+		hash = []byte(user.PasswordHash)
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(req.Password)) != nil || !hasPassword {
+		h.recordFailure(c, ipKey, h.Config.LoginMaxIPFailures)
+		h.recordFailure(c, userKey, h.Config.LoginMaxFailures)
+		reason := "wrong password"
+		if user == nil {
+			reason = "unknown user"
+		} else if !hasPassword {
+			reason = "no password set"
+		}
+		h.auditLogin(c, model.ActionLogin, model.OutcomeFailure, req.Username, user, reason)
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
 		return
 	}
 
-	token, err := h.generateToken(user.ID)
+	// The IP record is kept so that one valid account cannot be used to
+	// reset the count while guessing others
+	if _, err := h.Repo.ClearThrottle(c.Request.Context(), userKey); err != nil {
+		log.Printf("Warning: failed to clear login failures for %s: %v", userKey, err)
+	}
+
+	resp, err := h.completeLogin(c, user)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
 		return
 	}
+	reason := ""
+	if user.TwoFactorEnabled {
+		reason = "second factor required"
+	}
+	h.auditLogin(c, model.ActionLogin, model.OutcomeSuccess, req.Username, user, reason)
 
-	c.JSON(http.StatusOK, model.AuthResponse{
-		Token: token,
-		User:  *user,
-	})
+	c.JSON(http.StatusOK, resp)
 }
 
 func (h *AuthHandler) Me(c *gin.Context) {
@@ -102,12 +228,159 @@ func (h *AuthHandler) Me(c *gin.Context) {
 	c.JSON(http.StatusOK, user)
 }
 
-func (h *AuthHandler) generateToken(userID int) (string, error) {
-	claims := jwt.MapClaims{
-		"user_id": userID,
-		"exp":     time.Now().Add(time.Hour * 24).Unix(),
+// Refresh exchanges a refresh token for a new access token and a new
+// refresh token. Presenting a refresh token that was already used revokes
+// its whole session, since one of the two holders must be an attacker.
+func (h *AuthHandler) Refresh(c *gin.Context) {
+	var req model.RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	stored, err := h.Repo.GetRefreshToken(ctx, auth.HashToken(req.RefreshToken))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+	if stored.Revoked || stored.Expired {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+
+	refreshToken, refreshHash, err := auth.NewOpaqueToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	rotated := false
+	if stored.UsedAt == nil {
+		rotated, err = h.Repo.RotateRefreshToken(ctx, stored.ID, stored.SessionID, refreshHash, h.Config.RefreshTokenTTL)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refresh session"})
+			return
+		}
+	}
+	if !rotated {
+		log.Printf("Refresh token reuse detected for user %d, revoking session %s", stored.UserID, stored.SessionID)
+		h.Repo.RevokeSession(ctx, stored.SessionID)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Refresh token has already been used"})
+		return
+	}
+
+	user, err := h.Repo.GetUserByID(stored.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
+		return
+	}
+
+	token, err := h.Tokens.Sign(user.ID, jwt.MapClaims{"sid": stored.SessionID})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, model.AuthResponse{
+		Token:        token,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(h.Tokens.TTL().Seconds()),
+		User:         *user,
+	})
+}
+
+// Logout revokes the session of the presented access token
+func (h *AuthHandler) Logout(c *gin.Context) {
+	sessionID, exists := c.Get("session_id")
+	if !exists {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Token is not bound to a session"})
+		return
+	}
+
+	if err := h.Repo.RevokeSession(c.Request.Context(), sessionID.(string)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke session"})
+		return
+	}
+	h.Pools.CloseUser(c.GetInt("user_id"))
+	h.auditUser(c, model.ActionLogout, model.OutcomeSuccess, c.GetInt("user_id"), nil)
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// LogoutAll revokes every session of the current user
+func (h *AuthHandler) LogoutAll(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	if err := h.Repo.RevokeUserSessions(c.Request.Context(), userID.(int)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke sessions"})
+		return
+	}
+	h.Pools.CloseUser(userID.(int))
+	h.auditUser(c, model.ActionLogoutAll, model.OutcomeSuccess, userID.(int), nil)
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// completeLogin finishes a first-factor login: users with two-factor
+// authentication get a challenge, everyone else a session. The result is a
+// *model.ChallengeResponse or a *model.AuthResponse.
+func (h *AuthHandler) completeLogin(c *gin.Context, user *model.User) (any, error) {
+	if !user.TwoFactorEnabled {
+		return h.startSession(c, user)
+	}
+
+	challenge, err := h.Tokens.SignChallenge(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &model.ChallengeResponse{
+		TwoFactorRequired: true,
+		ChallengeToken:    challenge,
+		ExpiresIn:         int(auth.ChallengeTTL.Seconds()),
+	}, nil
+}
+
+// startSession records a new login session and issues its first access and
+// refresh tokens
+func (h *AuthHandler) startSession(c *gin.Context, user *model.User) (*model.AuthResponse, error) {
+	sessionID, err := auth.NewSessionID()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := c.Request.Context()
+	session := &model.Session{
+		ID:        sessionID,
+		UserID:    user.ID,
+		UserAgent: c.Request.UserAgent(),
+		IPAddress: c.ClientIP(),
+	}
+	if err := h.Repo.CreateSession(ctx, session); err != nil {
+		return nil, err
+	}
+
+	refreshToken, refreshHash, err := auth.NewOpaqueToken()
+	if err != nil {
+		return nil, err
+	}
+	if err := h.Repo.CreateRefreshToken(ctx, sessionID, refreshHash, h.Config.RefreshTokenTTL); err != nil {
+		return nil, err
+	}
+
+	token, err := h.Tokens.Sign(user.ID, jwt.MapClaims{"sid": sessionID})
+	if err != nil {
+		return nil, err
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(h.Config.JWTSecret))
+	return &model.AuthResponse{
+		Token:        token,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(h.Tokens.TTL().Seconds()),
+		User:         *user,
+	}, nil
 }
@@ -0,0 +1,21 @@
+package handler
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/magenta9/ai-web-tools/server/internal/model"
+)
+
+// getCaller returns the authenticated user set by the auth middleware and
+// the workspace selected by the workspace middleware, if any
+func getCaller(c *gin.Context) (model.Caller, bool) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		return model.Caller{}, false
+	}
+	return model.Caller{
+		UserID:        userID.(int),
+		Role:          c.GetString("role"),
+		WorkspaceID:   c.GetInt("workspace_id"),
+		WorkspaceRole: c.GetString("workspace_role"),
+	}, true
+}
@@ -0,0 +1,178 @@
+package handler
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/magenta9/ai-web-tools/server/internal/model"
+	"github.com/magenta9/ai-web-tools/server/internal/repository"
+)
+
+// ChatHandler serves saved chat sessions in the personal scope or the
+// selected workspace
+type ChatHandler struct {
+	repo *repository.Repository
+}
+
+func NewChatHandler(repo *repository.Repository) *ChatHandler {
+	return &ChatHandler{repo: repo}
+}
+
+type chatSessionRequest struct {
+	Title    string              `json:"title"`
+	Model    string              `json:"model"`
+	Messages []model.ChatMessage `json:"messages"`
+}
+
+func (h *ChatHandler) Create(c *gin.Context) {
+	caller, ok := getCaller(c)
+	if !ok {
+		c.JSON(401, gin.H{"success": false, "error": "Unauthorized"})
+		return
+	}
+
+	var req chatSessionRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.Model == "" || len(req.Title) > 200 {
+		c.JSON(400, gin.H{"success": false, "error": "model is required and title at most 200 characters"})
+		return
+	}
+	if !validChatMessages(c, req.Messages) {
+		return
+	}
+
+	ctx := c.Request.Context()
+	session := &model.ChatSession{Title: req.Title, Model: req.Model}
+	if err := h.repo.CreateChatSession(ctx, session, caller); err != nil {
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+	if len(req.Messages) > 0 {
+		if _, err := h.repo.AddChatMessages(ctx, session.ID, caller, req.Messages); err != nil {
+			c.JSON(500, gin.H{"success": false, "error": err.Error()})
+			return
+		}
+		session.Messages = req.Messages
+	}
+
+	c.JSON(201, gin.H{"success": true, "session": session})
+}
+
+func (h *ChatHandler) List(c *gin.Context) {
+	caller, ok := getCaller(c)
+	if !ok {
+		c.JSON(401, gin.H{"success": false, "error": "Unauthorized"})
+		return
+	}
+
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	sessions, err := h.repo.ListChatSessions(c.Request.Context(), caller, limit)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true, "sessions": sessions})
+}
+
+func (h *ChatHandler) Get(c *gin.Context) {
+	caller, ok := getCaller(c)
+	if !ok {
+		c.JSON(401, gin.H{"success": false, "error": "Unauthorized"})
+		return
+	}
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(400, gin.H{"success": false, "error": "invalid id"})
+		return
+	}
+
+	session, err := h.repo.GetChatSession(c.Request.Context(), id, caller)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(404, gin.H{"success": false, "error": "chat session not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true, "session": session})
+}
+
+// AddMessages appends messages to a session
+func (h *ChatHandler) AddMessages(c *gin.Context) {
+	caller, ok := getCaller(c)
+	if !ok {
+		c.JSON(401, gin.H{"success": false, "error": "Unauthorized"})
+		return
+	}
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(400, gin.H{"success": false, "error": "invalid id"})
+		return
+	}
+
+	var req struct {
+		Messages []model.ChatMessage `json:"messages"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || len(req.Messages) == 0 {
+		c.JSON(400, gin.H{"success": false, "error": "messages are required"})
+		return
+	}
+	if !validChatMessages(c, req.Messages) {
+		return
+	}
+
+	found, err := h.repo.AddChatMessages(c.Request.Context(), id, caller, req.Messages)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+	if !found {
+		c.JSON(404, gin.H{"success": false, "error": "chat session not found"})
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true})
+}
+
+func (h *ChatHandler) Delete(c *gin.Context) {
+	caller, ok := getCaller(c)
+	if !ok {
+		c.JSON(401, gin.H{"success": false, "error": "Unauthorized"})
+		return
+	}
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(400, gin.H{"success": false, "error": "invalid id"})
+		return
+	}
+
+	found, err := h.repo.DeleteChatSession(c.Request.Context(), id, caller)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+	if !found {
+		c.JSON(404, gin.H{"success": false, "error": "chat session not found"})
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true})
+}
+
+// validChatMessages checks message roles, writing an error response if one
+// is invalid
+func validChatMessages(c *gin.Context, messages []model.ChatMessage) bool {
+	for _, m := range messages {
+		switch m.Role {
+		case "user", "assistant", "system":
+		default:
+			c.JSON(400, gin.H{"success": false, "error": "message role must be user, assistant or system"})
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,205 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/magenta9/ai-web-tools/server/internal/model"
+)
+
+// connectionPasswordPurpose binds an encrypted password to its saved
+// connection, so that it cannot be copied into another connection's row
+func connectionPasswordPurpose(id int) string {
+	return fmt.Sprintf("db-connection-password:%d", id)
+}
+
+// CreateConnection saves a connection in the personal scope or the
+// selected workspace
+func (h *DBHandler) CreateConnection(c *gin.Context) {
+	caller, req, ok := h.bindConnection(c)
+	if !ok {
+		return
+	}
+
+	conn := connectionFromRequest(req)
+	id, err := h.repo.NextDBConnectionID(c.Request.Context())
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+	conn.ID = id
+
+	var encryptedPassword []byte
+	if req.Password != nil && *req.Password != "" {
+		if encryptedPassword, err = h.cipher.Encrypt([]byte(*req.Password), connectionPasswordPurpose(id)); err != nil {
+			c.JSON(500, gin.H{"success": false, "error": "Failed to encrypt password"})
+			return
+		}
+	}
+
+	if err := h.repo.CreateDBConnection(c.Request.Context(), conn, encryptedPassword, caller); err != nil {
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+	h.auditConnection(c, model.ActionConnectionCreate, conn)
+
+	c.JSON(201, gin.H{"success": true, "connection": conn})
+}
+
+func (h *DBHandler) ListConnections(c *gin.Context) {
+	caller, ok := getCaller(c)
+	if !ok {
+		c.JSON(401, gin.H{"success": false, "error": "Unauthorized"})
+		return
+	}
+
+	conns, err := h.repo.ListDBConnections(c.Request.Context(), caller)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true, "connections": conns})
+}
+
+func (h *DBHandler) GetConnection(c *gin.Context) {
+	caller, ok := getCaller(c)
+	if !ok {
+		c.JSON(401, gin.H{"success": false, "error": "Unauthorized"})
+		return
+	}
+	id, ok := parseConnectionID(c)
+	if !ok {
+		return
+	}
+
+	conn, _, err := h.repo.GetDBConnection(c.Request.Context(), id, caller)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(404, gin.H{"success": false, "error": "connection not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true, "connection": conn})
+}
+
+// UpdateConnection replaces a connection's settings. Omitting the password
+// keeps the stored one unless the type, host, port or user changes; an
+// empty password removes it.
+func (h *DBHandler) UpdateConnection(c *gin.Context) {
+	id, ok := parseConnectionID(c)
+	if !ok {
+		return
+	}
+	caller, req, ok := h.bindConnection(c)
+	if !ok {
+		return
+	}
+
+	var encryptedPassword []byte
+	if req.Password != nil && *req.Password != "" {
+		var err error
+		if encryptedPassword, err = h.cipher.Encrypt([]byte(*req.Password), connectionPasswordPurpose(id)); err != nil {
+			c.JSON(500, gin.H{"success": false, "error": "Failed to encrypt password"})
+			return
+		}
+	}
+
+	conn := connectionFromRequest(req)
+	conn.ID = id
+	found, err := h.repo.UpdateDBConnection(c.Request.Context(), conn, req.Password != nil, encryptedPassword, caller)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+	if !found {
+		c.JSON(404, gin.H{"success": false, "error": "connection not found"})
+		return
+	}
+	h.auditConnection(c, model.ActionConnectionUpdate, conn)
+
+	c.JSON(200, gin.H{"success": true, "connection": conn})
+}
+
+func (h *DBHandler) DeleteConnection(c *gin.Context) {
+	caller, ok := getCaller(c)
+	if !ok {
+		c.JSON(401, gin.H{"success": false, "error": "Unauthorized"})
+		return
+	}
+	id, ok := parseConnectionID(c)
+	if !ok {
+		return
+	}
+
+	found, err := h.repo.DeleteDBConnection(c.Request.Context(), id, caller)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+	if !found {
+		c.JSON(404, gin.H{"success": false, "error": "connection not found"})
+		return
+	}
+	h.auditConnection(c, model.ActionConnectionDelete, &model.DBConnection{ID: id})
+
+	c.JSON(200, gin.H{"success": true})
+}
+
+// bindConnection parses a create or update body, writing an error response
+// if it is invalid
+func (h *DBHandler) bindConnection(c *gin.Context) (model.Caller, *model.DBConnectionRequest, bool) {
+	caller, ok := getCaller(c)
+	if !ok {
+		c.JSON(401, gin.H{"success": false, "error": "Unauthorized"})
+		return caller, nil, false
+	}
+
+	var req model.DBConnectionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"success": false, "error": "name, host and user are required and type must be mysql, postgres, mssql or clickhouse"})
+		return caller, nil, false
+	}
+	return caller, &req, true
+}
+
+func connectionFromRequest(req *model.DBConnectionRequest) *model.DBConnection {
+	dbType := req.Type
+	if dbType == "" {
+		dbType = "mysql"
+	}
+	return &model.DBConnection{
+		Name:     req.Name,
+		Type:     dbType,
+		Host:     req.Host,
+		Port:     req.Port,
+		User:     req.User,
+		Database: req.Database,
+		SSL:      req.SSL,
+	}
+}
+
+func (h *DBHandler) auditConnection(c *gin.Context, action string, conn *model.DBConnection) {
+	e := model.AuditEvent{Action: action, TargetType: "connection", TargetID: strconv.Itoa(conn.ID)}
+	if conn.Host != "" {
+		e.Details = map[string]any{"name": conn.Name, "target": (&dbConfig{
+			Type: conn.Type, Host: conn.Host, Port: conn.Port, User: conn.User, Database: conn.Database,
+		}).target()}
+	}
+	h.audit.Log(c, e)
+}
+
+func parseConnectionID(c *gin.Context) (int, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id <= 0 {
+		c.JSON(400, gin.H{"success": false, "error": "invalid id"})
+		return 0, false
+	}
+	return id, true
+}
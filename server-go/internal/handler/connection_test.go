@@ -0,0 +1,85 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/magenta9/ai-web-tools/server/internal/config"
+	"github.com/magenta9/ai-web-tools/server/internal/model"
+	"github.com/magenta9/ai-web-tools/server/internal/secrets"
+)
+
+// A saved password is bound to its connection and is not kept when the
+// connection is pointed at another server or user
+func TestUpdateConnectionPassword(t *testing.T) {
+	repo := testRepository(t)
+	alice := testUser(t, repo)
+	cipher, err := secrets.NewCipher(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := NewDBHandler(&config.Config{}, nil, repo, cipher, nil, nil)
+	r := testRouter()
+	r.POST("/connections", h.CreateConnection)
+	r.PUT("/connections/:id", h.UpdateConnection)
+
+	conn := map[string]any{
+		"name": "reporting", "type": "postgres", "host": "db1.internal", "port": 5432,
+		"user": "reporter", "password": "s3cret", "database": "reports",
+	}
+	code, resp := doJSON(t, r, alice, "POST", "/connections", conn)
+	if code != 201 {
+		t.Fatalf("create connection: %d %v", code, resp)
+	}
+	id := int(resp["connection"].(map[string]any)["id"].(float64))
+	path := fmt.Sprintf("/connections/%d", id)
+
+	caller := model.Caller{UserID: alice.ID}
+	_, encrypted, err := repo.GetDBConnection(context.Background(), id, caller)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext, err := cipher.Decrypt(encrypted, connectionPasswordPurpose(id)); err != nil || string(plaintext) != "s3cret" {
+		t.Errorf("decrypt stored password = %q, %v", plaintext, err)
+	}
+	if _, err := cipher.Decrypt(encrypted, connectionPasswordPurpose(id+1)); err == nil {
+		t.Error("stored password decrypts for another connection")
+	}
+
+	delete(conn, "password")
+	for _, tt := range []struct {
+		name         string
+		change       map[string]any
+		wantPassword bool
+	}{
+		{"rename", map[string]any{"name": "reports"}, true},
+		{"other database", map[string]any{"database": "archive"}, true},
+		{"other host", map[string]any{"host": "db2.internal"}, false},
+		{"new password", map[string]any{"password": "s3cret"}, true},
+		{"other port", map[string]any{"port": 6432}, false},
+		{"new password", map[string]any{"password": "s3cret"}, true},
+		{"other user", map[string]any{"user": "admin"}, false},
+		{"new password", map[string]any{"password": "s3cret"}, true},
+		{"other type", map[string]any{"type": "mysql"}, false},
+	} {
+		body := map[string]any{}
+		for k, v := range conn {
+			body[k] = v
+		}
+		for k, v := range tt.change {
+			body[k] = v
+			if k != "password" {
+				conn[k] = v
+			}
+		}
+		code, resp := doJSON(t, r, alice, "PUT", path, body)
+		if code != 200 {
+			t.Fatalf("%s: update connection: %d %v", tt.name, code, resp)
+		}
+		if got := resp["connection"].(map[string]any)["has_password"]; got != tt.wantPassword {
+			t.Errorf("%s: has_password = %v, want %v", tt.name, got, tt.wantPassword)
+		}
+	}
+}
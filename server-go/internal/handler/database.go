@@ -2,45 +2,234 @@ package handler
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	_ "github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5"
 	_ "github.com/lib/pq"
+	"github.com/magenta9/ai-web-tools/server/internal/audit"
+	"github.com/magenta9/ai-web-tools/server/internal/config"
+	"github.com/magenta9/ai-web-tools/server/internal/dbfile"
+	"github.com/magenta9/ai-web-tools/server/internal/dbpool"
+	"github.com/magenta9/ai-web-tools/server/internal/model"
+	"github.com/magenta9/ai-web-tools/server/internal/repository"
+	"github.com/magenta9/ai-web-tools/server/internal/secrets"
+	"github.com/magenta9/ai-web-tools/server/internal/sqlguard"
+	_ "github.com/microsoft/go-mssqldb"
 )
 
-type DBHandler struct{}
+// DBHandler queries target databases given inline or as saved
+// connections, or database files on the server, through pools shared
+// across requests. repo and cipher are nil when saved connections are
+// unavailable.
+type DBHandler struct {
+	audit  *audit.Logger
+	repo   *repository.Repository
+	cipher *secrets.Cipher
+	pools  *dbpool.Manager
+	files  *dbfile.Store
+
+	queryTimeout       time.Duration
+	queryMaxRows       int
+	queryMaxBytes      int
+	queryStreamTimeout time.Duration
+	queryStreamMaxRows int
+	fileMaxBytes       int64
+}
 
-func NewDBHandler() *DBHandler {
-	return &DBHandler{}
+func NewDBHandler(cfg *config.Config, auditLog *audit.Logger, repo *repository.Repository, cipher *secrets.Cipher, pools *dbpool.Manager, files *dbfile.Store) *DBHandler {
+	return &DBHandler{
+		audit:              auditLog,
+		repo:               repo,
+		cipher:             cipher,
+		pools:              pools,
+		files:              files,
+		queryTimeout:       cfg.QueryTimeout,
+		queryMaxRows:       cfg.QueryMaxRows,
+		queryMaxBytes:      cfg.QueryMaxBytes,
+		queryStreamTimeout: cfg.QueryStreamTimeout,
+		queryStreamMaxRows: cfg.QueryStreamMaxRows,
+		fileMaxBytes:       int64(cfg.TargetFileMaxBytes),
+	}
 }
 
+// dbConfig describes the target database. ConnectionID names a saved
+// connection that fills in the other fields; a database given alongside it
+// overrides the saved one. The sqlite and duckdb types open File instead,
+// the ID of an upload or a path in an allowed directory.
 type dbConfig struct {
-	Type     string `json:"type"`
-	Host     string `json:"host"`
-	Port     int    `json:"port"`
-	User     string `json:"user"`
-	Password string `json:"password"`
-	Database string `json:"database"`
-	SSL      bool   `json:"ssl"`
+	ConnectionID int    `json:"connection_id"`
+	Type         string `json:"type"`
+	Host         string `json:"host"`
+	Port         int    `json:"port"`
+	User         string `json:"user"`
+	Password     string `json:"password"`
+	Database     string `json:"database"`
+	SSL          bool   `json:"ssl"`
+	File         string `json:"file"`
+
+	// allowWrites is set from a saved connection an admin opened to writes
+	allowWrites bool
+	// path is File resolved by checkTarget
+	path string
+}
+
+// resolveConnection loads the saved connection named by cfg.ConnectionID
+// into cfg, writing an error response if that fails. Without a connection
+// ID cfg is used as given.
+func (h *DBHandler) resolveConnection(c *gin.Context, cfg *dbConfig) bool {
+	if cfg.ConnectionID == 0 {
+		return true
+	}
+	if h.repo == nil || h.cipher == nil {
+		c.JSON(503, gin.H{"success": false, "error": "Saved connections are unavailable"})
+		return false
+	}
+	caller, ok := getCaller(c)
+	if !ok {
+		c.JSON(401, gin.H{"success": false, "error": "Unauthorized"})
+		return false
+	}
+
+	conn, encryptedPassword, err := h.repo.GetDBConnection(c.Request.Context(), cfg.ConnectionID, caller)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(404, gin.H{"success": false, "error": "connection not found"})
+		return false
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		return false
+	}
+
+	password := ""
+	if encryptedPassword != nil {
+		plaintext, err := h.cipher.Decrypt(encryptedPassword, connectionPasswordPurpose(conn.ID))
+		if err != nil {
+			c.JSON(500, gin.H{"success": false, "error": "Failed to decrypt connection password"})
+			return false
+		}
+		password = string(plaintext)
+	}
+
+	cfg.Type = conn.Type
+	cfg.Host = conn.Host
+	cfg.Port = conn.Port
+	cfg.User = conn.User
+	cfg.Password = password
+	cfg.SSL = conn.SSL
+	cfg.allowWrites = conn.AllowWrites
+	if cfg.Database == "" {
+		cfg.Database = conn.Database
+	}
+	return true
+}
+
+// checkTarget writes an error response unless cfg names a target database
+// of a supported type. withDatabase requires a database on a server;
+// database files open their default one. Files are resolved for the
+// caller.
+func (h *DBHandler) checkTarget(c *gin.Context, cfg *dbConfig, withDatabase bool) bool {
+	switch cfg.Type {
+	case "", "mysql", "postgres", "mssql", "clickhouse":
+		if withDatabase && (cfg.Host == "" || cfg.User == "" || cfg.Database == "") {
+			c.JSON(400, gin.H{"success": false, "error": "Host, user, and database are required"})
+			return false
+		}
+		if cfg.Host == "" || cfg.User == "" {
+			c.JSON(400, gin.H{"success": false, "error": "Host and user are required"})
+			return false
+		}
+		return true
+	case "sqlite", "duckdb":
+	default:
+		c.JSON(400, gin.H{"success": false, "error": "type must be mysql, postgres, mssql, clickhouse, sqlite or duckdb"})
+		return false
+	}
+
+	if cfg.File == "" {
+		c.JSON(400, gin.H{"success": false, "error": "File is required"})
+		return false
+	}
+	path, err := h.files.Resolve(c.GetInt("user_id"), cfg.File)
+	switch {
+	case errors.Is(err, dbfile.ErrNotFound):
+		c.JSON(404, gin.H{"success": false, "error": "file not found"})
+		return false
+	case errors.Is(err, dbfile.ErrNotAllowed):
+		c.JSON(403, gin.H{"success": false, "error": "file is not in an allowed directory"})
+		return false
+	case err != nil:
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		return false
+	}
+	if !dbfile.Opens(cfg.Type, path) {
+		c.JSON(400, gin.H{"success": false, "error": fmt.Sprintf("%s cannot open this type of file", cfg.Type)})
+		return false
+	}
+	cfg.path = path
+	return true
+}
+
+// target identifies the database in audit entries, without the password
+func (cfg *dbConfig) target() string {
+	dbType := cfg.Type
+	if dbType == "" {
+		dbType = "mysql"
+	}
+	if cfg.File != "" {
+		return fmt.Sprintf("%s://%s", dbType, cfg.File)
+	}
+	return fmt.Sprintf("%s://%s@%s:%d/%s", dbType, cfg.User, cfg.Host, cfg.Port, cfg.Database)
+}
+
+// auditDB records an access to a target database. A non-nil err marks it
+// failed and is recorded with the details.
+func (h *DBHandler) auditDB(c *gin.Context, action string, cfg *dbConfig, err error, details map[string]any) {
+	if err != nil {
+		if details == nil {
+			details = map[string]any{}
+		}
+		details["error"] = err.Error()
+	}
+	if cfg.ConnectionID > 0 {
+		if details == nil {
+			details = map[string]any{}
+		}
+		details["connection_id"] = cfg.ConnectionID
+	}
+	h.audit.Log(c, model.AuditEvent{
+		Action:     action,
+		TargetType: "database",
+		TargetID:   cfg.target(),
+		Outcome:    audit.Outcome(err),
+		Details:    details,
+	})
 }
 
 func (h *DBHandler) Connect(c *gin.Context) {
 	var cfg dbConfig
-	if err := c.ShouldBindJSON(&cfg); err != nil || cfg.Host == "" || cfg.User == "" {
+	if err := c.ShouldBindJSON(&cfg); err != nil {
 		c.JSON(400, gin.H{"success": false, "error": "Host and user are required"})
 		return
 	}
-
-	db, err := h.openDB(&cfg)
-	if err != nil {
-		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+	if !h.resolveConnection(c, &cfg) || !h.checkTarget(c, &cfg, false) {
 		return
 	}
-	defer db.Close()
 
-	if err := db.PingContext(c.Request.Context()); err != nil {
+	db, err := h.openDB(c, &cfg)
+	if err == nil {
+		err = db.PingContext(c.Request.Context())
+	}
+	h.auditDB(c, model.ActionDBConnect, &cfg, err, nil)
+	if err != nil {
 		c.JSON(500, gin.H{"success": false, "error": err.Error()})
 		return
 	}
@@ -50,28 +239,40 @@ func (h *DBHandler) Connect(c *gin.Context) {
 
 func (h *DBHandler) GetDatabases(c *gin.Context) {
 	var cfg dbConfig
-	if err := c.ShouldBindJSON(&cfg); err != nil || cfg.Host == "" || cfg.User == "" {
+	if err := c.ShouldBindJSON(&cfg); err != nil {
 		c.JSON(400, gin.H{"success": false, "error": "Host and user are required"})
 		return
 	}
+	if !h.resolveConnection(c, &cfg) || !h.checkTarget(c, &cfg, false) {
+		return
+	}
 
-	db, err := h.openDB(&cfg)
+	db, err := h.openDB(c, &cfg)
 	if err != nil {
 		c.JSON(500, gin.H{"success": false, "error": err.Error()})
 		return
 	}
-	defer db.Close()
 
 	var databases []string
 	var query string
 
-	if cfg.Type == "postgres" {
+	switch cfg.dialect() {
+	case sqlguard.Postgres:
 		query = "SELECT datname FROM pg_database WHERE datname NOT IN ('postgres', 'template0', 'template1') ORDER BY datname"
-	} else {
+	case sqlguard.SQLite:
+		query = "SELECT name FROM pragma_database_list ORDER BY seq"
+	case sqlguard.DuckDB:
+		query = "SELECT database_name FROM duckdb_databases() WHERE NOT internal ORDER BY database_name"
+	case sqlguard.MSSQL:
+		query = "SELECT name FROM sys.databases WHERE database_id > 4 ORDER BY name"
+	case sqlguard.ClickHouse:
+		query = "SELECT name FROM system.databases WHERE name NOT IN ('system', 'INFORMATION_SCHEMA', 'information_schema') ORDER BY name"
+	default:
 		query = "SHOW DATABASES"
 	}
 
 	rows, err := db.QueryContext(c.Request.Context(), query)
+	h.auditDB(c, model.ActionDBDatabases, &cfg, err, nil)
 	if err != nil {
 		c.JSON(500, gin.H{"success": false, "error": err.Error()})
 		return
@@ -87,166 +288,319 @@ func (h *DBHandler) GetDatabases(c *gin.Context) {
 	c.JSON(200, gin.H{"success": true, "databases": databases})
 }
 
-func (h *DBHandler) GetSchema(c *gin.Context) {
-	var cfg dbConfig
-	if err := c.ShouldBindJSON(&cfg); err != nil || cfg.Host == "" || cfg.User == "" || cfg.Database == "" {
-		c.JSON(400, gin.H{"success": false, "error": "Host, user, and database are required"})
-		return
+// checkReadQuery resolves the target database and checks that query is
+// read-only, writing an error response and, for a rejected query, a
+// denied audit entry if not
+func (h *DBHandler) checkReadQuery(c *gin.Context, action string, cfg *dbConfig, query string) bool {
+	if !h.resolveConnection(c, cfg) || !h.checkTarget(c, cfg, true) {
+		return false
 	}
 
-	db, err := h.openDB(&cfg)
-	if err != nil {
-		c.JSON(500, gin.H{"success": false, "error": err.Error()})
-		return
+	// Security check
+	if err := sqlguard.CheckReadOnly(query, cfg.dialect()); err != nil {
+		h.audit.Log(c, model.AuditEvent{
+			Action:     action,
+			TargetType: "database",
+			TargetID:   cfg.target(),
+			Outcome:    model.OutcomeDenied,
+			Details:    map[string]any{"sql": h.audit.SQL(query), "reason": err.(*sqlguard.Error).Reason},
+		})
+		c.JSON(400, gin.H{"success": false, "error": err.Error()})
+		return false
 	}
-	defer db.Close()
+	return true
+}
 
-	var rows *sql.Rows
-	var query string
+// executeRequest runs a read-only query. PageSize turns on pagination,
+// by offset or, with Keyset, by the values of those columns; Stream
+// returns NDJSON instead.
+type executeRequest struct {
+	dbConfig
+	SQL string `json:"sql"`
+	// MaxRows lowers the configured row cap
+	MaxRows int `json:"max_rows"`
+	// Format is structured (default) or legacy, the tab-joined rows
+	// returned before typed results
+	Format    string   `json:"format"`
+	PageSize  int      `json:"page_size"`
+	PageToken string   `json:"page_token"`
+	Keyset    []string `json:"keyset"`
+	Stream    bool     `json:"stream"`
+}
 
-	if cfg.Type == "postgres" {
-		query = `
-			SELECT c.column_name, c.data_type, c.is_nullable = 'YES', COALESCE(pk.is_primary_key, false) AS is_primary_key, t.table_name
-			FROM information_schema.columns c
-			JOIN information_schema.tables t ON c.table_schema = t.table_schema AND c.table_name = t.table_name
-			LEFT JOIN (
-				SELECT a.attname AS column_name, t.relname AS table_name, true AS is_primary_key
-				FROM pg_index i
-				JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey)
-				JOIN pg_class t ON t.oid = i.indrelid
-				WHERE i.indisprimary
-			) pk ON pk.column_name = c.column_name AND pk.table_name = c.table_name
-			WHERE c.table_schema = 'public' AND t.table_schema = 'public'
-			ORDER BY t.table_name, c.ordinal_position`
-	} else {
-		query = `
-			SELECT TABLE_NAME, COLUMN_NAME, COLUMN_TYPE, IS_NULLABLE, COLUMN_KEY
-			FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = ?
-			ORDER BY TABLE_NAME, ORDINAL_POSITION`
+func (h *DBHandler) Execute(c *gin.Context) {
+	var req executeRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.SQL == "" {
+		c.JSON(400, gin.H{"success": false, "error": "SQL query is required"})
+		return
+	}
+	if req.Format == "" {
+		req.Format = formatStructured
+	}
+	if req.Format != formatStructured && req.Format != formatLegacy {
+		c.JSON(400, gin.H{"success": false, "error": "format must be structured or legacy"})
+		return
+	}
+	if req.PageSize < 0 || req.PageSize > h.queryMaxRows {
+		c.JSON(400, gin.H{"success": false, "error": fmt.Sprintf("page_size must be between 1 and %d", h.queryMaxRows)})
+		return
+	}
+	if req.PageSize == 0 && (req.PageToken != "" || len(req.Keyset) > 0) {
+		c.JSON(400, gin.H{"success": false, "error": "page_size is required for pagination"})
+		return
+	}
+	if req.Stream && (req.PageSize > 0 || req.Format == formatLegacy) {
+		c.JSON(400, gin.H{"success": false, "error": "streamed results are structured and not paginated"})
+		return
+	}
+	if !h.checkReadQuery(c, model.ActionDBExecute, &req.dbConfig, req.SQL) {
+		return
 	}
 
-	if cfg.Type == "postgres" {
-		rows, err = db.QueryContext(c.Request.Context(), query)
-	} else {
-		rows, err = db.QueryContext(c.Request.Context(), query, cfg.Database)
+	query := req.SQL
+	var args []any
+	var page *pageToken
+	if req.PageSize > 0 {
+		var err error
+		if page, err = decodePageToken(req.PageToken, pageQueryHash(req.SQL, req.Keyset), req.Keyset); err != nil {
+			c.JSON(400, gin.H{"success": false, "error": err.Error()})
+			return
+		}
+		if query, args, err = pageQuery(req.SQL, req.dialect(), req.Keyset, page, req.PageSize); err != nil {
+			c.JSON(400, gin.H{"success": false, "error": err.Error()})
+			return
+		}
+	}
+	if req.Stream {
+		h.streamQuery(c, &req)
+		return
 	}
 
+	maxRows := h.queryMaxRows
+	if page != nil {
+		maxRows = req.PageSize
+	} else if req.MaxRows > 0 && req.MaxRows < maxRows {
+		maxRows = req.MaxRows
+	}
+
+	// The read-only transaction backs up the check: the server refuses
+	// writes the classifier did not recognize, such as those made by
+	// user-defined functions
+	started := time.Now()
+	rows, err := h.startReadQuery(c, &req.dbConfig, query, h.queryTimeout, args...)
 	if err != nil {
-		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		h.auditDB(c, model.ActionDBExecute, &req.dbConfig, err, map[string]any{"sql": h.audit.SQL(req.SQL)})
+		h.queryError(c, err)
 		return
 	}
 	defer rows.Close()
 
-	tables := make(map[string][]map[string]any)
-	for rows.Next() {
-		var tableName, colName, colType string
-		if cfg.Type == "postgres" {
-			var nullable, isPrimaryKey bool
-			rows.Scan(&colName, &colType, &nullable, &isPrimaryKey, &tableName)
-			tables[tableName] = append(tables[tableName], map[string]any{
-				"name": colName, "type": colType, "nullable": nullable, "isPrimaryKey": isPrimaryKey,
-			})
+	cols, err := resultColumns(rows.Rows)
+	legacyRows := []string{}
+	typedRows := [][]any{}
+	var last []any
+	rowCount, size := 0, 0
+	truncated, more := false, false
+	for err == nil && rows.Next() {
+		if rowCount == maxRows {
+			// Pages read one row ahead to know whether another follows
+			more = page != nil
+			truncated = page == nil
+			break
+		}
+		var values []any
+		if values, err = scanRow(rows.Rows, len(cols)); err != nil {
+			break
+		}
+		if req.Format == formatLegacy {
+			row := legacyRow(values)
+			if size += len(row); size <= h.queryMaxBytes {
+				legacyRows = append(legacyRows, row)
+			}
 		} else {
-			var nullable, colKey string
-			rows.Scan(&tableName, &colName, &colType, &nullable, &colKey)
-			tables[tableName] = append(tables[tableName], map[string]any{
-				"name": colName, "type": colType, "nullable": nullable == "YES", "isPrimaryKey": colKey == "PRI",
-			})
+			row, rowSize := typedRow(values, cols)
+			if size += rowSize; size <= h.queryMaxBytes {
+				typedRows = append(typedRows, row)
+			}
+		}
+		if size > h.queryMaxBytes {
+			truncated = true
+			break
 		}
+		last = values
+		rowCount++
 	}
-
-	// Convert map to array for frontend
-	var tablesArray []map[string]any
-	for name, cols := range tables {
-		tablesArray = append(tablesArray, map[string]any{
-			"name": name, "columns": cols,
-		})
+	if err == nil {
+		err = rows.Err()
+	}
+	h.auditDB(c, model.ActionDBExecute, &req.dbConfig, err, map[string]any{
+		"sql":         h.audit.SQL(req.SQL),
+		"row_count":   rowCount,
+		"truncated":   truncated,
+		"duration_ms": time.Since(started).Milliseconds(),
+	})
+	if err != nil {
+		h.queryError(c, err)
+		return
 	}
 
-	var formatted strings.Builder
-	formatted.WriteString("Database Schema:\n\n")
-	for _, table := range tablesArray {
-		tableName := table["name"].(string)
-		cols := table["columns"].([]map[string]any)
-		formatted.WriteString(fmt.Sprintf("Table: %s\n  Columns:\n", tableName))
-		for _, col := range cols {
-			pk := ""
-			if col["isPrimaryKey"].(bool) {
-				pk = " (PRIMARY KEY)"
-			}
-			formatted.WriteString(fmt.Sprintf("    - %s %s%s\n", col["name"], col["type"], pk))
+	var resp gin.H
+	if req.Format == formatLegacy {
+		names := make([]string, len(cols))
+		for i, col := range cols {
+			names[i] = col.Name
+		}
+		resp = gin.H{
+			"success":   true,
+			"rows":      legacyRows,
+			"header":    strings.Join(names, "\t"),
+			"rowCount":  rowCount,
+			"truncated": truncated,
+			"hasTabs":   true,
+		}
+	} else {
+		resp = gin.H{
+			"success":   true,
+			"columns":   cols,
+			"rows":      typedRows,
+			"rowCount":  rowCount,
+			"truncated": truncated,
 		}
-		formatted.WriteString("\n")
 	}
-
-	c.JSON(200, gin.H{"success": true, "schema": gin.H{"tables": tablesArray, "formatted": formatted.String()}})
+	// A page cut short by the byte cap continues after its last row
+	if page != nil && (more || truncated) && rowCount > 0 {
+		token, err := nextPageToken(page, req.dialect(), req.Keyset, cols, last, rowCount)
+		if err != nil {
+			c.JSON(400, gin.H{"success": false, "error": err.Error()})
+			return
+		}
+		resp["nextPageToken"] = token
+	}
+	c.JSON(200, resp)
 }
 
-func (h *DBHandler) Execute(c *gin.Context) {
-	var req struct {
-		dbConfig
-		SQL string `json:"sql"`
+// streamQuery writes the result as NDJSON while it is read: a line with
+// the columns, a JSON array per row, and a last line with the row count,
+// or with the error that ended the query
+func (h *DBHandler) streamQuery(c *gin.Context, req *executeRequest) {
+	maxRows := h.queryStreamMaxRows
+	if req.MaxRows > 0 && (maxRows == 0 || req.MaxRows < maxRows) {
+		maxRows = req.MaxRows
 	}
-	if err := c.ShouldBindJSON(&req); err != nil || req.SQL == "" {
-		c.JSON(400, gin.H{"success": false, "error": "SQL query is required"})
-		return
+
+	started := time.Now()
+	rows, err := h.startReadQuery(c, &req.dbConfig, req.SQL, h.queryStreamTimeout)
+	var cols []resultColumn
+	if err == nil {
+		defer rows.Close()
+		cols, err = resultColumns(rows.Rows)
 	}
-	if req.Host == "" || req.User == "" || req.Database == "" {
-		c.JSON(400, gin.H{"success": false, "error": "Host, user, and database are required"})
+	if err != nil {
+		h.auditDB(c, model.ActionDBExecute, &req.dbConfig, err, map[string]any{"sql": h.audit.SQL(req.SQL), "stream": true})
+		h.queryError(c, err)
 		return
 	}
 
-	// Security check
-	upper := strings.ToUpper(strings.TrimSpace(req.SQL))
-	if !strings.HasPrefix(upper, "SELECT") && !strings.HasPrefix(upper, "SHOW") &&
-		!strings.HasPrefix(upper, "DESCRIBE") && !strings.HasPrefix(upper, "EXPLAIN") && !strings.HasPrefix(upper, "WITH") {
-		c.JSON(400, gin.H{"success": false, "error": "Only SELECT, SHOW, DESCRIBE, EXPLAIN queries are allowed"})
-		return
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Status(200)
+	enc := json.NewEncoder(c.Writer)
+	err = enc.Encode(gin.H{"columns": cols})
+
+	rowCount := 0
+	truncated := false
+	for err == nil && rows.Next() {
+		if maxRows > 0 && rowCount == maxRows {
+			truncated = true
+			break
+		}
+		var values []any
+		if values, err = scanRow(rows.Rows, len(cols)); err != nil {
+			break
+		}
+		row, _ := typedRow(values, cols)
+		if err = enc.Encode(row); err != nil {
+			break
+		}
+		if rowCount++; rowCount%100 == 0 {
+			c.Writer.Flush()
+		}
+	}
+	if err == nil {
+		err = rows.Err()
 	}
+	h.auditDB(c, model.ActionDBExecute, &req.dbConfig, err, map[string]any{
+		"sql":         h.audit.SQL(req.SQL),
+		"row_count":   rowCount,
+		"truncated":   truncated,
+		"stream":      true,
+		"duration_ms": time.Since(started).Milliseconds(),
+	})
 
-	db, err := h.openDB(&req.dbConfig)
 	if err != nil {
-		c.JSON(500, gin.H{"success": false, "error": err.Error()})
-		return
+		enc.Encode(gin.H{"error": err.Error()})
+	} else {
+		enc.Encode(gin.H{"rowCount": rowCount, "truncated": truncated})
 	}
-	defer db.Close()
+	c.Writer.Flush()
+}
 
-	rows, err := db.QueryContext(c.Request.Context(), req.SQL)
-	if err != nil {
+// queryError responds to a failed query. Nobody is listening if the client
+// went away.
+func (h *DBHandler) queryError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errQueryTimeout):
+		c.JSON(504, gin.H{"success": false, "error": err.Error()})
+	case c.Request.Context().Err() != nil:
+		c.Status(499)
+	default:
 		c.JSON(500, gin.H{"success": false, "error": err.Error()})
-		return
 	}
-	defer rows.Close()
+}
 
-	cols, _ := rows.Columns()
-	var results []string
-	for rows.Next() {
-		values := make([]any, len(cols))
-		ptrs := make([]any, len(cols))
-		for i := range values {
-			ptrs[i] = &values[i]
-		}
-		rows.Scan(ptrs...)
-		rowValues := make([]string, len(cols))
-		for i := range cols {
-			if b, ok := values[i].([]byte); ok {
-				rowValues[i] = string(b)
-			} else {
-				rowValues[i] = fmt.Sprintf("%v", values[i])
-			}
-		}
-		results = append(results, strings.Join(rowValues, "\t"))
-	}
+// openDB returns the caller's pool for cfg. The pool is shared with later
+// requests and must not be closed.
+func (h *DBHandler) openDB(c *gin.Context, cfg *dbConfig) (*sql.DB, error) {
+	driver, dsn := cfg.dsn()
+	return h.pools.Get(c.Request.Context(), c.GetInt("user_id"), driver, dsn)
+}
 
-	c.JSON(200, gin.H{"success": true, "rows": results, "header": strings.Join(cols, "\t"), "rowCount": len(results), "hasTabs": true})
+// dialect returns the SQL dialect of the target database
+func (cfg *dbConfig) dialect() sqlguard.Dialect {
+	switch cfg.Type {
+	case "postgres":
+		return sqlguard.Postgres
+	case "sqlite":
+		return sqlguard.SQLite
+	case "duckdb":
+		return sqlguard.DuckDB
+	case "mssql":
+		return sqlguard.MSSQL
+	case "clickhouse":
+		return sqlguard.ClickHouse
+	}
+	return sqlguard.MySQL
 }
 
-func (h *DBHandler) openDB(cfg *dbConfig) (*sql.DB, error) {
+// dsn returns the driver name and data source name for cfg. Database
+// files are opened by path, see dbfile.Store.Open.
+func (cfg *dbConfig) dsn() (string, string) {
+	if cfg.Type == "sqlite" || cfg.Type == "duckdb" {
+		return cfg.Type, cfg.path
+	}
+
 	port := cfg.Port
 	if port == 0 {
-		if cfg.Type == "postgres" {
+		switch cfg.Type {
+		case "postgres":
 			port = 5432
-		} else {
+		case "mssql":
+			port = 1433
+		case "clickhouse":
+			port = 9000
+			if cfg.SSL {
+				port = 9440
+			}
+		default:
 			port = 3306
 		}
 	}
@@ -265,7 +619,40 @@ func (h *DBHandler) openDB(cfg *dbConfig) (*sql.DB, error) {
 	if dbType == "postgres" {
 		dsn := fmt.Sprintf("postgres://%s:%s@%s:%d/%s?sslmode=disable",
 			cfg.User, cfg.Password, host, port, cfg.Database)
-		return sql.Open("postgres", dsn)
+		return "postgres", dsn
+	}
+
+	if dbType == "mssql" {
+		// GUIDs are converted from their mixed-endian wire form, so
+		// UNIQUEIDENTIFIER columns read as standard UUIDs
+		query := url.Values{"guid conversion": {"true"}}
+		if cfg.Database != "" {
+			query.Set("database", cfg.Database)
+		}
+		if cfg.SSL {
+			query.Set("encrypt", "true")
+		}
+		u := url.URL{
+			Scheme:   "sqlserver",
+			User:     url.UserPassword(cfg.User, cfg.Password),
+			Host:     net.JoinHostPort(host, strconv.Itoa(port)),
+			RawQuery: query.Encode(),
+		}
+		return "sqlserver", u.String()
+	}
+
+	if dbType == "clickhouse" {
+		// The native protocol; the HTTP port does not work here
+		u := url.URL{
+			Scheme: "clickhouse",
+			User:   url.UserPassword(cfg.User, cfg.Password),
+			Host:   net.JoinHostPort(host, strconv.Itoa(port)),
+			Path:   "/" + cfg.Database,
+		}
+		if cfg.SSL {
+			u.RawQuery = "secure=true"
+		}
+		return "clickhouse", u.String()
 	}
 
 	// MySQL
@@ -276,5 +663,5 @@ func (h *DBHandler) openDB(cfg *dbConfig) (*sql.DB, error) {
 	if cfg.SSL {
 		dsn += "?tls=true"
 	}
-	return sql.Open("mysql", dsn)
+	return "mysql", dsn
 }
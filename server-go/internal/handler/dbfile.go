@@ -0,0 +1,112 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/magenta9/ai-web-tools/server/internal/dbfile"
+	"github.com/magenta9/ai-web-tools/server/internal/model"
+)
+
+// ListFiles returns the caller's uploaded database files, and whether
+// uploads and DuckDB are available
+func (h *DBHandler) ListFiles(c *gin.Context) {
+	files, err := h.files.List(c.GetInt("user_id"))
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{
+		"success": true,
+		"files":   files,
+		"uploads": h.files.UploadsEnabled(),
+		"duckdb":  dbfile.DuckDBEnabled,
+	})
+}
+
+// UploadFile stores the multipart field "file" for the caller. The
+// extension decides how it is opened: .sqlite, .sqlite3, .db and .db3
+// with SQLite, and .duckdb, .ddb, .parquet, .csv, .tsv, .json, .jsonl and
+// .ndjson with DuckDB.
+func (h *DBHandler) UploadFile(c *gin.Context) {
+	if !h.files.UploadsEnabled() {
+		c.JSON(503, gin.H{"success": false, "error": "Uploads are disabled"})
+		return
+	}
+
+	// Leave room for the multipart framing
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, h.fileMaxBytes+1<<20)
+	header, err := c.FormFile("file")
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		c.JSON(413, gin.H{"success": false, "error": "File is too large"})
+		return
+	}
+	if err != nil {
+		c.JSON(400, gin.H{"success": false, "error": "file is required"})
+		return
+	}
+	f, err := header.Open()
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+	defer f.Close()
+
+	file, err := h.files.Save(c.GetInt("user_id"), header.Filename, f)
+	switch {
+	case errors.Is(err, dbfile.ErrUnsupported):
+		c.JSON(400, gin.H{"success": false, "error": "unsupported file type"})
+		return
+	case errors.Is(err, dbfile.ErrTooLarge):
+		c.JSON(413, gin.H{"success": false, "error": "File is too large"})
+		return
+	case errors.Is(err, dbfile.ErrQuotaExceeded):
+		c.JSON(413, gin.H{"success": false, "error": "Upload quota exceeded; delete some files first"})
+		return
+	case err != nil:
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+
+	h.audit.Log(c, model.AuditEvent{
+		Action:     model.ActionDBFileUpload,
+		TargetType: "db_file",
+		TargetID:   file.ID,
+		Outcome:    model.OutcomeSuccess,
+		Details:    map[string]any{"name": file.Name, "size": file.Size},
+	})
+	c.JSON(200, gin.H{"success": true, "file": file})
+}
+
+// DeleteFile removes one of the caller's uploads, closing the caller's
+// pools that have it open
+func (h *DBHandler) DeleteFile(c *gin.Context) {
+	id := c.Param("id")
+	userID := c.GetInt("user_id")
+	if path, err := h.files.Resolve(userID, id); err == nil {
+		for _, driver := range []string{"sqlite", "duckdb"} {
+			if dbfile.Opens(driver, path) {
+				h.pools.CloseDSN(userID, driver, path)
+			}
+		}
+	}
+	err := h.files.Delete(userID, id)
+	if errors.Is(err, dbfile.ErrNotFound) {
+		c.JSON(404, gin.H{"success": false, "error": "file not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+
+	h.audit.Log(c, model.AuditEvent{
+		Action:     model.ActionDBFileDelete,
+		TargetType: "db_file",
+		TargetID:   id,
+		Outcome:    model.OutcomeSuccess,
+	})
+	c.JSON(200, gin.H{"success": true})
+}
@@ -0,0 +1,54 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/magenta9/ai-web-tools/server/internal/config"
+	"github.com/magenta9/ai-web-tools/server/internal/dbfile"
+	"github.com/magenta9/ai-web-tools/server/internal/dbpool"
+	"github.com/magenta9/ai-web-tools/server/internal/model"
+)
+
+// Deleting an upload closes the pool that has it open
+func TestDeleteFileClosesPool(t *testing.T) {
+	files := dbfile.New(nil, t.TempDir(), 1<<20, 0, 0)
+	pools := dbpool.New(dbpool.Options{
+		MaxPerUser:  4,
+		IdleTimeout: time.Minute,
+		Open: func(string, string) (*sql.DB, error) {
+			return sql.OpenDB(&fakeSQL{}), nil
+		},
+	})
+	t.Cleanup(pools.Close)
+	h := NewDBHandler(&config.Config{}, nil, nil, nil, pools, files)
+
+	alice := &model.User{ID: 1}
+	f, err := files.Save(alice.ID, "orders.sqlite", strings.NewReader("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, err := files.Resolve(alice.ID, f.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pools.Get(context.Background(), alice.ID, "sqlite", path); err != nil {
+		t.Fatal(err)
+	}
+	// Another user's pool for an unrelated file stays open
+	if _, err := pools.Get(context.Background(), 2, "sqlite", "/srv/data/other.sqlite"); err != nil {
+		t.Fatal(err)
+	}
+
+	r := testRouter()
+	r.DELETE("/files/:id", h.DeleteFile)
+	if code, resp := doJSON(t, r, alice, "DELETE", "/files/"+f.ID, nil); code != 200 {
+		t.Fatalf("delete: %d %v", code, resp)
+	}
+	if n := pools.Len(); n != 1 {
+		t.Errorf("%d pools open after the delete, want 1", n)
+	}
+}
@@ -0,0 +1,494 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/lib/pq"
+	"github.com/magenta9/ai-web-tools/server/internal/auth"
+	"github.com/magenta9/ai-web-tools/server/internal/model"
+	"github.com/magenta9/ai-web-tools/server/internal/sqlguard"
+)
+
+// dbWriteConfirmTTL is how long a previewed write can be confirmed
+const dbWriteConfirmTTL = 5 * time.Minute
+
+// PreviewWrite dry-runs a write through a saved connection that allows
+// writes: the statement runs in a transaction that is rolled back, and the
+// affected row count is returned with a one-time token for ConfirmWrite.
+func (h *DBHandler) PreviewWrite(c *gin.Context) {
+	var req model.DBWriteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"success": false, "error": "connection_id and sql are required"})
+		return
+	}
+	cfg := dbConfig{ConnectionID: req.ConnectionID}
+	if !h.resolveConnection(c, &cfg) || !h.checkWrite(c, model.ActionDBWritePreview, &cfg, req.SQL) ||
+		!h.checkTransactional(c, model.ActionDBWritePreview, &cfg, req.SQL) {
+		return
+	}
+
+	tx, rowsAffected, err := h.execWrite(c, &cfg, req.SQL)
+	if err == nil {
+		err = tx.Rollback()
+	}
+	h.auditDB(c, model.ActionDBWritePreview, &cfg, err, map[string]any{
+		"sql":           h.audit.SQL(req.SQL),
+		"rows_affected": rowsAffected,
+	})
+	if err != nil {
+		c.JSON(writeErrorStatus(err), gin.H{"success": false, "error": err.Error()})
+		return
+	}
+
+	token, hash, err := auth.NewOpaqueToken()
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "Failed to create confirmation"})
+		return
+	}
+	w := &model.DBWriteConfirmation{ConnectionID: req.ConnectionID, SQL: req.SQL, RowsAffected: rowsAffected}
+	if err := h.repo.CreateDBWriteConfirmation(c.Request.Context(), hash, c.GetInt("user_id"), w, dbWriteConfirmTTL); err != nil {
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"success":      true,
+		"dryRun":       true,
+		"rowsAffected": rowsAffected,
+		"confirmToken": token,
+		"expiresAt":    w.ExpiresAt,
+	})
+}
+
+// ConfirmWrite commits a write previewed by the same user. The token is
+// used up even if the write fails. If the write would now affect a
+// different number of rows than the preview showed, it is rolled back.
+func (h *DBHandler) ConfirmWrite(c *gin.Context) {
+	var req model.DBWriteConfirmRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"success": false, "error": "token is required"})
+		return
+	}
+
+	w, err := h.repo.ConsumeDBWriteConfirmation(c.Request.Context(), auth.HashToken(req.Token), c.GetInt("user_id"))
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(404, gin.H{"success": false, "error": "confirmation not found or expired"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+
+	// The connection may have been closed to writes since the preview
+	cfg := dbConfig{ConnectionID: w.ConnectionID}
+	if !h.resolveConnection(c, &cfg) || !h.checkWrite(c, model.ActionDBWriteCommit, &cfg, w.SQL) ||
+		!h.checkTransactional(c, model.ActionDBWriteCommit, &cfg, w.SQL) {
+		return
+	}
+
+	tx, rowsAffected, err := h.execWrite(c, &cfg, w.SQL)
+	if err == nil {
+		if rowsAffected != w.RowsAffected {
+			tx.Rollback()
+			err = &rowCountMismatch{previewed: w.RowsAffected, affected: rowsAffected}
+		} else {
+			err = tx.Commit()
+		}
+	}
+	details := map[string]any{
+		"sql":           h.audit.SQL(w.SQL),
+		"rows_affected": rowsAffected,
+		"previewed":     w.RowsAffected,
+	}
+	h.auditDB(c, model.ActionDBWriteCommit, &cfg, err, details)
+	var mismatch *rowCountMismatch
+	if errors.As(err, &mismatch) {
+		c.JSON(409, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(writeErrorStatus(err), gin.H{"success": false, "error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true, "rowsAffected": rowsAffected})
+}
+
+// checkWrite writes an error response and a denied audit entry unless the
+// connection allows writes and query is a single data-modifying statement
+func (h *DBHandler) checkWrite(c *gin.Context, action string, cfg *dbConfig, query string) bool {
+	reason := ""
+	status := 403
+	switch d := cfg.dialect(); {
+	case d == sqlguard.SQLite || d == sqlguard.DuckDB:
+		// Uploaded files are opened read-only
+		reason, status = fmt.Sprintf("writes are not supported on %s files", d), 400
+	case !cfg.allowWrites:
+		reason = "writes are not enabled for this connection"
+	case cfg.Database == "":
+		reason, status = "the connection has no database", 400
+	case d == sqlguard.ClickHouse:
+		// Without transactions a write cannot be previewed and rolled back
+		reason, status = "writes cannot be previewed on ClickHouse", 400
+	default:
+		if err := sqlguard.CheckWrite(query, d); err != nil {
+			reason, status = err.(*sqlguard.Error).Reason, 400
+		}
+	}
+	if reason == "" {
+		return true
+	}
+	h.denyWrite(c, action, cfg, query, status, reason)
+	return false
+}
+
+// checkTransactional writes an error response and a denied audit entry if
+// a MySQL write could reach a table that cannot be rolled back, such as a
+// MyISAM or MEMORY table, since the preview would change it for good
+func (h *DBHandler) checkTransactional(c *gin.Context, action string, cfg *dbConfig, query string) bool {
+	if cfg.dialect() != sqlguard.MySQL {
+		return true
+	}
+	db, err := h.openDB(c, cfg)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		return false
+	}
+	tables, err := nonTransactionalTables(c.Request.Context(), db, cfg.Database, query)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		return false
+	}
+	if len(tables) == 0 {
+		return true
+	}
+	h.denyWrite(c, action, cfg, query, 400, "writes cannot be previewed unless every table they reach supports transactions: "+strings.Join(tables, ", "))
+	return false
+}
+
+func (h *DBHandler) denyWrite(c *gin.Context, action string, cfg *dbConfig, query string, status int, reason string) {
+	h.audit.Log(c, model.AuditEvent{
+		Action:     action,
+		TargetType: "database",
+		TargetID:   cfg.target(),
+		Outcome:    model.OutcomeDenied,
+		Details:    map[string]any{"sql": h.audit.SQL(query), "reason": reason, "connection_id": cfg.ConnectionID},
+	})
+	c.JSON(status, gin.H{"success": false, "error": reason})
+}
+
+// nonTransactionalTables returns the MySQL tables, as "schema.table
+// (ENGINE)", that do not support transactions and that query may reach:
+// those it names, and those named by the views, routines and triggers it
+// reaches in turn. Names are matched loosely, so it may return tables the
+// query does not touch. A view or routine whose definition the user cannot
+// see is returned too; triggers the user cannot see are not.
+func nonTransactionalTables(ctx context.Context, db *sql.DB, database, query string) ([]string, error) {
+	names, err := sqlguard.Identifiers(query, sqlguard.MySQL)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{strings.ToLower(database): true}
+	for _, name := range names {
+		seen[name] = true
+	}
+	names = append(names, strings.ToLower(database))
+
+	var hidden []string
+	expanded := map[string]bool{}
+	for {
+		placeholders, args := mysqlNameList(names)
+		rows, err := db.QueryContext(ctx, fmt.Sprintf(nonTransactionalDefinitionsQuery, placeholders), repeatArgs(args, 6)...)
+		if err != nil {
+			return nil, err
+		}
+		added := false
+		for rows.Next() {
+			var kind, schema, name string
+			var definition sql.NullString
+			if err := rows.Scan(&kind, &schema, &name, &definition); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			key := kind + " " + schema + "." + name
+			if expanded[key] {
+				continue
+			}
+			expanded[key] = true
+			if !definition.Valid {
+				hidden = append(hidden, fmt.Sprintf("%s.%s (%s definition not visible)", schema, name, kind))
+				continue
+			}
+			defNames, err := sqlguard.Identifiers(definition.String, sqlguard.MySQL)
+			if err != nil {
+				hidden = append(hidden, fmt.Sprintf("%s.%s (%s definition not readable)", schema, name, kind))
+				continue
+			}
+			for _, n := range append(defNames, strings.ToLower(schema)) {
+				if !seen[n] {
+					seen[n] = true
+					names = append(names, n)
+					added = true
+				}
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		if !added {
+			break
+		}
+	}
+
+	placeholders, args := mysqlNameList(names)
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(nonTransactionalTablesQuery, placeholders), repeatArgs(args, 2)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			return nil, err
+		}
+		tables = append(tables, table)
+	}
+	return append(tables, hidden...), rows.Err()
+}
+
+// nonTransactionalDefinitionsQuery returns the triggers on, and the views
+// and routines among, the named objects, with their definitions
+const nonTransactionalDefinitionsQuery = `
+SELECT 'trigger', TRIGGER_SCHEMA, TRIGGER_NAME, ACTION_STATEMENT FROM information_schema.TRIGGERS
+ WHERE LOWER(EVENT_OBJECT_SCHEMA) IN (%[1]s) AND LOWER(EVENT_OBJECT_TABLE) IN (%[1]s)
+UNION ALL
+SELECT 'view', TABLE_SCHEMA, TABLE_NAME, NULLIF(VIEW_DEFINITION, '') FROM information_schema.VIEWS
+ WHERE LOWER(TABLE_SCHEMA) IN (%[1]s) AND LOWER(TABLE_NAME) IN (%[1]s)
+UNION ALL
+SELECT 'routine', ROUTINE_SCHEMA, ROUTINE_NAME, ROUTINE_DEFINITION FROM information_schema.ROUTINES
+ WHERE LOWER(ROUTINE_SCHEMA) IN (%[1]s) AND LOWER(ROUTINE_NAME) IN (%[1]s)`
+
+// nonTransactionalTablesQuery returns the named base tables whose engine
+// does not support transactions
+const nonTransactionalTablesQuery = `
+SELECT CONCAT(t.TABLE_SCHEMA, '.', t.TABLE_NAME, ' (', t.ENGINE, ')')
+FROM information_schema.TABLES t
+LEFT JOIN information_schema.ENGINES e ON e.ENGINE = t.ENGINE
+WHERE t.TABLE_TYPE = 'BASE TABLE' AND COALESCE(e.TRANSACTIONS, 'NO') <> 'YES'
+  AND LOWER(t.TABLE_SCHEMA) IN (%[1]s) AND LOWER(t.TABLE_NAME) IN (%[1]s)
+ORDER BY 1`
+
+// mysqlNameList returns a placeholder list for names and its arguments
+func mysqlNameList(names []string) (string, []any) {
+	args := make([]any, len(names))
+	for i, name := range names {
+		args[i] = name
+	}
+	return strings.TrimSuffix(strings.Repeat("?, ", len(names)), ", "), args
+}
+
+// repeatArgs repeats args for a query that uses the same list n times
+func repeatArgs(args []any, n int) []any {
+	all := make([]any, 0, len(args)*n)
+	for range n {
+		all = append(all, args...)
+	}
+	return all
+}
+
+// writeErrorStatus returns the response status for a failed write
+func writeErrorStatus(err error) int {
+	if errors.Is(err, errWriteTimeout) {
+		return 504
+	}
+	return 500
+}
+
+// rowCountMismatch is returned when a confirmed write would change a
+// different number of rows than its preview
+type rowCountMismatch struct {
+	previewed, affected int64
+}
+
+func (e *rowCountMismatch) Error() string {
+	return fmt.Sprintf("write would affect %d rows but the preview affected %d; it was rolled back, preview it again", e.affected, e.previewed)
+}
+
+// writeTx is a write's open transaction on a connection of its own. The
+// connection goes back to the pool once the transaction ends.
+type writeTx struct {
+	*sql.Tx
+	conn *sql.Conn
+}
+
+func (w *writeTx) Commit() error {
+	defer w.conn.Close()
+	return w.Tx.Commit()
+}
+
+func (w *writeTx) Rollback() error {
+	defer w.conn.Close()
+	return w.Tx.Rollback()
+}
+
+// execWrite runs query in a new transaction and returns the transaction,
+// still open, with the affected row count. The statement gets the query
+// timeout both on the context and, where the server has one, as its
+// statement timeout.
+func (h *DBHandler) execWrite(c *gin.Context, cfg *dbConfig, query string) (*writeTx, int64, error) {
+	db, err := h.openDB(c, cfg)
+	if err != nil {
+		return nil, 0, err
+	}
+	// The transaction outlives the statement, until it is confirmed or
+	// rolled back, so only the statement gets the timeout
+	conn, err := db.Conn(c.Request.Context())
+	if err != nil {
+		return nil, 0, err
+	}
+	tx, err := conn.BeginTx(c.Request.Context(), nil)
+	if err != nil {
+		conn.Close()
+		return nil, 0, err
+	}
+	w := &writeTx{Tx: tx, conn: conn}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), h.queryTimeout)
+	defer cancel()
+
+	// The session must read quotes as sqlguard did when it checked query
+	var connID int64
+	switch cfg.dialect() {
+	case sqlguard.MySQL:
+		err = pinMySQLQuoting(ctx, tx)
+		if err == nil {
+			err = tx.QueryRowContext(ctx, "SELECT CONNECTION_ID()").Scan(&connID)
+		}
+	case sqlguard.Postgres:
+		_, err = tx.ExecContext(ctx, "SELECT set_config('statement_timeout', $1, true), set_config('standard_conforming_strings', 'on', true)",
+			fmt.Sprint(h.queryTimeout.Milliseconds()))
+	}
+	if err != nil {
+		w.Rollback()
+		return nil, 0, err
+	}
+
+	// MAX_EXECUTION_TIME only limits SELECTs, and MySQL keeps running a
+	// statement whose client went away, so it is killed from another
+	// connection instead
+	killed := func() bool { return false }
+	if connID != 0 {
+		killed = killOnDone(ctx, db, connID)
+	}
+	res, err := tx.ExecContext(ctx, query)
+	var pqErr *pq.Error
+	if err != nil && (errors.Is(ctx.Err(), context.DeadlineExceeded) || errors.As(err, &pqErr) && pqErr.Code == "57014") {
+		err = errWriteTimeout
+	}
+	if killed() {
+		// The kill may have come after the statement ended, and would
+		// then hit the next one on the connection, so it is not reused
+		tx.Rollback()
+		conn.Raw(func(any) error { return driver.ErrBadConn })
+		conn.Close()
+		if err == nil {
+			err = errWriteTimeout
+		}
+		return nil, 0, err
+	}
+	if err != nil {
+		w.Rollback()
+		return nil, 0, err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		w.Rollback()
+		return nil, 0, err
+	}
+	return w, rowsAffected, nil
+}
+
+// killOnDone kills the MySQL statement running on connection connID if ctx
+// ends first. The returned function stops watching and reports whether
+// the statement was killed.
+func killOnDone(ctx context.Context, db *sql.DB, connID int64) func() bool {
+	done, watched := make(chan struct{}), make(chan struct{})
+	killed := false
+	go func() {
+		defer close(watched)
+		select {
+		case <-done:
+		case <-ctx.Done():
+			killCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if _, err := db.ExecContext(killCtx, fmt.Sprintf("KILL QUERY %d", connID)); err != nil {
+				log.Printf("Warning: failed to kill timed out write on connection %d: %v", connID, err)
+			}
+			killed = true
+		}
+	}()
+	return func() bool {
+		close(done)
+		<-watched
+		return killed
+	}
+}
+
+// errWriteTimeout replaces the driver errors of a write that ran out of time
+var errWriteTimeout = errors.New("write timed out and was rolled back")
+
+// ListConnections lists every saved connection so admins can find the ones
+// to open to writes
+func (h *AdminHandler) ListConnections(c *gin.Context) {
+	conns, err := h.repo.ListAllDBConnections(c.Request.Context())
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true, "connections": conns})
+}
+
+// SetConnectionWrites enables or disables previewed writes through a saved
+// connection
+func (h *AdminHandler) SetConnectionWrites(c *gin.Context) {
+	id, ok := parseConnectionID(c)
+	if !ok {
+		return
+	}
+	var req model.ConnectionWritesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"success": false, "error": "allow_writes is required"})
+		return
+	}
+
+	found, err := h.repo.SetDBConnectionWrites(c.Request.Context(), id, *req.AllowWrites)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+	if !found {
+		c.JSON(404, gin.H{"success": false, "error": "connection not found"})
+		return
+	}
+	h.audit.Log(c, model.AuditEvent{
+		Action:     model.ActionConnectionWrites,
+		TargetType: "connection",
+		TargetID:   strconv.Itoa(id),
+		Details:    map[string]any{"allow_writes": *req.AllowWrites},
+	})
+
+	c.JSON(200, gin.H{"success": true})
+}
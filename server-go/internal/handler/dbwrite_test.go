@@ -0,0 +1,207 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"github.com/magenta9/ai-web-tools/server/internal/config"
+	"github.com/magenta9/ai-web-tools/server/internal/model"
+)
+
+func TestCheckWrite(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	h := NewDBHandler(&config.Config{}, nil, nil, nil, nil, nil)
+
+	tests := []struct {
+		name  string
+		cfg   dbConfig
+		query string
+		want  int
+	}{
+		{"mysql", dbConfig{Type: "mysql", Database: "shop", allowWrites: true}, "UPDATE t SET n = 1", 0},
+		{"postgres", dbConfig{Type: "postgres", Database: "shop", allowWrites: true}, "DELETE FROM t", 0},
+		{"writes not enabled", dbConfig{Type: "mysql", Database: "shop"}, "UPDATE t SET n = 1", 403},
+		{"no database", dbConfig{Type: "mysql", allowWrites: true}, "UPDATE t SET n = 1", 400},
+		{"sqlite file", dbConfig{Type: "sqlite", Database: "main", allowWrites: true}, "UPDATE t SET n = 1", 400},
+		{"duckdb file", dbConfig{Type: "duckdb", Database: "main", allowWrites: true}, "UPDATE t SET n = 1", 400},
+		{"sqlite file without writes", dbConfig{Type: "sqlite", Database: "main"}, "UPDATE t SET n = 1", 400},
+		{"clickhouse", dbConfig{Type: "clickhouse", Database: "logs", allowWrites: true}, "INSERT INTO t VALUES (1)", 400},
+		{"not a write", dbConfig{Type: "mysql", Database: "shop", allowWrites: true}, "DROP TABLE t", 400},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("POST", "/api/db/write/preview", nil)
+
+		ok := h.checkWrite(c, model.ActionDBWritePreview, &tt.cfg, tt.query)
+		if ok != (tt.want == 0) {
+			t.Errorf("%s: checkWrite = %v, want %v", tt.name, ok, tt.want == 0)
+		}
+		if tt.want != 0 && w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.want, w.Body.String())
+		}
+	}
+}
+
+// TestNonTransactionalTables runs against the MySQL database named by
+// TEST_MYSQL_DSN, such as root:secret@tcp(localhost:3306)/webtools_test,
+// and is skipped when it is not set
+func TestNonTransactionalTables(t *testing.T) {
+	dsn := os.Getenv("TEST_MYSQL_DSN")
+	if dsn == "" {
+		t.Skip("TEST_MYSQL_DSN is not set")
+	}
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		t.Fatalf("TEST_MYSQL_DSN: %v", err)
+	}
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	ctx := context.Background()
+	drop := func() {
+		for _, q := range []string{
+			"DROP VIEW IF EXISTS guard_view",
+			"DROP TABLE IF EXISTS guard_innodb, guard_myisam, guard_memory, guard_logged",
+		} {
+			if _, err := db.ExecContext(ctx, q); err != nil {
+				t.Errorf("%s: %v", q, err)
+			}
+		}
+	}
+	drop()
+	t.Cleanup(drop)
+	for _, q := range []string{
+		"CREATE TABLE guard_innodb (id INT PRIMARY KEY, n INT) ENGINE=InnoDB",
+		"CREATE TABLE guard_myisam (id INT PRIMARY KEY, n INT) ENGINE=MyISAM",
+		"CREATE TABLE guard_memory (id INT PRIMARY KEY, n INT) ENGINE=MEMORY",
+		"CREATE TABLE guard_logged (id INT PRIMARY KEY, n INT) ENGINE=InnoDB",
+		"CREATE TRIGGER guard_log AFTER DELETE ON guard_logged FOR EACH ROW INSERT INTO guard_myisam VALUES (OLD.id, OLD.n)",
+		"CREATE VIEW guard_view AS SELECT * FROM guard_memory",
+	} {
+		if _, err := db.ExecContext(ctx, q); err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+	}
+
+	myisam := cfg.DBName + ".guard_myisam (MyISAM)"
+	memory := cfg.DBName + ".guard_memory (MEMORY)"
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"UPDATE guard_innodb SET n = 1", nil},
+		{"UPDATE `Guard_MyISAM` SET n = 1", []string{myisam}},
+		{"UPDATE " + cfg.DBName + ".guard_memory SET n = 1", []string{memory}},
+		{"INSERT INTO guard_innodb SELECT * FROM guard_myisam", []string{myisam}},
+		{"DELETE FROM guard_logged WHERE id = 1", []string{myisam}},
+		{"UPDATE guard_view SET n = 1", []string{memory}},
+	}
+	for _, tt := range tests {
+		got, err := nonTransactionalTables(ctx, db, cfg.DBName, tt.query)
+		if err != nil {
+			t.Errorf("%s: %v", tt.query, err)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: non-transactional tables %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+// Writes run with the quoting sqlguard checked them with
+func TestExecWritePinsQuoting(t *testing.T) {
+	tests := []struct {
+		typ, sqlMode, query string
+		want                []string
+	}{
+		{"mysql", "ANSI_QUOTES,NO_BACKSLASH_ESCAPES", `UPDATE t SET a = 'a\' , sleep(10) -- '`, []string{
+			"BEGIN",
+			"SELECT @@SESSION.sql_mode",
+			"SET SESSION sql_mode = ? []",
+			"SELECT CONNECTION_ID()",
+			`UPDATE t SET a = 'a\' , sleep(10) -- '`,
+			"ROLLBACK",
+		}},
+		{"postgres", "", `UPDATE t SET a = '\'' , pg_sleep(10) -- '`, []string{
+			"BEGIN",
+			"SELECT set_config('statement_timeout', $1, true), set_config('standard_conforming_strings', 'on', true) [5000]",
+			`UPDATE t SET a = '\'' , pg_sleep(10) -- '`,
+			"ROLLBACK",
+		}},
+	}
+	for _, tt := range tests {
+		f := &fakeSQL{sqlMode: tt.sqlMode}
+		h := fakeSQLHandler(t, f)
+		cfg := &dbConfig{Type: tt.typ, Host: "db", Database: "shop", allowWrites: true}
+
+		tx, _, err := h.execWrite(fakeSQLContext(), cfg, tt.query)
+		if err != nil {
+			t.Fatalf("%s: execWrite: %v", tt.typ, err)
+		}
+		tx.Rollback()
+		if logs := f.log(); len(logs) != 1 || !slices.Equal(logs[0], tt.want) {
+			t.Errorf("%s: statements\n%q\nwant\n%q", tt.typ, logs, tt.want)
+		}
+	}
+}
+
+// A write that runs out of time is stopped on the server and rolled back
+func TestExecWriteTimeout(t *testing.T) {
+	killed := make(chan struct{})
+	f := &fakeSQL{respond: func(query string, _ []driver.NamedValue) (*fakeRows, error) {
+		switch {
+		case query == "UPDATE t SET a = 1":
+			<-killed
+			return nil, &mysql.MySQLError{Number: 1317, Message: "Query execution was interrupted"}
+		case query == "KILL QUERY 1":
+			close(killed)
+		}
+		return nil, nil
+	}}
+	h := fakeSQLHandler(t, f)
+	h.queryTimeout = 100 * time.Millisecond
+	cfg := &dbConfig{Type: "mysql", Host: "db", Database: "shop", allowWrites: true}
+
+	if _, _, err := h.execWrite(fakeSQLContext(), cfg, "UPDATE t SET a = 1"); err != errWriteTimeout {
+		t.Fatalf("execWrite = %v, want errWriteTimeout", err)
+	}
+	tx, _, err := h.execWrite(fakeSQLContext(), cfg, "UPDATE t SET a = 2")
+	if err != nil {
+		t.Fatalf("execWrite after a timeout: %v", err)
+	}
+	tx.Rollback()
+
+	logs := f.log()
+	if len(logs) < 2 || logs[0][len(logs[0])-1] != "ROLLBACK" || slices.Contains(logs[0], "UPDATE t SET a = 2") {
+		t.Errorf("the killed write's connection was reused or not rolled back: %q", logs)
+	}
+	if !slices.Contains(logs[1], "KILL QUERY 1") {
+		t.Errorf("the write was not killed: %q", logs)
+	}
+
+	// Postgres stops the statement itself
+	f = &fakeSQL{respond: func(query string, _ []driver.NamedValue) (*fakeRows, error) {
+		if query == "UPDATE t SET a = 1" {
+			return nil, &pq.Error{Code: "57014"}
+		}
+		return nil, nil
+	}}
+	h = fakeSQLHandler(t, f)
+	cfg.Type = "postgres"
+	if _, _, err := h.execWrite(fakeSQLContext(), cfg, "UPDATE t SET a = 1"); err != errWriteTimeout {
+		t.Errorf("execWrite on Postgres = %v, want errWriteTimeout", err)
+	}
+}
@@ -0,0 +1,502 @@
+package handler
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/magenta9/ai-web-tools/server/internal/model"
+	"github.com/magenta9/ai-web-tools/server/internal/sqlguard"
+)
+
+// exportWriter writes a query result in a download format as it is read
+type exportWriter interface {
+	header(cols []resultColumn) error
+	// row takes the raw driver values of a row
+	row(values []any) error
+	close() error
+}
+
+type exportFormat struct {
+	ext         string
+	contentType string
+	new         func(w io.Writer, d sqlguard.Dialect, table string) exportWriter
+}
+
+var exportFormats = map[string]exportFormat{
+	"csv": {"csv", "text/csv; charset=utf-8", func(w io.Writer, _ sqlguard.Dialect, _ string) exportWriter {
+		return newDelimitedExport(w, ',', true)
+	}},
+	"tsv": {"tsv", "text/tab-separated-values; charset=utf-8", func(w io.Writer, _ sqlguard.Dialect, _ string) exportWriter {
+		return newDelimitedExport(w, '\t', false)
+	}},
+	"jsonl": {"jsonl", "application/x-ndjson", func(w io.Writer, _ sqlguard.Dialect, _ string) exportWriter {
+		return &jsonlExport{w: w}
+	}},
+	"xlsx": {"xlsx", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", func(w io.Writer, _ sqlguard.Dialect, _ string) exportWriter {
+		return &xlsxExport{zw: zip.NewWriter(w)}
+	}},
+	"markdown": {"md", "text/markdown; charset=utf-8", func(w io.Writer, _ sqlguard.Dialect, _ string) exportWriter {
+		return &markdownExport{w: w}
+	}},
+	"sql": {"sql", "application/sql; charset=utf-8", func(w io.Writer, d sqlguard.Dialect, table string) exportWriter {
+		return &insertExport{w: w, dialect: d, table: table}
+	}},
+}
+
+var filenameUnsafe = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// Export reruns a read-only query and streams its result as a download in
+// the requested format, with the same row cap and timeout as Execute.
+// Rows are written as they are read, so the status is sent before the
+// query ends; the X-Export-Row-Count, X-Export-Truncated and
+// X-Export-Error trailers report how it went.
+func (h *DBHandler) Export(c *gin.Context) {
+	var req struct {
+		dbConfig
+		SQL     string `json:"sql"`
+		Format  string `json:"format"`
+		MaxRows int    `json:"max_rows"`
+		// Table names the target of sql format INSERT statements
+		Table string `json:"table"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.SQL == "" {
+		c.JSON(400, gin.H{"success": false, "error": "SQL query is required"})
+		return
+	}
+	format, ok := exportFormats[req.Format]
+	if !ok {
+		c.JSON(400, gin.H{"success": false, "error": "format must be one of csv, tsv, jsonl, xlsx, markdown, sql"})
+		return
+	}
+	if req.Table == "" {
+		req.Table = "query_result"
+	}
+	if !h.checkReadQuery(c, model.ActionDBExport, &req.dbConfig, req.SQL) {
+		return
+	}
+
+	maxRows := h.queryMaxRows
+	if req.MaxRows > 0 && req.MaxRows < maxRows {
+		maxRows = req.MaxRows
+	}
+
+	started := time.Now()
+	rows, err := h.startReadQuery(c, &req.dbConfig, req.SQL, h.queryTimeout)
+	var cols []resultColumn
+	if err == nil {
+		defer rows.Close()
+		cols, err = resultColumns(rows.Rows)
+	}
+	if err != nil {
+		h.auditDB(c, model.ActionDBExport, &req.dbConfig, err, map[string]any{"sql": h.audit.SQL(req.SQL), "format": req.Format})
+		h.queryError(c, err)
+		return
+	}
+
+	name := filenameUnsafe.ReplaceAllString(req.Database, "_")
+	filename := fmt.Sprintf("%s-%s.%s", name, time.Now().Format("20060102-150405"), format.ext)
+	c.Header("Content-Type", format.contentType)
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	c.Header("Trailer", "X-Export-Row-Count, X-Export-Truncated, X-Export-Error")
+	c.Status(200)
+
+	w := format.new(c.Writer, req.dialect(), req.Table)
+	err = w.header(cols)
+	rowCount := 0
+	truncated := false
+	for err == nil && rows.Next() {
+		if rowCount == maxRows {
+			truncated = true
+			break
+		}
+		var values []any
+		if values, err = scanRow(rows.Rows, len(cols)); err != nil {
+			break
+		}
+		if err = w.row(values); err != nil {
+			break
+		}
+		rowCount++
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	if err == nil {
+		err = w.close()
+	}
+	h.auditDB(c, model.ActionDBExport, &req.dbConfig, err, map[string]any{
+		"sql":         h.audit.SQL(req.SQL),
+		"format":      req.Format,
+		"row_count":   rowCount,
+		"truncated":   truncated,
+		"duration_ms": time.Since(started).Milliseconds(),
+	})
+
+	c.Writer.Header().Set("X-Export-Row-Count", strconv.Itoa(rowCount))
+	c.Writer.Header().Set("X-Export-Truncated", strconv.FormatBool(truncated))
+	if err != nil {
+		c.Writer.Header().Set("X-Export-Error", err.Error())
+	}
+}
+
+// exportText renders a value as cell text; NULL is empty
+func exportText(v any, col resultColumn) string {
+	switch v := jsonValue(v, col.Type).(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return string(v)
+	case json.RawMessage:
+		return string(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// delimitedExport writes CSV, quoted as RFC 4180 with CRLF line endings,
+// or TSV
+type delimitedExport struct {
+	w    *csv.Writer
+	cols []resultColumn
+}
+
+func newDelimitedExport(w io.Writer, comma rune, crlf bool) *delimitedExport {
+	cw := csv.NewWriter(w)
+	cw.Comma = comma
+	cw.UseCRLF = crlf
+	return &delimitedExport{w: cw}
+}
+
+func (e *delimitedExport) header(cols []resultColumn) error {
+	e.cols = cols
+	names := make([]string, len(cols))
+	for i, col := range cols {
+		names[i] = col.Name
+	}
+	return e.w.Write(names)
+}
+
+func (e *delimitedExport) row(values []any) error {
+	record := make([]string, len(values))
+	for i, v := range values {
+		record[i] = exportText(v, e.cols[i])
+	}
+	return e.w.Write(record)
+}
+
+func (e *delimitedExport) close() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// jsonlExport writes a JSON object per row, keys in column order
+type jsonlExport struct {
+	w    io.Writer
+	cols []resultColumn
+	keys [][]byte
+}
+
+func (e *jsonlExport) header(cols []resultColumn) error {
+	e.cols = cols
+	for _, col := range cols {
+		key, _ := json.Marshal(col.Name)
+		e.keys = append(e.keys, key)
+	}
+	return nil
+}
+
+func (e *jsonlExport) row(values []any) error {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, v := range values {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		value, err := json.Marshal(jsonValue(v, e.cols[i].Type))
+		if err != nil {
+			return err
+		}
+		b.Write(e.keys[i])
+		b.WriteByte(':')
+		b.Write(value)
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(e.w, b.String())
+	return err
+}
+
+func (e *jsonlExport) close() error { return nil }
+
+// markdownExport writes a GitHub-flavored Markdown table
+type markdownExport struct {
+	w    io.Writer
+	cols []resultColumn
+}
+
+var markdownEscaper = strings.NewReplacer("|", `\|`, "\r\n", "<br>", "\n", "<br>", "\r", "<br>")
+
+func (e *markdownExport) line(cells []string) error {
+	_, err := io.WriteString(e.w, "| "+strings.Join(cells, " | ")+" |\n")
+	return err
+}
+
+func (e *markdownExport) header(cols []resultColumn) error {
+	e.cols = cols
+	names := make([]string, len(cols))
+	rule := make([]string, len(cols))
+	for i, col := range cols {
+		names[i] = markdownEscaper.Replace(col.Name)
+		rule[i] = "---"
+	}
+	if err := e.line(names); err != nil {
+		return err
+	}
+	return e.line(rule)
+}
+
+func (e *markdownExport) row(values []any) error {
+	cells := make([]string, len(values))
+	for i, v := range values {
+		cells[i] = markdownEscaper.Replace(exportText(v, e.cols[i]))
+	}
+	return e.line(cells)
+}
+
+func (e *markdownExport) close() error { return nil }
+
+// insertExport writes an INSERT statement per row, quoted for the
+// dialect of the source database
+type insertExport struct {
+	w       io.Writer
+	dialect sqlguard.Dialect
+	table   string
+	cols    []resultColumn
+	prefix  string
+}
+
+func (e *insertExport) quoteIdent(name string) string {
+	switch e.dialect {
+	case sqlguard.MySQL:
+		return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+	case sqlguard.MSSQL:
+		return "[" + strings.ReplaceAll(name, "]", "]]") + "]"
+	case sqlguard.ClickHouse:
+		return `"` + strings.ReplaceAll(strings.ReplaceAll(name, `\`, `\\`), `"`, `\"`) + `"`
+	}
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func (e *insertExport) header(cols []resultColumn) error {
+	e.cols = cols
+	// schema.table is quoted part by part
+	parts := strings.Split(e.table, ".")
+	for i, part := range parts {
+		parts[i] = e.quoteIdent(part)
+	}
+	names := make([]string, len(cols))
+	for i, col := range cols {
+		names[i] = e.quoteIdent(col.Name)
+	}
+	e.prefix = fmt.Sprintf("INSERT INTO %s (%s) VALUES (", strings.Join(parts, "."), strings.Join(names, ", "))
+	return nil
+}
+
+func (e *insertExport) row(values []any) error {
+	literals := make([]string, len(values))
+	for i, v := range values {
+		literals[i] = e.literal(v, e.cols[i])
+	}
+	_, err := io.WriteString(e.w, e.prefix+strings.Join(literals, ", ")+");\n")
+	return err
+}
+
+func (e *insertExport) close() error { return nil }
+
+// literal renders a value as a SQL literal. Numbers and booleans are
+// written bare, binary data as a hex literal, and everything else as a
+// string in the database's own text form.
+func (e *insertExport) literal(v any, col resultColumn) string {
+	if b, ok := v.([]byte); ok && isBinaryType(col.Type) {
+		switch e.dialect {
+		case sqlguard.Postgres:
+			return `'\x` + hex.EncodeToString(b) + `'`
+		case sqlguard.DuckDB:
+			var lit strings.Builder
+			for _, c := range b {
+				fmt.Fprintf(&lit, `\x%02X`, c)
+			}
+			return "'" + lit.String() + "'::BLOB"
+		case sqlguard.MSSQL:
+			return "0x" + hex.EncodeToString(b)
+		}
+		return "X'" + hex.EncodeToString(b) + "'"
+	}
+
+	text, _ := driverText(v)
+	switch jv := jsonValue(v, col.Type).(type) {
+	case nil:
+		return "NULL"
+	case json.Number, int64, float64:
+		return fmt.Sprint(jv)
+	case bool:
+		// T-SQL has no boolean literals; BIT columns take 1 and 0
+		if e.dialect == sqlguard.MSSQL {
+			if jv {
+				return "1"
+			}
+			return "0"
+		}
+		if jv {
+			return "TRUE"
+		}
+		return "FALSE"
+	case json.RawMessage:
+		// JSON columns, and DuckDB lists and structs
+		text = string(jv)
+	case string:
+		// Dates without the time, and UUIDs DuckDB and SQL Server return
+		// as bytes
+		if _, ok := v.(time.Time); ok || isUUIDType(col.Type) {
+			text = jv
+		}
+	}
+	switch e.dialect {
+	case sqlguard.MySQL:
+		return "'" + mysqlStringEscaper.Replace(text) + "'"
+	case sqlguard.ClickHouse:
+		return "'" + clickhouseStringEscaper.Replace(text) + "'"
+	case sqlguard.MSSQL:
+		// N'' keeps text outside the database's code page
+		return "N'" + strings.ReplaceAll(text, "'", "''") + "'"
+	}
+	return "'" + strings.ReplaceAll(text, "'", "''") + "'"
+}
+
+var mysqlStringEscaper = strings.NewReplacer(`\`, `\\`, "'", "''", "\x00", `\0`, "\n", `\n`, "\r", `\r`, "\x1a", `\Z`)
+
+// clickhouseStringEscaper escapes a ClickHouse string literal, in which
+// backslashes are escapes
+var clickhouseStringEscaper = strings.NewReplacer(`\`, `\\`, "'", `\'`)
+
+// xlsxExport writes a single-sheet workbook, streaming the sheet into the
+// zip archive. Strings are stored inline, so no shared string table has to
+// be built in memory.
+type xlsxExport struct {
+	zw    *zip.Writer
+	sheet io.Writer
+	cols  []resultColumn
+	rowN  int
+}
+
+const (
+	xlsxContentTypes = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/><Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/></Types>`
+	xlsxRootRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`
+	xlsxWorkbook = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="Result" sheetId="1" r:id="rId1"/></sheets></workbook>`
+	xlsxWorkbookRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/></Relationships>`
+	xlsxSheetStart = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`
+	xlsxSheetEnd = `</sheetData></worksheet>`
+)
+
+func (e *xlsxExport) header(cols []resultColumn) error {
+	e.cols = cols
+	for _, part := range []struct{ name, body string }{
+		{"[Content_Types].xml", xlsxContentTypes},
+		{"_rels/.rels", xlsxRootRels},
+		{"xl/workbook.xml", xlsxWorkbook},
+		{"xl/_rels/workbook.xml.rels", xlsxWorkbookRels},
+	} {
+		w, err := e.zw.Create(part.name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, part.body); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	if e.sheet, err = e.zw.Create("xl/worksheets/sheet1.xml"); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(e.sheet, xlsxSheetStart); err != nil {
+		return err
+	}
+	names := make([]any, len(cols))
+	for i, col := range cols {
+		names[i] = col.Name
+	}
+	return e.writeRow(names)
+}
+
+func (e *xlsxExport) row(values []any) error {
+	cells := make([]any, len(values))
+	for i, v := range values {
+		cells[i] = jsonValue(v, e.cols[i].Type)
+	}
+	return e.writeRow(cells)
+}
+
+// writeRow writes converted values; NULL cells are left out
+func (e *xlsxExport) writeRow(cells []any) error {
+	e.rowN++
+	var b strings.Builder
+	fmt.Fprintf(&b, `<row r="%d">`, e.rowN)
+	for i, v := range cells {
+		ref := xlsxColumn(i) + strconv.Itoa(e.rowN)
+		switch v := v.(type) {
+		case nil:
+		case bool:
+			n := 0
+			if v {
+				n = 1
+			}
+			fmt.Fprintf(&b, `<c r="%s" t="b"><v>%d</v></c>`, ref, n)
+		case json.Number, int64, float64:
+			fmt.Fprintf(&b, `<c r="%s"><v>%v</v></c>`, ref, v)
+		default:
+			text := fmt.Sprint(v)
+			if raw, ok := v.(json.RawMessage); ok {
+				text = string(raw)
+			}
+			fmt.Fprintf(&b, `<c r="%s" t="inlineStr"><is><t xml:space="preserve">`, ref)
+			xml.EscapeText(&b, []byte(text))
+			b.WriteString(`</t></is></c>`)
+		}
+	}
+	b.WriteString(`</row>`)
+	_, err := io.WriteString(e.sheet, b.String())
+	return err
+}
+
+func (e *xlsxExport) close() error {
+	if _, err := io.WriteString(e.sheet, xlsxSheetEnd); err != nil {
+		return err
+	}
+	return e.zw.Close()
+}
+
+// xlsxColumn returns the letters of a zero-based column: A, B, ..., AA
+func xlsxColumn(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
@@ -0,0 +1,117 @@
+package handler
+
+import (
+	"database/sql"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	chproto "github.com/ClickHouse/ch-go/proto"
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/proto"
+	"github.com/magenta9/ai-web-tools/server/internal/config"
+	"github.com/magenta9/ai-web-tools/server/internal/dbpool"
+)
+
+// fakeClickHouse is a ClickHouse HTTP interface that answers every query
+// with a single row holding 1 and records the queries with the settings
+// they were sent with. The column is named n, or 1 for the driver's ping.
+type fakeClickHouse struct {
+	*httptest.Server
+	// stall is a query left running until the client goes away
+	stall string
+
+	mu      sync.Mutex
+	queries []fakeClickHouseQuery
+}
+
+type fakeClickHouseQuery struct {
+	query    string
+	settings url.Values
+}
+
+func newFakeClickHouse(t *testing.T) *fakeClickHouse {
+	t.Helper()
+	f := &fakeClickHouse{}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeClickHouse) serve(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query := string(body)
+
+	block := proto.NewBlock()
+	if strings.HasPrefix(query, "SELECT displayName()") {
+		// The handshake the HTTP client makes in place of the native one
+		block.AddColumn("displayName()", "String")
+		block.AddColumn("version()", "String")
+		block.AddColumn("revision()", "UInt32")
+		block.AddColumn("timezone()", "String")
+		err = block.Append("fake", "24.8.1", uint32(clickhouse.ClientTCPProtocolVersion), "UTC")
+	} else {
+		f.mu.Lock()
+		f.queries = append(f.queries, fakeClickHouseQuery{query, r.URL.Query()})
+		f.mu.Unlock()
+		if query == f.stall {
+			<-r.Context().Done()
+			return
+		}
+		name := "n"
+		if query == "SELECT 1" {
+			name = "1"
+		}
+		block.AddColumn(name, "UInt8")
+		err = block.Append(uint8(1))
+	}
+	var buf chproto.Buffer
+	if err == nil {
+		err = block.Encode(&buf, clickhouse.ClientTCPProtocolVersion)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(buf.Buf)
+}
+
+// log returns the queries run so far
+func (f *fakeClickHouse) log() []fakeClickHouseQuery {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]fakeClickHouseQuery(nil), f.queries...)
+}
+
+// fakeClickHouseHandler returns a DBHandler whose target pools all
+// connect to f over HTTP
+func fakeClickHouseHandler(t *testing.T, f *fakeClickHouse) *DBHandler {
+	t.Helper()
+	addr := strings.TrimPrefix(f.URL, "http://")
+	pools := dbpool.New(dbpool.Options{
+		MaxPerUser:   4,
+		IdleTimeout:  time.Minute,
+		MaxOpenConns: 4,
+		Open: func(string, string) (*sql.DB, error) {
+			return clickhouse.OpenDB(&clickhouse.Options{
+				Protocol: clickhouse.HTTP,
+				Addr:     []string{addr},
+			}), nil
+		},
+	})
+	t.Cleanup(pools.Close)
+	return NewDBHandler(&config.Config{
+		QueryTimeout:  5 * time.Second,
+		QueryMaxRows:  1000,
+		QueryMaxBytes: 1 << 20,
+	}, nil, nil, nil, pools, nil)
+}
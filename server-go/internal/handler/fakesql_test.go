@@ -0,0 +1,189 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/magenta9/ai-web-tools/server/internal/config"
+	"github.com/magenta9/ai-web-tools/server/internal/dbpool"
+)
+
+// fakeSQL is a database/sql connector for testing the query paths of
+// databases that cannot run here. It records the statements each
+// connection runs and answers them with respond.
+type fakeSQL struct {
+	// respond answers a query or statement; nil rows is an empty result
+	respond func(query string, args []driver.NamedValue) (*fakeRows, error)
+	// sqlMode is the MySQL sql_mode new connections start with
+	sqlMode string
+
+	mu    sync.Mutex
+	conns []*fakeConn
+}
+
+func (f *fakeSQL) Connect(context.Context) (driver.Conn, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c := &fakeConn{f: f, id: int64(len(f.conns) + 1), sqlMode: f.sqlMode}
+	f.conns = append(f.conns, c)
+	return c, nil
+}
+
+func (f *fakeSQL) Driver() driver.Driver { return nil }
+
+// log returns the statements run on each connection opened so far
+func (f *fakeSQL) log() [][]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	logs := make([][]string, len(f.conns))
+	for i, c := range f.conns {
+		logs[i] = append([]string(nil), c.log...)
+	}
+	return logs
+}
+
+type fakeConn struct {
+	f       *fakeSQL
+	id      int64
+	sqlMode string
+	log     []string
+}
+
+func (c *fakeConn) record(stmt string, args []driver.NamedValue) {
+	for _, a := range args {
+		stmt += fmt.Sprintf(" [%v]", a.Value)
+	}
+	c.f.mu.Lock()
+	c.log = append(c.log, stmt)
+	c.f.mu.Unlock()
+}
+
+func (c *fakeConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("fakeSQL does not prepare statements")
+}
+
+func (c *fakeConn) Close() error { return nil }
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *fakeConn) BeginTx(_ context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if opts.ReadOnly {
+		c.record("BEGIN READ ONLY", nil)
+	} else {
+		c.record("BEGIN", nil)
+	}
+	return fakeTx{c}, nil
+}
+
+func (c *fakeConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.record(query, args)
+	if _, err := c.answer(query, args); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(0), nil
+}
+
+func (c *fakeConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.record(query, args)
+	rows, err := c.answer(query, args)
+	if err != nil {
+		return nil, err
+	}
+	if rows == nil {
+		rows = &fakeRows{}
+	}
+	return rows.clone(), nil
+}
+
+// answer responds to a query, giving MySQL's CONNECTION_ID() the
+// connection's own ID and keeping its sql_mode
+func (c *fakeConn) answer(query string, args []driver.NamedValue) (*fakeRows, error) {
+	switch query {
+	case "SELECT CONNECTION_ID()":
+		return &fakeRows{cols: []string{"CONNECTION_ID()"}, rows: [][]driver.Value{{c.id}}}, nil
+	case "SELECT @@SESSION.sql_mode":
+		return &fakeRows{cols: []string{"@@SESSION.sql_mode"}, rows: [][]driver.Value{{c.sqlMode}}}, nil
+	case "SET SESSION sql_mode = ?":
+		c.sqlMode = args[0].Value.(string)
+	}
+	if c.f.respond == nil {
+		return nil, nil
+	}
+	return c.f.respond(query, args)
+}
+
+type fakeTx struct{ c *fakeConn }
+
+func (tx fakeTx) Commit() error {
+	tx.c.record("COMMIT", nil)
+	return nil
+}
+
+func (tx fakeTx) Rollback() error {
+	tx.c.record("ROLLBACK", nil)
+	return nil
+}
+
+// fakeRows is a canned result
+type fakeRows struct {
+	cols []string
+	rows [][]driver.Value
+	next int
+}
+
+func (r *fakeRows) clone() *fakeRows {
+	return &fakeRows{cols: r.cols, rows: r.rows}
+}
+
+func (r *fakeRows) Columns() []string { return r.cols }
+
+func (r *fakeRows) Close() error { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.next == len(r.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rows[r.next])
+	r.next++
+	return nil
+}
+
+// fakeSQLHandler returns a DBHandler whose target pools all open f
+func fakeSQLHandler(t *testing.T, f *fakeSQL) *DBHandler {
+	t.Helper()
+	pools := dbpool.New(dbpool.Options{
+		MaxPerUser:   4,
+		IdleTimeout:  time.Minute,
+		MaxOpenConns: 4,
+		Open: func(string, string) (*sql.DB, error) {
+			return sql.OpenDB(f), nil
+		},
+	})
+	t.Cleanup(pools.Close)
+	return NewDBHandler(&config.Config{
+		QueryTimeout:  5 * time.Second,
+		QueryMaxRows:  1000,
+		QueryMaxBytes: 1 << 20,
+	}, nil, nil, nil, pools, nil)
+}
+
+// fakeSQLContext returns a request context signed in as user 1
+func fakeSQLContext() *gin.Context {
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("POST", "/api/db/execute", strings.NewReader("{}"))
+	c.Set("user_id", 1)
+	return c
+}
@@ -4,16 +4,18 @@ import (
 	"strconv"
 
 	"github.com/gin-gonic/gin"
+	"github.com/magenta9/ai-web-tools/server/internal/audit"
 	"github.com/magenta9/ai-web-tools/server/internal/model"
 	"github.com/magenta9/ai-web-tools/server/internal/repository"
 )
 
 type HistoryHandler struct {
-	repo *repository.Repository
+	repo  *repository.Repository
+	audit *audit.Logger
 }
 
-func NewHistoryHandler(repo *repository.Repository) *HistoryHandler {
-	return &HistoryHandler{repo: repo}
+func NewHistoryHandler(repo *repository.Repository, auditLog *audit.Logger) *HistoryHandler {
+	return &HistoryHandler{repo: repo, audit: auditLog}
 }
 
 func (h *HistoryHandler) Save(c *gin.Context) {
@@ -70,6 +72,12 @@ func (h *HistoryHandler) Get(c *gin.Context) {
 }
 
 func (h *HistoryHandler) Delete(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(401, gin.H{"success": false, "error": "Unauthorized"})
+		return
+	}
+
 	idStr := c.Param("id")
 	id, err := strconv.ParseInt(idStr, 10, 64)
 	if err != nil || id <= 0 {
@@ -77,27 +85,39 @@ func (h *HistoryHandler) Delete(c *gin.Context) {
 		return
 	}
 
-	err = h.repo.DeleteHistory(c.Request.Context(), id)
+	found, err := h.repo.DeleteHistory(c.Request.Context(), id, userID.(int))
 	if err != nil {
 		c.JSON(500, gin.H{"success": false, "error": err.Error()})
 		return
 	}
+	if !found {
+		c.JSON(404, gin.H{"success": false, "error": "history not found"})
+		return
+	}
+	h.audit.Log(c, model.AuditEvent{Action: model.ActionHistoryDelete, TargetType: "history", TargetID: idStr})
 
 	c.JSON(200, gin.H{"success": true})
 }
 
 func (h *HistoryHandler) Clear(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(401, gin.H{"success": false, "error": "Unauthorized"})
+		return
+	}
+
 	toolName := c.Query("tool_name")
 	if toolName == "" {
 		c.JSON(400, gin.H{"success": false, "error": "tool_name is required"})
 		return
 	}
 
-	err := h.repo.ClearHistory(c.Request.Context(), toolName)
+	err := h.repo.ClearHistory(c.Request.Context(), toolName, userID.(int))
 	if err != nil {
 		c.JSON(500, gin.H{"success": false, "error": err.Error()})
 		return
 	}
+	h.audit.Log(c, model.AuditEvent{Action: model.ActionHistoryClear, TargetType: "tool", TargetID: toolName})
 
 	c.JSON(200, gin.H{"success": true})
 }
@@ -0,0 +1,291 @@
+package handler
+
+import "github.com/magenta9/ai-web-tools/server/internal/sqlguard"
+
+// introspectionQuery holds a dialect's schema queries. Each %s is replaced
+// with the placeholders of the requested schemas; on DuckDB $1 is the
+// catalog. The rows they select are described on the scan functions.
+type introspectionQuery struct {
+	// schemas lists the default schemas; when empty the request's
+	// database is the only schema
+	schemas     string
+	tables      string
+	columns     string
+	indexes     string
+	foreignKeys string
+	enums       string
+}
+
+var introspectionQueries = map[sqlguard.Dialect]introspectionQuery{
+	sqlguard.Postgres: {
+		schemas: `
+			SELECT nspname FROM pg_namespace
+			WHERE nspname NOT IN ('information_schema', 'pg_catalog', 'pg_toast')
+				AND nspname NOT LIKE 'pg\_temp\_%' AND nspname NOT LIKE 'pg\_toast\_temp\_%'
+				AND has_schema_privilege(oid, 'USAGE')
+			ORDER BY nspname`,
+		// Partitions are described by their parent table
+		tables: `
+			SELECT n.nspname, c.relname,
+				CASE c.relkind WHEN 'v' THEN 'view' WHEN 'm' THEN 'materialized view' ELSE 'table' END,
+				obj_description(c.oid, 'pg_class'),
+				CASE WHEN c.relkind <> 'v' AND c.reltuples >= 0 THEN c.reltuples::bigint END
+			FROM pg_class c
+			JOIN pg_namespace n ON n.oid = c.relnamespace
+			WHERE n.nspname IN (%s) AND c.relkind IN ('r', 'p', 'v', 'm', 'f') AND NOT c.relispartition
+			ORDER BY n.nspname, c.relname`,
+		columns: `
+			SELECT n.nspname, c.relname, a.attname, format_type(a.atttypid, a.atttypmod), NOT a.attnotnull,
+				EXISTS (SELECT 1 FROM pg_index i WHERE i.indrelid = c.oid AND i.indisprimary AND a.attnum = ANY(i.indkey)),
+				col_description(c.oid, a.attnum)
+			FROM pg_attribute a
+			JOIN pg_class c ON c.oid = a.attrelid
+			JOIN pg_namespace n ON n.oid = c.relnamespace
+			WHERE n.nspname IN (%s) AND c.relkind IN ('r', 'p', 'v', 'm', 'f') AND NOT c.relispartition
+				AND a.attnum > 0 AND NOT a.attisdropped
+			ORDER BY n.nspname, c.relname, a.attnum`,
+		// pg_get_indexdef gives the column name or the expression of each
+		// key; included columns are left out
+		indexes: `
+			SELECT n.nspname, c.relname, ic.relname, i.indisunique, i.indisprimary,
+				pg_get_indexdef(i.indexrelid, k.pos, true)
+			FROM pg_index i
+			JOIN pg_class c ON c.oid = i.indrelid
+			JOIN pg_namespace n ON n.oid = c.relnamespace
+			JOIN pg_class ic ON ic.oid = i.indexrelid
+			CROSS JOIN LATERAL generate_series(1, i.indnkeyatts::int) AS k(pos)
+			WHERE n.nspname IN (%s)
+			ORDER BY n.nspname, c.relname, ic.relname, k.pos`,
+		foreignKeys: `
+			SELECT n.nspname, c.relname, k.conname, a.attname, rn.nspname, rc.relname, ra.attname
+			FROM pg_constraint k
+			JOIN pg_class c ON c.oid = k.conrelid
+			JOIN pg_namespace n ON n.oid = c.relnamespace
+			JOIN pg_class rc ON rc.oid = k.confrelid
+			JOIN pg_namespace rn ON rn.oid = rc.relnamespace
+			CROSS JOIN LATERAL unnest(k.conkey, k.confkey) WITH ORDINALITY AS u(attnum, refattnum, pos)
+			JOIN pg_attribute a ON a.attrelid = k.conrelid AND a.attnum = u.attnum
+			JOIN pg_attribute ra ON ra.attrelid = k.confrelid AND ra.attnum = u.refattnum
+			WHERE k.contype = 'f' AND n.nspname IN (%s)
+			ORDER BY n.nspname, c.relname, k.conname, u.pos`,
+		// The type is named as format_type names it on the columns
+		enums: `
+			SELECT n.nspname, format_type(t.oid, NULL), e.enumlabel
+			FROM pg_type t
+			JOIN pg_namespace n ON n.oid = t.typnamespace
+			JOIN pg_enum e ON e.enumtypid = t.oid
+			WHERE n.nspname IN (%s)
+			ORDER BY n.nspname, t.typname, e.enumsortorder`,
+	},
+	// MySQL's schemas are databases. Enum values are read from the column
+	// types, such as enum('a','b').
+	sqlguard.MySQL: {
+		tables: `
+			SELECT TABLE_SCHEMA, TABLE_NAME,
+				CASE WHEN TABLE_TYPE = 'VIEW' THEN 'view' ELSE 'table' END,
+				CASE WHEN TABLE_TYPE <> 'VIEW' THEN TABLE_COMMENT END,
+				CASE WHEN TABLE_TYPE <> 'VIEW' THEN TABLE_ROWS END
+			FROM information_schema.TABLES
+			WHERE TABLE_SCHEMA IN (%s)
+			ORDER BY TABLE_SCHEMA, TABLE_NAME`,
+		columns: `
+			SELECT TABLE_SCHEMA, TABLE_NAME, COLUMN_NAME, COLUMN_TYPE, IS_NULLABLE = 'YES', COLUMN_KEY = 'PRI', COLUMN_COMMENT
+			FROM information_schema.COLUMNS
+			WHERE TABLE_SCHEMA IN (%s)
+			ORDER BY TABLE_SCHEMA, TABLE_NAME, ORDINAL_POSITION`,
+		indexes: `
+			SELECT TABLE_SCHEMA, TABLE_NAME, INDEX_NAME, NON_UNIQUE = 0, INDEX_NAME = 'PRIMARY',
+				COALESCE(COLUMN_NAME, '(expression)')
+			FROM information_schema.STATISTICS
+			WHERE TABLE_SCHEMA IN (%s)
+			ORDER BY TABLE_SCHEMA, TABLE_NAME, INDEX_NAME, SEQ_IN_INDEX`,
+		foreignKeys: `
+			SELECT TABLE_SCHEMA, TABLE_NAME, CONSTRAINT_NAME, COLUMN_NAME,
+				REFERENCED_TABLE_SCHEMA, REFERENCED_TABLE_NAME, REFERENCED_COLUMN_NAME
+			FROM information_schema.KEY_COLUMN_USAGE
+			WHERE TABLE_SCHEMA IN (%s) AND REFERENCED_TABLE_NAME IS NOT NULL
+			ORDER BY TABLE_SCHEMA, TABLE_NAME, CONSTRAINT_NAME, ORDINAL_POSITION`,
+	},
+	sqlguard.MSSQL: {
+		schemas: `
+			SELECT s.name FROM sys.schemas s
+			WHERE EXISTS (
+				SELECT 1 FROM sys.objects o
+				WHERE o.schema_id = s.schema_id AND o.type IN ('U', 'V') AND o.is_ms_shipped = 0
+			)
+			ORDER BY s.name`,
+		// Indexed views are SQL Server's materialized views
+		tables: `
+			SELECT s.name, o.name,
+				CASE
+					WHEN o.type = 'U' THEN 'table'
+					WHEN EXISTS (SELECT 1 FROM sys.indexes i WHERE i.object_id = o.object_id AND i.index_id = 1) THEN 'materialized view'
+					ELSE 'view'
+				END,
+				CAST(ep.value AS nvarchar(max)),
+				(SELECT SUM(p.rows) FROM sys.partitions p WHERE p.object_id = o.object_id AND p.index_id IN (0, 1))
+			FROM sys.objects o
+			JOIN sys.schemas s ON s.schema_id = o.schema_id
+			LEFT JOIN sys.extended_properties ep
+				ON ep.class = 1 AND ep.major_id = o.object_id AND ep.minor_id = 0 AND ep.name = 'MS_Description'
+			WHERE o.type IN ('U', 'V') AND o.is_ms_shipped = 0 AND s.name IN (%s)
+			ORDER BY s.name, o.name`,
+		columns: `
+			SELECT s.name, o.name, c.name,
+				CASE
+					WHEN t.name IN ('char', 'varchar', 'binary', 'varbinary')
+						THEN t.name + '(' + CASE WHEN c.max_length = -1 THEN 'max' ELSE CAST(c.max_length AS varchar(10)) END + ')'
+					WHEN t.name IN ('nchar', 'nvarchar')
+						THEN t.name + '(' + CASE WHEN c.max_length = -1 THEN 'max' ELSE CAST(c.max_length / 2 AS varchar(10)) END + ')'
+					WHEN t.name IN ('decimal', 'numeric')
+						THEN t.name + '(' + CAST(c.precision AS varchar(10)) + ', ' + CAST(c.scale AS varchar(10)) + ')'
+					ELSE t.name
+				END,
+				c.is_nullable,
+				CAST(CASE WHEN EXISTS (
+					SELECT 1 FROM sys.indexes i
+					JOIN sys.index_columns ic ON ic.object_id = i.object_id AND ic.index_id = i.index_id
+					WHERE i.object_id = o.object_id AND i.is_primary_key = 1 AND ic.column_id = c.column_id
+				) THEN 1 ELSE 0 END AS bit),
+				CAST(ep.value AS nvarchar(max))
+			FROM sys.columns c
+			JOIN sys.objects o ON o.object_id = c.object_id
+			JOIN sys.schemas s ON s.schema_id = o.schema_id
+			JOIN sys.types t ON t.user_type_id = c.user_type_id
+			LEFT JOIN sys.extended_properties ep
+				ON ep.class = 1 AND ep.major_id = c.object_id AND ep.minor_id = c.column_id AND ep.name = 'MS_Description'
+			WHERE o.type IN ('U', 'V') AND o.is_ms_shipped = 0 AND s.name IN (%s)
+			ORDER BY s.name, o.name, c.column_id`,
+		// Included columns are left out
+		indexes: `
+			SELECT s.name, o.name, i.name, i.is_unique, i.is_primary_key, c.name
+			FROM sys.indexes i
+			JOIN sys.objects o ON o.object_id = i.object_id
+			JOIN sys.schemas s ON s.schema_id = o.schema_id
+			JOIN sys.index_columns ic ON ic.object_id = i.object_id AND ic.index_id = i.index_id AND ic.key_ordinal > 0
+			JOIN sys.columns c ON c.object_id = ic.object_id AND c.column_id = ic.column_id
+			WHERE o.type IN ('U', 'V') AND o.is_ms_shipped = 0 AND i.name IS NOT NULL AND s.name IN (%s)
+			ORDER BY s.name, o.name, i.name, ic.key_ordinal`,
+		foreignKeys: `
+			SELECT s.name, o.name, fk.name, pc.name, rs.name, ro.name, rc.name
+			FROM sys.foreign_keys fk
+			JOIN sys.foreign_key_columns fkc ON fkc.constraint_object_id = fk.object_id
+			JOIN sys.objects o ON o.object_id = fk.parent_object_id
+			JOIN sys.schemas s ON s.schema_id = o.schema_id
+			JOIN sys.columns pc ON pc.object_id = fkc.parent_object_id AND pc.column_id = fkc.parent_column_id
+			JOIN sys.objects ro ON ro.object_id = fk.referenced_object_id
+			JOIN sys.schemas rs ON rs.schema_id = ro.schema_id
+			JOIN sys.columns rc ON rc.object_id = fkc.referenced_object_id AND rc.column_id = fkc.referenced_column_id
+			WHERE s.name IN (%s)
+			ORDER BY s.name, o.name, fk.name, fkc.constraint_column_id`,
+	},
+	// ClickHouse's schemas are databases. It has no foreign keys; its
+	// indexes are the data skipping indexes, and enum values are read from
+	// the column types, such as Enum8('a' = 1, 'b' = 2).
+	sqlguard.ClickHouse: {
+		tables: `
+			SELECT database, name,
+				multiIf(engine = 'View', 'view', engine = 'MaterializedView', 'materialized view', 'table'),
+				comment, total_rows
+			FROM system.tables
+			WHERE database IN (%s) AND NOT is_temporary
+			ORDER BY database, name`,
+		columns: `
+			SELECT database, table, name, type, startsWith(type, 'Nullable('), is_in_primary_key = 1, comment
+			FROM system.columns
+			WHERE database IN (%s)
+			ORDER BY database, table, position`,
+		indexes: `
+			SELECT database, table, name, false, false, expr
+			FROM system.data_skipping_indices
+			WHERE database IN (%s)
+			ORDER BY database, table, name`,
+	},
+	// SQLite's schemas are the main database and the attached ones. Its
+	// foreign keys have no names, so they are numbered.
+	sqlguard.SQLite: {
+		tables: `
+			SELECT t.schema, t.name, t.type, NULL, NULL
+			FROM pragma_table_list t
+			WHERE t.schema IN (%s) AND t.type IN ('table', 'view') AND t.name NOT LIKE 'sqlite_%%'
+			ORDER BY t.schema, t.name`,
+		columns: `
+			SELECT t.schema, t.name, p.name, p.type, p."notnull" = 0, p.pk > 0, NULL
+			FROM pragma_table_list t
+			JOIN pragma_table_info(t.name, t.schema) p
+			WHERE t.schema IN (%s) AND t.type IN ('table', 'view') AND t.name NOT LIKE 'sqlite_%%'
+			ORDER BY t.schema, t.name, p.cid`,
+		indexes: `
+			SELECT t.schema, t.name, il.name, il."unique", il.origin = 'pk', COALESCE(ii.name, '(expression)')
+			FROM pragma_table_list t
+			JOIN pragma_index_list(t.name, t.schema) il
+			JOIN pragma_index_info(il.name, t.schema) ii
+			WHERE t.schema IN (%s) AND t.type = 'table' AND t.name NOT LIKE 'sqlite_%%'
+			ORDER BY t.schema, t.name, il.name, ii.seqno`,
+		// A reference without columns is to the primary key
+		foreignKeys: `
+			SELECT t.schema, t.name, CAST(f.id AS TEXT), f."from", t.schema, f."table",
+				COALESCE(f."to", (SELECT p.name FROM pragma_table_info(f."table", t.schema) p WHERE p.pk = f.seq + 1), '')
+			FROM pragma_table_list t
+			JOIN pragma_foreign_key_list(t.name, t.schema) f
+			WHERE t.schema IN (%s) AND t.type = 'table' AND t.name NOT LIKE 'sqlite_%%'
+			ORDER BY t.schema, t.name, f.id, f.seq`,
+	},
+	// DuckDB indexes unique and primary keys as constraints, listed with
+	// the indexes. Enum values are read from the column types, such as
+	// ENUM('a', 'b').
+	sqlguard.DuckDB: {
+		schemas: `
+			SELECT schema_name FROM duckdb_schemas()
+			WHERE database_name = COALESCE(NULLIF($1, ''), current_database())
+				AND schema_name NOT IN ('information_schema', 'pg_catalog')
+			ORDER BY schema_name`,
+		tables: `
+			SELECT schema_name, table_name, 'table', comment, estimated_size
+			FROM duckdb_tables()
+			WHERE database_name = COALESCE(NULLIF($1, ''), current_database()) AND schema_name IN (%[1]s)
+			UNION ALL
+			SELECT schema_name, view_name, 'view', comment, NULL
+			FROM duckdb_views()
+			WHERE database_name = COALESCE(NULLIF($1, ''), current_database()) AND schema_name IN (%[1]s) AND NOT internal
+			ORDER BY 1, 2`,
+		columns: `
+			SELECT c.schema_name, c.table_name, c.column_name, c.data_type, c.is_nullable,
+				EXISTS (
+					SELECT 1 FROM duckdb_constraints() k
+					WHERE k.database_name = c.database_name AND k.schema_name = c.schema_name
+						AND k.table_name = c.table_name AND k.constraint_type = 'PRIMARY KEY'
+						AND list_contains(k.constraint_column_names, c.column_name)
+				),
+				c.comment
+			FROM duckdb_columns() c
+			WHERE c.database_name = COALESCE(NULLIF($1, ''), current_database()) AND c.schema_name IN (%[1]s) AND NOT c.internal
+			ORDER BY c.schema_name, c.table_name, c.column_index`,
+		indexes: `
+			SELECT schema_name, table_name, name, is_unique, is_primary, col FROM (
+				SELECT schema_name, table_name, constraint_name AS name, true AS is_unique,
+					constraint_type = 'PRIMARY KEY' AS is_primary,
+					unnest(constraint_column_names) AS col, generate_subscripts(constraint_column_names, 1) AS pos
+				FROM duckdb_constraints()
+				WHERE database_name = COALESCE(NULLIF($1, ''), current_database()) AND schema_name IN (%[1]s)
+					AND constraint_type IN ('PRIMARY KEY', 'UNIQUE')
+				UNION ALL
+				SELECT schema_name, table_name, index_name, is_unique, is_primary,
+					unnest(expressions::VARCHAR[]), generate_subscripts(expressions::VARCHAR[], 1)
+				FROM duckdb_indexes()
+				WHERE database_name = COALESCE(NULLIF($1, ''), current_database()) AND schema_name IN (%[1]s)
+			)
+			ORDER BY schema_name, table_name, name, pos`,
+		// Foreign keys cannot reference another schema
+		foreignKeys: `
+			SELECT schema_name, table_name, name, col, schema_name, referenced_table, ref_col FROM (
+				SELECT schema_name, table_name, constraint_name AS name, referenced_table,
+					unnest(constraint_column_names) AS col, unnest(referenced_column_names) AS ref_col,
+					generate_subscripts(constraint_column_names, 1) AS pos
+				FROM duckdb_constraints()
+				WHERE database_name = COALESCE(NULLIF($1, ''), current_database()) AND schema_name IN (%[1]s)
+					AND constraint_type = 'FOREIGN KEY'
+			)
+			ORDER BY schema_name, table_name, name, pos`,
+	},
+}
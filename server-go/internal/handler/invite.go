@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/magenta9/ai-web-tools/server/internal/auth"
+	"github.com/magenta9/ai-web-tools/server/internal/model"
+)
+
+// CreateInvite issues an invite code. The code is returned only in this
+// response.
+func (h *AdminHandler) CreateInvite(c *gin.Context) {
+	var req model.CreateInviteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"success": false, "error": "max_uses must be between 1 and 10000 and note at most 200 characters"})
+		return
+	}
+	if req.ExpiresAt != nil && req.ExpiresAt.Before(time.Now()) {
+		c.JSON(400, gin.H{"success": false, "error": "expires_at must be in the future"})
+		return
+	}
+	if req.MaxUses == 0 {
+		req.MaxUses = 1
+	}
+
+	secret, _, err := auth.NewOpaqueToken()
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": "failed to generate invite code"})
+		return
+	}
+	code := model.InvitePrefix + secret
+
+	createdBy := c.GetInt("user_id")
+	invite := &model.Invite{
+		Prefix:    code[:len(model.InvitePrefix)+6],
+		CodeHash:  auth.HashToken(code),
+		Note:      req.Note,
+		MaxUses:   req.MaxUses,
+		CreatedBy: &createdBy,
+	}
+	if err := h.repo.CreateInvite(c.Request.Context(), invite, req.ExpiresAt); err != nil {
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+
+	c.JSON(201, gin.H{"success": true, "code": code, "invite": invite})
+}
+
+func (h *AdminHandler) ListInvites(c *gin.Context) {
+	invites, err := h.repo.ListInvites(c.Request.Context())
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true, "invites": invites})
+}
+
+func (h *AdminHandler) RevokeInvite(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || id <= 0 {
+		c.JSON(400, gin.H{"success": false, "error": "invalid id"})
+		return
+	}
+
+	found, err := h.repo.RevokeInvite(c.Request.Context(), id)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+	if !found {
+		c.JSON(404, gin.H{"success": false, "error": "invite not found"})
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true})
+}
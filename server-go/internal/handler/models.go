@@ -4,9 +4,11 @@ import (
 	"encoding/json"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/magenta9/ai-web-tools/server/internal/config"
+	"github.com/magenta9/ai-web-tools/server/internal/llm"
 )
 
 // Model represents a unified model structure
@@ -14,6 +16,7 @@ type Model struct {
 	ID            string `json:"id"`
 	Name          string `json:"name"`
 	Provider      string `json:"provider"`
+	Instance      string `json:"instance"`
 	Description   string `json:"description,omitempty"`
 	ContextLength int    `json:"context_length,omitempty"`
 	Size          int64  `json:"size,omitempty"`
@@ -35,16 +38,16 @@ type ModelInfo struct {
 
 // ModelHandler handles model-related requests
 type ModelHandler struct {
-	cfg          *config.Config
-	ollamaHost   string
+	providers    *llm.Registry
 	modelsConfig *ModelsConfig
+	client       *http.Client
 }
 
 // NewModelHandler creates a new model handler
-func NewModelHandler(cfg *config.Config) *ModelHandler {
+func NewModelHandler(providers *llm.Registry) *ModelHandler {
 	h := &ModelHandler{
-		cfg:        cfg,
-		ollamaHost: cfg.OllamaHost,
+		providers: providers,
+		client:    &http.Client{Timeout: 5 * time.Second},
 	}
 	h.loadModelsConfig()
 	return h
@@ -91,38 +94,11 @@ func (h *ModelHandler) loadModelsConfig() {
 	}
 }
 
-// GetAllModels returns all available models from all providers
+// GetAllModels returns all available models from all provider instances
 func (h *ModelHandler) GetAllModels(c *gin.Context) {
-	var allModels []Model
-
-	// Get Ollama models (dynamic)
-	ollamaModels := h.getOllamaModels()
-	allModels = append(allModels, ollamaModels...)
-
-	// Get OpenAI models (from config)
-	if h.cfg.OpenAIAPIKey != "" {
-		for _, m := range h.modelsConfig.OpenAI {
-			allModels = append(allModels, Model{
-				ID:            m.ID,
-				Name:          m.Name,
-				Provider:      "openai",
-				Description:   m.Description,
-				ContextLength: m.ContextLength,
-			})
-		}
-	}
-
-	// Get Anthropic models (from config)
-	if h.cfg.AnthropicAPIKey != "" {
-		for _, m := range h.modelsConfig.Anthropic {
-			allModels = append(allModels, Model{
-				ID:            m.ID,
-				Name:          m.Name,
-				Provider:      "anthropic",
-				Description:   m.Description,
-				ContextLength: m.ContextLength,
-			})
-		}
+	allModels := []Model{}
+	for _, inst := range h.providers.Instances() {
+		allModels = append(allModels, h.instanceModels(inst)...)
 	}
 
 	c.JSON(200, gin.H{
@@ -131,41 +107,26 @@ func (h *ModelHandler) GetAllModels(c *gin.Context) {
 	})
 }
 
-// GetModelsByProvider returns models for a specific provider
+// GetModelsByProvider returns models for a provider instance, or for every
+// instance of a provider type
 func (h *ModelHandler) GetModelsByProvider(c *gin.Context) {
 	provider := c.Param("provider")
-	var models []Model
-
-	switch provider {
-	case "ollama":
-		models = h.getOllamaModels()
-	case "openai":
-		if h.cfg.OpenAIAPIKey != "" {
-			for _, m := range h.modelsConfig.OpenAI {
-				models = append(models, Model{
-					ID:            m.ID,
-					Name:          m.Name,
-					Provider:      "openai",
-					Description:   m.Description,
-					ContextLength: m.ContextLength,
-				})
-			}
-		}
-	case "anthropic":
-		if h.cfg.AnthropicAPIKey != "" {
-			for _, m := range h.modelsConfig.Anthropic {
-				models = append(models, Model{
-					ID:            m.ID,
-					Name:          m.Name,
-					Provider:      "anthropic",
-					Description:   m.Description,
-					ContextLength: m.ContextLength,
-				})
+	models := []Model{}
+
+	if inst, ok := h.providers.Get(provider); ok {
+		models = h.instanceModels(inst)
+	} else {
+		switch provider {
+		case config.ProviderTypeOllama, config.ProviderTypeOpenAI, config.ProviderTypeAnthropic:
+			for _, inst := range h.providers.Instances() {
+				if inst.Config.Type == provider {
+					models = append(models, h.instanceModels(inst)...)
+				}
 			}
+		default:
+			c.JSON(400, gin.H{"success": false, "error": "Invalid provider"})
+			return
 		}
-	default:
-		c.JSON(400, gin.H{"success": false, "error": "Invalid provider"})
-		return
 	}
 
 	c.JSON(200, gin.H{
@@ -174,9 +135,49 @@ func (h *ModelHandler) GetModelsByProvider(c *gin.Context) {
 	})
 }
 
-// getOllamaModels fetches models from Ollama API
-func (h *ModelHandler) getOllamaModels() []Model {
-	resp, err := http.Get(h.ollamaHost + "/api/tags")
+// instanceModels lists the models served by one provider instance, with
+// IDs namespaced by instance name
+func (h *ModelHandler) instanceModels(inst *llm.Instance) []Model {
+	pc := inst.Config
+
+	var models []Model
+	switch {
+	case pc.Type == config.ProviderTypeOllama:
+		models = h.getOllamaModels(pc.BaseURL)
+	case len(pc.Models) > 0:
+		for _, id := range pc.Models {
+			models = append(models, Model{ID: id, Name: id})
+		}
+	case pc.Type == config.ProviderTypeOpenAI:
+		models = fromModelInfo(h.modelsConfig.OpenAI)
+	case pc.Type == config.ProviderTypeAnthropic:
+		models = fromModelInfo(h.modelsConfig.Anthropic)
+	}
+
+	for i := range models {
+		models[i].ID = llm.ModelID(pc.Name, models[i].ID)
+		models[i].Provider = pc.Type
+		models[i].Instance = pc.Name
+	}
+	return models
+}
+
+func fromModelInfo(infos []ModelInfo) []Model {
+	models := make([]Model, 0, len(infos))
+	for _, m := range infos {
+		models = append(models, Model{
+			ID:            m.ID,
+			Name:          m.Name,
+			Description:   m.Description,
+			ContextLength: m.ContextLength,
+		})
+	}
+	return models
+}
+
+// getOllamaModels fetches models from an Ollama host
+func (h *ModelHandler) getOllamaModels(host string) []Model {
+	resp, err := h.client.Get(host + "/api/tags")
 	if err != nil {
 		return []Model{}
 	}
@@ -189,7 +190,7 @@ func (h *ModelHandler) getOllamaModels() []Model {
 	if modelList, ok := result["models"].([]any); ok {
 		for _, model := range modelList {
 			if mm, ok := model.(map[string]any); ok {
-				m := Model{Provider: "ollama"}
+				m := Model{}
 				if name, ok := mm["name"].(string); ok {
 					m.ID = name
 					m.Name = name
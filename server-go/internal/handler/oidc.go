@@ -0,0 +1,371 @@
+package handler
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/magenta9/ai-web-tools/server/internal/auth"
+	"github.com/magenta9/ai-web-tools/server/internal/config"
+	"github.com/magenta9/ai-web-tools/server/internal/model"
+	"github.com/magenta9/ai-web-tools/server/internal/repository"
+)
+
+// errEmailDomainNotAllowed refuses to provision a user whose verified email
+// is outside the registration email domains
+var errEmailDomainNotAllowed = errors.New("email domain not allowed")
+
+// errSSOSignupClosed refuses to provision a user on first SSO login unless
+// registration is open. An ID token carries no invite code, so invite mode
+// closes SSO sign-up too; such users sign up with an invite and then link
+// their identity.
+var errSSOSignupClosed = errors.New("registration is not open")
+
+// oidcStateMaxAge is how long a user has to complete a login at the provider
+const oidcStateMaxAge = 10 * time.Minute
+
+// oidcStateCookie binds a login or link to the browser that started it, so
+// that an attacker cannot complete their own login in a victim's browser, or
+// link a victim's provider identity to the attacker's account
+const oidcStateCookie = "oidc_state"
+
+// OIDCHandler serves single sign-on with an OpenID Connect provider using
+// the authorization code flow with PKCE
+type OIDCHandler struct {
+	*AuthHandler
+	client *auth.OIDCClient
+}
+
+func NewOIDCHandler(authH *AuthHandler, client *auth.OIDCClient) *OIDCHandler {
+	return &OIDCHandler{AuthHandler: authH, client: client}
+}
+
+// Login redirects the browser to the provider
+func (h *OIDCHandler) Login(c *gin.Context) {
+	authURL, state, err := h.begin(c, nil)
+	if err != nil {
+		log.Printf("OIDC login failed: %v", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Single sign-on is unavailable"})
+		return
+	}
+
+	setOIDCStateCookie(c, state)
+	c.Redirect(http.StatusFound, authURL)
+}
+
+// Link starts linking a provider identity to the signed-in user. It returns
+// the URL to send the browser to; the callback then links the identity
+// instead of logging in. The request must come from the browser that
+// follows the URL, which receives the state cookie.
+func (h *OIDCHandler) Link(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	id := userID.(int)
+	authURL, state, err := h.begin(c, &id)
+	if err != nil {
+		log.Printf("OIDC link failed: %v", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Single sign-on is unavailable"})
+		return
+	}
+
+	setOIDCStateCookie(c, state)
+	c.JSON(http.StatusOK, gin.H{"authorization_url": authURL})
+}
+
+func setOIDCStateCookie(c *gin.Context, state string) {
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcStateCookie, state, int(oidcStateMaxAge.Seconds()), "/api/auth/oidc", "", c.Request.TLS != nil, true)
+}
+
+// begin stores a new login state and returns the provider URL
+func (h *OIDCHandler) begin(c *gin.Context, linkUserID *int) (string, string, error) {
+	state, err := auth.NewNonce()
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := auth.NewNonce()
+	if err != nil {
+		return "", "", err
+	}
+	verifier := auth.NewPKCEVerifier()
+
+	authURL, err := h.client.AuthCodeURL(state, nonce, verifier)
+	if err != nil {
+		return "", "", err
+	}
+
+	err = h.Repo.CreateOIDCState(c.Request.Context(), &model.OIDCLoginState{
+		State:        state,
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+		LinkUserID:   linkUserID,
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return authURL, state, nil
+}
+
+// Callback completes a login or link started by Login or Link
+func (h *OIDCHandler) Callback(c *gin.Context) {
+	if errCode := c.Query("error"); errCode != "" {
+		log.Printf("OIDC provider returned error %s: %s", errCode, c.Query("error_description"))
+		h.finish(c, http.StatusUnauthorized, gin.H{"error": "Sign-in was not completed"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	state, err := h.Repo.ConsumeOIDCState(ctx, c.Query("state"), oidcStateMaxAge)
+	if errors.Is(err, pgx.ErrNoRows) {
+		h.finish(c, http.StatusBadRequest, gin.H{"error": "Sign-in expired, please try again"})
+		return
+	}
+	if err != nil {
+		h.finish(c, http.StatusInternalServerError, gin.H{"error": "Failed to load sign-in state"})
+		return
+	}
+
+	cookie, _ := c.Cookie(oidcStateCookie)
+	c.SetCookie(oidcStateCookie, "", -1, "/api/auth/oidc", "", c.Request.TLS != nil, true)
+	if cookie != state.State {
+		h.finish(c, http.StatusBadRequest, gin.H{"error": "Sign-in was started in another browser"})
+		return
+	}
+
+	claims, err := h.client.Exchange(ctx, c.Query("code"), state.CodeVerifier, state.Nonce)
+	if err != nil {
+		log.Printf("OIDC callback failed: %v", err)
+		h.Audit.Log(c, model.AuditEvent{
+			Action:  model.ActionSSOLogin,
+			Outcome: model.OutcomeFailure,
+			Details: map[string]any{"reason": "verification failed"},
+		})
+		h.finish(c, http.StatusUnauthorized, gin.H{"error": "Sign-in could not be verified"})
+		return
+	}
+
+	identity := &model.Identity{Issuer: claims.Issuer, Subject: claims.Subject, Email: claims.Email}
+
+	if state.LinkUserID != nil {
+		identity.UserID = *state.LinkUserID
+		err := h.Repo.LinkIdentity(ctx, identity)
+		if errors.Is(err, repository.ErrIdentityLinked) {
+			h.finish(c, http.StatusConflict, gin.H{"error": "This identity is already linked to a user"})
+			return
+		}
+		if err != nil {
+			h.finish(c, http.StatusInternalServerError, gin.H{"error": "Failed to link identity"})
+			return
+		}
+		h.finish(c, http.StatusOK, gin.H{"linked": true})
+		return
+	}
+
+	user, err := h.signIn(c, claims, identity)
+	if errors.Is(err, errSSOSignupClosed) {
+		h.Audit.Log(c, model.AuditEvent{
+			Action:     model.ActionSSOLogin,
+			TargetType: "identity",
+			TargetID:   claims.Subject,
+			Outcome:    model.OutcomeDenied,
+			Details:    map[string]any{"reason": "registration " + h.Config.RegistrationMode, "issuer": claims.Issuer},
+		})
+		h.finish(c, http.StatusForbidden, gin.H{"error": "Registration is closed, ask an administrator for an account"})
+		return
+	}
+	if errors.Is(err, errEmailDomainNotAllowed) {
+		h.Audit.Log(c, model.AuditEvent{
+			Action:     model.ActionSSOLogin,
+			TargetType: "identity",
+			TargetID:   claims.Subject,
+			Outcome:    model.OutcomeDenied,
+			Details:    map[string]any{"reason": "email domain not allowed", "issuer": claims.Issuer},
+		})
+		h.finish(c, http.StatusForbidden, gin.H{"error": "Your email domain is not allowed to sign up"})
+		return
+	}
+	if err != nil {
+		log.Printf("OIDC sign-in for %s failed: %v", claims.Subject, err)
+		h.finish(c, http.StatusInternalServerError, gin.H{"error": "Failed to sign in"})
+		return
+	}
+
+	resp, err := h.completeLogin(c, user)
+	if err != nil {
+		h.finish(c, http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+	h.auditUser(c, model.ActionSSOLogin, model.OutcomeSuccess, user.ID, map[string]any{"issuer": claims.Issuer})
+
+	switch r := resp.(type) {
+	case *model.ChallengeResponse:
+		h.finish(c, http.StatusOK, gin.H{
+			"two_factor_required": true,
+			"challenge_token":     r.ChallengeToken,
+			"expires_in":          r.ExpiresIn,
+		})
+	case *model.AuthResponse:
+		h.finish(c, http.StatusOK, gin.H{
+			"token":         r.Token,
+			"refresh_token": r.RefreshToken,
+			"expires_in":    r.ExpiresIn,
+		})
+	}
+}
+
+// signIn returns the user linked to the identity, provisioning one on first
+// login, and applies the group-to-role mapping
+func (h *OIDCHandler) signIn(c *gin.Context, claims *auth.OIDCClaims, identity *model.Identity) (*model.User, error) {
+	ctx := c.Request.Context()
+	role := h.mappedRole(claims.Groups)
+
+	userID, err := h.Repo.TouchIdentity(ctx, identity.Issuer, identity.Subject, identity.Email)
+	if errors.Is(err, pgx.ErrNoRows) {
+		if h.Config.RegistrationMode != config.RegistrationOpen {
+			return nil, errSSOSignupClosed
+		}
+		if len(h.Config.RegistrationEmailDomains) > 0 &&
+			(!claims.EmailVerified || !emailDomainAllowed(h.Config, claims.Email)) {
+			return nil, errEmailDomainNotAllowed
+		}
+		user, err := h.Repo.CreateSSOUser(ctx, ssoUsername(claims), role, identity)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Provisioned user %s (%d) for %s", user.Username, user.ID, identity.Subject)
+		return user, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := h.Repo.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(h.Config.OIDCRoleMapping) > 0 && user.Role != role {
+		err := h.Repo.UpdateUserRole(ctx, user.ID, role)
+		if errors.Is(err, repository.ErrLastAdmin) {
+			log.Printf("Keeping %s as admin: the group mapping would remove the last admin", user.Username)
+		} else if err != nil {
+			return nil, err
+		} else {
+			user.Role = role
+		}
+	}
+	return user, nil
+}
+
+// mappedRole returns the most privileged role mapped from the user's
+// groups, or the default role
+func (h *OIDCHandler) mappedRole(groups []string) string {
+	role := h.Config.OIDCDefaultRole
+	for _, group := range groups {
+		if mapped, ok := h.Config.OIDCRoleMapping[group]; ok && model.MorePrivileged(mapped, role) {
+			role = mapped
+		}
+	}
+	return role
+}
+
+var usernameInvalidChars = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+// ssoUsername derives a username for a provisioned user from the preferred
+// username or email. The repository appends a suffix if it is taken.
+func ssoUsername(claims *auth.OIDCClaims) string {
+	name := claims.PreferredUsername
+	if name == "" {
+		name, _, _ = strings.Cut(claims.Email, "@")
+	}
+	name = usernameInvalidChars.ReplaceAllString(name, "")
+	if len(name) > 40 {
+		name = name[:40]
+	}
+	if len(name) < 3 {
+		name = "sso-user"
+	}
+	return name
+}
+
+// finish ends a callback. Browsers are redirected to the configured frontend
+// page with the result in the URL fragment, which is never sent to servers;
+// without one the result is returned as JSON.
+func (h *OIDCHandler) finish(c *gin.Context, code int, result gin.H) {
+	if h.Config.OIDCPostLoginURL == "" {
+		c.JSON(code, result)
+		return
+	}
+
+	fragment := url.Values{}
+	for k, v := range result {
+		switch v := v.(type) {
+		case string:
+			fragment.Set(k, v)
+		case int:
+			fragment.Set(k, strconv.Itoa(v))
+		case bool:
+			fragment.Set(k, strconv.FormatBool(v))
+		}
+	}
+	c.Redirect(http.StatusFound, h.Config.OIDCPostLoginURL+"#"+fragment.Encode())
+}
+
+// ListIdentities lists the provider identities linked to the current user
+func (h *OIDCHandler) ListIdentities(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	identities, err := h.Repo.ListIdentities(c.Request.Context(), userID.(int))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list identities"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"identities": identities})
+}
+
+// Unlink removes a linked identity
+func (h *OIDCHandler) Unlink(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || id <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+
+	found, err := h.Repo.DeleteIdentity(c.Request.Context(), id, userID.(int))
+	if errors.Is(err, repository.ErrLastLoginMethod) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unlink identity"})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Identity not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
@@ -0,0 +1,386 @@
+package handler
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/magenta9/ai-web-tools/server/internal/auth"
+	"github.com/magenta9/ai-web-tools/server/internal/config"
+	"github.com/magenta9/ai-web-tools/server/internal/model"
+	"github.com/magenta9/ai-web-tools/server/internal/repository"
+)
+
+// mockOIDCProvider is an OpenID Connect provider serving discovery, a JWKS
+// and a token endpoint that issues RS256 ID tokens. The browser's visit to
+// the authorization endpoint is played by authorize.
+type mockOIDCProvider struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]mockOIDCGrant
+}
+
+// mockOIDCGrant is an authorization code and what the token request must
+// present for it
+type mockOIDCGrant struct {
+	challenge string
+	claims    jwt.MapClaims
+}
+
+const mockOIDCClientID = "web-tools"
+
+func newMockOIDCProvider(t *testing.T) *mockOIDCProvider {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &mockOIDCProvider{key: key, codes: map[string]mockOIDCGrant{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeMockJSON(w, http.StatusOK, map[string]any{
+			"issuer":                                p.URL,
+			"authorization_endpoint":                p.URL + "/authorize",
+			"token_endpoint":                        p.URL + "/token",
+			"jwks_uri":                              p.URL + "/jwks",
+			"response_types_supported":              []string{"code"},
+			"subject_types_supported":               []string{"public"},
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		writeMockJSON(w, http.StatusOK, auth.JWKS{Keys: []auth.JWK{{
+			Kty: "RSA",
+			Kid: "mock",
+			Alg: "RS256",
+			Use: "sig",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", p.token)
+
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+// authorize signs the subject in at the provider for the authorization URL
+// and returns the code the provider would redirect back with
+func (p *mockOIDCProvider) authorize(t *testing.T, authURL, subject, email string) string {
+	t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if q.Get("client_id") != mockOIDCClientID || q.Get("code_challenge_method") != "S256" {
+		t.Fatalf("unexpected authorization URL %s", authURL)
+	}
+
+	code := fmt.Sprintf("code-%d", time.Now().UnixNano())
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.codes[code] = mockOIDCGrant{
+		challenge: q.Get("code_challenge"),
+		claims: jwt.MapClaims{
+			"iss":            p.URL,
+			"aud":            mockOIDCClientID,
+			"sub":            subject,
+			"email":          email,
+			"email_verified": true,
+			"nonce":          q.Get("nonce"),
+			"iat":            time.Now().Unix(),
+			"exp":            time.Now().Add(time.Minute).Unix(),
+		},
+	}
+	return code
+}
+
+// token redeems a code once, checking the PKCE verifier
+func (p *mockOIDCProvider) token(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	grant, ok := p.codes[r.PostFormValue("code")]
+	delete(p.codes, r.PostFormValue("code"))
+	p.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != grant.challenge {
+		writeMockJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, grant.claims)
+	token.Header["kid"] = "mock"
+	idToken, err := token.SignedString(p.key)
+	if err != nil {
+		writeMockJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeMockJSON(w, http.StatusOK, map[string]any{
+		"access_token": "mock-access-token",
+		"token_type":   "Bearer",
+		"expires_in":   60,
+		"id_token":     idToken,
+	})
+}
+
+func writeMockJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (p *mockOIDCProvider) config() *config.Config {
+	return &config.Config{
+		OIDCIssuer:       p.URL,
+		OIDCClientID:     mockOIDCClientID,
+		OIDCRedirectURL:  "http://localhost/api/auth/oidc/callback",
+		OIDCScopes:       []string{"openid", "email"},
+		OIDCGroupsClaim:  "groups",
+		OIDCDefaultRole:  model.RoleMember,
+		RegistrationMode: config.RegistrationOpen,
+		JWTSecret:        "test-secret-test-secret-test-secret",
+		AccessTokenTTL:   time.Minute,
+	}
+}
+
+func TestOIDCClientExchange(t *testing.T) {
+	p := newMockOIDCProvider(t)
+	client := auth.NewOIDCClient(p.config())
+	ctx := context.Background()
+
+	start := func() (string, string) {
+		verifier := auth.NewPKCEVerifier()
+		authURL, err := client.AuthCodeURL("state", "nonce", verifier)
+		if err != nil {
+			t.Fatalf("AuthCodeURL: %v", err)
+		}
+		return p.authorize(t, authURL, "alice-sub", "alice@example.com"), verifier
+	}
+
+	code, verifier := start()
+	claims, err := client.Exchange(ctx, code, verifier, "nonce")
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if claims.Issuer != p.URL || claims.Subject != "alice-sub" || claims.Email != "alice@example.com" || !claims.EmailVerified {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+
+	code, verifier = start()
+	if _, err := client.Exchange(ctx, code, verifier, "other nonce"); err == nil {
+		t.Error("Exchange accepted an ID token with another nonce")
+	}
+	code, _ = start()
+	if _, err := client.Exchange(ctx, code, auth.NewPKCEVerifier(), "nonce"); err == nil {
+		t.Error("Exchange succeeded with another PKCE verifier")
+	}
+}
+
+// oidcTestRouter serves the OIDC routes under their real paths, which the
+// state cookie is scoped to
+func oidcTestRouter(t *testing.T, repo *repository.Repository, p *mockOIDCProvider) (*gin.Engine, *OIDCHandler) {
+	t.Helper()
+	cfg := p.config()
+	tokens, err := auth.NewTokenManager(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewOIDCHandler(NewAuthHandler(repo, cfg, tokens, nil, nil, nil), auth.NewOIDCClient(cfg))
+
+	r := testRouter()
+	r.GET("/api/auth/oidc/login", h.Login)
+	r.GET("/api/auth/oidc/callback", h.Callback)
+	r.POST("/api/auth/oidc/link", h.Link)
+	return r, h
+}
+
+// oidcRequest sends a request as the user, or signed out when user is nil,
+// with the state cookie when one is given
+func oidcRequest(r http.Handler, user *model.User, method, target string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	if user != nil {
+		req.Header.Set(testUserHeader, strconv.Itoa(user.ID))
+	}
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func stateCookie(t *testing.T, w *httptest.ResponseRecorder) *http.Cookie {
+	t.Helper()
+	for _, c := range w.Result().Cookies() {
+		if c.Name == oidcStateCookie && c.Value != "" {
+			if c.Path != "/api/auth/oidc" || !c.HttpOnly {
+				t.Errorf("state cookie is not HttpOnly on /api/auth/oidc: %+v", c)
+			}
+			return c
+		}
+	}
+	t.Fatalf("no %s cookie in response %d %s", oidcStateCookie, w.Code, w.Body.String())
+	return nil
+}
+
+func callbackURL(t *testing.T, authURL, code string) string {
+	t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "/api/auth/oidc/callback?" + url.Values{"state": {u.Query().Get("state")}, "code": {code}}.Encode()
+}
+
+// An attacker who starts a link and sends the victim the authorization URL
+// must not end up with the victim's identity linked to their account
+func TestOIDCLinkRequiresStateCookie(t *testing.T) {
+	repo := testRepository(t)
+	p := newMockOIDCProvider(t)
+	r, _ := oidcTestRouter(t, repo, p)
+	attacker := testUser(t, repo)
+	subject := fmt.Sprintf("victim-%d", time.Now().UnixNano())
+
+	link := func() (string, *http.Cookie) {
+		w := oidcRequest(r, attacker, "POST", "/api/auth/oidc/link", nil)
+		var resp map[string]string
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("link: %d %s", w.Code, w.Body.String())
+		}
+		return resp["authorization_url"], stateCookie(t, w)
+	}
+
+	// The victim's browser completes the attacker's link without the cookie
+	authURL, _ := link()
+	code := p.authorize(t, authURL, subject, "victim@example.com")
+	if w := oidcRequest(r, nil, "GET", callbackURL(t, authURL, code), nil); w.Code != http.StatusBadRequest {
+		t.Errorf("callback without state cookie = %d %s, want 400", w.Code, w.Body.String())
+	}
+	identities, err := repo.ListIdentities(context.Background(), attacker.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(identities) != 0 {
+		t.Fatalf("identity linked without the state cookie: %+v", identities)
+	}
+
+	// The cookie of another link does not help either
+	authURL, _ = link()
+	_, otherCookie := link()
+	code = p.authorize(t, authURL, subject, "victim@example.com")
+	if w := oidcRequest(r, nil, "GET", callbackURL(t, authURL, code), otherCookie); w.Code != http.StatusBadRequest {
+		t.Errorf("callback with another link's state cookie = %d %s, want 400", w.Code, w.Body.String())
+	}
+
+	// The browser that started the link completes it
+	authURL, cookie := link()
+	code = p.authorize(t, authURL, subject, "victim@example.com")
+	if w := oidcRequest(r, nil, "GET", callbackURL(t, authURL, code), cookie); w.Code != http.StatusOK {
+		t.Fatalf("callback with state cookie = %d %s, want 200", w.Code, w.Body.String())
+	}
+	identities, err = repo.ListIdentities(context.Background(), attacker.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(identities) != 1 || identities[0].Subject != subject || identities[0].Issuer != p.URL {
+		t.Errorf("linked identities = %+v, want %s", identities, subject)
+	}
+}
+
+func TestOIDCLoginRequiresStateCookie(t *testing.T) {
+	repo := testRepository(t)
+	p := newMockOIDCProvider(t)
+	r, h := oidcTestRouter(t, repo, p)
+	subject := fmt.Sprintf("sso-%d", time.Now().UnixNano())
+
+	login := func() (string, *http.Cookie) {
+		w := oidcRequest(r, nil, "GET", "/api/auth/oidc/login", nil)
+		if w.Code != http.StatusFound {
+			t.Fatalf("login: %d %s", w.Code, w.Body.String())
+		}
+		return w.Header().Get("Location"), stateCookie(t, w)
+	}
+
+	authURL, _ := login()
+	code := p.authorize(t, authURL, subject, "sso@example.com")
+	if w := oidcRequest(r, nil, "GET", callbackURL(t, authURL, code), nil); w.Code != http.StatusBadRequest {
+		t.Errorf("callback without state cookie = %d %s, want 400", w.Code, w.Body.String())
+	}
+
+	authURL, cookie := login()
+	code = p.authorize(t, authURL, subject, "sso@example.com")
+	w := oidcRequest(r, nil, "GET", callbackURL(t, authURL, code), cookie)
+	if w.Code != http.StatusOK {
+		t.Fatalf("callback with state cookie = %d %s, want 200", w.Code, w.Body.String())
+	}
+	var resp map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	claims, err := h.Tokens.Parse(fmt.Sprint(resp["token"]))
+	if err != nil {
+		t.Fatalf("parse access token: %v", err)
+	}
+	userID, _ := strconv.Atoi(fmt.Sprint(claims["sub"]))
+	t.Cleanup(func() {
+		if err := repo.DeleteUser(context.Background(), userID); err != nil {
+			t.Errorf("delete user %d: %v", userID, err)
+		}
+	})
+
+	// The code was redeemed once and the state consumed, so a replay fails
+	if w := oidcRequest(r, nil, "GET", callbackURL(t, authURL, code), cookie); w.Code != http.StatusBadRequest {
+		t.Errorf("replayed callback = %d %s, want 400", w.Code, w.Body.String())
+	}
+}
+
+// Single sign-on only provisions users when registration is open; existing
+// identities still sign in
+func TestOIDCSignupFollowsRegistrationMode(t *testing.T) {
+	repo := testRepository(t)
+	p := newMockOIDCProvider(t)
+	r, h := oidcTestRouter(t, repo, p)
+	linked := testUser(t, repo)
+	linkedSubject := fmt.Sprintf("linked-%d", time.Now().UnixNano())
+	if err := repo.LinkIdentity(context.Background(), &model.Identity{
+		UserID: linked.ID, Issuer: p.URL, Subject: linkedSubject,
+	}); err != nil {
+		t.Fatalf("link identity: %v", err)
+	}
+
+	signIn := func(subject string) int {
+		w := oidcRequest(r, nil, "GET", "/api/auth/oidc/login", nil)
+		authURL := w.Header().Get("Location")
+		code := p.authorize(t, authURL, subject, subject+"@example.com")
+		return oidcRequest(r, nil, "GET", callbackURL(t, authURL, code), stateCookie(t, w)).Code
+	}
+
+	for _, mode := range []string{config.RegistrationInvite, config.RegistrationClosed} {
+		h.Config.RegistrationMode = mode
+		if code := signIn(fmt.Sprintf("new-%s-%d", mode, time.Now().UnixNano())); code != http.StatusForbidden {
+			t.Errorf("%s: new identity signed in with %d, want 403", mode, code)
+		}
+		if code := signIn(linkedSubject); code != http.StatusOK {
+			t.Errorf("%s: linked identity signed in with %d, want 200", mode, code)
+		}
+	}
+}
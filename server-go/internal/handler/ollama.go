@@ -11,14 +11,21 @@ import (
 )
 
 type OllamaHandler struct {
-	host     string
-	provider llm.LLMProvider
+	host      string
+	providers *llm.Registry
 }
 
-func NewOllamaHandler(cfg *config.Config) *OllamaHandler {
+func NewOllamaHandler(cfg *config.Config, providers *llm.Registry) *OllamaHandler {
+	host := cfg.OllamaHost
+	for _, inst := range providers.Instances() {
+		if inst.Config.Type == config.ProviderTypeOllama {
+			host = inst.Config.BaseURL
+			break
+		}
+	}
 	return &OllamaHandler{
-		host:     cfg.OllamaHost,
-		provider: llm.NewProvider(cfg),
+		host:      host,
+		providers: providers,
 	}
 }
 
@@ -61,6 +68,17 @@ func (h *OllamaHandler) GetModels(c *gin.Context) {
 	c.JSON(200, gin.H{"success": true, "models": models})
 }
 
+// sqlDialects name the SQL dialect of each database type in the Generate
+// prompt, with hints on its syntax. Unknown types are treated as MySQL.
+var sqlDialects = map[string]struct{ name, hint string }{
+	"mysql":      {"MySQL", ""},
+	"postgres":   {"PostgreSQL", " Use PostgreSQL syntax (e.g., SERIAL for auto-increment, $1 for parameters if needed)."},
+	"sqlite":     {"SQLite", " Use SQLite syntax (e.g., || to concatenate strings, date(), datetime() and strftime() for dates, no ILIKE; types are loose, so cast when comparing numbers stored as text)."},
+	"duckdb":     {"DuckDB", " Use DuckDB syntax (e.g., ILIKE, date_trunc(), list and struct functions, QUALIFY to filter window results). Parquet, CSV and JSON files are loaded as tables named after the file; query those tables instead of read_csv or read_parquet, which are disabled."},
+	"mssql":      {"Microsoft SQL Server", " Use T-SQL syntax (e.g., TOP (n) or ORDER BY ... OFFSET ... FETCH NEXT instead of LIMIT, square brackets for identifiers, GETDATE(), DATEADD() and DATEDIFF() for dates, CONCAT() or + for strings). Write a single SELECT without DECLARE, SET or EXEC."},
+	"clickhouse": {"ClickHouse", " Use ClickHouse syntax (e.g., toStartOfDay(), toStartOfMonth() and now() for dates, countIf() and sumIf() for conditional aggregates, uniq() for approximate distinct counts, arrayJoin() to unnest arrays). Prefer JOINs to correlated subqueries, and do not use table functions such as url, s3, file or remote, which are disabled."},
+}
+
 func (h *OllamaHandler) Generate(c *gin.Context) {
 	var req struct {
 		Prompt string `json:"prompt"`
@@ -73,40 +91,30 @@ func (h *OllamaHandler) Generate(c *gin.Context) {
 		return
 	}
 
-	dbType := req.DbType
-	if dbType == "" {
-		dbType = "mysql"
+	dialect, ok := sqlDialects[req.DbType]
+	if !ok {
+		dialect = sqlDialects["mysql"]
 	}
 
 	fullPrompt := req.Prompt
 	if req.Schema != "" {
-		if dbType == "postgres" {
-			fullPrompt = fmt.Sprintf(`You are a PostgreSQL expert. Based on the following database schema, write a PostgreSQL query for the request.
-
-Database Schema:
-%s
-
-Request: %s
-
-Write only the SQL query, nothing else. Do not include markdown code blocks. Use PostgreSQL syntax (e.g., SERIAL for auto-increment, $1 for parameters if needed).`, req.Schema, req.Prompt)
-		} else {
-			fullPrompt = fmt.Sprintf(`You are a MySQL expert. Based on the following database schema, write a MySQL query for the request.
+		fullPrompt = fmt.Sprintf(`You are a %s expert. Based on the following database schema, write a %s query for the request.
 
 Database Schema:
 %s
 
 Request: %s
 
-Write only the SQL query, nothing else. Do not include markdown code blocks.`, req.Schema, req.Prompt)
-		}
+Write only the SQL query, nothing else. Do not include markdown code blocks.%s`, dialect.name, dialect.name, req.Schema, req.Prompt, dialect.hint)
 	}
 
-	model := req.Model
-	if model == "" {
-		model = "claude-3-5-sonnet-20241022"
+	provider, model, err := h.providers.Resolve(req.Model)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		return
 	}
 
-	result, err := h.provider.Generate(fullPrompt, model)
+	result, err := provider.Generate(fullPrompt, model)
 	if err != nil {
 		c.JSON(500, gin.H{"success": false, "error": err.Error()})
 		return
@@ -131,9 +139,10 @@ func (h *OllamaHandler) Chat(c *gin.Context) {
 		return
 	}
 
-	model := req.Model
-	if model == "" {
-		model = "claude-3-5-sonnet-20241022"
+	provider, model, err := h.providers.Resolve(req.Model)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		return
 	}
 
 	// Build messages array
@@ -175,7 +184,7 @@ func (h *OllamaHandler) Chat(c *gin.Context) {
 		}
 		
 		// 调用流式聊天
-		err := h.provider.ChatStream(messages, model, callback)
+		err := provider.ChatStream(messages, model, callback)
 		if err != nil {
 			// 发送错误信息
 			c.Writer.WriteString("data: [ERROR] " + err.Error() + "\n")
@@ -190,7 +199,7 @@ func (h *OllamaHandler) Chat(c *gin.Context) {
 	}
 
 	// Non-streaming response
-	result, err := h.provider.Chat(messages, model)
+	result, err := provider.Chat(messages, model)
 	if err != nil {
 		c.JSON(500, gin.H{"success": false, "error": err.Error()})
 		return
@@ -246,12 +255,13 @@ Text: %s
 
 Translation:`, srcLang, tgtLang, styleInstr, req.Text)
 
-	model := req.Model
-	if model == "" {
-		model = "claude-3-5-sonnet-20241022"
+	provider, model, err := h.providers.Resolve(req.Model)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		return
 	}
 
-	result, err := h.provider.Generate(prompt, model)
+	result, err := provider.Generate(prompt, model)
 	if err != nil {
 		c.JSON(500, gin.H{"success": false, "error": err.Error()})
 		return
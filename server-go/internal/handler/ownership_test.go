@@ -0,0 +1,167 @@
+package handler
+
+import (
+	"fmt"
+	"testing"
+)
+
+// Another user's prompts, history and chat sessions are reported as not
+// found, so their IDs cannot be probed.
+func TestPromptOwnership(t *testing.T) {
+	repo := testRepository(t)
+	alice, bob := testUser(t, repo), testUser(t, repo)
+
+	h := NewPromptHandler(repo, nil)
+	r := testRouter()
+	r.POST("/prompts", h.Create)
+	r.GET("/prompts", h.List)
+	r.GET("/prompts/:id", h.Get)
+	r.PUT("/prompts/:id", h.Update)
+	r.DELETE("/prompts/:id", h.Delete)
+	r.POST("/prompts/:id/use", h.IncrementUse)
+
+	create := func(visibility string) string {
+		code, resp := doJSON(t, r, alice, "POST", "/prompts", map[string]any{
+			"title": "Alice's " + visibility + " prompt", "content": "secret", "visibility": visibility,
+		})
+		if code != 200 {
+			t.Fatalf("create %s prompt: %d %v", visibility, code, resp)
+		}
+		return fmt.Sprint(resp["prompt"].(map[string]any)["id"])
+	}
+	private, team := create("private"), create("team")
+	update := map[string]any{"title": "taken", "content": "over", "visibility": "public"}
+
+	for _, tt := range []struct {
+		method, path string
+		body         any
+		want         int
+	}{
+		{"GET", "/prompts/" + private, nil, 404},
+		{"PUT", "/prompts/" + private, update, 404},
+		{"POST", "/prompts/" + private + "/use", nil, 404},
+		{"DELETE", "/prompts/" + private, nil, 404},
+		// Team prompts can be read by other users but not changed
+		{"GET", "/prompts/" + team, nil, 200},
+		{"PUT", "/prompts/" + team, update, 404},
+		{"DELETE", "/prompts/" + team, nil, 404},
+	} {
+		if code, resp := doJSON(t, r, bob, tt.method, tt.path, tt.body); code != tt.want {
+			t.Errorf("bob %s %s = %d %v, want %d", tt.method, tt.path, code, resp, tt.want)
+		}
+	}
+
+	_, resp := doJSON(t, r, bob, "GET", "/prompts", nil)
+	prompts, _ := resp["prompts"].([]any)
+	for _, p := range prompts {
+		if id := fmt.Sprint(p.(map[string]any)["id"]); id == private {
+			t.Errorf("bob's prompt list includes alice's private prompt %s", id)
+		}
+	}
+
+	// The prompts are unchanged for their owner
+	for _, id := range []string{private, team} {
+		code, resp := doJSON(t, r, alice, "GET", "/prompts/"+id, nil)
+		if code != 200 {
+			t.Fatalf("alice GET /prompts/%s = %d %v", id, code, resp)
+		}
+		if title := resp["prompt"].(map[string]any)["title"]; title == "taken" {
+			t.Errorf("prompt %s was updated by bob", id)
+		}
+	}
+	if code, resp := doJSON(t, r, alice, "DELETE", "/prompts/"+private, nil); code != 200 {
+		t.Errorf("alice DELETE /prompts/%s = %d %v", private, code, resp)
+	}
+}
+
+func TestHistoryOwnership(t *testing.T) {
+	repo := testRepository(t)
+	alice, bob := testUser(t, repo), testUser(t, repo)
+
+	h := NewHistoryHandler(repo, nil)
+	r := testRouter()
+	r.POST("/history", h.Save)
+	r.GET("/history", h.Get)
+	r.DELETE("/history/:id", h.Delete)
+	r.DELETE("/history", h.Clear)
+
+	if code, resp := doJSON(t, r, alice, "POST", "/history", map[string]any{
+		"tool_name": "json", "input_data": "alice's input", "output_data": "alice's output",
+	}); code != 200 {
+		t.Fatalf("save history: %d %v", code, resp)
+	}
+	_, resp := doJSON(t, r, alice, "GET", "/history?tool_name=json", nil)
+	items := resp["history"].([]any)
+	if len(items) != 1 {
+		t.Fatalf("alice has %d history items, want 1", len(items))
+	}
+	id := fmt.Sprint(items[0].(map[string]any)["id"])
+
+	_, resp = doJSON(t, r, bob, "GET", "/history?tool_name=json", nil)
+	if items, _ := resp["history"].([]any); len(items) != 0 {
+		t.Errorf("bob's history includes %d of alice's items", len(items))
+	}
+	if code, resp := doJSON(t, r, bob, "DELETE", "/history/"+id, nil); code != 404 {
+		t.Errorf("bob DELETE /history/%s = %d %v, want 404", id, code, resp)
+	}
+	if code, resp := doJSON(t, r, bob, "DELETE", "/history?tool_name=json", nil); code != 200 {
+		t.Errorf("bob clearing their own history = %d %v", code, resp)
+	}
+
+	_, resp = doJSON(t, r, alice, "GET", "/history?tool_name=json", nil)
+	if items := resp["history"].([]any); len(items) != 1 {
+		t.Errorf("alice has %d history items after bob's deletes, want 1", len(items))
+	}
+	if code, resp := doJSON(t, r, alice, "DELETE", "/history/"+id, nil); code != 200 {
+		t.Errorf("alice DELETE /history/%s = %d %v", id, code, resp)
+	}
+}
+
+func TestChatSessionOwnership(t *testing.T) {
+	repo := testRepository(t)
+	alice, bob := testUser(t, repo), testUser(t, repo)
+
+	h := NewChatHandler(repo)
+	r := testRouter()
+	r.POST("/chat/sessions", h.Create)
+	r.GET("/chat/sessions", h.List)
+	r.GET("/chat/sessions/:id", h.Get)
+	r.POST("/chat/sessions/:id/messages", h.AddMessages)
+	r.DELETE("/chat/sessions/:id", h.Delete)
+
+	code, resp := doJSON(t, r, alice, "POST", "/chat/sessions", map[string]any{
+		"title": "Alice's chat", "model": "ollama/llama3.2",
+		"messages": []map[string]any{{"role": "user", "content": "hello"}},
+	})
+	if code != 201 {
+		t.Fatalf("create session: %d %v", code, resp)
+	}
+	id := fmt.Sprint(resp["session"].(map[string]any)["id"])
+	messages := map[string]any{"messages": []map[string]any{{"role": "user", "content": "injected"}}}
+
+	for _, tt := range []struct {
+		method, path string
+		body         any
+	}{
+		{"GET", "/chat/sessions/" + id, nil},
+		{"POST", "/chat/sessions/" + id + "/messages", messages},
+		{"DELETE", "/chat/sessions/" + id, nil},
+	} {
+		if code, resp := doJSON(t, r, bob, tt.method, tt.path, tt.body); code != 404 {
+			t.Errorf("bob %s %s = %d %v, want 404", tt.method, tt.path, code, resp)
+		}
+	}
+
+	_, resp = doJSON(t, r, bob, "GET", "/chat/sessions", nil)
+	if sessions, _ := resp["sessions"].([]any); len(sessions) != 0 {
+		t.Errorf("bob's session list includes %d of alice's sessions", len(sessions))
+	}
+
+	code, resp = doJSON(t, r, alice, "GET", "/chat/sessions/"+id, nil)
+	if code != 200 {
+		t.Fatalf("alice GET /chat/sessions/%s = %d %v", id, code, resp)
+	}
+	if got := resp["session"].(map[string]any)["messages"].([]any); len(got) != 1 {
+		t.Errorf("alice's session has %d messages, want 1", len(got))
+	}
+}
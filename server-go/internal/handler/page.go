@@ -0,0 +1,254 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/magenta9/ai-web-tools/server/internal/sqlguard"
+)
+
+// pageToken is the position after a page of query results. Clients get it
+// as opaque base64url JSON. It is bound to its query, so it cannot be used
+// to page through a different one.
+type pageToken struct {
+	Query string `json:"q"`
+	// Offset counts the rows before the page in offset pagination
+	Offset int `json:"o,omitempty"`
+	// After holds the keyset values of the last row in keyset pagination
+	After []string `json:"a,omitempty"`
+	// Types holds the types of the keyset columns for DuckDB and
+	// ClickHouse, which do not compare text with other types
+	Types []string `json:"t,omitempty"`
+}
+
+var errInvalidPageToken = errors.New("invalid page_token")
+
+// pageQueryHash identifies the query and keyset a page token belongs to
+func pageQueryHash(query string, keyset []string) string {
+	sum := sha256.Sum256([]byte(query + "\x00" + strings.Join(keyset, "\x00")))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (t *pageToken) encode() string {
+	b, _ := json.Marshal(t)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodePageToken parses a token for the query with the given hash. An
+// empty token is the first page.
+func decodePageToken(s, queryHash string, keyset []string) (*pageToken, error) {
+	t := &pageToken{Query: queryHash}
+	if s == "" {
+		return t, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || json.Unmarshal(b, t) != nil || t.Query != queryHash || t.Offset < 0 {
+		return nil, errInvalidPageToken
+	}
+	if len(keyset) > 0 && len(t.After) != len(keyset) {
+		return nil, errInvalidPageToken
+	}
+	if len(t.Types) > 0 && len(t.Types) != len(keyset) {
+		return nil, errInvalidPageToken
+	}
+	for _, typ := range t.Types {
+		if !castTypePattern.MatchString(typ) {
+			return nil, errInvalidPageToken
+		}
+	}
+	return t, nil
+}
+
+// castTypePattern matches scalar type names such as DuckDB's DOUBLE,
+// DECIMAL(18,3) or TIMESTAMP WITH TIME ZONE, or ClickHouse's UInt64
+var castTypePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_ ]*(\([0-9]+(, ?[0-9]+)?\))?$`)
+
+var identifierPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// pageQuery wraps query as a derived table that returns the page after t,
+// plus one row to tell whether another page follows. With a keyset the
+// rows are ordered by those columns, which must be unique and not null
+// together; otherwise the query's own order is kept, and it should be
+// deterministic for pages to be stable.
+func pageQuery(query string, d sqlguard.Dialect, keyset []string, t *pageToken, size int) (string, []any, error) {
+	sub, ok := sqlguard.Subquery(query, d)
+	if !ok {
+		return "", nil, errors.New("only SELECT, WITH, VALUES and TABLE queries can be paginated")
+	}
+	// The newline ends a trailing line comment
+	wrapped := "SELECT * FROM (\n" + sub + "\n) AS page_query"
+
+	if len(keyset) == 0 {
+		if d == sqlguard.MSSQL {
+			return fmt.Sprintf("%s ORDER BY (SELECT NULL) OFFSET %d ROWS FETCH NEXT %d ROWS ONLY", wrapped, t.Offset, size+1), nil, nil
+		}
+		return fmt.Sprintf("%s LIMIT %d OFFSET %d", wrapped, size+1, t.Offset), nil, nil
+	}
+
+	cols := make([]string, len(keyset))
+	params := make([]string, len(keyset))
+	for i, name := range keyset {
+		if !identifierPattern.MatchString(name) {
+			return "", nil, fmt.Errorf("invalid keyset column %q", name)
+		}
+		switch d {
+		case sqlguard.MySQL:
+			cols[i] = "`" + name + "`"
+			params[i] = "?"
+		case sqlguard.SQLite:
+			cols[i] = `"` + name + `"`
+			params[i] = "?"
+		case sqlguard.DuckDB:
+			cols[i] = `"` + name + `"`
+			params[i] = "$" + strconv.Itoa(i+1)
+			if t.Types != nil {
+				params[i] = fmt.Sprintf("CAST(%s AS %s)", params[i], t.Types[i])
+			}
+		case sqlguard.MSSQL:
+			cols[i] = "[" + name + "]"
+			params[i] = "@p" + strconv.Itoa(i+1)
+		case sqlguard.ClickHouse:
+			// The driver binds parameters by searching the whole query for
+			// placeholders, including the user's string literals, so the
+			// values are written as literals instead
+			cols[i] = "`" + name + "`"
+			if t.After != nil && t.Types != nil {
+				params[i] = fmt.Sprintf("CAST('%s' AS %s)", clickhouseStringEscaper.Replace(t.After[i]), clickhouseCastType(t.Types[i]))
+			}
+		default:
+			cols[i] = `"` + name + `"`
+			params[i] = "$" + strconv.Itoa(i+1)
+		}
+	}
+	var args []any
+	if t.After != nil {
+		if d == sqlguard.MSSQL {
+			wrapped += " WHERE " + rowAfter(cols, params)
+		} else {
+			wrapped += fmt.Sprintf(" WHERE (%s) > (%s)", strings.Join(cols, ", "), strings.Join(params, ", "))
+		}
+		if d != sqlguard.ClickHouse {
+			for _, v := range t.After {
+				args = append(args, v)
+			}
+		}
+	}
+	if d == sqlguard.MSSQL {
+		return fmt.Sprintf("%s ORDER BY %s OFFSET 0 ROWS FETCH NEXT %d ROWS ONLY", wrapped, strings.Join(cols, ", "), size+1), args, nil
+	}
+	return fmt.Sprintf("%s ORDER BY %s LIMIT %d", wrapped, strings.Join(cols, ", "), size+1), args, nil
+}
+
+// rowAfter compares cols with params column by column, for T-SQL, which
+// has no row value comparisons: a > x OR a = x AND (b > y OR ...)
+func rowAfter(cols, params []string) string {
+	cond := fmt.Sprintf("%s > %s", cols[len(cols)-1], params[len(params)-1])
+	for i := len(cols) - 2; i >= 0; i-- {
+		cond = fmt.Sprintf("%s > %s OR %s = %s AND (%s)", cols[i], params[i], cols[i], params[i], cond)
+	}
+	return "(" + cond + ")"
+}
+
+// clickhouseCastType returns the type to cast a ClickHouse keyset value
+// to. Times are kept in UTC, so their columns' time zones do not matter.
+func clickhouseCastType(typ string) string {
+	if strings.HasPrefix(typ, "DateTime") {
+		return "DateTime64(9, 'UTC')"
+	}
+	return typ
+}
+
+// nextPageToken returns the token for the page after last, the raw values
+// of the last row returned, which was returned rows into the page
+func nextPageToken(t *pageToken, d sqlguard.Dialect, keyset []string, cols []resultColumn, last []any, returned int) (string, error) {
+	next := &pageToken{Query: t.Query, Offset: t.Offset + returned}
+	if len(keyset) == 0 {
+		return next.encode(), nil
+	}
+
+	next.Offset = 0
+	for _, name := range keyset {
+		i := columnIndex(cols, name)
+		if i < 0 {
+			return "", fmt.Errorf("keyset column %s is not in the result", name)
+		}
+		v, ok := keysetText(last[i], d, cols[i].Type)
+		if !ok {
+			return "", fmt.Errorf("keyset column %s is NULL", name)
+		}
+		next.After = append(next.After, v)
+		switch d {
+		case sqlguard.DuckDB:
+			next.Types = append(next.Types, cols[i].Type)
+		case sqlguard.ClickHouse:
+			typ := unwrapType(cols[i].Type)
+			if strings.HasPrefix(typ, "DateTime") {
+				typ = "DateTime"
+			}
+			if !castTypePattern.MatchString(typ) {
+				return "", fmt.Errorf("keyset column %s has type %s, which cannot be used for paging", name, cols[i].Type)
+			}
+			next.Types = append(next.Types, typ)
+		}
+	}
+	return next.encode(), nil
+}
+
+func columnIndex(cols []resultColumn, name string) int {
+	for i, col := range cols {
+		if col.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// keysetText turns a driver value into a keyset parameter. Times are
+// written the way SQL Server and ClickHouse parse them, and UUIDs read as
+// bytes in their text form.
+func keysetText(v any, d sqlguard.Dialect, dbType string) (string, bool) {
+	switch v := v.(type) {
+	case time.Time:
+		switch d {
+		case sqlguard.MSSQL:
+			if dbType == "DATETIMEOFFSET" {
+				return v.Format("2006-01-02T15:04:05.9999999Z07:00"), true
+			}
+			return v.Format("2006-01-02T15:04:05.9999999"), true
+		case sqlguard.ClickHouse:
+			if typ := unwrapType(dbType); typ == "Date" || typ == "Date32" {
+				return v.Format(time.DateOnly), true
+			}
+			return v.UTC().Format("2006-01-02 15:04:05.999999999"), true
+		}
+	case []byte:
+		if s, ok := jsonValue(v, dbType).(string); ok && isUUIDType(dbType) {
+			return s, true
+		}
+	}
+	return driverText(v)
+}
+
+// driverText turns a driver value into text the databases read back as
+// the same value, for keyset parameters and exported INSERT statements. It
+// reports false for NULL.
+func driverText(v any) (string, bool) {
+	switch v := v.(type) {
+	case nil:
+		return "", false
+	case []byte:
+		return string(v), true
+	case time.Time:
+		return v.Format("2006-01-02 15:04:05.999999999Z07:00"), true
+	default:
+		return fmt.Sprint(v), true
+	}
+}
@@ -0,0 +1,175 @@
+package handler
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/magenta9/ai-web-tools/server/internal/sqlguard"
+)
+
+func TestPageQueryMSSQL(t *testing.T) {
+	// The trailing comment is dropped along with the semicolon
+	query := "SELECT id, name FROM [dbo].[users]; -- all of them"
+	wrapped := "SELECT * FROM (\nSELECT id, name FROM [dbo].[users]\n) AS page_query"
+
+	got, args, err := pageQuery(query, sqlguard.MSSQL, nil, &pageToken{Offset: 40}, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := wrapped + " ORDER BY (SELECT NULL) OFFSET 40 ROWS FETCH NEXT 21 ROWS ONLY"
+	if got != want || args != nil {
+		t.Errorf("offset page:\n%s %v\nwant\n%s", got, args, want)
+	}
+
+	keyset := []string{"created", "id"}
+	got, args, err = pageQuery(query, sqlguard.MSSQL, keyset, &pageToken{}, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = wrapped + " ORDER BY [created], [id] OFFSET 0 ROWS FETCH NEXT 21 ROWS ONLY"
+	if got != want || args != nil {
+		t.Errorf("first keyset page:\n%s %v\nwant\n%s", got, args, want)
+	}
+
+	after := []string{"2024-05-01T10:00:00", "7"}
+	got, args, err = pageQuery(query, sqlguard.MSSQL, keyset, &pageToken{After: after}, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = wrapped +
+		" WHERE ([created] > @p1 OR [created] = @p1 AND ([id] > @p2))" +
+		" ORDER BY [created], [id] OFFSET 0 ROWS FETCH NEXT 21 ROWS ONLY"
+	if got != want || !slices.Equal(args, []any{after[0], after[1]}) {
+		t.Errorf("next keyset page:\n%s %v\nwant\n%s %v", got, args, want, after)
+	}
+
+	if _, _, err := pageQuery("WITH s AS (SELECT 1 AS id) SELECT id FROM s", sqlguard.MSSQL, nil, &pageToken{}, 20); err == nil {
+		t.Error("paginated a CTE on SQL Server")
+	}
+	if _, _, err := pageQuery(query, sqlguard.MSSQL, []string{"id]; DROP TABLE t --"}, &pageToken{}, 20); err == nil {
+		t.Error("accepted an invalid keyset column")
+	}
+}
+
+func TestRowAfter(t *testing.T) {
+	got := rowAfter([]string{"[a]", "[b]", "[c]"}, []string{"@p1", "@p2", "@p3"})
+	want := "([a] > @p1 OR [a] = @p1 AND ([b] > @p2 OR [b] = @p2 AND ([c] > @p3)))"
+	if got != want {
+		t.Errorf("rowAfter = %s, want %s", got, want)
+	}
+}
+
+// ClickHouse keyset values are written into the query as literals
+func TestPageQueryClickHouse(t *testing.T) {
+	query := "SELECT ts, host, msg FROM logs WHERE msg LIKE '%?%'"
+	tok := &pageToken{
+		After: []string{"2024-05-01 10:00:00.123456789", `it's a \ host`},
+		Types: []string{"DateTime", "String"},
+	}
+	got, args, err := pageQuery(query, sqlguard.ClickHouse, []string{"ts", "host"}, tok, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "SELECT * FROM (\n" + query + "\n) AS page_query" +
+		" WHERE (`ts`, `host`) > (CAST('2024-05-01 10:00:00.123456789' AS DateTime64(9, 'UTC')), CAST('it\\'s a \\\\ host' AS String))" +
+		" ORDER BY `ts`, `host` LIMIT 101"
+	if got != want || args != nil {
+		t.Errorf("pageQuery:\n%s %v\nwant\n%s", got, args, want)
+	}
+
+	got, _, err = pageQuery(query, sqlguard.ClickHouse, nil, &pageToken{Offset: 100}, 100)
+	if want := "SELECT * FROM (\n" + query + "\n) AS page_query LIMIT 101 OFFSET 100"; err != nil || got != want {
+		t.Errorf("offset page: %s, %v", got, err)
+	}
+}
+
+func TestNextPageToken(t *testing.T) {
+	ts := time.Date(2024, 5, 1, 12, 0, 0, 123456700, time.FixedZone("", 2*60*60))
+
+	tests := []struct {
+		d     sqlguard.Dialect
+		cols  []resultColumn
+		last  []any
+		after []string
+		types []string
+	}{
+		{
+			sqlguard.MSSQL,
+			[]resultColumn{{"created", "DATETIME2"}, {"id", "INT"}},
+			[]any{ts, int64(7)},
+			[]string{"2024-05-01T12:00:00.1234567", "7"},
+			nil,
+		},
+		{
+			sqlguard.MSSQL,
+			[]resultColumn{{"created", "DATETIMEOFFSET"}},
+			[]any{ts},
+			[]string{"2024-05-01T12:00:00.1234567+02:00"},
+			nil,
+		},
+		{
+			sqlguard.ClickHouse,
+			[]resultColumn{{"ts", "Nullable(DateTime64(3, 'Europe/Berlin'))"}, {"host", "LowCardinality(String)"}},
+			[]any{ts, "web-1"},
+			[]string{"2024-05-01 10:00:00.1234567", "web-1"},
+			[]string{"DateTime", "String"},
+		},
+		{
+			sqlguard.ClickHouse,
+			[]resultColumn{{"day", "Date32"}, {"n", "UInt64"}},
+			[]any{ts, uint64(3)},
+			[]string{"2024-05-01", "3"},
+			[]string{"Date32", "UInt64"},
+		},
+	}
+	for _, tt := range tests {
+		keyset := make([]string, len(tt.cols))
+		for i, col := range tt.cols {
+			keyset[i] = col.Name
+		}
+		s, err := nextPageToken(&pageToken{Query: "h", Offset: 20}, tt.d, keyset, tt.cols, tt.last, 20)
+		if err != nil {
+			t.Errorf("%s %v: %v", tt.d, tt.cols, err)
+			continue
+		}
+		next, err := decodePageToken(s, "h", keyset)
+		if err != nil {
+			t.Errorf("%s %v: decode: %v", tt.d, tt.cols, err)
+			continue
+		}
+		if next.Offset != 0 || !slices.Equal(next.After, tt.after) || !slices.Equal(next.Types, tt.types) {
+			t.Errorf("%s %v: token %+v, want after %q types %q", tt.d, tt.cols, next, tt.after, tt.types)
+		}
+	}
+
+	cols := []resultColumn{{"tags", "Array(String)"}}
+	if _, err := nextPageToken(&pageToken{}, sqlguard.ClickHouse, []string{"tags"}, cols, []any{"[]"}, 1); err == nil {
+		t.Error("paged by an Array column")
+	}
+	cols = []resultColumn{{"id", "INT"}}
+	if _, err := nextPageToken(&pageToken{}, sqlguard.MSSQL, []string{"id"}, cols, []any{nil}, 1); err == nil {
+		t.Error("paged after a NULL keyset value")
+	}
+}
+
+// Types in a token end up in the query, so only type names are accepted
+func TestDecodePageTokenTypes(t *testing.T) {
+	keyset := []string{"id"}
+	for _, typ := range []string{"UInt64", "Decimal(18, 3)", "TIMESTAMP WITH TIME ZONE"} {
+		s := (&pageToken{Query: "h", After: []string{"1"}, Types: []string{typ}}).encode()
+		if _, err := decodePageToken(s, "h", keyset); err != nil {
+			t.Errorf("type %s: %v", typ, err)
+		}
+	}
+	for _, typ := range []string{"String) OR 1=1 --", "DateTime64(9, 'UTC')", "String'"} {
+		s := (&pageToken{Query: "h", After: []string{"1"}, Types: []string{typ}}).encode()
+		if _, err := decodePageToken(s, "h", keyset); err == nil {
+			t.Errorf("accepted type %q", typ)
+		}
+	}
+	s := (&pageToken{Query: "other", After: []string{"1"}}).encode()
+	if _, err := decodePageToken(s, "h", keyset); err == nil {
+		t.Error("accepted a token for another query")
+	}
+}
@@ -1,49 +1,112 @@
 package handler
 
 import (
+	"errors"
 	"strconv"
 	"strings"
 
 	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/magenta9/ai-web-tools/server/internal/audit"
 	"github.com/magenta9/ai-web-tools/server/internal/model"
 	"github.com/magenta9/ai-web-tools/server/internal/repository"
 )
 
 type PromptHandler struct {
-	repo *repository.Repository
+	repo  *repository.Repository
+	audit *audit.Logger
 }
 
-func NewPromptHandler(repo *repository.Repository) *PromptHandler {
-	return &PromptHandler{repo: repo}
+func NewPromptHandler(repo *repository.Repository, auditLog *audit.Logger) *PromptHandler {
+	return &PromptHandler{repo: repo, audit: auditLog}
 }
 
-func (h *PromptHandler) Create(c *gin.Context) {
-	var req struct {
-		Title   string   `json:"title"`
-		Content string   `json:"content"`
-		Tags    []string `json:"tags"`
+// auditPrompt records a change to a prompt in the caller's scope
+func (h *PromptHandler) auditPrompt(c *gin.Context, action, outcome string, id int64, caller model.Caller, details map[string]any) {
+	if caller.WorkspaceID > 0 {
+		if details == nil {
+			details = map[string]any{}
+		}
+		details["workspace_id"] = caller.WorkspaceID
 	}
+	h.audit.Log(c, model.AuditEvent{
+		Action:     action,
+		TargetType: "prompt",
+		TargetID:   strconv.FormatInt(id, 10),
+		Outcome:    outcome,
+		Details:    details,
+	})
+}
+
+type promptRequest struct {
+	Title      string   `json:"title"`
+	Content    string   `json:"content"`
+	Tags       []string `json:"tags"`
+	Visibility string   `json:"visibility"`
+}
+
+// bindPromptRequest parses and validates a create/update body
+func bindPromptRequest(c *gin.Context) (*promptRequest, bool) {
+	var req promptRequest
 	if err := c.ShouldBindJSON(&req); err != nil || req.Title == "" || req.Content == "" {
 		c.JSON(400, gin.H{"success": false, "error": "title and content are required"})
+		return nil, false
+	}
+	if req.Visibility == "" {
+		req.Visibility = model.VisibilityPrivate
+	}
+	if !model.IsValidVisibility(req.Visibility) {
+		c.JSON(400, gin.H{"success": false, "error": "visibility must be private, team or public"})
+		return nil, false
+	}
+	return &req, true
+}
+
+func (h *PromptHandler) Create(c *gin.Context) {
+	caller, ok := getCaller(c)
+	if !ok {
+		c.JSON(401, gin.H{"success": false, "error": "Unauthorized"})
+		return
+	}
+
+	req, ok := bindPromptRequest(c)
+	if !ok {
 		return
 	}
 
 	prompt := &model.Prompt{
-		Title:   req.Title,
-		Content: req.Content,
-		Tags:    req.Tags,
+		Title:      req.Title,
+		Content:    req.Content,
+		Tags:       req.Tags,
+		Visibility: req.Visibility,
 	}
 
-	result, err := h.repo.CreatePrompt(c.Request.Context(), prompt)
+	result, err := h.repo.CreatePrompt(c.Request.Context(), prompt, caller)
 	if err != nil {
 		c.JSON(500, gin.H{"success": false, "error": err.Error()})
 		return
 	}
+	h.auditPrompt(c, model.ActionPromptCreate, model.OutcomeSuccess, result.ID, caller,
+		map[string]any{"title": result.Title, "visibility": result.Visibility})
 
 	c.JSON(200, gin.H{"success": true, "prompt": result})
 }
 
 func (h *PromptHandler) List(c *gin.Context) {
+	caller, ok := getCaller(c)
+	if !ok {
+		c.JSON(401, gin.H{"success": false, "error": "Unauthorized"})
+		return
+	}
+	h.list(c, caller)
+}
+
+// ListPublic lists public prompts without requiring a login
+func (h *PromptHandler) ListPublic(c *gin.Context) {
+	h.list(c, model.Caller{})
+}
+
+func (h *PromptHandler) list(c *gin.Context, caller model.Caller) {
 	search := c.Query("search")
 	tagsParam := c.Query("tags")
 	var tags []string
@@ -52,7 +115,7 @@ func (h *PromptHandler) List(c *gin.Context) {
 	}
 	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
 
-	prompts, err := h.repo.GetPrompts(c.Request.Context(), search, tags, limit)
+	prompts, err := h.repo.GetPrompts(c.Request.Context(), caller, search, tags, limit)
 	if err != nil {
 		c.JSON(500, gin.H{"success": false, "error": err.Error()})
 		return
@@ -62,6 +125,12 @@ func (h *PromptHandler) List(c *gin.Context) {
 }
 
 func (h *PromptHandler) Get(c *gin.Context) {
+	caller, ok := getCaller(c)
+	if !ok {
+		c.JSON(401, gin.H{"success": false, "error": "Unauthorized"})
+		return
+	}
+
 	idStr := c.Param("id")
 	id, err := strconv.ParseInt(idStr, 10, 64)
 	if err != nil || id <= 0 {
@@ -69,7 +138,11 @@ func (h *PromptHandler) Get(c *gin.Context) {
 		return
 	}
 
-	prompt, err := h.repo.GetPrompt(c.Request.Context(), id)
+	prompt, err := h.repo.GetPrompt(c.Request.Context(), id, caller)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(404, gin.H{"success": false, "error": "prompt not found"})
+		return
+	}
 	if err != nil {
 		c.JSON(500, gin.H{"success": false, "error": err.Error()})
 		return
@@ -79,6 +152,12 @@ func (h *PromptHandler) Get(c *gin.Context) {
 }
 
 func (h *PromptHandler) Update(c *gin.Context) {
+	caller, ok := getCaller(c)
+	if !ok {
+		c.JSON(401, gin.H{"success": false, "error": "Unauthorized"})
+		return
+	}
+
 	idStr := c.Param("id")
 	id, err := strconv.ParseInt(idStr, 10, 64)
 	if err != nil || id <= 0 {
@@ -86,33 +165,42 @@ func (h *PromptHandler) Update(c *gin.Context) {
 		return
 	}
 
-	var req struct {
-		Title   string   `json:"title"`
-		Content string   `json:"content"`
-		Tags    []string `json:"tags"`
-	}
-	if err := c.ShouldBindJSON(&req); err != nil || req.Title == "" || req.Content == "" {
-		c.JSON(400, gin.H{"success": false, "error": "title and content are required"})
+	req, ok := bindPromptRequest(c)
+	if !ok {
 		return
 	}
 
 	prompt := &model.Prompt{
-		ID:      id,
-		Title:   req.Title,
-		Content: req.Content,
-		Tags:    req.Tags,
+		ID:         id,
+		Title:      req.Title,
+		Content:    req.Content,
+		Tags:       req.Tags,
+		Visibility: req.Visibility,
 	}
 
-	err = h.repo.UpdatePrompt(c.Request.Context(), prompt)
+	found, err := h.repo.UpdatePrompt(c.Request.Context(), prompt, caller)
 	if err != nil {
 		c.JSON(500, gin.H{"success": false, "error": err.Error()})
 		return
 	}
+	if !found {
+		h.auditPrompt(c, model.ActionPromptUpdate, model.OutcomeFailure, id, caller, map[string]any{"reason": "not found or not editable"})
+		c.JSON(404, gin.H{"success": false, "error": "prompt not found"})
+		return
+	}
+	h.auditPrompt(c, model.ActionPromptUpdate, model.OutcomeSuccess, id, caller,
+		map[string]any{"title": prompt.Title, "visibility": prompt.Visibility})
 
 	c.JSON(200, gin.H{"success": true})
 }
 
 func (h *PromptHandler) Delete(c *gin.Context) {
+	caller, ok := getCaller(c)
+	if !ok {
+		c.JSON(401, gin.H{"success": false, "error": "Unauthorized"})
+		return
+	}
+
 	idStr := c.Param("id")
 	id, err := strconv.ParseInt(idStr, 10, 64)
 	if err != nil || id <= 0 {
@@ -120,16 +208,28 @@ func (h *PromptHandler) Delete(c *gin.Context) {
 		return
 	}
 
-	err = h.repo.DeletePrompt(c.Request.Context(), id)
+	found, err := h.repo.DeletePrompt(c.Request.Context(), id, caller)
 	if err != nil {
 		c.JSON(500, gin.H{"success": false, "error": err.Error()})
 		return
 	}
+	if !found {
+		h.auditPrompt(c, model.ActionPromptDelete, model.OutcomeFailure, id, caller, map[string]any{"reason": "not found or not editable"})
+		c.JSON(404, gin.H{"success": false, "error": "prompt not found"})
+		return
+	}
+	h.auditPrompt(c, model.ActionPromptDelete, model.OutcomeSuccess, id, caller, nil)
 
 	c.JSON(200, gin.H{"success": true})
 }
 
 func (h *PromptHandler) IncrementUse(c *gin.Context) {
+	caller, ok := getCaller(c)
+	if !ok {
+		c.JSON(401, gin.H{"success": false, "error": "Unauthorized"})
+		return
+	}
+
 	idStr := c.Param("id")
 	id, err := strconv.ParseInt(idStr, 10, 64)
 	if err != nil || id <= 0 {
@@ -137,17 +237,27 @@ func (h *PromptHandler) IncrementUse(c *gin.Context) {
 		return
 	}
 
-	err = h.repo.IncrementPromptUseCount(c.Request.Context(), id)
+	found, err := h.repo.IncrementPromptUseCount(c.Request.Context(), id, caller)
 	if err != nil {
 		c.JSON(500, gin.H{"success": false, "error": err.Error()})
 		return
 	}
+	if !found {
+		c.JSON(404, gin.H{"success": false, "error": "prompt not found"})
+		return
+	}
 
 	c.JSON(200, gin.H{"success": true})
 }
 
 func (h *PromptHandler) GetTags(c *gin.Context) {
-	tags, err := h.repo.GetAllTags(c.Request.Context())
+	caller, ok := getCaller(c)
+	if !ok {
+		c.JSON(401, gin.H{"success": false, "error": "Unauthorized"})
+		return
+	}
+
+	tags, err := h.repo.GetAllTags(c.Request.Context(), caller)
 	if err != nil {
 		c.JSON(500, gin.H{"success": false, "error": err.Error()})
 		return
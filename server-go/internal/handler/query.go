@@ -0,0 +1,257 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"github.com/magenta9/ai-web-tools/server/internal/sqlguard"
+)
+
+// readQuery is a read-only query running on a connection of its own. The
+// query is cancelled on the database when it times out, when the client
+// disconnects, or when it is closed before all rows were read.
+type readQuery struct {
+	*sql.Rows
+	ctx    context.Context
+	cancel context.CancelFunc
+	conn   *sql.Conn
+	tx     *sql.Tx
+	// watched is closed once the MySQL kill watcher has returned, and
+	// killed tells whether it killed the query
+	watched chan struct{}
+	killed  bool
+	// sessionTimeout is set once MAX_EXECUTION_TIME was set on the MySQL
+	// session, which outlives the query on the pooled connection
+	sessionTimeout bool
+	done           chan struct{}
+	// exhausted is set once Next has returned false
+	exhausted bool
+}
+
+// startReadQuery runs query in a read-only transaction with timeout set
+// both on the context and, where the server has one, as its statement
+// timeout
+func (h *DBHandler) startReadQuery(c *gin.Context, cfg *dbConfig, query string, timeout time.Duration, args ...any) (*readQuery, error) {
+	db, err := h.openDB(c, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// The request context ends when the client disconnects
+	ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+	q := &readQuery{ctx: ctx, cancel: cancel, done: make(chan struct{})}
+	if q.conn, err = db.Conn(ctx); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	timeoutMS := timeout.Milliseconds()
+	if cfg.dialect() == sqlguard.MySQL {
+		// MySQL keeps running a query whose client went away, so kill it
+		// from another connection
+		var connID int64
+		if err := q.conn.QueryRowContext(ctx, "SELECT CONNECTION_ID()").Scan(&connID); err != nil {
+			q.release()
+			return nil, err
+		}
+		q.watched = make(chan struct{})
+		go q.killOnCancel(db, connID)
+
+		if err := pinMySQLQuoting(ctx, q.conn); err != nil {
+			q.Close()
+			return nil, err
+		}
+
+		// MariaDB and MySQL before 5.7.8 lack the variable; the context
+		// deadline still applies there
+		_, err := q.conn.ExecContext(ctx, fmt.Sprintf("SET SESSION MAX_EXECUTION_TIME = %d", timeoutMS))
+		if err != nil && ctx.Err() != nil {
+			q.Close()
+			return nil, err
+		}
+		q.sessionTimeout = err == nil
+	}
+
+	if cfg.dialect() == sqlguard.ClickHouse {
+		// ClickHouse has no transactions. The query runs with readonly=2,
+		// which refuses writes but lets the timeout be set alongside.
+		settings := clickhouse.Settings{
+			"readonly":           2,
+			"max_execution_time": int(math.Ceil(timeout.Seconds())),
+		}
+		// The driver replaces max_execution_time with the context's
+		// deadline plus five seconds, so the query context has no
+		// deadline and is cancelled along with ctx instead
+		chCtx, stop := context.WithCancel(context.WithoutCancel(ctx))
+		context.AfterFunc(ctx, stop)
+		chCtx = clickhouse.Context(chCtx, clickhouse.WithSettings(settings))
+		if q.Rows, err = q.conn.QueryContext(chCtx, query, args...); err != nil {
+			// Close cancels the context, which err looks at
+			err = q.err(err)
+			q.Close()
+			return nil, err
+		}
+		return q, nil
+	}
+
+	// DuckDB and SQL Server have no read-only transactions. DuckDB files
+	// are opened read-only instead; on SQL Server the transaction is
+	// rolled back like the others, undoing writes the check missed.
+	readOnly := cfg.dialect() != sqlguard.DuckDB && cfg.dialect() != sqlguard.MSSQL
+	if q.tx, err = q.conn.BeginTx(ctx, &sql.TxOptions{ReadOnly: readOnly}); err != nil {
+		q.Close()
+		return nil, err
+	}
+	if cfg.dialect() == sqlguard.Postgres {
+		// sqlguard reads backslashes in strings as Postgres does by default
+		_, err := q.tx.ExecContext(ctx, "SELECT set_config('statement_timeout', $1, true), set_config('standard_conforming_strings', 'on', true)", fmt.Sprint(timeoutMS))
+		if err != nil {
+			q.Close()
+			return nil, err
+		}
+	}
+	if q.Rows, err = q.tx.QueryContext(ctx, query, args...); err != nil {
+		err = q.err(err)
+		q.Close()
+		return nil, err
+	}
+	return q, nil
+}
+
+// mysqlQuotingModes are the sql_mode flags under which MySQL reads quotes
+// and backslashes differently from sqlguard, which lexes with the defaults:
+// NO_BACKSLASH_ESCAPES lets 'a\' end a string where sqlguard sees an
+// escaped quote, and ANSI_QUOTES makes "..." an identifier. The rest are
+// combination modes that include ANSI_QUOTES.
+var mysqlQuotingModes = map[string]bool{
+	"NO_BACKSLASH_ESCAPES": true, "ANSI_QUOTES": true,
+	"ANSI": true, "DB2": true, "MAXDB": true, "MSSQL": true, "ORACLE": true, "POSTGRESQL": true,
+}
+
+// sqlSession is a connection or transaction to run session statements on
+type sqlSession interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// pinMySQLQuoting turns off mysqlQuotingModes on the session, so that text
+// sqlguard took for a string or comment cannot run as SQL. The session
+// keeps the change, which the pool's other queries do not mind.
+func pinMySQLQuoting(ctx context.Context, s sqlSession) error {
+	var mode string
+	if err := s.QueryRowContext(ctx, "SELECT @@SESSION.sql_mode").Scan(&mode); err != nil {
+		return err
+	}
+	var kept []string
+	for _, m := range strings.Split(mode, ",") {
+		if m != "" && !mysqlQuotingModes[strings.ToUpper(m)] {
+			kept = append(kept, m)
+		}
+	}
+	if strings.Join(kept, ",") == mode {
+		return nil
+	}
+	_, err := s.ExecContext(ctx, "SET SESSION sql_mode = ?", strings.Join(kept, ","))
+	return err
+}
+
+// killOnCancel kills the running MySQL query once the context ends, unless
+// the query finished first. It runs while the connection is still held,
+// so it cannot hit a later query that reuses the connection.
+func (q *readQuery) killOnCancel(db *sql.DB, connID int64) {
+	defer close(q.watched)
+	select {
+	case <-q.done:
+	case <-q.ctx.Done():
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if _, err := db.ExecContext(ctx, fmt.Sprintf("KILL QUERY %d", connID)); err != nil {
+			log.Printf("Warning: failed to kill cancelled query on connection %d: %v", connID, err)
+		}
+		q.killed = true
+	}
+}
+
+// err explains a query error caused by the timeout, whether the context
+// deadline or the server's statement timeout hit first
+func (q *readQuery) err(err error) error {
+	if err == nil || errors.Is(q.ctx.Err(), context.Canceled) {
+		return err
+	}
+	var pqErr *pq.Error
+	var mysqlErr *mysql.MySQLError
+	var chErr *clickhouse.Exception
+	switch {
+	case errors.Is(q.ctx.Err(), context.DeadlineExceeded),
+		errors.As(err, &pqErr) && pqErr.Code == "57014",
+		errors.As(err, &mysqlErr) && mysqlErr.Number == 3024,
+		errors.As(err, &chErr) && chErr.Code == 159: // TIMEOUT_EXCEEDED
+		return errQueryTimeout
+	}
+	return err
+}
+
+// Next advances to the next row, recording when the rows run out
+func (q *readQuery) Next() bool {
+	more := q.Rows.Next()
+	if !more {
+		q.exhausted = true
+	}
+	return more
+}
+
+// Err returns the error that ended the rows
+func (q *readQuery) Err() error {
+	return q.err(q.Rows.Err())
+}
+
+// Close ends the query, cancelling it if rows are left unread, and returns
+// the connection to the pool
+func (q *readQuery) Close() {
+	if q.Rows != nil && !q.exhausted {
+		q.cancel()
+	}
+	q.release()
+}
+
+func (q *readQuery) release() {
+	close(q.done)
+	if q.watched != nil {
+		<-q.watched
+	}
+	if q.Rows != nil {
+		q.Rows.Close()
+	}
+	if q.tx != nil {
+		q.tx.Rollback()
+	}
+	if q.killed {
+		// A kill that arrives after the query ended can interrupt the
+		// next statement on the connection, so don't reuse it
+		q.conn.Raw(func(any) error { return driver.ErrBadConn })
+	} else if q.sessionTimeout {
+		// Other users of the pool, such as confirmed writes, must not
+		// inherit the timeout
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if _, err := q.conn.ExecContext(ctx, "SET SESSION MAX_EXECUTION_TIME = DEFAULT"); err != nil {
+			q.conn.Raw(func(any) error { return driver.ErrBadConn })
+		}
+		cancel()
+	}
+	q.conn.Close()
+	q.cancel()
+}
+
+// errQueryTimeout replaces the driver errors of a query that ran out of time
+var errQueryTimeout = errors.New("query timed out; narrow it down or add a LIMIT")
@@ -0,0 +1,272 @@
+package handler
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"github.com/magenta9/ai-web-tools/server/internal/sqlguard"
+)
+
+// MAX_EXECUTION_TIME is set on the MySQL session for the query and reset
+// before the connection goes back to the pool
+func TestReadQueryResetsMySQLTimeout(t *testing.T) {
+	f := &fakeSQL{}
+	h := fakeSQLHandler(t, f)
+	cfg := &dbConfig{Type: "mysql", Host: "db", Database: "shop"}
+
+	for range 2 {
+		q, err := h.startReadQuery(fakeSQLContext(), cfg, "SELECT 1", 1500*time.Millisecond)
+		if err != nil {
+			t.Fatalf("startReadQuery: %v", err)
+		}
+		for q.Next() {
+		}
+		q.Close()
+	}
+
+	logs := f.log()
+	if len(logs) != 1 {
+		t.Fatalf("queries used %d connections, want the pooled one reused: %q", len(logs), logs)
+	}
+	query := []string{
+		"SELECT CONNECTION_ID()",
+		"SELECT @@SESSION.sql_mode",
+		"SET SESSION MAX_EXECUTION_TIME = 1500",
+		"BEGIN READ ONLY",
+		"SELECT 1",
+		"ROLLBACK",
+		"SET SESSION MAX_EXECUTION_TIME = DEFAULT",
+	}
+	if want := slices.Concat(query, query); !slices.Equal(logs[0], want) {
+		t.Errorf("statements\n%q\nwant\n%q", logs[0], want)
+	}
+}
+
+// sqlguard lexes with the servers' default quoting, so the session is made
+// to read these queries as one string literal, as the check did, before
+// they run
+func TestReadQueryPinsQuoting(t *testing.T) {
+	tests := []struct {
+		typ, sqlMode, query, pin string
+	}{
+		{"mysql", "NO_BACKSLASH_ESCAPES,STRICT_TRANS_TABLES", `SELECT 'a\' , load_file('/etc/passwd') -- '`,
+			"SET SESSION sql_mode = ? [STRICT_TRANS_TABLES]"},
+		{"mysql", "REAL_AS_FLOAT,PIPES_AS_CONCAT,ANSI_QUOTES,IGNORE_SPACE,ONLY_FULL_GROUP_BY,ANSI", `SELECT "a\" , sleep(10) -- "`,
+			"SET SESSION sql_mode = ? [REAL_AS_FLOAT,PIPES_AS_CONCAT,IGNORE_SPACE,ONLY_FULL_GROUP_BY]"},
+		{"postgres", "", `SELECT '\'' , pg_sleep(10) -- '`,
+			"SELECT set_config('statement_timeout', $1, true), set_config('standard_conforming_strings', 'on', true) [1000]"},
+	}
+	for _, tt := range tests {
+		d := (&dbConfig{Type: tt.typ}).dialect()
+		if err := sqlguard.CheckReadOnly(tt.query, d); err != nil {
+			t.Fatalf("CheckReadOnly(%q) = %v", tt.query, err)
+		}
+		f := &fakeSQL{sqlMode: tt.sqlMode}
+		h := fakeSQLHandler(t, f)
+		cfg := &dbConfig{Type: tt.typ, Host: "db", Database: "shop"}
+
+		for range 2 {
+			q, err := h.startReadQuery(fakeSQLContext(), cfg, tt.query, time.Second)
+			if err != nil {
+				t.Fatalf("startReadQuery: %v", err)
+			}
+			q.Close()
+		}
+		log := f.log()[0]
+		pin, run := slices.Index(log, tt.pin), slices.Index(log, tt.query)
+		if pin < 0 || run < pin {
+			t.Errorf("%s: session not pinned before the query: %q", tt.typ, log)
+		}
+		// The MySQL session keeps the mode, so it is set only once
+		if tt.typ == "mysql" {
+			if n := len(slices.DeleteFunc(slices.Clone(log), func(s string) bool { return s != tt.pin })); n != 1 {
+				t.Errorf("sql_mode set %d times: %q", n, log)
+			}
+		}
+	}
+}
+
+// A connection whose timeout cannot be reset is not reused
+func TestReadQueryDropsConnectionWithTimeoutLeft(t *testing.T) {
+	f := &fakeSQL{respond: func(query string, _ []driver.NamedValue) (*fakeRows, error) {
+		if query == "SET SESSION MAX_EXECUTION_TIME = DEFAULT" {
+			return nil, errors.New("connection lost")
+		}
+		return nil, nil
+	}}
+	h := fakeSQLHandler(t, f)
+	cfg := &dbConfig{Type: "mysql", Host: "db", Database: "shop"}
+
+	for range 2 {
+		q, err := h.startReadQuery(fakeSQLContext(), cfg, "SELECT 1", time.Second)
+		if err != nil {
+			t.Fatalf("startReadQuery: %v", err)
+		}
+		for q.Next() {
+		}
+		q.Close()
+	}
+	if logs := f.log(); len(logs) != 2 {
+		t.Errorf("queries used %d connections, want 2: %q", len(logs), logs)
+	}
+}
+
+// MariaDB and old MySQL lack the variable, so there is nothing to reset
+func TestReadQueryWithoutMySQLTimeout(t *testing.T) {
+	f := &fakeSQL{respond: func(query string, _ []driver.NamedValue) (*fakeRows, error) {
+		if query == "SET SESSION MAX_EXECUTION_TIME = 1000" {
+			return nil, errors.New("Unknown system variable 'MAX_EXECUTION_TIME'")
+		}
+		return nil, nil
+	}}
+	h := fakeSQLHandler(t, f)
+
+	q, err := h.startReadQuery(fakeSQLContext(), &dbConfig{Type: "mysql", Host: "db"}, "SELECT 1", time.Second)
+	if err != nil {
+		t.Fatalf("startReadQuery: %v", err)
+	}
+	q.Close()
+	if log := f.log()[0]; slices.Contains(log, "SET SESSION MAX_EXECUTION_TIME = DEFAULT") {
+		t.Errorf("reset a timeout that was never set: %q", log)
+	}
+}
+
+// SQL Server has no read-only transactions, so the query runs in an
+// ordinary one that is always rolled back
+func TestReadQueryMSSQL(t *testing.T) {
+	f := &fakeSQL{}
+	h := fakeSQLHandler(t, f)
+	cfg := &dbConfig{Type: "mssql", Host: "db", Database: "shop"}
+
+	q, err := h.startReadQuery(fakeSQLContext(), cfg, "SELECT * FROM t WHERE id > @p1", time.Second, 7)
+	if err != nil {
+		t.Fatalf("startReadQuery: %v", err)
+	}
+	for q.Next() {
+	}
+	q.Close()
+
+	want := []string{"BEGIN", "SELECT * FROM t WHERE id > @p1 [7]", "ROLLBACK"}
+	if logs := f.log(); len(logs) != 1 || !slices.Equal(logs[0], want) {
+		t.Errorf("statements %q, want %q", logs, want)
+	}
+}
+
+// ClickHouse has no transactions; the query is sent with readonly=2 and
+// the timeout as settings instead
+func TestReadQueryClickHouse(t *testing.T) {
+	f := newFakeClickHouse(t)
+	h := fakeClickHouseHandler(t, f)
+	cfg := &dbConfig{Type: "clickhouse", Host: "db", Database: "logs"}
+
+	q, err := h.startReadQuery(fakeSQLContext(), cfg, "SELECT 1 AS n", 2500*time.Millisecond)
+	if err != nil {
+		t.Fatalf("startReadQuery: %v", err)
+	}
+	var n uint8
+	for q.Next() {
+		if err := q.Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.Err(); err != nil {
+		t.Fatal(err)
+	}
+	q.Close()
+	if n != 1 {
+		t.Errorf("read %d, want 1", n)
+	}
+
+	var sent *fakeClickHouseQuery
+	for _, query := range f.log() {
+		if query.query == "SELECT 1 AS n" {
+			sent = &query
+		}
+	}
+	if sent == nil {
+		t.Fatalf("query not sent: %v", f.log())
+	}
+	if got := sent.settings.Get("readonly"); got != "2" {
+		t.Errorf("readonly = %q, want 2", got)
+	}
+	if got := sent.settings.Get("max_execution_time"); got != "3" {
+		t.Errorf("max_execution_time = %q, want 3", got)
+	}
+}
+
+// The servers' own timeouts are reported like the context deadline
+func TestReadQueryTimeoutErrors(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	q := &readQuery{ctx: ctx}
+
+	for _, err := range []error{
+		&pq.Error{Code: "57014"},
+		&mysql.MySQLError{Number: 3024},
+		fmt.Errorf("read rows: %w", &clickhouse.Exception{Code: 159}),
+	} {
+		if got := q.err(err); got != errQueryTimeout {
+			t.Errorf("err(%v) = %v, want errQueryTimeout", err, got)
+		}
+	}
+	other := &clickhouse.Exception{Code: 60} // UNKNOWN_TABLE
+	if got := q.err(other); got != other {
+		t.Errorf("err(%v) = %v", other, got)
+	}
+
+	cancel()
+	if got := q.err(&mysql.MySQLError{Number: 3024}); got == errQueryTimeout {
+		t.Error("a cancelled query was reported as timed out")
+	}
+}
+
+// A server timeout when the query starts is reported as a timeout too
+func TestStartReadQueryServerTimeout(t *testing.T) {
+	for _, tt := range []struct {
+		typ string
+		err error
+	}{
+		{"postgres", &pq.Error{Code: "57014"}},
+		{"mysql", &mysql.MySQLError{Number: 3024}},
+	} {
+		f := &fakeSQL{respond: func(query string, _ []driver.NamedValue) (*fakeRows, error) {
+			if query == "SELECT * FROM big" {
+				return nil, tt.err
+			}
+			return nil, nil
+		}}
+		h := fakeSQLHandler(t, f)
+		cfg := &dbConfig{Type: tt.typ, Host: "db", Database: "shop"}
+		if _, err := h.startReadQuery(fakeSQLContext(), cfg, "SELECT * FROM big", time.Second); err != errQueryTimeout {
+			t.Errorf("%s: startReadQuery = %v, want errQueryTimeout", tt.typ, err)
+		}
+	}
+}
+
+// Without a deadline on the driver's context the query still ends with it
+func TestReadQueryClickHouseTimeout(t *testing.T) {
+	f := newFakeClickHouse(t)
+	f.stall = "SELECT sleepEachRow(1) FROM numbers(10)"
+	h := fakeClickHouseHandler(t, f)
+	cfg := &dbConfig{Type: "clickhouse", Host: "db", Database: "logs"}
+
+	start := time.Now()
+	q, err := h.startReadQuery(fakeSQLContext(), cfg, f.stall, 200*time.Millisecond)
+	if err == nil {
+		q.Close()
+	}
+	if err != errQueryTimeout {
+		t.Errorf("startReadQuery = %v, want errQueryTimeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("query ran for %s", elapsed)
+	}
+}
@@ -0,0 +1,217 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/magenta9/ai-web-tools/server/internal/dbfile"
+)
+
+// Result formats of /api/db/execute
+const (
+	formatStructured = "structured"
+	formatLegacy     = "legacy"
+)
+
+// resultColumn describes a result column with the database's type name
+type resultColumn struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+func resultColumns(rows *sql.Rows) ([]resultColumn, error) {
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	cols := make([]resultColumn, len(types))
+	for i, t := range types {
+		cols[i] = resultColumn{Name: t.Name(), Type: t.DatabaseTypeName()}
+	}
+	return cols, nil
+}
+
+// scanRow scans the current row into driver values
+func scanRow(rows *sql.Rows, n int) ([]any, error) {
+	values := make([]any, n)
+	ptrs := make([]any, n)
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	if err := rows.Scan(ptrs...); err != nil {
+		return nil, err
+	}
+	for i, v := range values {
+		values[i] = dbfile.Value(v)
+	}
+	return values, nil
+}
+
+// legacyRow joins a row with tabs, the format before typed results
+func legacyRow(values []any) string {
+	rowValues := make([]string, len(values))
+	for i, v := range values {
+		if b, ok := v.([]byte); ok {
+			rowValues[i] = string(b)
+		} else {
+			rowValues[i] = fmt.Sprintf("%v", v)
+		}
+	}
+	return strings.Join(rowValues, "\t")
+}
+
+// typedRow converts driver values to JSON values and returns them with
+// their approximate encoded size
+func typedRow(values []any, cols []resultColumn) ([]any, int) {
+	row := make([]any, len(values))
+	size := 0
+	for i, v := range values {
+		row[i] = jsonValue(v, cols[i].Type)
+		size += valueSize(row[i])
+	}
+	return row, size
+}
+
+// jsonValue converts a driver value to a JSON value: NULL to null,
+// numbers to numbers, booleans to booleans, timestamps to RFC 3339, JSON
+// columns, lists and structs to JSON and binary data to base64. MySQL
+// returns most values as text, so those are converted by the column's type
+// name.
+func jsonValue(v any, dbType string) any {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case bool, int64, json.Number:
+		return v
+	case int8, int16, int32, int, uint8, uint16, uint32, uint64, uint:
+		return json.Number(fmt.Sprint(v))
+	case *big.Int:
+		return json.Number(v.String())
+	case float32:
+		return jsonValue(float64(v), dbType)
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return strconv.FormatFloat(v, 'g', -1, 64)
+		}
+		return v
+	case time.Time:
+		switch baseType(dbType) {
+		case "DATE", "DATE32":
+			return v.Format(time.DateOnly)
+		case "TIME":
+			return v.Format("15:04:05.999999")
+		}
+		return v.Format(time.RFC3339Nano)
+	case string:
+		return textValue(v, dbType)
+	case []byte:
+		if isUUIDType(dbType) && len(v) == 16 {
+			// DuckDB and SQL Server return UUIDs as bytes
+			h := hex.EncodeToString(v)
+			return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+		}
+		if isBinaryType(dbType) {
+			return base64.StdEncoding.EncodeToString(v)
+		}
+		if !utf8.Valid(v) {
+			return base64.StdEncoding.EncodeToString(v)
+		}
+		return textValue(string(v), dbType)
+	case fmt.Stringer:
+		return v.String()
+	default:
+		if b, err := json.Marshal(v); err == nil {
+			return json.RawMessage(b)
+		}
+		return fmt.Sprint(v)
+	}
+}
+
+// textValue converts a value the driver returned as text
+func textValue(s, dbType string) any {
+	t := strings.TrimPrefix(baseType(dbType), "UNSIGNED ")
+	switch t {
+	case "TINYINT", "SMALLINT", "MEDIUMINT", "INT", "INTEGER", "BIGINT", "YEAR",
+		"INT2", "INT4", "INT8", "DECIMAL", "NUMERIC", "FLOAT", "DOUBLE", "REAL", "FLOAT4", "FLOAT8",
+		"MONEY", "SMALLMONEY":
+		// json.Number keeps the exact digits of decimals and big integers.
+		// NaN and Infinity stay strings.
+		if s != "" && (s[0] == '-' || s[0] >= '0' && s[0] <= '9') && json.Valid([]byte(s)) {
+			return json.Number(s)
+		}
+	case "BOOL", "BOOLEAN":
+		if b, err := strconv.ParseBool(s); err == nil {
+			return b
+		}
+	case "DATETIME", "TIMESTAMP":
+		// MySQL sends these without a zone, in the connection's time zone
+		if ts, err := time.Parse("2006-01-02 15:04:05.999999", s); err == nil {
+			return ts.Format(time.RFC3339Nano)
+		}
+	case "JSON", "JSONB":
+		if json.Valid([]byte(s)) {
+			return json.RawMessage(s)
+		}
+	}
+	return s
+}
+
+func isBinaryType(dbType string) bool {
+	switch dbType {
+	case "BINARY", "VARBINARY", "BLOB", "TINYBLOB", "MEDIUMBLOB", "LONGBLOB", "BIT", "GEOMETRY", "BYTEA", "IMAGE":
+		return true
+	}
+	return false
+}
+
+func isUUIDType(dbType string) bool {
+	return dbType == "UUID" || dbType == "UNIQUEIDENTIFIER"
+}
+
+// unwrapType strips the Nullable and LowCardinality wrappers from a
+// ClickHouse type name, so Nullable(Decimal(9, 2)) is Decimal(9, 2)
+func unwrapType(dbType string) string {
+	for {
+		inner, ok := strings.CutPrefix(dbType, "Nullable(")
+		if !ok {
+			inner, ok = strings.CutPrefix(dbType, "LowCardinality(")
+		}
+		if !ok || !strings.HasSuffix(inner, ")") {
+			return dbType
+		}
+		dbType = inner[:len(inner)-1]
+	}
+}
+
+// baseType returns a type name upper-cased and without its parameters,
+// such as DECIMAL for DuckDB's DECIMAL(18,3) or ClickHouse's
+// Nullable(Decimal(9, 2))
+func baseType(dbType string) string {
+	t, _, _ := strings.Cut(unwrapType(dbType), "(")
+	return strings.ToUpper(t)
+}
+
+// valueSize approximates the JSON size of a converted value
+func valueSize(v any) int {
+	switch v := v.(type) {
+	case nil:
+		return 4
+	case string:
+		return len(v) + 2
+	case json.Number:
+		return len(v)
+	case json.RawMessage:
+		return len(v)
+	default:
+		return 8
+	}
+}
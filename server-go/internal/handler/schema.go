@@ -0,0 +1,471 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/magenta9/ai-web-tools/server/internal/model"
+	"github.com/magenta9/ai-web-tools/server/internal/sqlguard"
+)
+
+// Kinds of schemaTable
+const (
+	tableKindTable            = "table"
+	tableKindView             = "view"
+	tableKindMaterializedView = "materialized view"
+)
+
+// schemaTable describes a table or view for the schema browser and the
+// SQL generation prompt
+type schemaTable struct {
+	Schema  string `json:"schema"`
+	Name    string `json:"name"`
+	Kind    string `json:"kind"`
+	Comment string `json:"comment,omitempty"`
+	// RowEstimate is the database's statistics estimate, nil if unknown
+	RowEstimate *int64              `json:"rowEstimate,omitempty"`
+	Columns     []*schemaColumn     `json:"columns"`
+	Indexes     []*schemaIndex      `json:"indexes,omitempty"`
+	ForeignKeys []*schemaForeignKey `json:"foreignKeys,omitempty"`
+}
+
+type schemaColumn struct {
+	Name         string   `json:"name"`
+	Type         string   `json:"type"`
+	Nullable     bool     `json:"nullable"`
+	IsPrimaryKey bool     `json:"isPrimaryKey"`
+	Comment      string   `json:"comment,omitempty"`
+	EnumValues   []string `json:"enumValues,omitempty"`
+}
+
+type schemaIndex struct {
+	Name string `json:"name"`
+	// Columns are column names, or "(expression)" for expression parts
+	Columns []string `json:"columns"`
+	Unique  bool     `json:"unique"`
+	Primary bool     `json:"primary"`
+}
+
+type schemaForeignKey struct {
+	Name              string   `json:"name"`
+	Columns           []string `json:"columns"`
+	ReferencedSchema  string   `json:"referencedSchema"`
+	ReferencedTable   string   `json:"referencedTable"`
+	ReferencedColumns []string `json:"referencedColumns"`
+}
+
+// schemaRequest selects the target database and, optionally, the schemas
+// to describe: Postgres, SQL Server and DuckDB schemas, or MySQL and
+// ClickHouse databases. By default every user schema is described, or on
+// MySQL and ClickHouse the request's database.
+type schemaRequest struct {
+	dbConfig
+	Schemas []string `json:"schemas"`
+}
+
+func (h *DBHandler) GetSchema(c *gin.Context) {
+	var req schemaRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"success": false, "error": "Host, user, and database are required"})
+		return
+	}
+	cfg := &req.dbConfig
+	if !h.resolveConnection(c, cfg) || !h.checkTarget(c, cfg, true) {
+		return
+	}
+
+	db, err := h.openDB(c, cfg)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), h.queryTimeout)
+	defer cancel()
+	in := &introspection{db: db, dialect: cfg.dialect(), catalog: cfg.Database, schemas: req.Schemas}
+	tables, err := in.run(ctx)
+	details := map[string]any{"schemas": in.schemas}
+	if len(in.warnings) > 0 {
+		details["warnings"] = in.warnings
+	}
+	h.auditDB(c, model.ActionDBSchema, cfg, err, details)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+
+	schema := gin.H{
+		"tables":    tables,
+		"schemas":   in.schemas,
+		"formatted": formatSchema(tables, cfg.defaultSchema()),
+	}
+	if len(in.warnings) > 0 {
+		schema["warnings"] = in.warnings
+	}
+	c.JSON(200, gin.H{"success": true, "schema": schema})
+}
+
+// defaultSchema is the schema queries name tables in without qualifying
+// them
+func (cfg *dbConfig) defaultSchema() string {
+	switch cfg.dialect() {
+	case sqlguard.Postgres:
+		return "public"
+	case sqlguard.MSSQL:
+		return "dbo"
+	case sqlguard.DuckDB:
+		return "main"
+	case sqlguard.SQLite:
+		if cfg.Database == "" {
+			return "main"
+		}
+	}
+	return cfg.Database
+}
+
+// introspection reads the schema of a target database. Tables and columns
+// are required; indexes, foreign keys and enums are skipped with a warning
+// when the server cannot list them, such as an older version without the
+// catalog tables.
+type introspection struct {
+	db      *sql.DB
+	dialect sqlguard.Dialect
+	// catalog is the database DuckDB reads schemas from
+	catalog  string
+	schemas  []string
+	warnings []string
+
+	tables map[[2]string]*schemaTable
+	list   []*schemaTable
+}
+
+func (in *introspection) run(ctx context.Context) ([]*schemaTable, error) {
+	q := introspectionQueries[in.dialect]
+	if len(in.schemas) == 0 {
+		if err := in.defaultSchemas(ctx, q.schemas); err != nil {
+			return nil, err
+		}
+	}
+	in.tables = map[[2]string]*schemaTable{}
+	in.list = []*schemaTable{}
+	if len(in.schemas) == 0 {
+		return in.list, nil
+	}
+
+	if err := in.query(ctx, q.tables, in.scanTable); err != nil {
+		return nil, err
+	}
+	if err := in.query(ctx, q.columns, in.scanColumn); err != nil {
+		return nil, err
+	}
+	for _, step := range []struct {
+		what  string
+		query string
+		scan  func(*sql.Rows) error
+	}{
+		{"indexes", q.indexes, in.scanIndex},
+		{"foreign keys", q.foreignKeys, in.scanForeignKey},
+		{"enums", q.enums, in.scanEnum},
+	} {
+		if step.query == "" {
+			continue
+		}
+		if err := in.query(ctx, step.query, step.scan); err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			in.warnings = append(in.warnings, fmt.Sprintf("%s: %v", step.what, err))
+		}
+	}
+
+	// Enum values shown in the type name are listed as well
+	for _, t := range in.list {
+		for _, col := range t.Columns {
+			if col.EnumValues == nil && strings.HasPrefix(baseType(col.Type), "ENUM") {
+				col.EnumValues = quotedValues(col.Type)
+			}
+		}
+	}
+	return in.list, nil
+}
+
+// defaultSchemas lists the user schemas, or takes the request's database
+// on the dialects where databases play their part
+func (in *introspection) defaultSchemas(ctx context.Context, query string) error {
+	if query == "" {
+		schema := in.catalog
+		if schema == "" && in.dialect == sqlguard.SQLite {
+			schema = "main"
+		}
+		in.schemas = []string{schema}
+		return nil
+	}
+	var args []any
+	if in.dialect == sqlguard.DuckDB {
+		args = []any{in.catalog}
+	}
+	rows, err := in.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	in.schemas = []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		in.schemas = append(in.schemas, name)
+	}
+	return rows.Err()
+}
+
+// query runs one of the introspection queries, filling its %s with
+// placeholders for the schemas, and scans each row
+func (in *introspection) query(ctx context.Context, query string, scan func(*sql.Rows) error) error {
+	var args []any
+	first := 1
+	if in.dialect == sqlguard.DuckDB {
+		// $1 is the catalog
+		args = append(args, in.catalog)
+		first = 2
+	}
+	placeholders := make([]string, len(in.schemas))
+	for i, schema := range in.schemas {
+		switch in.dialect {
+		case sqlguard.Postgres, sqlguard.DuckDB:
+			placeholders[i] = "$" + strconv.Itoa(first+i)
+		case sqlguard.MSSQL:
+			placeholders[i] = "@p" + strconv.Itoa(first+i)
+		default:
+			placeholders[i] = "?"
+		}
+		args = append(args, schema)
+	}
+
+	rows, err := in.db.QueryContext(ctx, fmt.Sprintf(query, strings.Join(placeholders, ", ")), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// The scan functions read the rows of the introspection queries, which
+// select these columns in this order
+
+// scanTable reads schema, name, kind, comment and row estimate
+func (in *introspection) scanTable(rows *sql.Rows) error {
+	var schema, name, kind string
+	var comment sql.NullString
+	var estimate sql.NullInt64
+	if err := rows.Scan(&schema, &name, &kind, &comment, &estimate); err != nil {
+		return err
+	}
+	t := &schemaTable{Schema: schema, Name: name, Kind: kind, Comment: comment.String, Columns: []*schemaColumn{}}
+	if estimate.Valid && estimate.Int64 >= 0 {
+		t.RowEstimate = &estimate.Int64
+	}
+	in.tables[[2]string{schema, name}] = t
+	in.list = append(in.list, t)
+	return nil
+}
+
+// scanColumn reads schema, table, name, type, nullability, primary key
+// flag and comment
+func (in *introspection) scanColumn(rows *sql.Rows) error {
+	var schema, table string
+	var col schemaColumn
+	var comment sql.NullString
+	if err := rows.Scan(&schema, &table, &col.Name, &col.Type, &col.Nullable, &col.IsPrimaryKey, &comment); err != nil {
+		return err
+	}
+	col.Comment = comment.String
+	if t := in.tables[[2]string{schema, table}]; t != nil {
+		t.Columns = append(t.Columns, &col)
+	}
+	return nil
+}
+
+// scanIndex reads schema, table, index name, unique and primary flags,
+// and a column, ordered by table, index and position in the index
+func (in *introspection) scanIndex(rows *sql.Rows) error {
+	var schema, table, name, column string
+	var unique, primary bool
+	if err := rows.Scan(&schema, &table, &name, &unique, &primary, &column); err != nil {
+		return err
+	}
+	t := in.tables[[2]string{schema, table}]
+	if t == nil {
+		return nil
+	}
+	if n := len(t.Indexes); n > 0 && t.Indexes[n-1].Name == name {
+		t.Indexes[n-1].Columns = append(t.Indexes[n-1].Columns, column)
+		return nil
+	}
+	t.Indexes = append(t.Indexes, &schemaIndex{Name: name, Columns: []string{column}, Unique: unique, Primary: primary})
+	return nil
+}
+
+// scanForeignKey reads schema, table, constraint name, column, and the
+// referenced schema, table and column, ordered by table, constraint and
+// position in the key
+func (in *introspection) scanForeignKey(rows *sql.Rows) error {
+	var schema, table, name, column, refSchema, refTable, refColumn string
+	if err := rows.Scan(&schema, &table, &name, &column, &refSchema, &refTable, &refColumn); err != nil {
+		return err
+	}
+	t := in.tables[[2]string{schema, table}]
+	if t == nil {
+		return nil
+	}
+	if n := len(t.ForeignKeys); n > 0 && t.ForeignKeys[n-1].Name == name {
+		fk := t.ForeignKeys[n-1]
+		fk.Columns = append(fk.Columns, column)
+		fk.ReferencedColumns = append(fk.ReferencedColumns, refColumn)
+		return nil
+	}
+	t.ForeignKeys = append(t.ForeignKeys, &schemaForeignKey{
+		Name:              name,
+		Columns:           []string{column},
+		ReferencedSchema:  refSchema,
+		ReferencedTable:   refTable,
+		ReferencedColumns: []string{refColumn},
+	})
+	return nil
+}
+
+// scanEnum reads the schema and name of a Postgres enum type and one of
+// its labels, in order, and adds the label to the columns of that type
+func (in *introspection) scanEnum(rows *sql.Rows) error {
+	var schema, typ, label string
+	if err := rows.Scan(&schema, &typ, &label); err != nil {
+		return err
+	}
+	for _, t := range in.list {
+		for _, col := range t.Columns {
+			if col.Type == typ {
+				col.EnumValues = append(col.EnumValues, label)
+			}
+		}
+	}
+	return nil
+}
+
+// quotedValues returns the quoted strings in a type name such as
+// enum('a','b') or Enum8('a' = 1, 'b' = 2)
+func quotedValues(typ string) []string {
+	var values []string
+	for i := 0; i < len(typ); i++ {
+		if typ[i] != '\'' {
+			continue
+		}
+		var v strings.Builder
+		for i++; i < len(typ); i++ {
+			if typ[i] == '\\' && i+1 < len(typ) {
+				i++
+			} else if typ[i] == '\'' {
+				if i+1 < len(typ) && typ[i+1] == '\'' {
+					i++
+				} else {
+					break
+				}
+			}
+			v.WriteByte(typ[i])
+		}
+		values = append(values, v.String())
+	}
+	return values
+}
+
+// formatSchema describes the tables as text for the SQL generation
+// prompt. Tables outside defaultSchema are qualified with their schema.
+func formatSchema(tables []*schemaTable, defaultSchema string) string {
+	qualify := func(schema, name string) string {
+		if schema == defaultSchema || schema == "" {
+			return name
+		}
+		return schema + "." + name
+	}
+	sorted := append([]*schemaTable(nil), tables...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return qualify(sorted[i].Schema, sorted[i].Name) < qualify(sorted[j].Schema, sorted[j].Name)
+	})
+
+	var b strings.Builder
+	b.WriteString("Database Schema:\n\n")
+	for _, t := range sorted {
+		kind := "Table"
+		switch t.Kind {
+		case tableKindView:
+			kind = "View"
+		case tableKindMaterializedView:
+			kind = "Materialized view"
+		}
+		fmt.Fprintf(&b, "%s: %s", kind, qualify(t.Schema, t.Name))
+		if t.RowEstimate != nil {
+			fmt.Fprintf(&b, " (~%d rows)", *t.RowEstimate)
+		}
+		if t.Comment != "" {
+			fmt.Fprintf(&b, " -- %s", oneLine(t.Comment))
+		}
+		b.WriteString("\n  Columns:\n")
+		for _, col := range t.Columns {
+			fmt.Fprintf(&b, "    - %s %s", col.Name, col.Type)
+			if col.IsPrimaryKey {
+				b.WriteString(" (PRIMARY KEY)")
+			} else if !col.Nullable {
+				b.WriteString(" NOT NULL")
+			}
+			if len(col.EnumValues) > 0 && !strings.Contains(col.Type, "'") {
+				fmt.Fprintf(&b, " ENUM('%s')", strings.Join(col.EnumValues, "', '"))
+			}
+			if col.Comment != "" {
+				fmt.Fprintf(&b, " -- %s", oneLine(col.Comment))
+			}
+			b.WriteString("\n")
+		}
+
+		// The primary key is already marked on its columns
+		var indexes []*schemaIndex
+		for _, idx := range t.Indexes {
+			if !idx.Primary {
+				indexes = append(indexes, idx)
+			}
+		}
+		if len(indexes) > 0 {
+			b.WriteString("  Indexes:\n")
+			for _, idx := range indexes {
+				unique := ""
+				if idx.Unique {
+					unique = "UNIQUE "
+				}
+				fmt.Fprintf(&b, "    - %s%s (%s)\n", unique, idx.Name, strings.Join(idx.Columns, ", "))
+			}
+		}
+		if len(t.ForeignKeys) > 0 {
+			b.WriteString("  Foreign keys:\n")
+			for _, fk := range t.ForeignKeys {
+				fmt.Fprintf(&b, "    - (%s) REFERENCES %s (%s)\n",
+					strings.Join(fk.Columns, ", "), qualify(fk.ReferencedSchema, fk.ReferencedTable), strings.Join(fk.ReferencedColumns, ", "))
+			}
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// oneLine keeps a comment on its line of the schema text
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
@@ -0,0 +1,166 @@
+package handler
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/magenta9/ai-web-tools/server/internal/model"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// maxLoginDelay caps the progressive delay between failed logins
+const maxLoginDelay = 30 * time.Second
+
+// dummyPasswordHash is compared against when a login names an unknown user,
+// so that the response takes as long as for a wrong password
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not-a-real-password"), bcrypt.DefaultCost)
+
+// Throttle keys. Logins are counted per username and per client IP so that
+// neither guessing one account from many IPs nor spraying many accounts from
+// one IP goes unchecked. Usernames are keyed whether or not they exist.
+func loginUserKey(username string) string {
+	return "login-user:" + strings.ToLower(username)
+}
+
+func loginIPKey(ip string) string {
+	return "login-ip:" + ip
+}
+
+func registerIPKey(ip string) string {
+	return "register-ip:" + ip
+}
+
+// loginDelay is the wait required after the given number of consecutive
+// failures: 1s, 2s, 4s, ... up to maxLoginDelay
+func loginDelay(failures int) time.Duration {
+	if failures <= 0 {
+		return 0
+	}
+	if failures > 6 {
+		return maxLoginDelay
+	}
+	return min(time.Second<<(failures-1), maxLoginDelay)
+}
+
+// checkThrottle responds with 429 and returns false if key is locked, or if
+// progressive is set and the delay since its last failure has not passed
+func (h *AuthHandler) checkThrottle(c *gin.Context, key string, progressive bool) bool {
+	t, err := h.Repo.GetThrottle(c.Request.Context(), key, h.Config.LoginFailureWindow)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check rate limit"})
+		return false
+	}
+
+	wait := t.LockedFor
+	if progressive {
+		wait = max(wait, loginDelay(t.Failures)-t.SinceLastFailure)
+	}
+	if wait <= 0 {
+		return true
+	}
+
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many attempts, try again later"})
+	return false
+}
+
+// recordFailure counts a failure against key, locking it once limit is hit
+func (h *AuthHandler) recordFailure(c *gin.Context, key string, limit int) {
+	failures, err := h.Repo.IncrementThrottle(c.Request.Context(), key,
+		h.Config.LoginFailureWindow, limit, h.Config.LoginLockout)
+	if err != nil {
+		log.Printf("Warning: failed to record auth failure for %s: %v", key, err)
+		return
+	}
+	if failures == limit {
+		log.Printf("Locking %s for %s after %d failures", key, h.Config.LoginLockout, failures)
+	}
+}
+
+// reauthWindow is how recently a user without a password must have signed
+// in through single sign-on to confirm a sensitive action without a code
+const reauthWindow = 10 * time.Minute
+
+// confirmIdentity confirms a sensitive action of a signed-in user with
+// their password, or, for users signed up through single sign-on who have
+// none, with a two-factor code or a recent sign-on. It responds and
+// returns false if the action is not confirmed.
+func (h *AuthHandler) confirmIdentity(c *gin.Context, user *model.User, password, code, action, mismatch string) bool {
+	if user.PasswordHash != "" {
+		if password == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "The password is required"})
+			return false
+		}
+		return h.checkPassword(c, user, password, action, mismatch)
+	}
+
+	if code != "" && user.TwoFactorEnabled {
+		return h.checkSecondFactor(c, user, code, action)
+	}
+	fresh, err := h.Repo.IsSessionFresh(c.Request.Context(), c.GetString("session_id"), user.ID, reauthWindow)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check session"})
+		return false
+	}
+	if !fresh {
+		h.auditUser(c, action, model.OutcomeFailure, user.ID, map[string]any{"reason": "sign-in too old"})
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error":         "Sign in again with single sign-on, or enter a two-factor code, to confirm",
+			"reauth_window": int(reauthWindow.Seconds()),
+		})
+		return false
+	}
+	return true
+}
+
+// checkSecondFactor confirms a sensitive action with a TOTP or recovery
+// code, under the two-factor lockout
+func (h *AuthHandler) checkSecondFactor(c *gin.Context, user *model.User, code, action string) bool {
+	key := twoFactorUserKey(user.ID)
+	if !h.checkThrottle(c, key, true) {
+		h.auditUser(c, action, model.OutcomeDenied, user.ID, map[string]any{"reason": "throttled"})
+		return false
+	}
+	ok, err := h.verifySecondFactor(c, user.ID, code)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify code"})
+		return false
+	}
+	if !ok {
+		h.recordFailure(c, key, h.Config.LoginMaxFailures)
+		h.auditUser(c, action, model.OutcomeFailure, user.ID, map[string]any{"reason": "invalid code"})
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+		return false
+	}
+	if _, err := h.Repo.ClearThrottle(c.Request.Context(), key); err != nil {
+		log.Printf("Warning: failed to clear two-factor failures for %s: %v", key, err)
+	}
+	return true
+}
+
+// checkPassword confirms a sensitive action of a signed-in user with their
+// password, responding with mismatch if it is wrong. Failures count toward
+// the same lockout as logins, so a stolen access token cannot be used to
+// guess the password.
+func (h *AuthHandler) checkPassword(c *gin.Context, user *model.User, password, action, mismatch string) bool {
+	key := loginUserKey(user.Username)
+	if !h.checkThrottle(c, key, true) {
+		h.auditUser(c, action, model.OutcomeDenied, user.ID, map[string]any{"reason": "throttled"})
+		return false
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
+		h.recordFailure(c, key, h.Config.LoginMaxFailures)
+		h.auditUser(c, action, model.OutcomeFailure, user.ID, map[string]any{"reason": "wrong password"})
+		c.JSON(http.StatusUnauthorized, gin.H{"error": mismatch})
+		return false
+	}
+	if _, err := h.Repo.ClearThrottle(c.Request.Context(), key); err != nil {
+		log.Printf("Warning: failed to clear login failures for %s: %v", key, err)
+	}
+	return true
+}
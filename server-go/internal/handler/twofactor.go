@@ -0,0 +1,296 @@
+package handler
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/magenta9/ai-web-tools/server/internal/auth"
+	"github.com/magenta9/ai-web-tools/server/internal/model"
+)
+
+// totpIssuer is the account label shown in authenticator apps
+const totpIssuer = "AI Web Tools"
+
+// recoveryCodeCount is the number of recovery codes issued at a time
+const recoveryCodeCount = 10
+
+func twoFactorUserKey(userID int) string {
+	return "2fa-user:" + strconv.Itoa(userID)
+}
+
+// LoginTwoFactor completes a login by exchanging the challenge token from
+// Login and a TOTP or recovery code for a session
+func (h *AuthHandler) LoginTwoFactor(c *gin.Context) {
+	var req model.TwoFactorLoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID, err := h.Tokens.ParseChallenge(req.ChallengeToken)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired challenge"})
+		return
+	}
+
+	key := twoFactorUserKey(userID)
+	if !h.checkThrottle(c, key, true) {
+		h.auditUser(c, model.ActionLoginTwoFactor, model.OutcomeDenied, userID, map[string]any{"reason": "throttled"})
+		return
+	}
+
+	ok, err := h.verifySecondFactor(c, userID, req.Code)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify code"})
+		return
+	}
+	if !ok {
+		h.recordFailure(c, key, h.Config.LoginMaxFailures)
+		h.auditUser(c, model.ActionLoginTwoFactor, model.OutcomeFailure, userID, map[string]any{"reason": "invalid code"})
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+		return
+	}
+	if _, err := h.Repo.ClearThrottle(c.Request.Context(), key); err != nil {
+		log.Printf("Warning: failed to clear two-factor failures for %s: %v", key, err)
+	}
+
+	user, err := h.Repo.GetUserByID(userID)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired challenge"})
+		return
+	}
+
+	resp, err := h.startSession(c, user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+	h.auditUser(c, model.ActionLoginTwoFactor, model.OutcomeSuccess, userID, nil)
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// SetupTwoFactor starts enrollment by generating a new secret. It takes
+// effect only after EnableTwoFactor confirms a code from it.
+func (h *AuthHandler) SetupTwoFactor(c *gin.Context) {
+	user, ok := h.currentUser(c)
+	if !ok {
+		return
+	}
+
+	secret, err := auth.NewTOTPSecret()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate secret"})
+		return
+	}
+
+	pending, err := h.Repo.SetPendingTOTP(c.Request.Context(), user.ID, secret)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store secret"})
+		return
+	}
+	if !pending {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"secret":      secret,
+		"otpauth_uri": auth.TOTPURI(totpIssuer, user.Username, secret),
+	})
+}
+
+// EnableTwoFactor confirms enrollment with a code from the pending secret
+// and returns the recovery codes. They are not shown again.
+func (h *AuthHandler) EnableTwoFactor(c *gin.Context) {
+	user, ok := h.currentUser(c)
+	if !ok {
+		return
+	}
+
+	var req model.TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	state, err := h.Repo.GetTOTP(ctx, user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load two-factor settings"})
+		return
+	}
+	if state.Enabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+		return
+	}
+	if state.Secret == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Call /api/auth/2fa/setup first"})
+		return
+	}
+
+	ok, err = h.verifyTOTP(c, user.ID, state, req.Code)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify code"})
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate recovery codes"})
+		return
+	}
+	if err := h.Repo.EnableTOTP(ctx, user.ID, hashes); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to enable two-factor authentication"})
+		return
+	}
+	h.auditUser(c, model.ActionTwoFactorEnable, model.OutcomeSuccess, user.ID, nil)
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "recovery_codes": codes})
+}
+
+// DisableTwoFactor turns two-factor authentication off. It requires the
+// password, if the user has one, and a TOTP or recovery code.
+func (h *AuthHandler) DisableTwoFactor(c *gin.Context) {
+	user, ok := h.currentUser(c)
+	if !ok {
+		return
+	}
+
+	var req model.DisableTwoFactorRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// Users signed up through single sign-on have no password; the code
+	// stands in for it
+	if user.PasswordHash != "" && !h.confirmIdentity(c, user, req.Password, "", model.ActionTwoFactorDisable, "Password is incorrect") {
+		return
+	}
+	if !h.checkSecondFactor(c, user, req.Code, model.ActionTwoFactorDisable) {
+		return
+	}
+
+	if err := h.Repo.DisableTOTP(c.Request.Context(), user.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to disable two-factor authentication"})
+		return
+	}
+	h.auditUser(c, model.ActionTwoFactorDisable, model.OutcomeSuccess, user.ID, nil)
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes after checking a TOTP
+// code
+func (h *AuthHandler) RegenerateRecoveryCodes(c *gin.Context) {
+	user, ok := h.currentUser(c)
+	if !ok {
+		return
+	}
+
+	var req model.TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	state, err := h.Repo.GetTOTP(ctx, user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load two-factor settings"})
+		return
+	}
+	if !state.Enabled {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Two-factor authentication is not enabled"})
+		return
+	}
+
+	key := twoFactorUserKey(user.ID)
+	if !h.checkThrottle(c, key, true) {
+		return
+	}
+	ok, err = h.verifyTOTP(c, user.ID, state, req.Code)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify code"})
+		return
+	}
+	if !ok {
+		h.recordFailure(c, key, h.Config.LoginMaxFailures)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate recovery codes"})
+		return
+	}
+	if err := h.Repo.ReplaceRecoveryCodes(ctx, user.ID, hashes); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store recovery codes"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "recovery_codes": codes})
+}
+
+// TwoFactorStatus reports whether two-factor authentication is enabled and
+// how many recovery codes are left
+func (h *AuthHandler) TwoFactorStatus(c *gin.Context) {
+	user, ok := h.currentUser(c)
+	if !ok {
+		return
+	}
+
+	remaining, err := h.Repo.CountRecoveryCodes(c.Request.Context(), user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load two-factor settings"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"enabled": user.TwoFactorEnabled, "recovery_codes_remaining": remaining})
+}
+
+// verifySecondFactor accepts either a current TOTP code or an unused
+// recovery code of a user with two-factor authentication enabled
+func (h *AuthHandler) verifySecondFactor(c *gin.Context, userID int, code string) (bool, error) {
+	ctx := c.Request.Context()
+	state, err := h.Repo.GetTOTP(ctx, userID)
+	if err != nil || !state.Enabled {
+		return false, err
+	}
+
+	if ok, err := h.verifyTOTP(c, userID, state, code); ok || err != nil {
+		return ok, err
+	}
+	return h.Repo.UseRecoveryCode(ctx, userID, auth.HashToken(auth.NormalizeRecoveryCode(code)))
+}
+
+// verifyTOTP checks a TOTP code and consumes its time step so that the same
+// code cannot be replayed
+func (h *AuthHandler) verifyTOTP(c *gin.Context, userID int, state *model.TOTPState, code string) (bool, error) {
+	counter, ok := auth.ValidateTOTP(state.Secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+	return h.Repo.UseTOTPCounter(c.Request.Context(), userID, counter)
+}
+
+// newRecoveryCodes returns fresh recovery codes and the hashes to store
+func newRecoveryCodes() ([]string, []string, error) {
+	codes, err := auth.NewRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		return nil, nil, err
+	}
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = auth.HashToken(code)
+	}
+	return codes, hashes, nil
+}
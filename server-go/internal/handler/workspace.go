@@ -0,0 +1,338 @@
+package handler
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/magenta9/ai-web-tools/server/internal/model"
+	"github.com/magenta9/ai-web-tools/server/internal/repository"
+)
+
+// WorkspaceHandler serves workspaces, their members and invitations
+type WorkspaceHandler struct {
+	repo *repository.Repository
+}
+
+func NewWorkspaceHandler(repo *repository.Repository) *WorkspaceHandler {
+	return &WorkspaceHandler{repo: repo}
+}
+
+func (h *WorkspaceHandler) Create(c *gin.Context) {
+	var req model.WorkspaceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"success": false, "error": "name is required and at most 100 characters"})
+		return
+	}
+
+	ws := &model.Workspace{Name: req.Name}
+	if err := h.repo.CreateWorkspace(c.Request.Context(), ws, c.GetInt("user_id")); err != nil {
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+
+	c.JSON(201, gin.H{"success": true, "workspace": ws})
+}
+
+// List returns the workspaces the user belongs to
+func (h *WorkspaceHandler) List(c *gin.Context) {
+	workspaces, err := h.repo.ListWorkspaces(c.Request.Context(), c.GetInt("user_id"))
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true, "workspaces": workspaces})
+}
+
+// Get returns a workspace with its members
+func (h *WorkspaceHandler) Get(c *gin.Context) {
+	ws, ok := h.workspace(c, false)
+	if !ok {
+		return
+	}
+
+	members, err := h.repo.ListWorkspaceMembers(c.Request.Context(), ws.ID)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true, "workspace": ws, "members": members})
+}
+
+func (h *WorkspaceHandler) Rename(c *gin.Context) {
+	ws, ok := h.workspace(c, true)
+	if !ok {
+		return
+	}
+
+	var req model.WorkspaceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"success": false, "error": "name is required and at most 100 characters"})
+		return
+	}
+
+	found, err := h.repo.RenameWorkspace(c.Request.Context(), ws.ID, req.Name, c.GetInt("user_id"))
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+	if !found {
+		c.JSON(404, gin.H{"success": false, "error": "workspace not found"})
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true})
+}
+
+// Delete deletes a workspace together with everything in it
+func (h *WorkspaceHandler) Delete(c *gin.Context) {
+	ws, ok := h.workspace(c, true)
+	if !ok {
+		return
+	}
+
+	if _, err := h.repo.DeleteWorkspace(c.Request.Context(), ws.ID); err != nil {
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true})
+}
+
+func (h *WorkspaceHandler) ListMembers(c *gin.Context) {
+	ws, ok := h.workspace(c, false)
+	if !ok {
+		return
+	}
+
+	members, err := h.repo.ListWorkspaceMembers(c.Request.Context(), ws.ID)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true, "members": members})
+}
+
+func (h *WorkspaceHandler) UpdateMemberRole(c *gin.Context) {
+	ws, ok := h.workspace(c, true)
+	if !ok {
+		return
+	}
+	userID, ok := parseUserIDParam(c)
+	if !ok {
+		return
+	}
+
+	var req model.UpdateMemberRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil || !model.IsValidWorkspaceRole(req.Role) {
+		c.JSON(400, gin.H{"success": false, "error": "role must be owner, editor or viewer"})
+		return
+	}
+
+	err := h.repo.UpdateWorkspaceMemberRole(c.Request.Context(), ws.ID, userID, req.Role, c.GetInt("user_id"))
+	if !h.memberChangeOK(c, err) {
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true})
+}
+
+// RemoveMember removes a member. Owners may remove anyone; every member
+// may remove themselves to leave the workspace.
+func (h *WorkspaceHandler) RemoveMember(c *gin.Context) {
+	userID, ok := parseUserIDParam(c)
+	if !ok {
+		return
+	}
+	ws, ok := h.workspace(c, userID != c.GetInt("user_id"))
+	if !ok {
+		return
+	}
+
+	err := h.repo.RemoveWorkspaceMember(c.Request.Context(), ws.ID, userID, c.GetInt("user_id"))
+	if !h.memberChangeOK(c, err) {
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true})
+}
+
+// Invite invites an existing user by username
+func (h *WorkspaceHandler) Invite(c *gin.Context) {
+	ws, ok := h.workspace(c, true)
+	if !ok {
+		return
+	}
+
+	var req model.InviteMemberRequest
+	if err := c.ShouldBindJSON(&req); err != nil || !model.IsValidWorkspaceRole(req.Role) {
+		c.JSON(400, gin.H{"success": false, "error": "username is required and role must be owner, editor or viewer"})
+		return
+	}
+
+	inv, err := h.repo.CreateWorkspaceInvitation(c.Request.Context(), ws.ID, req.Username, req.Role, c.GetInt("user_id"))
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(404, gin.H{"success": false, "error": "user not found"})
+		return
+	}
+	if errors.Is(err, repository.ErrAlreadyMember) || errors.Is(err, repository.ErrInvitationPending) {
+		c.JSON(409, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+
+	c.JSON(201, gin.H{"success": true, "invitation": inv})
+}
+
+// ListInvitations returns a workspace's pending invitations
+func (h *WorkspaceHandler) ListInvitations(c *gin.Context) {
+	ws, ok := h.workspace(c, true)
+	if !ok {
+		return
+	}
+
+	invitations, err := h.repo.ListWorkspaceInvitations(c.Request.Context(), ws.ID)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true, "invitations": invitations})
+}
+
+func (h *WorkspaceHandler) RevokeInvitation(c *gin.Context) {
+	ws, ok := h.workspace(c, true)
+	if !ok {
+		return
+	}
+	id, err := strconv.ParseInt(c.Param("invitationId"), 10, 64)
+	if err != nil || id <= 0 {
+		c.JSON(400, gin.H{"success": false, "error": "invalid invitation id"})
+		return
+	}
+
+	found, err := h.repo.RevokeWorkspaceInvitation(c.Request.Context(), ws.ID, id, c.GetInt("user_id"))
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+	if !found {
+		c.JSON(404, gin.H{"success": false, "error": "invitation not found"})
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true})
+}
+
+// Audit returns the workspace's membership changes, newest first
+func (h *WorkspaceHandler) Audit(c *gin.Context) {
+	ws, ok := h.workspace(c, true)
+	if !ok {
+		return
+	}
+
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	entries, err := h.repo.ListWorkspaceAudit(c.Request.Context(), ws.ID, limit)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true, "audit": entries})
+}
+
+// MyInvitations returns the pending invitations addressed to the user
+func (h *WorkspaceHandler) MyInvitations(c *gin.Context) {
+	invitations, err := h.repo.ListUserInvitations(c.Request.Context(), c.GetInt("user_id"))
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true, "invitations": invitations})
+}
+
+func (h *WorkspaceHandler) AcceptInvitation(c *gin.Context) {
+	h.respond(c, true)
+}
+
+func (h *WorkspaceHandler) DeclineInvitation(c *gin.Context) {
+	h.respond(c, false)
+}
+
+func (h *WorkspaceHandler) respond(c *gin.Context, accept bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || id <= 0 {
+		c.JSON(400, gin.H{"success": false, "error": "invalid id"})
+		return
+	}
+
+	found, err := h.repo.RespondWorkspaceInvitation(c.Request.Context(), id, c.GetInt("user_id"), accept)
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		return
+	}
+	if !found {
+		c.JSON(404, gin.H{"success": false, "error": "invitation not found or expired"})
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true})
+}
+
+// workspace loads the workspace named by the :id parameter, writing an
+// error response if the user is not a member, or not an owner when
+// ownerOnly is set
+func (h *WorkspaceHandler) workspace(c *gin.Context, ownerOnly bool) (*model.Workspace, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id <= 0 {
+		c.JSON(400, gin.H{"success": false, "error": "invalid id"})
+		return nil, false
+	}
+
+	ws, err := h.repo.GetWorkspace(c.Request.Context(), id, c.GetInt("user_id"))
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(404, gin.H{"success": false, "error": "workspace not found"})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+		return nil, false
+	}
+	if ownerOnly && ws.Role != model.WorkspaceOwner {
+		c.JSON(403, gin.H{"success": false, "error": "only workspace owners can do this"})
+		return nil, false
+	}
+	return ws, true
+}
+
+// memberChangeOK writes the error response for a failed membership change
+func (h *WorkspaceHandler) memberChangeOK(c *gin.Context, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, pgx.ErrNoRows):
+		c.JSON(404, gin.H{"success": false, "error": "member not found"})
+	case errors.Is(err, repository.ErrLastOwner):
+		c.JSON(409, gin.H{"success": false, "error": err.Error()})
+	default:
+		c.JSON(500, gin.H{"success": false, "error": err.Error()})
+	}
+	return false
+}
+
+func parseUserIDParam(c *gin.Context) (int, bool) {
+	userID, err := strconv.Atoi(c.Param("userId"))
+	if err != nil || userID <= 0 {
+		c.JSON(400, gin.H{"success": false, "error": "invalid user id"})
+		return 0, false
+	}
+	return userID, true
+}
@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/magenta9/ai-web-tools/server/internal/model"
+)
+
+// What a member created in a shared workspace stays there when they delete
+// their account, and goes to the owner
+func TestDeleteMemberKeepsWorkspaceContent(t *testing.T) {
+	repo := testRepository(t)
+	owner := testUser(t, repo)
+	member := testUser(t, repo)
+	ctx := context.Background()
+
+	ws := &model.Workspace{Name: "shared"}
+	if err := repo.CreateWorkspace(ctx, ws, owner.ID); err != nil {
+		t.Fatal(err)
+	}
+	inv, err := repo.CreateWorkspaceInvitation(ctx, ws.ID, member.Username, model.WorkspaceEditor, owner.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := repo.RespondWorkspaceInvitation(ctx, inv.ID, member.ID, true); err != nil || !ok {
+		t.Fatalf("accept invitation: %v, %v", ok, err)
+	}
+
+	shared := model.Caller{UserID: member.ID, WorkspaceID: ws.ID, WorkspaceRole: model.WorkspaceEditor}
+	personal := model.Caller{UserID: member.ID}
+	prompt, err := repo.CreatePrompt(ctx, &model.Prompt{Title: "runbook", Content: "x"}, shared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	personalPrompt, err := repo.CreatePrompt(ctx, &model.Prompt{Title: "notes", Content: "x"}, personal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chat := &model.ChatSession{Model: "llama3"}
+	if err := repo.CreateChatSession(ctx, chat, shared); err != nil {
+		t.Fatal(err)
+	}
+	conn := &model.DBConnection{Name: "reporting", Type: "postgres", Host: "db.internal", Port: 5432, User: "reporter"}
+	if conn.ID, err = repo.NextDBConnectionID(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.CreateDBConnection(ctx, conn, nil, shared); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repo.DeleteUser(ctx, member.ID); err != nil {
+		t.Fatalf("delete member: %v", err)
+	}
+
+	ownerCaller := model.Caller{UserID: owner.ID, WorkspaceID: ws.ID, WorkspaceRole: model.WorkspaceOwner}
+	if p, err := repo.GetPrompt(ctx, prompt.ID, ownerCaller); err != nil {
+		t.Errorf("workspace prompt: %v", err)
+	} else if p.UserID == nil || *p.UserID != owner.ID {
+		t.Errorf("workspace prompt belongs to %v, want the owner %d", p.UserID, owner.ID)
+	}
+	if s, err := repo.GetChatSession(ctx, chat.ID, ownerCaller); err != nil {
+		t.Errorf("workspace chat session: %v", err)
+	} else if s.UserID == nil || *s.UserID != owner.ID {
+		t.Errorf("workspace chat session belongs to %v, want the owner %d", s.UserID, owner.ID)
+	}
+	if c, _, err := repo.GetDBConnection(ctx, conn.ID, ownerCaller); err != nil {
+		t.Errorf("workspace connection: %v", err)
+	} else if c.UserID != owner.ID {
+		t.Errorf("workspace connection belongs to %d, want the owner %d", c.UserID, owner.ID)
+	}
+
+	if _, err := repo.GetPrompt(ctx, personalPrompt.ID, personal); !errors.Is(err, pgx.ErrNoRows) {
+		t.Errorf("the member's personal prompt: %v, want it deleted", err)
+	}
+}
@@ -8,7 +8,6 @@ import (
 	"io"
 	"net/http"
 	"strings"
-	"time"
 
 	"github.com/magenta9/ai-web-tools/server/internal/config"
 )
@@ -51,15 +50,15 @@ type anthropicResponse struct {
 	} `json:"error"`
 }
 
-func NewAnthropicProvider(cfg *config.Config) *AnthropicProvider {
-	baseURL := cfg.AnthropicBaseURL
+func NewAnthropicProvider(pc config.ProviderConfig) *AnthropicProvider {
+	baseURL := pc.BaseURL
 	if baseURL == "" {
 		baseURL = "https://api.anthropic.com"
 	}
 	return &AnthropicProvider{
-		apiKey:  cfg.AnthropicAPIKey,
+		apiKey:  pc.APIKey,
 		baseURL: baseURL,
-		client:  &http.Client{Timeout: 120 * time.Second},
+		client:  &http.Client{Timeout: providerTimeout(pc)},
 	}
 }
 
@@ -6,20 +6,25 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	"time"
 
 	"github.com/magenta9/ai-web-tools/server/internal/config"
 )
 
 type OllamaProvider struct {
 	host   string
+	apiKey string
 	client *http.Client
 }
 
-func NewOllamaProvider(cfg *config.Config) *OllamaProvider {
+func NewOllamaProvider(pc config.ProviderConfig) *OllamaProvider {
+	host := pc.BaseURL
+	if host == "" {
+		host = "http://localhost:11434"
+	}
 	return &OllamaProvider{
-		host:   cfg.OllamaHost,
-		client: &http.Client{Timeout: 120 * time.Second},
+		host:   host,
+		apiKey: pc.APIKey,
+		client: &http.Client{Timeout: providerTimeout(pc)},
 	}
 }
 
@@ -52,7 +57,7 @@ func (p *OllamaProvider) Chat(messages []Message, model string) (string, error)
 		return "", fmt.Errorf("marshal request: %w", err)
 	}
 
-	resp, err := http.Post(p.host+"/api/chat", "application/json", bytes.NewBuffer(jsonData))
+	resp, err := p.post("/api/chat", jsonData)
 	if err != nil {
 		return "", fmt.Errorf("request failed: %w", err)
 	}
@@ -98,7 +103,7 @@ func (p *OllamaProvider) Generate(prompt string, model string) (string, error) {
 		return "", fmt.Errorf("marshal request: %w", err)
 	}
 
-	resp, err := http.Post(p.host+"/api/generate", "application/json", bytes.NewBuffer(jsonData))
+	resp, err := p.post("/api/generate", jsonData)
 	if err != nil {
 		return "", fmt.Errorf("request failed: %w", err)
 	}
@@ -120,3 +125,15 @@ func (p *OllamaProvider) Generate(prompt string, model string) (string, error) {
 
 	return "", fmt.Errorf("invalid response format")
 }
+
+func (p *OllamaProvider) post(path string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest("POST", p.host+path, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+p.apiKey)
+	}
+	return p.client.Do(req)
+}
@@ -11,13 +11,13 @@ type OpenAIProvider struct {
 	baseURL string
 }
 
-func NewOpenAIProvider(cfg *config.Config) *OpenAIProvider {
-	baseURL := cfg.OpenAIBaseURL
+func NewOpenAIProvider(pc config.ProviderConfig) *OpenAIProvider {
+	baseURL := pc.BaseURL
 	if baseURL == "" {
 		baseURL = "https://api.openai.com/v1"
 	}
 	return &OpenAIProvider{
-		apiKey:  cfg.OpenAIAPIKey,
+		apiKey:  pc.APIKey,
 		baseURL: baseURL,
 	}
 }
@@ -1,6 +1,9 @@
 package llm
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/magenta9/ai-web-tools/server/internal/config"
 )
 
@@ -30,13 +33,24 @@ type LLMProvider interface {
 	GetProviderType() ProviderType
 }
 
-// NewProvider 根据配置返回对应的 provider
-func NewProvider(cfg *config.Config) LLMProvider {
-	if cfg.AnthropicAPIKey != "" {
-		return NewAnthropicProvider(cfg)
+// NewProvider 根据实例配置创建对应类型的 provider
+func NewProvider(pc config.ProviderConfig) (LLMProvider, error) {
+	switch pc.Type {
+	case config.ProviderTypeOllama:
+		return NewOllamaProvider(pc), nil
+	case config.ProviderTypeOpenAI:
+		return NewOpenAIProvider(pc), nil
+	case config.ProviderTypeAnthropic:
+		return NewAnthropicProvider(pc), nil
+	default:
+		return nil, fmt.Errorf("unknown provider type %q", pc.Type)
 	}
-	if cfg.OpenAIAPIKey != "" {
-		return NewOpenAIProvider(cfg)
+}
+
+// providerTimeout 返回实例的请求超时，未配置时默认 120 秒
+func providerTimeout(pc config.ProviderConfig) time.Duration {
+	if pc.Timeout > 0 {
+		return time.Duration(pc.Timeout) * time.Second
 	}
-	return NewOllamaProvider(cfg)
+	return 120 * time.Second
 }
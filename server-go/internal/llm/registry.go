@@ -0,0 +1,116 @@
+package llm
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/magenta9/ai-web-tools/server/internal/config"
+)
+
+// Instance is a named, configured provider
+type Instance struct {
+	Config   config.ProviderConfig
+	Provider LLMProvider
+}
+
+// Registry holds every configured provider instance. Model IDs are
+// namespaced as "<instance>/<model>"; IDs without a known instance prefix
+// are sent to the default instance.
+type Registry struct {
+	instances   []*Instance
+	byName      map[string]*Instance
+	defaultName string
+}
+
+// NewRegistry creates providers for every instance in cfg.Providers
+func NewRegistry(cfg *config.Config) *Registry {
+	r := &Registry{byName: make(map[string]*Instance)}
+
+	for _, pc := range cfg.Providers {
+		p, err := NewProvider(pc)
+		if err != nil {
+			log.Printf("Warning: skipping provider %q: %v", pc.Name, err)
+			continue
+		}
+		inst := &Instance{Config: pc, Provider: p}
+		r.instances = append(r.instances, inst)
+		r.byName[pc.Name] = inst
+	}
+
+	r.defaultName = cfg.DefaultProvider
+	if _, ok := r.byName[r.defaultName]; !ok {
+		r.defaultName = r.pickDefault()
+	}
+	return r
+}
+
+// pickDefault prefers hosted providers over Ollama, matching the
+// behaviour of the single-host configuration.
+func (r *Registry) pickDefault() string {
+	for _, t := range []string{config.ProviderTypeAnthropic, config.ProviderTypeOpenAI, config.ProviderTypeOllama} {
+		for _, inst := range r.instances {
+			if inst.Config.Type == t {
+				return inst.Config.Name
+			}
+		}
+	}
+	return ""
+}
+
+// Instances returns all instances in configuration order
+func (r *Registry) Instances() []*Instance {
+	return r.instances
+}
+
+// Get returns the instance with the given name
+func (r *Registry) Get(name string) (*Instance, bool) {
+	inst, ok := r.byName[name]
+	return inst, ok
+}
+
+// Default returns the default instance, or nil when none is configured
+func (r *Registry) Default() *Instance {
+	return r.byName[r.defaultName]
+}
+
+// builtinDefaultModels are used by instances without a default_model, as
+// the single-host configuration did
+var builtinDefaultModels = map[string]string{
+	config.ProviderTypeOllama:    "llama3.2",
+	config.ProviderTypeAnthropic: "claude-3-5-sonnet-20241022",
+}
+
+// Resolve maps a (possibly namespaced) model ID to its provider and the
+// model name understood by that provider. An empty model resolves to the
+// instance's default model, or the built-in default for its type.
+func (r *Registry) Resolve(modelID string) (LLMProvider, string, error) {
+	inst := r.Default()
+	model := modelID
+
+	if name, rest, ok := strings.Cut(modelID, "/"); ok {
+		if named, found := r.byName[name]; found {
+			inst = named
+			model = rest
+		}
+	}
+
+	if inst == nil {
+		return nil, "", fmt.Errorf("no LLM provider configured")
+	}
+	if model == "" {
+		model = inst.Config.DefaultModel
+	}
+	if model == "" {
+		model = builtinDefaultModels[inst.Config.Type]
+	}
+	if model == "" {
+		return nil, "", fmt.Errorf("a model is required: provider %q has no default_model", inst.Config.Name)
+	}
+	return inst.Provider, model, nil
+}
+
+// ModelID returns the namespaced ID of a model served by an instance
+func ModelID(instance, model string) string {
+	return instance + "/" + model
+}
@@ -0,0 +1,49 @@
+package llm
+
+import (
+	"testing"
+
+	"github.com/magenta9/ai-web-tools/server/internal/config"
+)
+
+func TestResolveDefaultModel(t *testing.T) {
+	r := NewRegistry(&config.Config{
+		DefaultProvider: "claude",
+		Providers: []config.ProviderConfig{
+			{Name: "claude", Type: config.ProviderTypeAnthropic},
+			{Name: "local", Type: config.ProviderTypeOllama, DefaultModel: "qwen2.5:32b"},
+			{Name: "gpt", Type: config.ProviderTypeOpenAI},
+		},
+	})
+
+	tests := []struct {
+		modelID string
+		want    string
+		wantErr bool
+	}{
+		{"", "claude-3-5-sonnet-20241022", false},
+		{"claude/", "claude-3-5-sonnet-20241022", false},
+		{"claude-3-opus", "claude-3-opus", false},
+		{"local/", "qwen2.5:32b", false},
+		{"local/llama3.1", "llama3.1", false},
+		{"gpt/gpt-4o", "gpt-4o", false},
+		{"gpt/", "", true},
+	}
+	for _, tt := range tests {
+		_, model, err := r.Resolve(tt.modelID)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Resolve(%q) error = %v, wantErr %v", tt.modelID, err, tt.wantErr)
+			continue
+		}
+		if model != tt.want {
+			t.Errorf("Resolve(%q) model = %q, want %q", tt.modelID, model, tt.want)
+		}
+	}
+}
+
+func TestResolveWithoutProviders(t *testing.T) {
+	r := NewRegistry(&config.Config{})
+	if _, _, err := r.Resolve("llama3.2"); err == nil {
+		t.Error("Resolve with no providers should fail")
+	}
+}
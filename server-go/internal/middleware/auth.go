@@ -1,17 +1,37 @@
 package middleware
 
 import (
-	"fmt"
+	"context"
+	"errors"
+	"log"
 	"net/http"
-	"os"
+	"slices"
 	"strings"
 
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v5"
+	"github.com/magenta9/ai-web-tools/server/internal/auth"
+	"github.com/magenta9/ai-web-tools/server/internal/model"
 )
 
-func AuthMiddleware() gin.HandlerFunc {
+// AuthStore is the persistence the middleware needs to check sessions and
+// API keys; the repository implements it
+type AuthStore interface {
+	IsSessionActive(ctx context.Context, sessionID string) (bool, error)
+	GetActiveAPIKey(ctx context.Context, keyHash string) (*model.APIKey, error)
+	TouchAPIKey(ctx context.Context, id int64) error
+	GetUserRole(ctx context.Context, userID int) (string, error)
+}
+
+// AuthMiddleware accepts a JWT or an API key, either as a bearer token or
+// in the X-API-Key header. When store is nil (no database) only JWTs are
+// accepted and session revocation is not checked.
+func AuthMiddleware(tokens *auth.TokenManager, store AuthStore) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		if key := c.GetHeader("X-API-Key"); key != "" {
+			authenticateAPIKey(c, store, key)
+			return
+		}
+
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header is required"})
@@ -26,40 +46,137 @@ func AuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
-		tokenString := parts[1]
-		secret := os.Getenv("JWT_SECRET")
-		if secret == "" {
-			secret = "default-dev-secret" // Fallback for dev
+		if strings.HasPrefix(parts[1], model.APIKeyPrefix) {
+			authenticateAPIKey(c, store, parts[1])
+			return
 		}
 
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-			}
-			return []byte(secret), nil
-		})
-
-		if err != nil || !token.Valid {
+		claims, err := tokens.Parse(parts[1])
+		// Access tokens carry no typ; anything else, such as a two-factor
+		// challenge, must not authenticate requests
+		if err == nil && claims["typ"] != nil {
+			err = errors.New("not an access token")
+		}
+		if err != nil {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
 			c.Abort()
 			return
 		}
 
-		claims, ok := token.Claims.(jwt.MapClaims)
+		userIDFloat, ok := claims["user_id"].(float64)
 		if !ok {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token claims"})
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid user ID in token"})
 			c.Abort()
 			return
 		}
 
-		userIDFloat, ok := claims["user_id"].(float64)
-		if !ok {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid user ID in token"})
+		// Tokens issued before sessions existed carry no sid and simply expire
+		if sid, ok := claims["sid"].(string); ok && store != nil {
+			active, err := store.IsSessionActive(c.Request.Context(), sid)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify session"})
+				c.Abort()
+				return
+			}
+			if !active {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Session has been revoked"})
+				c.Abort()
+				return
+			}
+			c.Set("session_id", sid)
+		}
+
+		userID := int(userIDFloat)
+		if !setRole(c, store, userID) {
+			return
+		}
+		c.Set("user_id", userID)
+		c.Next()
+	}
+}
+
+// setRole loads the user's current role so that role changes take effect
+// immediately instead of when the token expires
+func setRole(c *gin.Context, store AuthStore, userID int) bool {
+	if store == nil {
+		c.Set("role", model.RoleMember)
+		return true
+	}
+
+	role, err := store.GetUserRole(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User no longer exists"})
+		c.Abort()
+		return false
+	}
+	c.Set("role", role)
+	return true
+}
+
+func authenticateAPIKey(c *gin.Context, store AuthStore, key string) {
+	if store == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "API keys are unavailable"})
+		c.Abort()
+		return
+	}
+
+	ctx := c.Request.Context()
+	apiKey, err := store.GetActiveAPIKey(ctx, auth.HashToken(key))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired API key"})
+		c.Abort()
+		return
+	}
+
+	if err := store.TouchAPIKey(ctx, apiKey.ID); err != nil {
+		log.Printf("Warning: failed to record API key use: %v", err)
+	}
+
+	if !setRole(c, store, apiKey.UserID) {
+		return
+	}
+	c.Set("user_id", apiKey.UserID)
+	c.Set("api_key_id", apiKey.ID)
+	c.Set("scopes", apiKey.Scopes)
+	c.Next()
+}
+
+// RequireScope limits API keys to routes covered by their scopes. Session
+// tokens are not scoped and always pass.
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		scopes, isKey := c.Get("scopes")
+		if isKey && !slices.Contains(scopes.([]string), scope) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "API key is missing scope: " + scope})
 			c.Abort()
 			return
 		}
+		c.Next()
+	}
+}
 
-		c.Set("user_id", int(userIDFloat))
+// RequirePermission allows the request only if the user's role grants perm
+func RequirePermission(perm model.Permission) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		role := c.GetString("role")
+		if !model.RoleHasPermission(role, perm) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// SessionOnly rejects API keys, for routes such as key management that
+// must only be reachable from an interactive login
+func SessionOnly() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, isKey := c.Get("api_key_id"); isKey {
+			c.JSON(http.StatusForbidden, gin.H{"error": "This endpoint cannot be used with an API key"})
+			c.Abort()
+			return
+		}
 		c.Next()
 	}
 }
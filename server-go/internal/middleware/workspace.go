@@ -0,0 +1,76 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/magenta9/ai-web-tools/server/internal/model"
+)
+
+// WorkspaceStore looks up workspace membership; the repository implements it
+type WorkspaceStore interface {
+	GetWorkspaceRole(ctx context.Context, workspaceID, userID int) (string, error)
+}
+
+// Workspace selects the workspace named by the X-Workspace-ID header or
+// the workspace_id query parameter, after checking that the user is a
+// member. Without either the request runs in the user's personal scope.
+// Workspaces the user does not belong to are reported as not found.
+func Workspace(store WorkspaceStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		raw := c.GetHeader(model.WorkspaceHeader)
+		if raw == "" {
+			raw = c.Query("workspace_id")
+		}
+		if raw == "" {
+			c.Next()
+			return
+		}
+
+		workspaceID, err := strconv.Atoi(raw)
+		if err != nil || workspaceID <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid workspace ID"})
+			c.Abort()
+			return
+		}
+		if store == nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Workspaces are unavailable"})
+			c.Abort()
+			return
+		}
+
+		role, err := store.GetWorkspaceRole(c.Request.Context(), workspaceID, c.GetInt("user_id"))
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Workspace not found"})
+			c.Abort()
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check workspace membership"})
+			c.Abort()
+			return
+		}
+
+		c.Set("workspace_id", workspaceID)
+		c.Set("workspace_role", role)
+		c.Next()
+	}
+}
+
+// WorkspaceWriter rejects changes by viewers of the selected workspace.
+// The personal scope always passes.
+func WorkspaceWriter() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		caller := model.Caller{WorkspaceID: c.GetInt("workspace_id"), WorkspaceRole: c.GetString("workspace_role")}
+		if !caller.CanEditWorkspace() {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Viewers cannot change workspace content"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
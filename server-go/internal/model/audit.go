@@ -0,0 +1,82 @@
+package model
+
+import "time"
+
+// Audit outcomes
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+	// OutcomeDenied is a request refused by a policy, such as a lockout or
+	// the read-only check, rather than one that failed
+	OutcomeDenied = "denied"
+)
+
+// Audit log actions
+const (
+	ActionLogin            = "auth.login"
+	ActionLoginTwoFactor   = "auth.login_2fa"
+	ActionSSOLogin         = "auth.sso_login"
+	ActionLogout           = "auth.logout"
+	ActionLogoutAll        = "auth.logout_all"
+	ActionRegister         = "auth.register"
+	ActionPasswordChange   = "auth.password_change"
+	ActionAccountDelete    = "auth.account_delete"
+	ActionTwoFactorEnable  = "auth.2fa_enable"
+	ActionTwoFactorDisable = "auth.2fa_disable"
+	ActionRoleChange       = "admin.role_change"
+	ActionUnlock           = "admin.unlock"
+	ActionAuditExport      = "admin.audit_export"
+	ActionDBConnect        = "db.connect"
+	ActionDBDatabases      = "db.databases"
+	ActionDBSchema         = "db.schema"
+	ActionDBExecute        = "db.execute"
+	ActionDBExport         = "db.export"
+	ActionConnectionCreate = "db.connection_create"
+	ActionConnectionUpdate = "db.connection_update"
+	ActionConnectionDelete = "db.connection_delete"
+	ActionConnectionWrites = "admin.connection_writes"
+	ActionDBWritePreview   = "db.write_preview"
+	ActionDBWriteCommit    = "db.write_commit"
+	ActionDBFileUpload     = "db.file_upload"
+	ActionDBFileDelete     = "db.file_delete"
+	ActionPromptCreate     = "prompt.create"
+	ActionPromptUpdate     = "prompt.update"
+	ActionPromptDelete     = "prompt.delete"
+	ActionHistoryDelete    = "history.delete"
+	ActionHistoryClear     = "history.clear"
+)
+
+// AuditEvent is one entry of the append-only audit log
+type AuditEvent struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	ActorID   *int      `json:"actor_id"`
+	ActorName string    `json:"actor_name,omitempty"`
+	APIKeyID  *int64    `json:"api_key_id,omitempty"`
+	Action    string    `json:"action"`
+	// TargetType and TargetID name what the action was applied to, such as
+	// a prompt ID or a database
+	TargetType string         `json:"target_type,omitempty"`
+	TargetID   string         `json:"target_id,omitempty"`
+	IP         string         `json:"ip,omitempty"`
+	UserAgent  string         `json:"user_agent,omitempty"`
+	Outcome    string         `json:"outcome"`
+	Details    map[string]any `json:"details,omitempty"`
+}
+
+// AuditFilter selects audit log entries. Zero fields match everything. An
+// Action ending in * matches by prefix.
+type AuditFilter struct {
+	ActorID    int
+	Action     string
+	TargetType string
+	TargetID   string
+	Outcome    string
+	IP         string
+	Since      *time.Time
+	Until      *time.Time
+	// BeforeID continues a listing after the last entry of the previous
+	// page
+	BeforeID int64
+	Limit    int
+}
@@ -0,0 +1,61 @@
+package model
+
+import "time"
+
+// DBConnection is a saved target database connection. The password is
+// stored encrypted and never returned.
+type DBConnection struct {
+	ID          int       `json:"id"`
+	UserID      int       `json:"user_id"`
+	WorkspaceID *int      `json:"workspace_id"`
+	Name        string    `json:"name"`
+	Type        string    `json:"type"`
+	Host        string    `json:"host"`
+	Port        int       `json:"port"`
+	User        string    `json:"user"`
+	Database    string    `json:"database"`
+	SSL         bool      `json:"ssl"`
+	HasPassword bool      `json:"has_password"`
+	AllowWrites bool      `json:"allow_writes"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// DBConnectionRequest creates or updates a saved connection. On update a
+// nil Password keeps the stored one and an empty one removes it.
+type DBConnectionRequest struct {
+	Name     string  `json:"name" binding:"required,max=100"`
+	Type     string  `json:"type" binding:"omitempty,oneof=mysql postgres mssql clickhouse"`
+	Host     string  `json:"host" binding:"required,max=255"`
+	Port     int     `json:"port" binding:"min=0,max=65535"`
+	User     string  `json:"user" binding:"required,max=255"`
+	Password *string `json:"password"`
+	Database string  `json:"database" binding:"max=255"`
+	SSL      bool    `json:"ssl"`
+}
+
+// ConnectionWritesRequest lets an admin enable or disable writes through a
+// saved connection
+type ConnectionWritesRequest struct {
+	AllowWrites *bool `json:"allow_writes" binding:"required"`
+}
+
+// DBWriteRequest previews a write through a saved connection that allows
+// writes. Writes always go to the connection's own database.
+type DBWriteRequest struct {
+	ConnectionID int    `json:"connection_id" binding:"required,min=1"`
+	SQL          string `json:"sql" binding:"required"`
+}
+
+// DBWriteConfirmRequest commits a previewed write
+type DBWriteConfirmRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+// DBWriteConfirmation is a previewed write waiting to be confirmed
+type DBWriteConfirmation struct {
+	ConnectionID int
+	SQL          string
+	RowsAffected int64
+	ExpiresAt    time.Time
+}
@@ -0,0 +1,24 @@
+package model
+
+import "time"
+
+// Identity links a user to an account at an OpenID Connect provider
+type Identity struct {
+	ID          int64      `json:"id"`
+	UserID      int        `json:"user_id"`
+	Issuer      string     `json:"issuer"`
+	Subject     string     `json:"subject"`
+	Email       string     `json:"email,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	LastLoginAt *time.Time `json:"last_login_at,omitempty"`
+}
+
+// OIDCLoginState is kept between the redirect to the provider and the
+// callback
+type OIDCLoginState struct {
+	State        string
+	Nonce        string
+	CodeVerifier string
+	// LinkUserID is set when a signed-in user is linking an identity
+	LinkUserID *int
+}
@@ -0,0 +1,29 @@
+package model
+
+import "time"
+
+// InvitePrefix marks invite codes so they are recognizable when pasted
+const InvitePrefix = "inv_"
+
+// Invite is a registration invite code. The code itself is only returned
+// when the invite is created.
+type Invite struct {
+	ID        int64      `json:"id"`
+	Prefix    string     `json:"prefix"`
+	CodeHash  string     `json:"-"`
+	Note      string     `json:"note,omitempty"`
+	MaxUses   int        `json:"max_uses"`
+	Uses      int        `json:"uses"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	CreatedBy *int       `json:"created_by"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// CreateInviteRequest creates an invite. MaxUses defaults to 1 (single
+// use) and ExpiresAt to seven days from now.
+type CreateInviteRequest struct {
+	Note      string     `json:"note" binding:"max=200"`
+	MaxUses   int        `json:"max_uses" binding:"min=0,max=10000"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
@@ -10,18 +10,71 @@ type ToolHistory struct {
 	CreatedAt  time.Time `json:"created_at"`
 }
 
+type ChatSession struct {
+	ID          int64         `json:"id"`
+	UserID      *int          `json:"user_id"`
+	WorkspaceID *int          `json:"workspace_id"`
+	Title       string        `json:"title"`
+	Model       string        `json:"model"`
+	Messages    []ChatMessage `json:"messages"`
+	CreatedAt   time.Time     `json:"created_at"`
+	UpdatedAt   time.Time     `json:"updated_at"`
+}
+
+type ChatMessage struct {
+	Role      string    `json:"role"`
+	Content   string    `json:"content"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
 type Config struct {
 	Key       string    `json:"key"`
 	Value     any       `json:"value"`
 	UpdatedAt time.Time `json:"updated_at"`
 }
 
+// Prompt visibility levels
+const (
+	VisibilityPrivate = "private" // owner only
+	VisibilityTeam    = "team"    // the workspace, or every signed-in user for personal prompts
+	VisibilityPublic  = "public"  // also listed without signing in
+)
+
 type Prompt struct {
-	ID        int64     `json:"id"`
-	Title     string    `json:"title"`
-	Content   string    `json:"content"`
-	Tags      []string  `json:"tags"`
-	UseCount  int       `json:"use_count"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID          int64     `json:"id"`
+	UserID      *int      `json:"user_id"`
+	WorkspaceID *int      `json:"workspace_id"`
+	Visibility  string    `json:"visibility"`
+	Title       string    `json:"title"`
+	Content     string    `json:"content"`
+	Tags        []string  `json:"tags"`
+	UseCount    int       `json:"use_count"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// IsValidVisibility reports whether v is a known visibility level
+func IsValidVisibility(v string) bool {
+	return v == VisibilityPrivate || v == VisibilityTeam || v == VisibilityPublic
+}
+
+// Caller identifies the user a repository query runs on behalf of. The zero
+// value is an anonymous caller that can only see public data.
+type Caller struct {
+	UserID int
+	Role   string
+	// WorkspaceID is the selected workspace, 0 for the personal scope
+	WorkspaceID   int
+	WorkspaceRole string
+}
+
+// IsAdmin reports whether the caller has the admin role
+func (c Caller) IsAdmin() bool {
+	return c.Role == RoleAdmin
+}
+
+// CanEditWorkspace reports whether the caller may change shared content in
+// the selected workspace. Personal content is always editable by its owner.
+func (c Caller) CanEditWorkspace() bool {
+	return c.WorkspaceID == 0 || c.WorkspaceRole == WorkspaceOwner || c.WorkspaceRole == WorkspaceEditor
 }
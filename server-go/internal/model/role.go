@@ -0,0 +1,49 @@
+package model
+
+import "slices"
+
+// User roles
+const (
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+	RoleViewer = "viewer"
+)
+
+// Roles lists every valid role, most privileged first
+var Roles = []string{RoleAdmin, RoleMember, RoleViewer}
+
+// Permission names an action guarded by the permission middleware
+type Permission string
+
+const (
+	PermUseLLM      Permission = "llm:use"
+	PermQueryDB     Permission = "db:query"
+	PermEditPrompts Permission = "prompts:edit"
+	PermManageUsers Permission = "users:manage"
+)
+
+var rolePermissions = map[string][]Permission{
+	RoleAdmin:  {PermUseLLM, PermQueryDB, PermEditPrompts, PermManageUsers},
+	RoleMember: {PermUseLLM, PermQueryDB, PermEditPrompts},
+	RoleViewer: {PermUseLLM},
+}
+
+// RoleHasPermission reports whether role grants perm
+func RoleHasPermission(role string, perm Permission) bool {
+	return slices.Contains(rolePermissions[role], perm)
+}
+
+// IsValidRole reports whether role is one of Roles
+func IsValidRole(role string) bool {
+	return slices.Contains(Roles, role)
+}
+
+// MorePrivileged reports whether role a ranks above role b
+func MorePrivileged(a, b string) bool {
+	i, j := slices.Index(Roles, a), slices.Index(Roles, b)
+	return i >= 0 && (j < 0 || i < j)
+}
+
+type UpdateRoleRequest struct {
+	Role string `json:"role" binding:"required"`
+}
@@ -0,0 +1,29 @@
+package model
+
+import "time"
+
+// Session is one login. Access tokens reference it by ID, and revoking it
+// invalidates them together with the session's refresh tokens.
+type Session struct {
+	ID         string     `json:"id"`
+	UserID     int        `json:"user_id"`
+	UserAgent  string     `json:"user_agent"`
+	IPAddress  string     `json:"ip_address"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt time.Time  `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// RefreshToken is a single-use token, stored as a SHA-256 hash
+type RefreshToken struct {
+	ID        int64
+	SessionID string
+	UserID    int
+	Expired   bool
+	UsedAt    *time.Time
+	Revoked   bool
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
@@ -0,0 +1,20 @@
+package model
+
+import "time"
+
+// Throttle is the recent failure record of one throttle key, such as a
+// username or client IP
+type Throttle struct {
+	// Failures is the number of failures in the current window
+	Failures int
+	// SinceLastFailure is the time elapsed since the most recent failure
+	SinceLastFailure time.Duration
+	// LockedFor is how much longer the key stays locked, zero if it is not
+	LockedFor time.Duration
+}
+
+// UnlockRequest clears the login throttling of a username, an IP, or both
+type UnlockRequest struct {
+	Username string `json:"username"`
+	IP       string `json:"ip"`
+}
@@ -0,0 +1,87 @@
+package model
+
+import "time"
+
+// Workspace roles. Owners manage members; editors change shared content;
+// viewers only read it.
+const (
+	WorkspaceOwner  = "owner"
+	WorkspaceEditor = "editor"
+	WorkspaceViewer = "viewer"
+)
+
+// WorkspaceRoles lists every valid workspace role
+var WorkspaceRoles = []string{WorkspaceOwner, WorkspaceEditor, WorkspaceViewer}
+
+// WorkspaceHeader selects the workspace a request runs in. The
+// workspace_id query parameter does the same.
+const WorkspaceHeader = "X-Workspace-ID"
+
+// Workspace audit actions
+const (
+	AuditWorkspaceCreated   = "workspace.created"
+	AuditWorkspaceRenamed   = "workspace.renamed"
+	AuditMemberInvited      = "member.invited"
+	AuditMemberJoined       = "member.joined"
+	AuditInvitationDeclined = "invitation.declined"
+	AuditInvitationRevoked  = "invitation.revoked"
+	AuditMemberRoleChanged  = "member.role_changed"
+	AuditMemberRemoved      = "member.removed"
+	AuditMemberLeft         = "member.left"
+)
+
+type Workspace struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	CreatedBy *int      `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+	// Role is the requesting user's role in the workspace
+	Role string `json:"role,omitempty"`
+}
+
+type WorkspaceMember struct {
+	UserID   int       `json:"user_id"`
+	Username string    `json:"username"`
+	Role     string    `json:"role"`
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+type WorkspaceInvitation struct {
+	ID            int64     `json:"id"`
+	WorkspaceID   int       `json:"workspace_id"`
+	WorkspaceName string    `json:"workspace_name,omitempty"`
+	InviteeID     int       `json:"invitee_id"`
+	Invitee       string    `json:"invitee"`
+	Role          string    `json:"role"`
+	InvitedBy     *int      `json:"invited_by"`
+	Status        string    `json:"status"`
+	CreatedAt     time.Time `json:"created_at"`
+	ExpiresAt     time.Time `json:"expires_at"`
+}
+
+type WorkspaceAuditEntry struct {
+	ID           int64          `json:"id"`
+	ActorID      *int           `json:"actor_id"`
+	Action       string         `json:"action"`
+	TargetUserID *int           `json:"target_user_id"`
+	Details      map[string]any `json:"details,omitempty"`
+	CreatedAt    time.Time      `json:"created_at"`
+}
+
+type WorkspaceRequest struct {
+	Name string `json:"name" binding:"required,max=100"`
+}
+
+type InviteMemberRequest struct {
+	Username string `json:"username" binding:"required"`
+	Role     string `json:"role" binding:"required"`
+}
+
+type UpdateMemberRoleRequest struct {
+	Role string `json:"role" binding:"required"`
+}
+
+// IsValidWorkspaceRole reports whether role is one of WorkspaceRoles
+func IsValidWorkspaceRole(role string) bool {
+	return role == WorkspaceOwner || role == WorkspaceEditor || role == WorkspaceViewer
+}
@@ -3,9 +3,13 @@ package repository
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/magenta9/ai-web-tools/server/internal/config"
 	"github.com/magenta9/ai-web-tools/server/internal/model"
@@ -52,8 +56,8 @@ func (r *Repository) Close() {
 func (r *Repository) CreateUser(u *model.User) error {
 	var id int
 	err := r.pool.QueryRow(context.Background(),
-		`INSERT INTO users (username, password_hash) VALUES ($1, $2) RETURNING id, created_at`,
-		u.Username, u.PasswordHash).Scan(&id, &u.CreatedAt)
+		`INSERT INTO users (username, password_hash, email) VALUES ($1, $2, NULLIF($3, '')) RETURNING id, role, created_at`,
+		u.Username, u.PasswordHash, u.Email).Scan(&id, &u.Role, &u.CreatedAt)
 	if err != nil {
 		return err
 	}
@@ -61,11 +65,47 @@ func (r *Repository) CreateUser(u *model.User) error {
 	return nil
 }
 
+// ErrInvalidInvite is returned for an unknown, expired, revoked or used up
+// invite code
+var ErrInvalidInvite = errors.New("invalid or expired invite code")
+
+// CreateUserWithInvite creates a user and consumes one use of the invite
+// with the given hash, atomically so that concurrent sign-ups cannot use a
+// code more often than allowed
+func (r *Repository) CreateUserWithInvite(ctx context.Context, u *model.User, inviteHash string) error {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var inviteID int64
+	err = tx.QueryRow(ctx,
+		`UPDATE invite_codes SET uses = uses + 1
+		 WHERE code_hash = $1 AND revoked_at IS NULL AND expires_at > NOW() AND uses < max_uses
+		 RETURNING id`, inviteHash).Scan(&inviteID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrInvalidInvite
+	}
+	if err != nil {
+		return err
+	}
+
+	err = tx.QueryRow(ctx,
+		`INSERT INTO users (username, password_hash, email, invite_code_id)
+		 VALUES ($1, $2, NULLIF($3, ''), $4) RETURNING id, role, created_at`,
+		u.Username, u.PasswordHash, u.Email, inviteID).Scan(&u.ID, &u.Role, &u.CreatedAt)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
 func (r *Repository) GetUserByUsername(username string) (*model.User, error) {
 	var u model.User
 	err := r.pool.QueryRow(context.Background(),
-		`SELECT id, username, password_hash, created_at FROM users WHERE username = $1`,
-		username).Scan(&u.ID, &u.Username, &u.PasswordHash, &u.CreatedAt)
+		`SELECT id, username, password_hash, COALESCE(email, ''), role, totp_enabled, created_at FROM users WHERE username = $1`,
+		username).Scan(&u.ID, &u.Username, &u.PasswordHash, &u.Email, &u.Role, &u.TwoFactorEnabled, &u.CreatedAt)
 	if err != nil {
 		return nil, err
 	}
@@ -75,204 +115,2070 @@ func (r *Repository) GetUserByUsername(username string) (*model.User, error) {
 func (r *Repository) GetUserByID(id int) (*model.User, error) {
 	var u model.User
 	err := r.pool.QueryRow(context.Background(),
-		`SELECT id, username, password_hash, created_at FROM users WHERE id = $1`,
-		id).Scan(&u.ID, &u.Username, &u.PasswordHash, &u.CreatedAt)
+		`SELECT id, username, password_hash, COALESCE(email, ''), role, totp_enabled, created_at FROM users WHERE id = $1`,
+		id).Scan(&u.ID, &u.Username, &u.PasswordHash, &u.Email, &u.Role, &u.TwoFactorEnabled, &u.CreatedAt)
 	if err != nil {
 		return nil, err
 	}
 	return &u, nil
 }
 
-func (r *Repository) SaveHistory(ctx context.Context, h *model.ToolHistory, userID int) error {
-	inputJSON, err := json.Marshal(h.InputData)
+func (r *Repository) UpdatePassword(ctx context.Context, userID int, passwordHash string) error {
+	_, err := r.pool.Exec(ctx, `UPDATE users SET password_hash = $1 WHERE id = $2`, passwordHash, userID)
+	return err
+}
+
+// DeleteUser deletes a user; history, personal chat sessions, prompts and
+// connections, sessions and API keys go with it through ON DELETE CASCADE,
+// as do workspaces the user is the only member of. Content in workspaces
+// with other members is handed to one of their owners. The last admin
+// cannot be deleted, nor the only owner of a workspace with other members
+// (ErrLastOwner).
+func (r *Repository) DeleteUser(ctx context.Context, userID int) error {
+	tx, err := r.pool.Begin(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to marshal input_data: %w", err)
+		return err
 	}
-	outputJSON, err := json.Marshal(h.OutputData)
-	if err != nil {
-		return fmt.Errorf("failed to marshal output_data: %w", err)
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `LOCK TABLE users IN SHARE ROW EXCLUSIVE MODE`); err != nil {
+		return err
 	}
 
-	_, err = r.pool.Exec(ctx,
-		`INSERT INTO tool_history (tool_name, input_data, output_data, user_id) VALUES ($1, $2, $3, $4)`,
-		h.ToolName, inputJSON, outputJSON, userID)
-	return err
-}
+	var role string
+	if err := tx.QueryRow(ctx, `SELECT role FROM users WHERE id = $1`, userID).Scan(&role); err != nil {
+		return err
+	}
+	if role == model.RoleAdmin {
+		var otherAdmins int
+		if err := tx.QueryRow(ctx,
+			`SELECT COUNT(*) FROM users WHERE role = 'admin' AND id <> $1`, userID).Scan(&otherAdmins); err != nil {
+			return err
+		}
+		if otherAdmins == 0 {
+			return ErrLastAdmin
+		}
+	}
 
-func (r *Repository) GetHistory(ctx context.Context, toolName string, userID int, limit int) ([]model.ToolHistory, error) {
-	if limit <= 0 {
-		limit = 50
+	var soleOwner bool
+	if err := tx.QueryRow(ctx,
+		`SELECT EXISTS (
+			SELECT 1 FROM workspace_members m WHERE m.user_id = $1 AND m.role = 'owner'
+			AND NOT EXISTS (SELECT 1 FROM workspace_members o
+				WHERE o.workspace_id = m.workspace_id AND o.user_id <> $1 AND o.role = 'owner')
+			AND EXISTS (SELECT 1 FROM workspace_members o
+				WHERE o.workspace_id = m.workspace_id AND o.user_id <> $1))`, userID).Scan(&soleOwner); err != nil {
+		return err
+	}
+	if soleOwner {
+		return ErrLastOwner
+	}
+	if _, err := tx.Exec(ctx,
+		`DELETE FROM workspaces w WHERE EXISTS (SELECT 1 FROM workspace_members m WHERE m.workspace_id = w.id AND m.user_id = $1)
+		 AND NOT EXISTS (SELECT 1 FROM workspace_members m WHERE m.workspace_id = w.id AND m.user_id <> $1)`, userID); err != nil {
+		return err
+	}
+
+	// What the user created in shared workspaces belongs to the workspace,
+	// so it is handed to a remaining owner rather than deleted with them
+	for _, table := range []string{"prompts", "chat_sessions", "db_connections"} {
+		if _, err := tx.Exec(ctx,
+			`UPDATE `+table+` t SET user_id = COALESCE((
+				SELECT m.user_id FROM workspace_members m WHERE m.workspace_id = t.workspace_id AND m.user_id <> $1
+				ORDER BY m.role = 'owner' DESC, m.joined_at, m.user_id LIMIT 1), t.user_id)
+			 WHERE t.user_id = $1 AND t.workspace_id IS NOT NULL`, userID); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(ctx, `DELETE FROM users WHERE id = $1`, userID); err != nil {
+		return err
 	}
+	return tx.Commit(ctx)
+}
 
+func (r *Repository) ListUsers(ctx context.Context) ([]model.User, error) {
 	rows, err := r.pool.Query(ctx,
-		`SELECT id, tool_name, input_data, output_data, created_at 
-		 FROM tool_history WHERE tool_name = $1 AND user_id = $2
-		 ORDER BY created_at DESC LIMIT $3`, toolName, userID, limit)
+		`SELECT id, username, COALESCE(email, ''), role, totp_enabled, created_at FROM users ORDER BY id`)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var results []model.ToolHistory
+	users := []model.User{}
 	for rows.Next() {
-		var h model.ToolHistory
-		var inputJSON, outputJSON []byte
-		if err := rows.Scan(&h.ID, &h.ToolName, &inputJSON, &outputJSON, &h.CreatedAt); err != nil {
+		var u model.User
+		if err := rows.Scan(&u.ID, &u.Username, &u.Email, &u.Role, &u.TwoFactorEnabled, &u.CreatedAt); err != nil {
 			return nil, err
 		}
-		if err := json.Unmarshal(inputJSON, &h.InputData); err != nil {
-			return nil, fmt.Errorf("failed to unmarshal input_data: %w", err)
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+func (r *Repository) GetUserRole(ctx context.Context, userID int) (string, error) {
+	var role string
+	err := r.pool.QueryRow(ctx, `SELECT role FROM users WHERE id = $1`, userID).Scan(&role)
+	return role, err
+}
+
+// ErrLastAdmin is returned when a role change would leave no admin
+var ErrLastAdmin = errors.New("cannot remove the last admin")
+
+// UpdateUserRole changes a user's role. Demoting the only remaining admin
+// is refused with ErrLastAdmin.
+func (r *Repository) UpdateUserRole(ctx context.Context, userID int, role string) error {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// Serialize role changes so two concurrent demotions can't both pass
+	if _, err := tx.Exec(ctx, `LOCK TABLE users IN SHARE ROW EXCLUSIVE MODE`); err != nil {
+		return err
+	}
+
+	var current string
+	if err := tx.QueryRow(ctx, `SELECT role FROM users WHERE id = $1`, userID).Scan(&current); err != nil {
+		return err
+	}
+	if current == model.RoleAdmin && role != model.RoleAdmin {
+		var otherAdmins int
+		if err := tx.QueryRow(ctx,
+			`SELECT COUNT(*) FROM users WHERE role = 'admin' AND id <> $1`, userID).Scan(&otherAdmins); err != nil {
+			return err
 		}
-		if err := json.Unmarshal(outputJSON, &h.OutputData); err != nil {
-			return nil, fmt.Errorf("failed to unmarshal output_data: %w", err)
+		if otherAdmins == 0 {
+			return ErrLastAdmin
 		}
-		results = append(results, h)
 	}
-	return results, nil
+
+	if _, err := tx.Exec(ctx, `UPDATE users SET role = $1 WHERE id = $2`, role, userID); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
 }
 
-func (r *Repository) GetConfig(ctx context.Context, key string) (*model.Config, error) {
-	var c model.Config
-	var valueJSON []byte
+// PromoteFirstAdmin makes the named user an admin if no admin exists yet.
+// It returns false if an admin already exists.
+func (r *Repository) PromoteFirstAdmin(ctx context.Context, username string) (bool, error) {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `LOCK TABLE users IN SHARE ROW EXCLUSIVE MODE`); err != nil {
+		return false, err
+	}
+
+	var admins int
+	if err := tx.QueryRow(ctx, `SELECT COUNT(*) FROM users WHERE role = 'admin'`).Scan(&admins); err != nil {
+		return false, err
+	}
+	if admins > 0 {
+		return false, nil
+	}
+
+	tag, err := tx.Exec(ctx, `UPDATE users SET role = 'admin' WHERE username = $1`, username)
+	if err != nil {
+		return false, err
+	}
+	if tag.RowsAffected() == 0 {
+		return false, pgx.ErrNoRows
+	}
+	return true, tx.Commit(ctx)
+}
+
+// Two-factor methods
+
+func (r *Repository) GetTOTP(ctx context.Context, userID int) (*model.TOTPState, error) {
+	var t model.TOTPState
+	var secret *string
 	err := r.pool.QueryRow(ctx,
-		`SELECT key, value, updated_at FROM config WHERE key = $1`, key).
-		Scan(&c.Key, &valueJSON, &c.UpdatedAt)
+		`SELECT totp_secret, totp_enabled, totp_last_counter FROM users WHERE id = $1`, userID).
+		Scan(&secret, &t.Enabled, &t.LastCounter)
 	if err != nil {
 		return nil, err
 	}
-	if err := json.Unmarshal(valueJSON, &c.Value); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal config value: %w", err)
+	if secret != nil {
+		t.Secret = *secret
 	}
-	return &c, nil
+	return &t, nil
 }
 
-func (r *Repository) SetConfig(ctx context.Context, key string, value any) error {
-	valueJSON, err := json.Marshal(value)
+// SetPendingTOTP stores a new, unconfirmed secret. It returns false if
+// two-factor authentication is already enabled.
+func (r *Repository) SetPendingTOTP(ctx context.Context, userID int, secret string) (bool, error) {
+	tag, err := r.pool.Exec(ctx,
+		`UPDATE users SET totp_secret = $2, totp_last_counter = NULL WHERE id = $1 AND NOT totp_enabled`,
+		userID, secret)
 	if err != nil {
-		return fmt.Errorf("failed to marshal config value: %w", err)
+		return false, err
 	}
-	_, err = r.pool.Exec(ctx,
-		`INSERT INTO config (key, value, updated_at) VALUES ($1, $2, NOW())
-		 ON CONFLICT (key) DO UPDATE SET value = $2, updated_at = NOW()`, key, valueJSON)
-	return err
+	return tag.RowsAffected() > 0, nil
 }
 
-func (r *Repository) DeleteHistory(ctx context.Context, id int64) error {
-	_, err := r.pool.Exec(ctx, `DELETE FROM tool_history WHERE id = $1`, id)
-	return err
+// UseTOTPCounter records the time step of an accepted code. It returns
+// false if a code from the same or a later step was already used.
+func (r *Repository) UseTOTPCounter(ctx context.Context, userID int, counter int64) (bool, error) {
+	tag, err := r.pool.Exec(ctx,
+		`UPDATE users SET totp_last_counter = $2
+		 WHERE id = $1 AND (totp_last_counter IS NULL OR totp_last_counter < $2)`,
+		userID, counter)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
 }
 
-func (r *Repository) ClearHistory(ctx context.Context, toolName string) error {
-	_, err := r.pool.Exec(ctx, `DELETE FROM tool_history WHERE tool_name = $1`, toolName)
-	return err
+// EnableTOTP turns on two-factor authentication and replaces the user's
+// recovery codes
+func (r *Repository) EnableTOTP(ctx context.Context, userID int, recoveryHashes []string) error {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `UPDATE users SET totp_enabled = TRUE WHERE id = $1`, userID); err != nil {
+		return err
+	}
+	if err := replaceRecoveryCodes(ctx, tx, userID, recoveryHashes); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
 }
 
-// Prompt methods
-func (r *Repository) CreatePrompt(ctx context.Context, p *model.Prompt) (*model.Prompt, error) {
-	var id int64
-	err := r.pool.QueryRow(ctx,
-		`INSERT INTO prompts (title, content, tags) VALUES ($1, $2, $3) RETURNING id, created_at, updated_at`,
-		p.Title, p.Content, p.Tags).Scan(&id, &p.CreatedAt, &p.UpdatedAt)
+// DisableTOTP turns off two-factor authentication and deletes the secret
+// and recovery codes
+func (r *Repository) DisableTOTP(ctx context.Context, userID int) error {
+	tx, err := r.pool.Begin(ctx)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	p.ID = id
-	return p, nil
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx,
+		`UPDATE users SET totp_enabled = FALSE, totp_secret = NULL, totp_last_counter = NULL WHERE id = $1`,
+		userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
 }
 
-func (r *Repository) GetPrompts(ctx context.Context, search string, tags []string, limit int) ([]model.Prompt, error) {
-	if limit <= 0 {
-		limit = 100
+// ReplaceRecoveryCodes invalidates the user's recovery codes and stores new
+// ones
+func (r *Repository) ReplaceRecoveryCodes(ctx context.Context, userID int, hashes []string) error {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return err
 	}
+	defer tx.Rollback(ctx)
 
-	query := `SELECT id, title, content, tags, use_count, created_at, updated_at FROM prompts WHERE 1=1`
-	args := []interface{}{}
-	argCount := 1
+	if err := replaceRecoveryCodes(ctx, tx, userID, hashes); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
 
-	if search != "" {
-		query += fmt.Sprintf(` AND (title ILIKE $%d OR content ILIKE $%d)`, argCount, argCount)
-		args = append(args, "%"+search+"%")
-		argCount++
+func replaceRecoveryCodes(ctx context.Context, tx pgx.Tx, userID int, hashes []string) error {
+	if _, err := tx.Exec(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return err
 	}
+	_, err := tx.Exec(ctx,
+		`INSERT INTO recovery_codes (user_id, code_hash) SELECT $1, unnest($2::text[])`,
+		userID, hashes)
+	return err
+}
 
-	if len(tags) > 0 {
-		query += fmt.Sprintf(` AND tags && $%d`, argCount)
-		args = append(args, tags)
-		argCount++
+// UseRecoveryCode marks an unused recovery code as used and reports whether
+// it was valid
+func (r *Repository) UseRecoveryCode(ctx context.Context, userID int, codeHash string) (bool, error) {
+	tag, err := r.pool.Exec(ctx,
+		`UPDATE recovery_codes SET used_at = NOW()
+		 WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL`,
+		userID, codeHash)
+	if err != nil {
+		return false, err
 	}
+	return tag.RowsAffected() > 0, nil
+}
 
-	query += ` ORDER BY created_at DESC LIMIT $` + fmt.Sprintf("%d", argCount)
-	args = append(args, limit)
+// CountRecoveryCodes returns how many unused recovery codes the user has
+func (r *Repository) CountRecoveryCodes(ctx context.Context, userID int) (int, error) {
+	var n int
+	err := r.pool.QueryRow(ctx,
+		`SELECT COUNT(*) FROM recovery_codes WHERE user_id = $1 AND used_at IS NULL`, userID).Scan(&n)
+	return n, err
+}
 
-	rows, err := r.pool.Query(ctx, query, args...)
+// Invite methods
+
+// CreateInvite stores an invite that expires at expiresAt, or seven days
+// from now if it is nil
+func (r *Repository) CreateInvite(ctx context.Context, inv *model.Invite, expiresAt *time.Time) error {
+	return r.pool.QueryRow(ctx,
+		`INSERT INTO invite_codes (prefix, code_hash, note, max_uses, expires_at, created_by)
+		 VALUES ($1, $2, NULLIF($3, ''), $4, COALESCE($5::timestamptz::timestamp, NOW() + INTERVAL '7 days'), $6)
+		 RETURNING id, expires_at, created_at`,
+		inv.Prefix, inv.CodeHash, inv.Note, inv.MaxUses, expiresAt, inv.CreatedBy).
+		Scan(&inv.ID, &inv.ExpiresAt, &inv.CreatedAt)
+}
+
+func (r *Repository) ListInvites(ctx context.Context) ([]model.Invite, error) {
+	rows, err := r.pool.Query(ctx,
+		`SELECT id, prefix, COALESCE(note, ''), max_uses, uses, expires_at, created_by, created_at, revoked_at
+		 FROM invite_codes ORDER BY created_at DESC`)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var results []model.Prompt
+	invites := []model.Invite{}
 	for rows.Next() {
-		var p model.Prompt
-		if err := rows.Scan(&p.ID, &p.Title, &p.Content, &p.Tags, &p.UseCount, &p.CreatedAt, &p.UpdatedAt); err != nil {
+		var i model.Invite
+		if err := rows.Scan(&i.ID, &i.Prefix, &i.Note, &i.MaxUses, &i.Uses, &i.ExpiresAt,
+			&i.CreatedBy, &i.CreatedAt, &i.RevokedAt); err != nil {
 			return nil, err
 		}
-		results = append(results, p)
+		invites = append(invites, i)
 	}
-	return results, nil
+	return invites, rows.Err()
 }
 
-func (r *Repository) GetPrompt(ctx context.Context, id int64) (*model.Prompt, error) {
-	var p model.Prompt
-	err := r.pool.QueryRow(ctx,
-		`SELECT id, title, content, tags, use_count, created_at, updated_at FROM prompts WHERE id = $1`, id).
-		Scan(&p.ID, &p.Title, &p.Content, &p.Tags, &p.UseCount, &p.CreatedAt, &p.UpdatedAt)
+// RevokeInvite revokes an invite and reports whether it existed
+func (r *Repository) RevokeInvite(ctx context.Context, id int64) (bool, error) {
+	tag, err := r.pool.Exec(ctx,
+		`UPDATE invite_codes SET revoked_at = NOW() WHERE id = $1 AND revoked_at IS NULL`, id)
 	if err != nil {
-		return nil, err
+		return false, err
 	}
-	return &p, nil
+	return tag.RowsAffected() > 0, nil
 }
 
-func (r *Repository) UpdatePrompt(ctx context.Context, p *model.Prompt) error {
-	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
-	defer cancel()
+// Identity methods
 
-	tags := p.Tags
-	if tags == nil {
-		tags = []string{}
-	}
+// uniqueViolation is the Postgres error code for a unique constraint failure
+const uniqueViolation = "23505"
+
+// ErrIdentityLinked is returned when an identity already belongs to a user
+var ErrIdentityLinked = errors.New("identity is already linked to a user")
+
+// ErrLastLoginMethod is returned when unlinking would leave a user who has
+// no password without any way to sign in
+var ErrLastLoginMethod = errors.New("cannot unlink the only sign-in method")
 
+func (r *Repository) CreateOIDCState(ctx context.Context, s *model.OIDCLoginState) error {
 	_, err := r.pool.Exec(ctx,
-		`UPDATE prompts SET title = $1, content = $2, tags = $3, updated_at = NOW() WHERE id = $4`,
-		p.Title, p.Content, tags, p.ID)
+		`INSERT INTO oidc_login_states (state, nonce, code_verifier, link_user_id) VALUES ($1, $2, $3, $4)`,
+		s.State, s.Nonce, s.CodeVerifier, s.LinkUserID)
 	return err
 }
 
-func (r *Repository) DeletePrompt(ctx context.Context, id int64) error {
-	_, err := r.pool.Exec(ctx, `DELETE FROM prompts WHERE id = $1`, id)
+// ConsumeOIDCState deletes and returns a login state no older than maxAge,
+// so that each callback can be completed only once
+func (r *Repository) ConsumeOIDCState(ctx context.Context, state string, maxAge time.Duration) (*model.OIDCLoginState, error) {
+	s := model.OIDCLoginState{State: state}
+	err := r.pool.QueryRow(ctx,
+		`DELETE FROM oidc_login_states
+		 WHERE state = $1 AND created_at > NOW() - make_interval(secs => $2)
+		 RETURNING nonce, code_verifier, link_user_id`, state, maxAge.Seconds()).
+		Scan(&s.Nonce, &s.CodeVerifier, &s.LinkUserID)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// PruneOIDCStates deletes logins that were never completed
+func (r *Repository) PruneOIDCStates(ctx context.Context, maxAge time.Duration) error {
+	_, err := r.pool.Exec(ctx,
+		`DELETE FROM oidc_login_states WHERE created_at < NOW() - make_interval(secs => $1)`, maxAge.Seconds())
 	return err
 }
 
-func (r *Repository) IncrementPromptUseCount(ctx context.Context, id int64) error {
-	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
-	defer cancel()
-	_, err := r.pool.Exec(ctx, `UPDATE prompts SET use_count = use_count + 1 WHERE id = $1`, id)
+// TouchIdentity records a login with an identity and returns its user. It
+// returns pgx.ErrNoRows if the identity is not linked.
+func (r *Repository) TouchIdentity(ctx context.Context, issuer, subject, email string) (int, error) {
+	var userID int
+	err := r.pool.QueryRow(ctx,
+		`UPDATE user_identities SET last_login_at = NOW(), email = NULLIF($3, '')
+		 WHERE issuer = $1 AND subject = $2 RETURNING user_id`,
+		issuer, subject, email).Scan(&userID)
+	return userID, err
+}
+
+// CreateSSOUser provisions a user for a new identity. The username is
+// username, or username-2, username-3, ... if it is taken. Users created
+// this way have no password.
+func (r *Repository) CreateSSOUser(ctx context.Context, username, role string, identity *model.Identity) (*model.User, error) {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	u := model.User{Email: identity.Email, Role: role}
+	for i := 1; u.ID == 0; i++ {
+		if i > 100 {
+			return nil, fmt.Errorf("no free username like %q", username)
+		}
+		candidate := username
+		if i > 1 {
+			candidate = fmt.Sprintf("%s-%d", username, i)
+		}
+		err := tx.QueryRow(ctx,
+			`INSERT INTO users (username, password_hash, email, role) VALUES ($1, '', NULLIF($2, ''), $3)
+			 ON CONFLICT (username) DO NOTHING RETURNING id, username, created_at`,
+			candidate, identity.Email, role).Scan(&u.ID, &u.Username, &u.CreatedAt)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			return nil, err
+		}
+	}
+
+	identity.UserID = u.ID
+	if err := insertIdentity(ctx, tx, identity); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// LinkIdentity links an identity to an existing user
+func (r *Repository) LinkIdentity(ctx context.Context, identity *model.Identity) error {
+	return insertIdentity(ctx, r.pool, identity)
+}
+
+func insertIdentity(ctx context.Context, q interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}, identity *model.Identity) error {
+	err := q.QueryRow(ctx,
+		`INSERT INTO user_identities (user_id, issuer, subject, email, last_login_at)
+		 VALUES ($1, $2, $3, NULLIF($4, ''), NOW()) RETURNING id, created_at`,
+		identity.UserID, identity.Issuer, identity.Subject, identity.Email).
+		Scan(&identity.ID, &identity.CreatedAt)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == uniqueViolation {
+		return ErrIdentityLinked
+	}
 	return err
 }
 
-func (r *Repository) GetAllTags(ctx context.Context) ([]string, error) {
-	rows, err := r.pool.Query(ctx, `SELECT DISTINCT unnest(tags) as tag FROM prompts ORDER BY tag`)
+func (r *Repository) ListIdentities(ctx context.Context, userID int) ([]model.Identity, error) {
+	rows, err := r.pool.Query(ctx,
+		`SELECT id, user_id, issuer, subject, COALESCE(email, ''), created_at, last_login_at
+		 FROM user_identities WHERE user_id = $1 ORDER BY id`, userID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var tags []string
+	identities := []model.Identity{}
 	for rows.Next() {
-		var tag string
-		if err := rows.Scan(&tag); err != nil {
+		var i model.Identity
+		if err := rows.Scan(&i.ID, &i.UserID, &i.Issuer, &i.Subject, &i.Email, &i.CreatedAt, &i.LastLoginAt); err != nil {
 			return nil, err
 		}
-		tags = append(tags, tag)
+		identities = append(identities, i)
 	}
-	return tags, nil
+	return identities, rows.Err()
+}
+
+// DeleteIdentity unlinks one of the user's identities and reports whether it
+// existed. A user without a password must keep at least one identity.
+func (r *Repository) DeleteIdentity(ctx context.Context, id int64, userID int) (bool, error) {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	var hasPassword bool
+	var identities int
+	if err := tx.QueryRow(ctx,
+		`SELECT password_hash <> '', (SELECT COUNT(*) FROM user_identities WHERE user_id = $1)
+		 FROM users WHERE id = $1 FOR UPDATE`, userID).Scan(&hasPassword, &identities); err != nil {
+		return false, err
+	}
+
+	tag, err := tx.Exec(ctx, `DELETE FROM user_identities WHERE id = $1 AND user_id = $2`, id, userID)
+	if err != nil {
+		return false, err
+	}
+	if tag.RowsAffected() == 0 {
+		return false, nil
+	}
+	if !hasPassword && identities <= 1 {
+		return false, ErrLastLoginMethod
+	}
+	return true, tx.Commit(ctx)
+}
+
+// Session methods
+func (r *Repository) CreateSession(ctx context.Context, s *model.Session) error {
+	return r.pool.QueryRow(ctx,
+		`INSERT INTO auth_sessions (id, user_id, user_agent, ip_address) VALUES ($1, $2, $3, $4)
+		 RETURNING created_at, last_used_at`,
+		s.ID, s.UserID, s.UserAgent, s.IPAddress).Scan(&s.CreatedAt, &s.LastUsedAt)
+}
+
+// CreateRefreshToken stores a refresh token expiring ttl from now. Expiry
+// times are computed with NOW() so they compare correctly against NOW()
+// regardless of the server and database time zones.
+func (r *Repository) CreateRefreshToken(ctx context.Context, sessionID, tokenHash string, ttl time.Duration) error {
+	_, err := r.pool.Exec(ctx,
+		`INSERT INTO refresh_tokens (session_id, token_hash, expires_at)
+		 VALUES ($1, $2, NOW() + make_interval(secs => $3))`,
+		sessionID, tokenHash, ttl.Seconds())
+	return err
+}
+
+func (r *Repository) GetRefreshToken(ctx context.Context, tokenHash string) (*model.RefreshToken, error) {
+	var t model.RefreshToken
+	err := r.pool.QueryRow(ctx,
+		`SELECT t.id, t.session_id, s.user_id, t.expires_at <= NOW(), t.used_at, s.revoked_at IS NOT NULL
+		 FROM refresh_tokens t JOIN auth_sessions s ON s.id = t.session_id
+		 WHERE t.token_hash = $1`, tokenHash).
+		Scan(&t.ID, &t.SessionID, &t.UserID, &t.Expired, &t.UsedAt, &t.Revoked)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// RotateRefreshToken marks a refresh token used and stores its successor in
+// the same session. It returns false if the token was already used, which
+// means it has been replayed.
+func (r *Repository) RotateRefreshToken(ctx context.Context, tokenID int64, sessionID, newHash string, ttl time.Duration) (bool, error) {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx,
+		`UPDATE refresh_tokens SET used_at = NOW() WHERE id = $1 AND used_at IS NULL`, tokenID)
+	if err != nil {
+		return false, err
+	}
+	if tag.RowsAffected() == 0 {
+		return false, nil
+	}
+
+	if _, err := tx.Exec(ctx,
+		`INSERT INTO refresh_tokens (session_id, token_hash, expires_at)
+		 VALUES ($1, $2, NOW() + make_interval(secs => $3))`,
+		sessionID, newHash, ttl.Seconds()); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(ctx,
+		`UPDATE auth_sessions SET last_used_at = NOW() WHERE id = $1`, sessionID); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit(ctx)
+}
+
+func (r *Repository) IsSessionActive(ctx context.Context, sessionID string) (bool, error) {
+	var active bool
+	err := r.pool.QueryRow(ctx,
+		`SELECT EXISTS (SELECT 1 FROM auth_sessions WHERE id = $1 AND revoked_at IS NULL)`,
+		sessionID).Scan(&active)
+	return active, err
+}
+
+// IsSessionFresh reports whether the active session of the user was signed
+// in within maxAge
+func (r *Repository) IsSessionFresh(ctx context.Context, sessionID string, userID int, maxAge time.Duration) (bool, error) {
+	var fresh bool
+	err := r.pool.QueryRow(ctx,
+		`SELECT EXISTS (SELECT 1 FROM auth_sessions
+		 WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL AND created_at > NOW() - make_interval(secs => $3))`,
+		sessionID, userID, maxAge.Seconds()).Scan(&fresh)
+	return fresh, err
+}
+
+func (r *Repository) RevokeSession(ctx context.Context, sessionID string) error {
+	_, err := r.pool.Exec(ctx,
+		`UPDATE auth_sessions SET revoked_at = NOW() WHERE id = $1 AND revoked_at IS NULL`, sessionID)
+	return err
+}
+
+func (r *Repository) RevokeUserSessions(ctx context.Context, userID int) error {
+	_, err := r.pool.Exec(ctx,
+		`UPDATE auth_sessions SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL`, userID)
+	return err
+}
+
+// RevokeOtherSessions revokes every session of the user except keepID
+func (r *Repository) RevokeOtherSessions(ctx context.Context, userID int, keepID string) error {
+	_, err := r.pool.Exec(ctx,
+		`UPDATE auth_sessions SET revoked_at = NOW() WHERE user_id = $1 AND id <> $2 AND revoked_at IS NULL`,
+		userID, keepID)
+	return err
+}
+
+func (r *Repository) ListSessions(ctx context.Context, userID int) ([]model.Session, error) {
+	rows, err := r.pool.Query(ctx,
+		`SELECT id, user_id, COALESCE(user_agent, ''), COALESCE(ip_address, ''), created_at, last_used_at, revoked_at
+		 FROM auth_sessions WHERE user_id = $1 ORDER BY created_at DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []model.Session{}
+	for rows.Next() {
+		var s model.Session
+		if err := rows.Scan(&s.ID, &s.UserID, &s.UserAgent, &s.IPAddress, &s.CreatedAt, &s.LastUsedAt, &s.RevokedAt); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// API key methods
+func (r *Repository) CreateAPIKey(ctx context.Context, k *model.APIKey) error {
+	return r.pool.QueryRow(ctx,
+		`INSERT INTO api_keys (user_id, name, prefix, key_hash, scopes, expires_at)
+		 VALUES ($1, $2, $3, $4, $5, $6::timestamptz) RETURNING id, created_at`,
+		k.UserID, k.Name, k.Prefix, k.KeyHash, k.Scopes, k.ExpiresAt).Scan(&k.ID, &k.CreatedAt)
+}
+
+func (r *Repository) ListAPIKeys(ctx context.Context, userID int) ([]model.APIKey, error) {
+	rows, err := r.pool.Query(ctx,
+		`SELECT id, user_id, name, prefix, scopes, expires_at, last_used_at, created_at, revoked_at
+		 FROM api_keys WHERE user_id = $1 ORDER BY created_at DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []model.APIKey{}
+	for rows.Next() {
+		var k model.APIKey
+		if err := rows.Scan(&k.ID, &k.UserID, &k.Name, &k.Prefix, &k.Scopes,
+			&k.ExpiresAt, &k.LastUsedAt, &k.CreatedAt, &k.RevokedAt); err != nil {
+			return nil, err
+		}
+		results = append(results, k)
+	}
+	return results, rows.Err()
+}
+
+// GetActiveAPIKey returns an unrevoked, unexpired key by hash
+func (r *Repository) GetActiveAPIKey(ctx context.Context, keyHash string) (*model.APIKey, error) {
+	var k model.APIKey
+	err := r.pool.QueryRow(ctx,
+		`SELECT id, user_id, name, prefix, scopes, expires_at, last_used_at, created_at
+		 FROM api_keys
+		 WHERE key_hash = $1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > NOW())`,
+		keyHash).Scan(&k.ID, &k.UserID, &k.Name, &k.Prefix, &k.Scopes, &k.ExpiresAt, &k.LastUsedAt, &k.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+// TouchAPIKey records use of a key, at most once a minute
+func (r *Repository) TouchAPIKey(ctx context.Context, id int64) error {
+	_, err := r.pool.Exec(ctx,
+		`UPDATE api_keys SET last_used_at = NOW()
+		 WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute')`, id)
+	return err
+}
+
+// RevokeAPIKey revokes one of the user's keys and reports whether it existed
+func (r *Repository) RevokeAPIKey(ctx context.Context, id int64, userID int) (bool, error) {
+	tag, err := r.pool.Exec(ctx,
+		`UPDATE api_keys SET revoked_at = NOW() WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL`,
+		id, userID)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// Throttle methods
+
+// GetThrottle returns the failure record of a throttle key. Failures older
+// than window are not counted. A key with no record has a zero Throttle.
+func (r *Repository) GetThrottle(ctx context.Context, key string, window time.Duration) (*model.Throttle, error) {
+	var failures int
+	var since, locked float64
+	err := r.pool.QueryRow(ctx,
+		`SELECT CASE WHEN window_start > NOW() - make_interval(secs => $2) THEN failures ELSE 0 END,
+		        EXTRACT(EPOCH FROM NOW() - last_failure_at)::float8,
+		        GREATEST(EXTRACT(EPOCH FROM COALESCE(locked_until, NOW()) - NOW()), 0)::float8
+		 FROM auth_throttle WHERE key = $1`, key, window.Seconds()).
+		Scan(&failures, &since, &locked)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return &model.Throttle{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &model.Throttle{
+		Failures:         failures,
+		SinceLastFailure: time.Duration(since * float64(time.Second)),
+		LockedFor:        time.Duration(locked * float64(time.Second)),
+	}, nil
+}
+
+// IncrementThrottle records a failure for key, starting a new window if the
+// current one is older than window. Once the count reaches limit the key is
+// locked for lockout. It returns the failure count in the current window.
+func (r *Repository) IncrementThrottle(ctx context.Context, key string, window time.Duration, limit int, lockout time.Duration) (int, error) {
+	var failures int
+	err := r.pool.QueryRow(ctx,
+		`INSERT INTO auth_throttle (key, failures, window_start, last_failure_at)
+		 VALUES ($1, 1, NOW(), NOW())
+		 ON CONFLICT (key) DO UPDATE SET
+		     failures = CASE WHEN auth_throttle.window_start > NOW() - make_interval(secs => $2)
+		                     THEN auth_throttle.failures + 1 ELSE 1 END,
+		     window_start = CASE WHEN auth_throttle.window_start > NOW() - make_interval(secs => $2)
+		                         THEN auth_throttle.window_start ELSE NOW() END,
+		     last_failure_at = NOW()
+		 RETURNING failures`, key, window.Seconds()).Scan(&failures)
+	if err != nil {
+		return 0, err
+	}
+
+	if failures >= limit {
+		_, err = r.pool.Exec(ctx,
+			`UPDATE auth_throttle SET locked_until = NOW() + make_interval(secs => $2) WHERE key = $1`,
+			key, lockout.Seconds())
+	}
+	return failures, err
+}
+
+// ClearThrottle removes the failure records of the given keys and returns
+// how many existed
+func (r *Repository) ClearThrottle(ctx context.Context, keys ...string) (int64, error) {
+	tag, err := r.pool.Exec(ctx, `DELETE FROM auth_throttle WHERE key = ANY($1)`, keys)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// PruneThrottle deletes records that are neither locked nor inside window
+func (r *Repository) PruneThrottle(ctx context.Context, window time.Duration) error {
+	_, err := r.pool.Exec(ctx,
+		`DELETE FROM auth_throttle
+		 WHERE last_failure_at < NOW() - make_interval(secs => $1)
+		   AND (locked_until IS NULL OR locked_until < NOW())`, window.Seconds())
+	return err
+}
+
+func (r *Repository) SaveHistory(ctx context.Context, h *model.ToolHistory, userID int) error {
+	inputJSON, err := json.Marshal(h.InputData)
+	if err != nil {
+		return fmt.Errorf("failed to marshal input_data: %w", err)
+	}
+	outputJSON, err := json.Marshal(h.OutputData)
+	if err != nil {
+		return fmt.Errorf("failed to marshal output_data: %w", err)
+	}
+
+	_, err = r.pool.Exec(ctx,
+		`INSERT INTO tool_history (tool_name, input_data, output_data, user_id) VALUES ($1, $2, $3, $4)`,
+		h.ToolName, inputJSON, outputJSON, userID)
+	return err
+}
+
+func (r *Repository) GetHistory(ctx context.Context, toolName string, userID int, limit int) ([]model.ToolHistory, error) {
+	if limit <= 0 {
+		limit = 50
+	}
+
+	rows, err := r.pool.Query(ctx,
+		`SELECT id, tool_name, input_data, output_data, created_at 
+		 FROM tool_history WHERE tool_name = $1 AND user_id = $2
+		 ORDER BY created_at DESC LIMIT $3`, toolName, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []model.ToolHistory
+	for rows.Next() {
+		var h model.ToolHistory
+		var inputJSON, outputJSON []byte
+		if err := rows.Scan(&h.ID, &h.ToolName, &inputJSON, &outputJSON, &h.CreatedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(inputJSON, &h.InputData); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal input_data: %w", err)
+		}
+		if err := json.Unmarshal(outputJSON, &h.OutputData); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal output_data: %w", err)
+		}
+		results = append(results, h)
+	}
+	return results, nil
+}
+
+// ForEachHistory calls fn for every history entry of the user, oldest first,
+// without loading them all into memory
+func (r *Repository) ForEachHistory(ctx context.Context, userID int, fn func(*model.ToolHistory) error) error {
+	rows, err := r.pool.Query(ctx,
+		`SELECT id, tool_name, input_data, output_data, created_at
+		 FROM tool_history WHERE user_id = $1 ORDER BY created_at`, userID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var h model.ToolHistory
+		var inputJSON, outputJSON []byte
+		if err := rows.Scan(&h.ID, &h.ToolName, &inputJSON, &outputJSON, &h.CreatedAt); err != nil {
+			return err
+		}
+		if err := json.Unmarshal(inputJSON, &h.InputData); err != nil {
+			return fmt.Errorf("failed to unmarshal input_data: %w", err)
+		}
+		if err := json.Unmarshal(outputJSON, &h.OutputData); err != nil {
+			return fmt.Errorf("failed to unmarshal output_data: %w", err)
+		}
+		if err := fn(&h); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// ForEachChatSession calls fn for every chat session of the user with its
+// messages
+func (r *Repository) ForEachChatSession(ctx context.Context, userID int, fn func(*model.ChatSession) error) error {
+	rows, err := r.pool.Query(ctx,
+		`SELECT s.id, COALESCE(s.title, ''), s.model, s.created_at, s.updated_at, m.role, m.content, m.created_at
+		 FROM chat_sessions s LEFT JOIN chat_messages m ON m.session_id = s.id
+		 WHERE s.user_id = $1 ORDER BY s.id, m.created_at, m.id`, userID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var current *model.ChatSession
+	for rows.Next() {
+		var s model.ChatSession
+		var role, content *string
+		var msgCreatedAt *time.Time
+		if err := rows.Scan(&s.ID, &s.Title, &s.Model, &s.CreatedAt, &s.UpdatedAt, &role, &content, &msgCreatedAt); err != nil {
+			return err
+		}
+		if current == nil || current.ID != s.ID {
+			if current != nil {
+				if err := fn(current); err != nil {
+					return err
+				}
+			}
+			s.Messages = []model.ChatMessage{}
+			current = &s
+		}
+		if role != nil {
+			current.Messages = append(current.Messages, model.ChatMessage{Role: *role, Content: *content, CreatedAt: *msgCreatedAt})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if current != nil {
+		return fn(current)
+	}
+	return nil
+}
+
+func (r *Repository) GetConfig(ctx context.Context, key string) (*model.Config, error) {
+	var c model.Config
+	var valueJSON []byte
+	err := r.pool.QueryRow(ctx,
+		`SELECT key, value, updated_at FROM config WHERE key = $1`, key).
+		Scan(&c.Key, &valueJSON, &c.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(valueJSON, &c.Value); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal config value: %w", err)
+	}
+	return &c, nil
+}
+
+func (r *Repository) SetConfig(ctx context.Context, key string, value any) error {
+	valueJSON, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to marshal config value: %w", err)
+	}
+	_, err = r.pool.Exec(ctx,
+		`INSERT INTO config (key, value, updated_at) VALUES ($1, $2, NOW())
+		 ON CONFLICT (key) DO UPDATE SET value = $2, updated_at = NOW()`, key, valueJSON)
+	return err
+}
+
+// DeleteHistory deletes one of the user's history entries and reports
+// whether it existed
+func (r *Repository) DeleteHistory(ctx context.Context, id int64, userID int) (bool, error) {
+	tag, err := r.pool.Exec(ctx, `DELETE FROM tool_history WHERE id = $1 AND user_id = $2`, id, userID)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+func (r *Repository) ClearHistory(ctx context.Context, toolName string, userID int) error {
+	_, err := r.pool.Exec(ctx, `DELETE FROM tool_history WHERE tool_name = $1 AND user_id = $2`, toolName, userID)
+	return err
+}
+
+// Prompt methods
+
+// promptColumns is the column list scanned by scanPrompt
+const promptColumns = `id, user_id, workspace_id, visibility, title, content, tags, use_count, created_at, updated_at`
+
+func scanPrompt(row pgx.Row, p *model.Prompt) error {
+	return row.Scan(&p.ID, &p.UserID, &p.WorkspaceID, &p.Visibility, &p.Title, &p.Content, &p.Tags, &p.UseCount, &p.CreatedAt, &p.UpdatedAt)
+}
+
+// visiblePromptsClause restricts prompts to those the caller may read,
+// using $1 for the caller's user ID (0 for anonymous callers) and $2 for
+// the selected workspace (0 for the personal scope). A workspace shows only
+// its own prompts; the personal scope shows the caller's personal prompts,
+// personal team prompts and every public prompt.
+const visiblePromptsClause = `(CASE WHEN $2 > 0
+	THEN workspace_id = $2 AND (user_id = $1 OR visibility <> 'private')
+	ELSE visibility = 'public' OR ($1 > 0 AND workspace_id IS NULL AND (user_id = $1 OR visibility = 'team'))
+	END)`
+
+// editablePromptsClause restricts prompts to those the caller may change,
+// using the same parameters as visiblePromptsClause. Workspace owners and
+// editors may change any prompt of the workspace. Prompts without an owner
+// predate ownership and can only be changed by admins.
+func editablePromptsClause(caller model.Caller) string {
+	switch {
+	case caller.WorkspaceID > 0 && caller.CanEditWorkspace():
+		return `(workspace_id = $2 AND $1 > 0)`
+	case caller.WorkspaceID > 0:
+		return `(workspace_id = $2 AND user_id = $1)`
+	case caller.IsAdmin():
+		return `(workspace_id IS NULL AND $2 = 0 AND (user_id = $1 OR user_id IS NULL))`
+	}
+	return `(workspace_id IS NULL AND $2 = 0 AND user_id = $1)`
+}
+
+// workspaceArg returns the selected workspace as a nullable column value
+func workspaceArg(caller model.Caller) *int {
+	if caller.WorkspaceID == 0 {
+		return nil
+	}
+	return &caller.WorkspaceID
+}
+
+func (r *Repository) CreatePrompt(ctx context.Context, p *model.Prompt, caller model.Caller) (*model.Prompt, error) {
+	userID := caller.UserID
+	p.UserID = &userID
+	p.WorkspaceID = workspaceArg(caller)
+	if p.Visibility == "" {
+		p.Visibility = model.VisibilityPrivate
+	}
+
+	var id int64
+	err := r.pool.QueryRow(ctx,
+		`INSERT INTO prompts (title, content, tags, user_id, visibility, workspace_id) VALUES ($1, $2, $3, $4, $5, $6)
+		 RETURNING id, created_at, updated_at`,
+		p.Title, p.Content, p.Tags, userID, p.Visibility, p.WorkspaceID).Scan(&id, &p.CreatedAt, &p.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	p.ID = id
+	return p, nil
+}
+
+func (r *Repository) GetPrompts(ctx context.Context, caller model.Caller, search string, tags []string, limit int) ([]model.Prompt, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+
+	query := `SELECT ` + promptColumns + ` FROM prompts WHERE ` + visiblePromptsClause
+	args := []interface{}{caller.UserID, caller.WorkspaceID}
+	argCount := 3
+
+	if search != "" {
+		query += fmt.Sprintf(` AND (title ILIKE $%d OR content ILIKE $%d)`, argCount, argCount)
+		args = append(args, "%"+search+"%")
+		argCount++
+	}
+
+	if len(tags) > 0 {
+		query += fmt.Sprintf(` AND tags && $%d`, argCount)
+		args = append(args, tags)
+		argCount++
+	}
+
+	query += ` ORDER BY created_at DESC LIMIT $` + fmt.Sprintf("%d", argCount)
+	args = append(args, limit)
+
+	rows, err := r.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []model.Prompt
+	for rows.Next() {
+		var p model.Prompt
+		if err := scanPrompt(rows, &p); err != nil {
+			return nil, err
+		}
+		results = append(results, p)
+	}
+	return results, nil
+}
+
+// GetOwnedPrompts returns every prompt the user owns, regardless of
+// visibility or workspace
+func (r *Repository) GetOwnedPrompts(ctx context.Context, userID int) ([]model.Prompt, error) {
+	rows, err := r.pool.Query(ctx,
+		`SELECT `+promptColumns+` FROM prompts WHERE user_id = $1 ORDER BY created_at`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []model.Prompt{}
+	for rows.Next() {
+		var p model.Prompt
+		if err := scanPrompt(rows, &p); err != nil {
+			return nil, err
+		}
+		results = append(results, p)
+	}
+	return results, rows.Err()
+}
+
+func (r *Repository) GetPrompt(ctx context.Context, id int64, caller model.Caller) (*model.Prompt, error) {
+	var p model.Prompt
+	row := r.pool.QueryRow(ctx,
+		`SELECT `+promptColumns+` FROM prompts WHERE `+visiblePromptsClause+` AND id = $3`,
+		caller.UserID, caller.WorkspaceID, id)
+	if err := scanPrompt(row, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// UpdatePrompt updates a prompt the caller may edit and reports whether it
+// was found
+func (r *Repository) UpdatePrompt(ctx context.Context, p *model.Prompt, caller model.Caller) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	tags := p.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	visibility := p.Visibility
+	if visibility == "" {
+		visibility = model.VisibilityPrivate
+	}
+
+	tag, err := r.pool.Exec(ctx,
+		`UPDATE prompts SET title = $3, content = $4, tags = $5, visibility = $6, updated_at = NOW()
+		 WHERE `+editablePromptsClause(caller)+` AND id = $7`,
+		caller.UserID, caller.WorkspaceID, p.Title, p.Content, tags, visibility, p.ID)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// DeletePrompt deletes a prompt the caller may edit and reports whether it
+// was found
+func (r *Repository) DeletePrompt(ctx context.Context, id int64, caller model.Caller) (bool, error) {
+	tag, err := r.pool.Exec(ctx,
+		`DELETE FROM prompts WHERE `+editablePromptsClause(caller)+` AND id = $3`,
+		caller.UserID, caller.WorkspaceID, id)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// IncrementPromptUseCount counts a use of a prompt visible to the caller and
+// reports whether it was found
+func (r *Repository) IncrementPromptUseCount(ctx context.Context, id int64, caller model.Caller) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	tag, err := r.pool.Exec(ctx,
+		`UPDATE prompts SET use_count = use_count + 1 WHERE `+visiblePromptsClause+` AND id = $3`,
+		caller.UserID, caller.WorkspaceID, id)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+func (r *Repository) GetAllTags(ctx context.Context, caller model.Caller) ([]string, error) {
+	rows, err := r.pool.Query(ctx,
+		`SELECT DISTINCT unnest(tags) as tag FROM prompts WHERE `+visiblePromptsClause+` ORDER BY tag`,
+		caller.UserID, caller.WorkspaceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tags []string
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
+
+// Workspace methods
+
+var (
+	// ErrLastOwner is returned when a membership change would leave a
+	// workspace without an owner
+	ErrLastOwner = errors.New("a workspace needs at least one owner")
+	// ErrAlreadyMember is returned when inviting a user who is a member
+	ErrAlreadyMember = errors.New("user is already a member")
+	// ErrInvitationPending is returned when the user already has a pending
+	// invitation to the workspace
+	ErrInvitationPending = errors.New("user already has a pending invitation")
+)
+
+// workspaceInvitationTTL is how long an invitation can be accepted
+const workspaceInvitationTTL = 14 * 24 * time.Hour
+
+// querier is implemented by the pool and by transactions
+type querier interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+}
+
+// auditWorkspace records a membership change. It runs inside the
+// transaction of the change so that the two cannot diverge.
+func auditWorkspace(ctx context.Context, q querier, workspaceID, actorID int, action string, targetUserID *int, details map[string]any) error {
+	var detailsJSON []byte
+	if details != nil {
+		var err error
+		if detailsJSON, err = json.Marshal(details); err != nil {
+			return err
+		}
+	}
+	_, err := q.Exec(ctx,
+		`INSERT INTO workspace_audit (workspace_id, actor_id, action, target_user_id, details)
+		 VALUES ($1, $2, $3, $4, $5)`,
+		workspaceID, actorID, action, targetUserID, detailsJSON)
+	return err
+}
+
+// CreateWorkspace creates a workspace with the creator as its owner
+func (r *Repository) CreateWorkspace(ctx context.Context, ws *model.Workspace, ownerID int) error {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	err = tx.QueryRow(ctx,
+		`INSERT INTO workspaces (name, created_by) VALUES ($1, $2) RETURNING id, created_at`,
+		ws.Name, ownerID).Scan(&ws.ID, &ws.CreatedAt)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx,
+		`INSERT INTO workspace_members (workspace_id, user_id, role) VALUES ($1, $2, 'owner')`,
+		ws.ID, ownerID); err != nil {
+		return err
+	}
+	if err := auditWorkspace(ctx, tx, ws.ID, ownerID, model.AuditWorkspaceCreated, nil,
+		map[string]any{"name": ws.Name}); err != nil {
+		return err
+	}
+
+	ws.CreatedBy = &ownerID
+	ws.Role = model.WorkspaceOwner
+	return tx.Commit(ctx)
+}
+
+// ListWorkspaces returns the workspaces the user is a member of with the
+// user's role in each
+func (r *Repository) ListWorkspaces(ctx context.Context, userID int) ([]model.Workspace, error) {
+	rows, err := r.pool.Query(ctx,
+		`SELECT w.id, w.name, w.created_by, w.created_at, m.role
+		 FROM workspaces w JOIN workspace_members m ON m.workspace_id = w.id
+		 WHERE m.user_id = $1 ORDER BY w.name, w.id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	workspaces := []model.Workspace{}
+	for rows.Next() {
+		var w model.Workspace
+		if err := rows.Scan(&w.ID, &w.Name, &w.CreatedBy, &w.CreatedAt, &w.Role); err != nil {
+			return nil, err
+		}
+		workspaces = append(workspaces, w)
+	}
+	return workspaces, rows.Err()
+}
+
+// GetWorkspace returns a workspace the user is a member of, or
+// pgx.ErrNoRows
+func (r *Repository) GetWorkspace(ctx context.Context, id, userID int) (*model.Workspace, error) {
+	var w model.Workspace
+	err := r.pool.QueryRow(ctx,
+		`SELECT w.id, w.name, w.created_by, w.created_at, m.role
+		 FROM workspaces w JOIN workspace_members m ON m.workspace_id = w.id
+		 WHERE w.id = $1 AND m.user_id = $2`, id, userID).
+		Scan(&w.ID, &w.Name, &w.CreatedBy, &w.CreatedAt, &w.Role)
+	if err != nil {
+		return nil, err
+	}
+	return &w, nil
+}
+
+// GetWorkspaceRole returns the user's role in the workspace, or
+// pgx.ErrNoRows if the user is not a member
+func (r *Repository) GetWorkspaceRole(ctx context.Context, workspaceID, userID int) (string, error) {
+	var role string
+	err := r.pool.QueryRow(ctx,
+		`SELECT role FROM workspace_members WHERE workspace_id = $1 AND user_id = $2`,
+		workspaceID, userID).Scan(&role)
+	return role, err
+}
+
+// RenameWorkspace renames a workspace and reports whether it exists
+func (r *Repository) RenameWorkspace(ctx context.Context, id int, name string, actorID int) (bool, error) {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	var oldName string
+	err = tx.QueryRow(ctx,
+		`UPDATE workspaces w SET name = $2 FROM workspaces old
+		 WHERE w.id = $1 AND old.id = w.id RETURNING old.name`, id, name).Scan(&oldName)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := auditWorkspace(ctx, tx, id, actorID, model.AuditWorkspaceRenamed, nil,
+		map[string]any{"from": oldName, "to": name}); err != nil {
+		return false, err
+	}
+	return true, tx.Commit(ctx)
+}
+
+// DeleteWorkspace deletes a workspace with its prompts, chat sessions,
+// members and audit, and reports whether it existed
+func (r *Repository) DeleteWorkspace(ctx context.Context, id int) (bool, error) {
+	tag, err := r.pool.Exec(ctx, `DELETE FROM workspaces WHERE id = $1`, id)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+func (r *Repository) ListWorkspaceMembers(ctx context.Context, workspaceID int) ([]model.WorkspaceMember, error) {
+	rows, err := r.pool.Query(ctx,
+		`SELECT m.user_id, u.username, m.role, m.joined_at
+		 FROM workspace_members m JOIN users u ON u.id = m.user_id
+		 WHERE m.workspace_id = $1 ORDER BY m.joined_at, m.user_id`, workspaceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []model.WorkspaceMember{}
+	for rows.Next() {
+		var m model.WorkspaceMember
+		if err := rows.Scan(&m.UserID, &m.Username, &m.Role, &m.JoinedAt); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+// lockWorkspaceMember locks the workspace's membership and returns the
+// user's role and the number of other owners. Locking every member row
+// serializes changes so two owners can't demote each other concurrently.
+func lockWorkspaceMember(ctx context.Context, tx pgx.Tx, workspaceID, userID int) (string, int, error) {
+	rows, err := tx.Query(ctx,
+		`SELECT user_id, role FROM workspace_members WHERE workspace_id = $1 FOR UPDATE`, workspaceID)
+	if err != nil {
+		return "", 0, err
+	}
+	defer rows.Close()
+
+	role := ""
+	otherOwners := 0
+	for rows.Next() {
+		var id int
+		var r string
+		if err := rows.Scan(&id, &r); err != nil {
+			return "", 0, err
+		}
+		if id == userID {
+			role = r
+		} else if r == model.WorkspaceOwner {
+			otherOwners++
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return "", 0, err
+	}
+	if role == "" {
+		return "", 0, pgx.ErrNoRows
+	}
+	return role, otherOwners, nil
+}
+
+// UpdateWorkspaceMemberRole changes a member's role. It returns
+// pgx.ErrNoRows for non-members and ErrLastOwner when demoting the only
+// owner.
+func (r *Repository) UpdateWorkspaceMemberRole(ctx context.Context, workspaceID, userID int, role string, actorID int) error {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	current, otherOwners, err := lockWorkspaceMember(ctx, tx, workspaceID, userID)
+	if err != nil {
+		return err
+	}
+	if current == role {
+		return nil
+	}
+	if current == model.WorkspaceOwner && otherOwners == 0 {
+		return ErrLastOwner
+	}
+
+	if _, err := tx.Exec(ctx,
+		`UPDATE workspace_members SET role = $3 WHERE workspace_id = $1 AND user_id = $2`,
+		workspaceID, userID, role); err != nil {
+		return err
+	}
+	if err := auditWorkspace(ctx, tx, workspaceID, actorID, model.AuditMemberRoleChanged, &userID,
+		map[string]any{"from": current, "to": role}); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// RemoveWorkspaceMember removes a member, or lets a member leave when actor
+// and user are the same. It returns pgx.ErrNoRows for non-members and
+// ErrLastOwner when removing the only owner. Prompts and chat sessions the
+// member created stay in the workspace.
+func (r *Repository) RemoveWorkspaceMember(ctx context.Context, workspaceID, userID, actorID int) error {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	current, otherOwners, err := lockWorkspaceMember(ctx, tx, workspaceID, userID)
+	if err != nil {
+		return err
+	}
+	if current == model.WorkspaceOwner && otherOwners == 0 {
+		return ErrLastOwner
+	}
+
+	if _, err := tx.Exec(ctx,
+		`DELETE FROM workspace_members WHERE workspace_id = $1 AND user_id = $2`,
+		workspaceID, userID); err != nil {
+		return err
+	}
+	action := model.AuditMemberRemoved
+	if actorID == userID {
+		action = model.AuditMemberLeft
+	}
+	if err := auditWorkspace(ctx, tx, workspaceID, actorID, action, &userID,
+		map[string]any{"role": current}); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// workspaceInvitationColumns is the column list scanned by
+// scanWorkspaceInvitation, for invitations aliased i joined with invitee u
+// and workspace w
+const workspaceInvitationColumns = `i.id, i.workspace_id, w.name, i.invitee_id, u.username, i.role,
+	i.invited_by, i.status, i.created_at, i.expires_at`
+
+func scanWorkspaceInvitation(row pgx.Row, inv *model.WorkspaceInvitation) error {
+	return row.Scan(&inv.ID, &inv.WorkspaceID, &inv.WorkspaceName, &inv.InviteeID, &inv.Invitee, &inv.Role,
+		&inv.InvitedBy, &inv.Status, &inv.CreatedAt, &inv.ExpiresAt)
+}
+
+// CreateWorkspaceInvitation invites the named user. It returns
+// pgx.ErrNoRows if no such user exists, ErrAlreadyMember or
+// ErrInvitationPending.
+func (r *Repository) CreateWorkspaceInvitation(ctx context.Context, workspaceID int, username, role string, actorID int) (*model.WorkspaceInvitation, error) {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	var inviteeID int
+	var isMember bool
+	err = tx.QueryRow(ctx,
+		`SELECT u.id, EXISTS (SELECT 1 FROM workspace_members m WHERE m.workspace_id = $1 AND m.user_id = u.id)
+		 FROM users u WHERE u.username = $2`, workspaceID, username).Scan(&inviteeID, &isMember)
+	if err != nil {
+		return nil, err
+	}
+	if isMember {
+		return nil, ErrAlreadyMember
+	}
+
+	// Expired pending invitations no longer block a new one
+	if _, err := tx.Exec(ctx,
+		`UPDATE workspace_invitations SET status = 'revoked', responded_at = NOW()
+		 WHERE workspace_id = $1 AND invitee_id = $2 AND status = 'pending' AND expires_at <= NOW()`,
+		workspaceID, inviteeID); err != nil {
+		return nil, err
+	}
+
+	var id int64
+	err = tx.QueryRow(ctx,
+		`INSERT INTO workspace_invitations (workspace_id, invitee_id, role, invited_by, expires_at)
+		 VALUES ($1, $2, $3, $4, NOW() + make_interval(secs => $5)) RETURNING id`,
+		workspaceID, inviteeID, role, actorID, workspaceInvitationTTL.Seconds()).Scan(&id)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == uniqueViolation {
+		return nil, ErrInvitationPending
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := auditWorkspace(ctx, tx, workspaceID, actorID, model.AuditMemberInvited, &inviteeID,
+		map[string]any{"role": role, "invitation_id": id}); err != nil {
+		return nil, err
+	}
+
+	var inv model.WorkspaceInvitation
+	row := tx.QueryRow(ctx,
+		`SELECT `+workspaceInvitationColumns+`
+		 FROM workspace_invitations i JOIN users u ON u.id = i.invitee_id JOIN workspaces w ON w.id = i.workspace_id
+		 WHERE i.id = $1`, id)
+	if err := scanWorkspaceInvitation(row, &inv); err != nil {
+		return nil, err
+	}
+	return &inv, tx.Commit(ctx)
+}
+
+// ListWorkspaceInvitations returns a workspace's pending invitations
+func (r *Repository) ListWorkspaceInvitations(ctx context.Context, workspaceID int) ([]model.WorkspaceInvitation, error) {
+	return r.listWorkspaceInvitations(ctx, `i.workspace_id = $1`, workspaceID)
+}
+
+// ListUserInvitations returns the pending invitations addressed to a user
+func (r *Repository) ListUserInvitations(ctx context.Context, userID int) ([]model.WorkspaceInvitation, error) {
+	return r.listWorkspaceInvitations(ctx, `i.invitee_id = $1`, userID)
+}
+
+func (r *Repository) listWorkspaceInvitations(ctx context.Context, where string, arg int) ([]model.WorkspaceInvitation, error) {
+	rows, err := r.pool.Query(ctx,
+		`SELECT `+workspaceInvitationColumns+`
+		 FROM workspace_invitations i JOIN users u ON u.id = i.invitee_id JOIN workspaces w ON w.id = i.workspace_id
+		 WHERE `+where+` AND i.status = 'pending' AND i.expires_at > NOW()
+		 ORDER BY i.created_at DESC`, arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invitations := []model.WorkspaceInvitation{}
+	for rows.Next() {
+		var inv model.WorkspaceInvitation
+		if err := scanWorkspaceInvitation(rows, &inv); err != nil {
+			return nil, err
+		}
+		invitations = append(invitations, inv)
+	}
+	return invitations, rows.Err()
+}
+
+// RevokeWorkspaceInvitation revokes a pending invitation and reports
+// whether one was found
+func (r *Repository) RevokeWorkspaceInvitation(ctx context.Context, workspaceID int, id int64, actorID int) (bool, error) {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	var inviteeID int
+	err = tx.QueryRow(ctx,
+		`UPDATE workspace_invitations SET status = 'revoked', responded_at = NOW()
+		 WHERE id = $1 AND workspace_id = $2 AND status = 'pending' RETURNING invitee_id`,
+		id, workspaceID).Scan(&inviteeID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := auditWorkspace(ctx, tx, workspaceID, actorID, model.AuditInvitationRevoked, &inviteeID,
+		map[string]any{"invitation_id": id}); err != nil {
+		return false, err
+	}
+	return true, tx.Commit(ctx)
+}
+
+// RespondWorkspaceInvitation accepts or declines one of the user's pending
+// invitations and reports whether one was found. Accepting makes the user
+// a member with the invited role.
+func (r *Repository) RespondWorkspaceInvitation(ctx context.Context, id int64, userID int, accept bool) (bool, error) {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	status, action := "declined", model.AuditInvitationDeclined
+	if accept {
+		status, action = "accepted", model.AuditMemberJoined
+	}
+
+	var workspaceID int
+	var role string
+	err = tx.QueryRow(ctx,
+		`UPDATE workspace_invitations SET status = $3, responded_at = NOW()
+		 WHERE id = $1 AND invitee_id = $2 AND status = 'pending' AND expires_at > NOW()
+		 RETURNING workspace_id, role`, id, userID, status).Scan(&workspaceID, &role)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if accept {
+		if _, err := tx.Exec(ctx,
+			`INSERT INTO workspace_members (workspace_id, user_id, role) VALUES ($1, $2, $3)
+			 ON CONFLICT (workspace_id, user_id) DO NOTHING`, workspaceID, userID, role); err != nil {
+			return false, err
+		}
+	}
+	if err := auditWorkspace(ctx, tx, workspaceID, userID, action, &userID,
+		map[string]any{"role": role, "invitation_id": id}); err != nil {
+		return false, err
+	}
+	return true, tx.Commit(ctx)
+}
+
+// ListWorkspaceAudit returns a workspace's membership changes, newest first
+func (r *Repository) ListWorkspaceAudit(ctx context.Context, workspaceID, limit int) ([]model.WorkspaceAuditEntry, error) {
+	if limit <= 0 || limit > 500 {
+		limit = 100
+	}
+	rows, err := r.pool.Query(ctx,
+		`SELECT id, actor_id, action, target_user_id, details, created_at FROM workspace_audit
+		 WHERE workspace_id = $1 ORDER BY created_at DESC, id DESC LIMIT $2`, workspaceID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []model.WorkspaceAuditEntry{}
+	for rows.Next() {
+		var e model.WorkspaceAuditEntry
+		var detailsJSON []byte
+		if err := rows.Scan(&e.ID, &e.ActorID, &e.Action, &e.TargetUserID, &detailsJSON, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		if detailsJSON != nil {
+			if err := json.Unmarshal(detailsJSON, &e.Details); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal audit details: %w", err)
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// Chat session methods
+
+// chatSessionScopeClause restricts chat sessions to the selected scope,
+// using $1 for the caller's user ID and $2 for the workspace (0 for the
+// personal scope). Every member can read a workspace's sessions.
+const chatSessionScopeClause = `(CASE WHEN $2 > 0 THEN workspace_id = $2 ELSE workspace_id IS NULL AND user_id = $1 END)`
+
+// chatSessionEditableClause additionally limits workspace sessions to
+// their creator unless the caller owns or edits the workspace
+func chatSessionEditableClause(caller model.Caller) string {
+	if caller.WorkspaceID > 0 && !caller.CanEditWorkspace() {
+		return chatSessionScopeClause + ` AND user_id = $1`
+	}
+	return chatSessionScopeClause
+}
+
+func (r *Repository) CreateChatSession(ctx context.Context, s *model.ChatSession, caller model.Caller) error {
+	userID := caller.UserID
+	s.UserID = &userID
+	s.WorkspaceID = workspaceArg(caller)
+	s.Messages = []model.ChatMessage{}
+	return r.pool.QueryRow(ctx,
+		`INSERT INTO chat_sessions (title, model, user_id, workspace_id) VALUES (NULLIF($1, ''), $2, $3, $4)
+		 RETURNING id, created_at, updated_at`,
+		s.Title, s.Model, userID, s.WorkspaceID).Scan(&s.ID, &s.CreatedAt, &s.UpdatedAt)
+}
+
+// ListChatSessions returns the sessions in the caller's scope without
+// their messages, most recently updated first
+func (r *Repository) ListChatSessions(ctx context.Context, caller model.Caller, limit int) ([]model.ChatSession, error) {
+	if limit <= 0 || limit > 500 {
+		limit = 100
+	}
+	rows, err := r.pool.Query(ctx,
+		`SELECT id, user_id, workspace_id, COALESCE(title, ''), model, created_at, updated_at
+		 FROM chat_sessions WHERE `+chatSessionScopeClause+`
+		 ORDER BY updated_at DESC, id DESC LIMIT $3`, caller.UserID, caller.WorkspaceID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []model.ChatSession{}
+	for rows.Next() {
+		var s model.ChatSession
+		if err := rows.Scan(&s.ID, &s.UserID, &s.WorkspaceID, &s.Title, &s.Model, &s.CreatedAt, &s.UpdatedAt); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// GetChatSession returns a session in the caller's scope with its
+// messages, or pgx.ErrNoRows
+func (r *Repository) GetChatSession(ctx context.Context, id int64, caller model.Caller) (*model.ChatSession, error) {
+	var s model.ChatSession
+	err := r.pool.QueryRow(ctx,
+		`SELECT id, user_id, workspace_id, COALESCE(title, ''), model, created_at, updated_at
+		 FROM chat_sessions WHERE `+chatSessionScopeClause+` AND id = $3`,
+		caller.UserID, caller.WorkspaceID, id).
+		Scan(&s.ID, &s.UserID, &s.WorkspaceID, &s.Title, &s.Model, &s.CreatedAt, &s.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := r.pool.Query(ctx,
+		`SELECT role, content, created_at FROM chat_messages WHERE session_id = $1 ORDER BY created_at, id`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	s.Messages = []model.ChatMessage{}
+	for rows.Next() {
+		var m model.ChatMessage
+		if err := rows.Scan(&m.Role, &m.Content, &m.CreatedAt); err != nil {
+			return nil, err
+		}
+		s.Messages = append(s.Messages, m)
+	}
+	return &s, rows.Err()
+}
+
+// AddChatMessages appends messages to a session the caller may change and
+// reports whether it was found
+func (r *Repository) AddChatMessages(ctx context.Context, id int64, caller model.Caller, messages []model.ChatMessage) (bool, error) {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx,
+		`UPDATE chat_sessions SET updated_at = NOW() WHERE `+chatSessionEditableClause(caller)+` AND id = $3`,
+		caller.UserID, caller.WorkspaceID, id)
+	if err != nil {
+		return false, err
+	}
+	if tag.RowsAffected() == 0 {
+		return false, nil
+	}
+
+	for _, m := range messages {
+		if _, err := tx.Exec(ctx,
+			`INSERT INTO chat_messages (session_id, role, content) VALUES ($1, $2, $3)`,
+			id, m.Role, m.Content); err != nil {
+			return false, err
+		}
+	}
+	return true, tx.Commit(ctx)
+}
+
+// DeleteChatSession deletes a session the caller may change and reports
+// whether it was found
+func (r *Repository) DeleteChatSession(ctx context.Context, id int64, caller model.Caller) (bool, error) {
+	tag, err := r.pool.Exec(ctx,
+		`DELETE FROM chat_sessions WHERE `+chatSessionEditableClause(caller)+` AND id = $3`,
+		caller.UserID, caller.WorkspaceID, id)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// Audit log methods
+
+// InsertAuditEvent appends an event to the audit log. The actor's name is
+// stored alongside the ID so that entries stay readable after the user is
+// deleted.
+func (r *Repository) InsertAuditEvent(ctx context.Context, e *model.AuditEvent) error {
+	var detailsJSON []byte
+	if e.Details != nil {
+		var err error
+		if detailsJSON, err = json.Marshal(e.Details); err != nil {
+			return err
+		}
+	}
+	return r.pool.QueryRow(ctx,
+		`INSERT INTO audit_log (actor_id, actor_name, api_key_id, action, target_type, target_id, ip, user_agent, outcome, details)
+		 VALUES ($1, (SELECT username FROM users WHERE id = $1), $2, $3, NULLIF($4, ''), NULLIF($5, ''), NULLIF($6, ''), NULLIF($7, ''), $8, $9)
+		 RETURNING id, created_at`,
+		e.ActorID, e.APIKeyID, e.Action, e.TargetType, e.TargetID, e.IP, e.UserAgent, e.Outcome, detailsJSON).
+		Scan(&e.ID, &e.CreatedAt)
+}
+
+// auditFilterClause builds the WHERE clause and arguments for a filter
+func auditFilterClause(f model.AuditFilter) (string, []any) {
+	where := `TRUE`
+	var args []any
+	add := func(cond string, arg any) {
+		args = append(args, arg)
+		where += fmt.Sprintf(` AND `+cond, len(args))
+	}
+
+	if f.ActorID > 0 {
+		add(`actor_id = $%d`, f.ActorID)
+	}
+	if prefix, ok := strings.CutSuffix(f.Action, "*"); ok {
+		add(`starts_with(action, $%d)`, prefix)
+	} else if f.Action != "" {
+		add(`action = $%d`, f.Action)
+	}
+	if f.TargetType != "" {
+		add(`target_type = $%d`, f.TargetType)
+	}
+	if f.TargetID != "" {
+		add(`target_id = $%d`, f.TargetID)
+	}
+	if f.Outcome != "" {
+		add(`outcome = $%d`, f.Outcome)
+	}
+	if f.IP != "" {
+		add(`ip = $%d`, f.IP)
+	}
+	if f.Since != nil {
+		add(`created_at >= $%d::timestamptz::timestamp`, *f.Since)
+	}
+	if f.Until != nil {
+		add(`created_at < $%d::timestamptz::timestamp`, *f.Until)
+	}
+	if f.BeforeID > 0 {
+		add(`id < $%d`, f.BeforeID)
+	}
+	return where, args
+}
+
+const auditColumns = `id, created_at, actor_id, COALESCE(actor_name, ''), api_key_id, action,
+	COALESCE(target_type, ''), COALESCE(target_id, ''), COALESCE(ip, ''), COALESCE(user_agent, ''), outcome, details`
+
+func scanAuditEvent(row pgx.Row, e *model.AuditEvent) error {
+	var detailsJSON []byte
+	if err := row.Scan(&e.ID, &e.CreatedAt, &e.ActorID, &e.ActorName, &e.APIKeyID, &e.Action,
+		&e.TargetType, &e.TargetID, &e.IP, &e.UserAgent, &e.Outcome, &detailsJSON); err != nil {
+		return err
+	}
+	if detailsJSON != nil {
+		if err := json.Unmarshal(detailsJSON, &e.Details); err != nil {
+			return fmt.Errorf("failed to unmarshal audit details: %w", err)
+		}
+	}
+	return nil
+}
+
+// ListAuditEvents returns a page of matching events, newest first
+func (r *Repository) ListAuditEvents(ctx context.Context, f model.AuditFilter) ([]model.AuditEvent, error) {
+	if f.Limit <= 0 || f.Limit > 1000 {
+		f.Limit = 100
+	}
+	where, args := auditFilterClause(f)
+	args = append(args, f.Limit)
+
+	rows, err := r.pool.Query(ctx,
+		`SELECT `+auditColumns+` FROM audit_log WHERE `+where+
+			fmt.Sprintf(` ORDER BY id DESC LIMIT $%d`, len(args)), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []model.AuditEvent{}
+	for rows.Next() {
+		var e model.AuditEvent
+		if err := scanAuditEvent(rows, &e); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// ForEachAuditEvent calls fn for every matching event, oldest first,
+// ignoring the filter's limit
+func (r *Repository) ForEachAuditEvent(ctx context.Context, f model.AuditFilter, fn func(*model.AuditEvent) error) error {
+	where, args := auditFilterClause(f)
+	rows, err := r.pool.Query(ctx,
+		`SELECT `+auditColumns+` FROM audit_log WHERE `+where+` ORDER BY id`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e model.AuditEvent
+		if err := scanAuditEvent(rows, &e); err != nil {
+			return err
+		}
+		if err := fn(&e); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// PruneAuditLog deletes entries older than retention and returns how many
+// were deleted. The append-only trigger lets only this transaction delete.
+func (r *Repository) PruneAuditLog(ctx context.Context, retention time.Duration) (int64, error) {
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `SELECT set_config('audit_log.pruning', 'on', true)`); err != nil {
+		return 0, err
+	}
+	tag, err := tx.Exec(ctx,
+		`DELETE FROM audit_log WHERE created_at < NOW() - make_interval(secs => $1)`, retention.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), tx.Commit(ctx)
+}
+
+// Saved connection methods
+
+// dbConnectionScopeClause restricts saved connections to the selected
+// scope, using $1 for the caller's user ID and $2 for the workspace (0 for
+// the personal scope). Every member of a workspace can use its connections.
+const dbConnectionScopeClause = `(CASE WHEN $2 > 0 THEN workspace_id = $2 ELSE workspace_id IS NULL AND user_id = $1 END)`
+
+const dbConnectionColumns = `id, user_id, workspace_id, name, type, host, port, username, database, ssl,
+	password_encrypted IS NOT NULL, allow_writes, created_at, updated_at`
+
+func scanDBConnection(row pgx.Row, conn *model.DBConnection, extra ...any) error {
+	return row.Scan(append([]any{&conn.ID, &conn.UserID, &conn.WorkspaceID, &conn.Name, &conn.Type, &conn.Host, &conn.Port,
+		&conn.User, &conn.Database, &conn.SSL, &conn.HasPassword, &conn.AllowWrites, &conn.CreatedAt, &conn.UpdatedAt}, extra...)...)
+}
+
+// NextDBConnectionID reserves the ID of a connection about to be created,
+// so that its password can be encrypted for it
+func (r *Repository) NextDBConnectionID(ctx context.Context) (int, error) {
+	var id int
+	err := r.pool.QueryRow(ctx, `SELECT nextval(pg_get_serial_sequence('db_connections', 'id'))`).Scan(&id)
+	return id, err
+}
+
+// CreateDBConnection saves a connection with the ID reserved by
+// NextDBConnectionID in the caller's scope
+func (r *Repository) CreateDBConnection(ctx context.Context, conn *model.DBConnection, encryptedPassword []byte, caller model.Caller) error {
+	conn.UserID = caller.UserID
+	conn.WorkspaceID = workspaceArg(caller)
+	conn.HasPassword = encryptedPassword != nil
+	return r.pool.QueryRow(ctx,
+		`INSERT INTO db_connections (id, user_id, workspace_id, name, type, host, port, username, password_encrypted, database, ssl)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING created_at, updated_at`,
+		conn.ID, conn.UserID, conn.WorkspaceID, conn.Name, conn.Type, conn.Host, conn.Port, conn.User,
+		encryptedPassword, conn.Database, conn.SSL).Scan(&conn.CreatedAt, &conn.UpdatedAt)
+}
+
+func (r *Repository) ListDBConnections(ctx context.Context, caller model.Caller) ([]model.DBConnection, error) {
+	rows, err := r.pool.Query(ctx,
+		`SELECT `+dbConnectionColumns+` FROM db_connections WHERE `+dbConnectionScopeClause+` ORDER BY name, id`,
+		caller.UserID, caller.WorkspaceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	conns := []model.DBConnection{}
+	for rows.Next() {
+		var conn model.DBConnection
+		if err := scanDBConnection(rows, &conn); err != nil {
+			return nil, err
+		}
+		conns = append(conns, conn)
+	}
+	return conns, rows.Err()
+}
+
+// GetOwnedDBConnections returns every connection the user owns, in any
+// workspace, without passwords
+func (r *Repository) GetOwnedDBConnections(ctx context.Context, userID int) ([]model.DBConnection, error) {
+	rows, err := r.pool.Query(ctx,
+		`SELECT `+dbConnectionColumns+` FROM db_connections WHERE user_id = $1 ORDER BY created_at, id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	conns := []model.DBConnection{}
+	for rows.Next() {
+		var conn model.DBConnection
+		if err := scanDBConnection(rows, &conn); err != nil {
+			return nil, err
+		}
+		conns = append(conns, conn)
+	}
+	return conns, rows.Err()
+}
+
+// GetDBConnection returns a connection in the caller's scope with its
+// encrypted password (nil for none), or pgx.ErrNoRows
+func (r *Repository) GetDBConnection(ctx context.Context, id int, caller model.Caller) (*model.DBConnection, []byte, error) {
+	var conn model.DBConnection
+	var encryptedPassword []byte
+	err := scanDBConnection(r.pool.QueryRow(ctx,
+		`SELECT `+dbConnectionColumns+`, password_encrypted FROM db_connections
+		 WHERE `+dbConnectionScopeClause+` AND id = $3`, caller.UserID, caller.WorkspaceID, id),
+		&conn, &encryptedPassword)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &conn, encryptedPassword, nil
+}
+
+// UpdateDBConnection updates a connection in the caller's scope, reading
+// back the stored row, and reports whether it was found. The password is
+// replaced only when setPassword is true. Pointing the connection at
+// another server or user removes the stored password, so that it is not
+// sent to a server it was not entered for, and pointing it at another
+// database too withdraws its write permission.
+func (r *Repository) UpdateDBConnection(ctx context.Context, conn *model.DBConnection, setPassword bool, encryptedPassword []byte, caller model.Caller) (bool, error) {
+	err := scanDBConnection(r.pool.QueryRow(ctx,
+		`UPDATE db_connections SET name = $4, type = $5, host = $6, port = $7, username = $8, database = $9, ssl = $10,
+			password_encrypted = CASE WHEN $11 THEN $12
+				WHEN (type, host, port, username) = ($5, $6, $7, $8) THEN password_encrypted END,
+			updated_at = NOW(),
+			allow_writes = allow_writes AND (type, host, port, username, database) = ($5, $6, $7, $8, $9)
+		 WHERE `+dbConnectionScopeClause+` AND id = $3
+		 RETURNING `+dbConnectionColumns,
+		caller.UserID, caller.WorkspaceID, conn.ID, conn.Name, conn.Type, conn.Host, conn.Port, conn.User,
+		conn.Database, conn.SSL, setPassword, encryptedPassword), conn)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// ListAllDBConnections returns every saved connection, for admins
+func (r *Repository) ListAllDBConnections(ctx context.Context) ([]model.DBConnection, error) {
+	rows, err := r.pool.Query(ctx, `SELECT `+dbConnectionColumns+` FROM db_connections ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	conns := []model.DBConnection{}
+	for rows.Next() {
+		var conn model.DBConnection
+		if err := scanDBConnection(rows, &conn); err != nil {
+			return nil, err
+		}
+		conns = append(conns, conn)
+	}
+	return conns, rows.Err()
+}
+
+// SetDBConnectionWrites enables or disables writes through a connection
+// and reports whether it was found
+func (r *Repository) SetDBConnectionWrites(ctx context.Context, id int, allow bool) (bool, error) {
+	tag, err := r.pool.Exec(ctx,
+		`UPDATE db_connections SET allow_writes = $2, updated_at = NOW() WHERE id = $1`, id, allow)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// DeleteDBConnection deletes a connection in the caller's scope and
+// reports whether it was found
+func (r *Repository) DeleteDBConnection(ctx context.Context, id int, caller model.Caller) (bool, error) {
+	tag, err := r.pool.Exec(ctx,
+		`DELETE FROM db_connections WHERE `+dbConnectionScopeClause+` AND id = $3`,
+		caller.UserID, caller.WorkspaceID, id)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// Write confirmation methods
+
+// CreateDBWriteConfirmation stores a previewed write of the user under the
+// hash of its confirm token, valid for ttl
+func (r *Repository) CreateDBWriteConfirmation(ctx context.Context, tokenHash string, userID int, w *model.DBWriteConfirmation, ttl time.Duration) error {
+	return r.pool.QueryRow(ctx,
+		`INSERT INTO db_write_confirmations (token_hash, user_id, connection_id, sql, rows_affected, expires_at)
+		 VALUES ($1, $2, $3, $4, $5, NOW() + make_interval(secs => $6)) RETURNING expires_at`,
+		tokenHash, userID, w.ConnectionID, w.SQL, w.RowsAffected, ttl.Seconds()).Scan(&w.ExpiresAt)
+}
+
+// ConsumeDBWriteConfirmation deletes and returns the user's unexpired
+// confirmation for a token hash, or pgx.ErrNoRows
+func (r *Repository) ConsumeDBWriteConfirmation(ctx context.Context, tokenHash string, userID int) (*model.DBWriteConfirmation, error) {
+	var w model.DBWriteConfirmation
+	err := r.pool.QueryRow(ctx,
+		`DELETE FROM db_write_confirmations WHERE token_hash = $1 AND user_id = $2 AND expires_at > NOW()
+		 RETURNING connection_id, sql, rows_affected, expires_at`, tokenHash, userID).
+		Scan(&w.ConnectionID, &w.SQL, &w.RowsAffected, &w.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return &w, nil
+}
+
+// PruneDBWriteConfirmations deletes confirmations that expired unused
+func (r *Repository) PruneDBWriteConfirmations(ctx context.Context) error {
+	_, err := r.pool.Exec(ctx, `DELETE FROM db_write_confirmations WHERE expires_at <= NOW()`)
+	return err
 }
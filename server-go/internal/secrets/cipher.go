@@ -0,0 +1,58 @@
+// Package secrets encrypts credentials stored in the database.
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+)
+
+// ErrDecrypt is returned for ciphertexts that were tampered with or
+// encrypted under another key
+var ErrDecrypt = errors.New("secrets: cannot decrypt value")
+
+// Cipher encrypts values with AES-256-GCM under a master key. Ciphertexts
+// are the random nonce followed by the sealed value.
+type Cipher struct {
+	aead cipher.AEAD
+}
+
+// NewCipher returns a Cipher for a 32-byte key
+func NewCipher(key []byte) (*Cipher, error) {
+	if len(key) != 32 {
+		return nil, errors.New("secrets: key must be 32 bytes")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Cipher{aead: aead}, nil
+}
+
+// Encrypt seals plaintext. The purpose is authenticated but not stored, so
+// that a value cannot be decrypted for a different purpose.
+func (c *Cipher) Encrypt(plaintext []byte, purpose string) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(plaintext)+c.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(nonce, nonce, plaintext, []byte(purpose)), nil
+}
+
+// Decrypt opens a value sealed by Encrypt with the same purpose
+func (c *Cipher) Decrypt(ciphertext []byte, purpose string) ([]byte, error) {
+	n := c.aead.NonceSize()
+	if len(ciphertext) < n+c.aead.Overhead() {
+		return nil, ErrDecrypt
+	}
+	plaintext, err := c.aead.Open(nil, ciphertext[:n], ciphertext[n:], []byte(purpose))
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plaintext, nil
+}
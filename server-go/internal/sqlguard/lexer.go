@@ -0,0 +1,220 @@
+package sqlguard
+
+import (
+	"errors"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokWord   tokenKind = iota // keyword, identifier or number
+	tokQuoted                  // string literal or quoted identifier
+	tokPunct                   // any other single character
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	// end is the offset just past the token in the query
+	end int
+}
+
+// lex splits query into tokens, dropping whitespace and comments. It
+// follows the quoting and comment rules of the dialect closely enough that
+// text it treats as a literal or comment is also one to the server;
+// anything ambiguous is an error.
+func lex(query string, d Dialect) ([]token, error) {
+	var toks []token
+	s := query
+	for i := 0; i < len(s); {
+		ch := s[i]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r' || ch == '\f' || ch == '\v':
+			i++
+
+		case ch == '-' && strings.HasPrefix(s[i:], "--") && lineComment(s[i+2:], d):
+			i = skipLine(s, i)
+		case ch == '#' && d == MySQL:
+			i = skipLine(s, i)
+		case ch == '#' && d == ClickHouse && (strings.HasPrefix(s[i:], "# ") || strings.HasPrefix(s[i:], "#!")):
+			// ClickHouse takes "# " and "#!" as line comments
+			i = skipLine(s, i)
+
+		case ch == '/' && strings.HasPrefix(s[i:], "/*"):
+			if d == MySQL && strings.HasPrefix(s[i:], "/*!") {
+				// MySQL runs the contents of /*! ... */ as SQL
+				return nil, errors.New("executable comments are not allowed")
+			}
+			end, err := skipBlockComment(s, i, d.nestedComments())
+			if err != nil {
+				return nil, err
+			}
+			i = end
+
+		case ch == '\'':
+			end, err := skipQuoted(s, i, '\'', d.backslashEscapes())
+			if err != nil {
+				return nil, err
+			}
+			toks = append(toks, token{tokQuoted, s[i:end], end})
+			i = end
+		case ch == '"':
+			end, err := skipQuoted(s, i, '"', d.backslashEscapes())
+			if err != nil {
+				return nil, err
+			}
+			toks = append(toks, token{tokQuoted, s[i:end], end})
+			i = end
+		case ch == '`' && (d == MySQL || d == SQLite || d == ClickHouse):
+			end, err := skipQuoted(s, i, '`', d == ClickHouse)
+			if err != nil {
+				return nil, err
+			}
+			toks = append(toks, token{tokQuoted, s[i:end], end})
+			i = end
+		case ch == '[' && d == SQLite:
+			// SQLite quotes identifiers in brackets, with no escapes
+			end := strings.IndexByte(s[i:], ']')
+			if end < 0 {
+				return nil, errors.New("unterminated quoted identifier")
+			}
+			end += i + 1
+			toks = append(toks, token{tokQuoted, s[i:end], end})
+			i = end
+		case ch == '[' && d == MSSQL:
+			// T-SQL doubles a closing bracket inside brackets
+			end, err := skipQuoted(s, i, ']', false)
+			if err != nil {
+				return nil, err
+			}
+			toks = append(toks, token{tokQuoted, s[i:end], end})
+			i = end
+
+		case ch == '$' && (d.postgresSyntax() || d == ClickHouse):
+			tag, ok := dollarTag(s[i:])
+			if !ok {
+				toks = append(toks, token{tokPunct, "$", i + 1})
+				i++
+				continue
+			}
+			end := strings.Index(s[i+len(tag):], tag)
+			if end < 0 {
+				return nil, errors.New("unterminated dollar-quoted string")
+			}
+			end += i + 2*len(tag)
+			toks = append(toks, token{tokQuoted, s[i:end], end})
+			i = end
+
+		case isWordChar(ch):
+			j := i
+			for j < len(s) && isWordChar(s[j]) {
+				j++
+			}
+			// Postgres U&"..." identifiers spell names with escapes, so
+			// the name they stand for is not what the text shows
+			if d.postgresSyntax() && j == i+1 && (ch == 'u' || ch == 'U') && strings.HasPrefix(s[j:], "&\"") {
+				return nil, errors.New("identifiers with Unicode escapes are not allowed")
+			}
+			// Postgres E'...' strings use backslash escapes
+			if d.postgresSyntax() && j == i+1 && (ch == 'e' || ch == 'E') && j < len(s) && s[j] == '\'' {
+				end, err := skipQuoted(s, j, '\'', true)
+				if err != nil {
+					return nil, err
+				}
+				toks = append(toks, token{tokQuoted, s[i:end], end})
+				i = end
+				continue
+			}
+			toks = append(toks, token{tokWord, s[i:j], j})
+			i = j
+
+		default:
+			toks = append(toks, token{tokPunct, string(ch), i + 1})
+			i++
+		}
+	}
+	return toks, nil
+}
+
+// lineComment reports whether "--" followed by rest starts a comment.
+// MySQL needs whitespace after the dashes; otherwise they are two minus
+// signs.
+func lineComment(rest string, d Dialect) bool {
+	if d != MySQL || rest == "" {
+		return true
+	}
+	c := rest[0]
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'
+}
+
+func skipLine(s string, i int) int {
+	if end := strings.IndexByte(s[i:], '\n'); end >= 0 {
+		return i + end + 1
+	}
+	return len(s)
+}
+
+// skipBlockComment returns the index after the comment starting at i.
+// Postgres, T-SQL and ClickHouse block comments nest.
+func skipBlockComment(s string, i int, nested bool) (int, error) {
+	depth := 0
+	for j := i; j+1 < len(s); j++ {
+		switch {
+		case s[j] == '/' && s[j+1] == '*':
+			if depth == 0 || nested {
+				depth++
+			}
+			j++
+		case s[j] == '*' && s[j+1] == '/':
+			depth--
+			j++
+			if depth == 0 {
+				return j + 1, nil
+			}
+		}
+	}
+	return 0, errors.New("unterminated comment")
+}
+
+// skipQuoted returns the index after the quoted text starting at i. A
+// doubled quote is an escaped quote, as is a backslash-escaped one when
+// backslash is set.
+func skipQuoted(s string, i int, quote byte, backslash bool) (int, error) {
+	for j := i + 1; j < len(s); j++ {
+		switch s[j] {
+		case '\\':
+			if backslash {
+				j++
+			}
+		case quote:
+			if j+1 < len(s) && s[j+1] == quote {
+				j++
+				continue
+			}
+			return j + 1, nil
+		}
+	}
+	return 0, errors.New("unterminated quoted string")
+}
+
+// dollarTag returns the opening $tag$ of a Postgres dollar-quoted string,
+// or a ClickHouse heredoc, at the start of s. $1 style parameters are not tags.
+func dollarTag(s string) (string, bool) {
+	for j := 1; j < len(s); j++ {
+		c := s[j]
+		switch {
+		case c == '$':
+			return s[:j+1], true
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80:
+		case c >= '0' && c <= '9' && j > 1:
+		default:
+			return "", false
+		}
+	}
+	return "", false
+}
+
+func isWordChar(c byte) bool {
+	return c == '_' || c == '$' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c >= 0x80
+}
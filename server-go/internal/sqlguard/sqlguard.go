@@ -0,0 +1,476 @@
+// Package sqlguard decides whether a SQL query may run through the DB
+// tool, either as a read or as a previewed write. It tokenizes the query
+// the way the target dialect does, so keywords hidden in comments, strings
+// or extra statements are seen for what they are. Reads should still run
+// in a read-only transaction; the check keeps out what such a transaction
+// does not, such as side-effecting functions and several statements at
+// once.
+package sqlguard
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Dialect is the SQL dialect of the target database
+type Dialect string
+
+const (
+	MySQL      Dialect = "mysql"
+	Postgres   Dialect = "postgres"
+	SQLite     Dialect = "sqlite"
+	DuckDB     Dialect = "duckdb"
+	MSSQL      Dialect = "mssql"
+	ClickHouse Dialect = "clickhouse"
+)
+
+// postgresSyntax reports whether d quotes and comments like Postgres, with
+// nested block comments, dollar quotes and E'...' strings. DuckDB uses the
+// Postgres parser.
+func (d Dialect) postgresSyntax() bool {
+	return d == Postgres || d == DuckDB
+}
+
+// nestedComments reports whether block comments nest in d
+func (d Dialect) nestedComments() bool {
+	return d.postgresSyntax() || d == MSSQL || d == ClickHouse
+}
+
+// backslashEscapes reports whether backslashes escape quotes in every
+// quoted string and identifier of d
+func (d Dialect) backslashEscapes() bool {
+	return d == MySQL || d == ClickHouse
+}
+
+// Error explains why a query was rejected
+type Error struct {
+	Reason string
+}
+
+func (e *Error) Error() string {
+	return "query not allowed: " + e.Reason
+}
+
+func reject(format string, args ...any) error {
+	return &Error{Reason: fmt.Sprintf(format, args...)}
+}
+
+// readStatements are the keywords a read-only statement may start with
+var readStatements = map[string]bool{
+	"SELECT":   true,
+	"WITH":     true,
+	"SHOW":     true,
+	"DESCRIBE": true,
+	"DESC":     true,
+	"EXPLAIN":  true,
+	"VALUES":   true,
+	"TABLE":    true,
+	// DuckDB
+	"FROM":      true,
+	"SUMMARIZE": true,
+	"PIVOT":     true,
+	"UNPIVOT":   true,
+	// ClickHouse
+	"EXISTS": true,
+}
+
+// writeKeywords may not appear anywhere in a query: they start writes,
+// including data-modifying CTEs, or turn a SELECT into one (SELECT INTO,
+// FOR UPDATE, LOCK IN SHARE MODE)
+var writeKeywords = map[string]bool{
+	"INSERT":   true,
+	"UPDATE":   true,
+	"DELETE":   true,
+	"MERGE":    true,
+	"REPLACE":  true,
+	"UPSERT":   true,
+	"CREATE":   true,
+	"ALTER":    true,
+	"DROP":     true,
+	"TRUNCATE": true,
+	"RENAME":   true,
+	"GRANT":    true,
+	"REVOKE":   true,
+	"INTO":     true,
+	"COPY":     true,
+	"CALL":     true,
+	"EXECUTE":  true,
+	"LOCK":     true,
+}
+
+// sideEffectFunctions change state, reach outside the database or hold
+// the server, even from a SELECT
+var sideEffectFunctions = map[Dialect]map[string]bool{
+	Postgres: {
+		"nextval": true, "setval": true, "set_config": true,
+		"pg_sleep": true, "pg_sleep_for": true, "pg_sleep_until": true,
+		"pg_advisory_lock": true, "pg_advisory_xact_lock": true,
+		"pg_advisory_lock_shared": true, "pg_advisory_xact_lock_shared": true,
+		"pg_try_advisory_lock": true, "pg_try_advisory_xact_lock": true,
+		"pg_terminate_backend": true, "pg_cancel_backend": true,
+		"pg_reload_conf": true, "pg_rotate_logfile": true, "pg_switch_wal": true,
+		"pg_create_restore_point": true, "pg_notify": true, "pg_logical_emit_message": true,
+		"pg_read_file": true, "pg_read_binary_file": true, "pg_ls_dir": true, "pg_stat_file": true,
+		"lo_import": true, "lo_export": true, "lo_create": true, "lo_unlink": true, "lo_from_bytea": true,
+		"dblink": true, "dblink_exec": true, "dblink_send_query": true,
+		"dblink_connect": true, "dblink_connect_u": true, "dblink_open": true,
+		"query_to_xml": true, "query_to_xml_and_xmlschema": true, "cursor_to_xml": true,
+	},
+	MySQL: {
+		"sleep": true, "benchmark": true,
+		"get_lock": true, "release_lock": true, "release_all_locks": true,
+		"load_file": true, "master_pos_wait": true, "source_pos_wait": true,
+	},
+	SQLite: {
+		"load_extension": true, "readfile": true, "writefile": true, "edit": true,
+		"fts3_tokenizer": true,
+	},
+	// The server also turns off DuckDB's access to files and the network;
+	// these read them or run other SQL
+	DuckDB: {
+		"nextval": true, "setseed": true, "query": true, "query_table": true, "getenv": true,
+		"read_csv": true, "read_csv_auto": true, "sniff_csv": true,
+		"read_parquet": true, "parquet_scan": true, "parquet_metadata": true, "parquet_schema": true,
+		"parquet_file_metadata": true, "parquet_kv_metadata": true,
+		"read_json": true, "read_json_auto": true, "read_json_objects": true, "read_json_objects_auto": true,
+		"read_ndjson": true, "read_ndjson_auto": true, "read_ndjson_objects": true,
+		"read_text": true, "read_blob": true, "glob": true,
+		"sqlite_scan": true, "sqlite_attach": true, "postgres_scan": true, "postgres_attach": true,
+		"postgres_query": true, "postgres_execute": true, "mysql_query": true, "mysql_execute": true,
+		"iceberg_scan": true, "delta_scan": true,
+	},
+	// T-SQL reaches linked servers and files through these; procedures
+	// such as xp_cmdshell need EXEC, which is rejected anyway
+	MSSQL: {
+		"openrowset": true, "opendatasource": true, "openquery": true,
+		"fn_get_audit_file": true, "fn_xe_file_target_read_file": true, "fn_trace_gettable": true,
+	},
+	// ClickHouse table functions that read files, other servers or the
+	// network; names are matched case-insensitively
+	ClickHouse: {
+		"sleep": true, "sleepeachrow": true,
+		"file": true, "filecluster": true, "url": true, "urlcluster": true,
+		"s3": true, "s3cluster": true, "gcs": true, "oss": true, "cosn": true,
+		"hdfs": true, "hdfscluster": true, "azureblobstorage": true, "azureblobstoragecluster": true,
+		"remote": true, "remotesecure": true, "cluster": true, "clusterallreplicas": true,
+		"mysql": true, "postgresql": true, "mongodb": true, "redis": true, "sqlite": true,
+		"jdbc": true, "odbc": true, "executable": true, "input": true,
+		"iceberg": true, "icebergs3": true, "deltalake": true, "hudi": true,
+	},
+}
+
+// batchKeywords start other statements in dialects that run several
+// statements in one batch without semicolons between them, as T-SQL does
+var batchKeywords = map[Dialect]map[string]bool{
+	MSSQL: {
+		"EXEC": true, "WAITFOR": true, "DECLARE": true, "SET": true, "USE": true,
+		"BEGIN": true, "COMMIT": true, "ROLLBACK": true, "SAVE": true,
+		"SHUTDOWN": true, "KILL": true, "DBCC": true, "BACKUP": true, "RESTORE": true,
+		"RECONFIGURE": true, "BULK": true, "DENY": true, "CHECKPOINT": true,
+		"SETUSER": true, "REVERT": true, "WRITETEXT": true, "UPDATETEXT": true,
+	},
+}
+
+// writeStatements are the keywords a data-modifying statement may start
+// with. Schema changes are not writes here: MySQL commits them at once, so
+// they cannot be previewed.
+var writeStatements = map[string]bool{
+	"INSERT":  true,
+	"UPDATE":  true,
+	"DELETE":  true,
+	"REPLACE": true,
+	"MERGE":   true,
+	"WITH":    true,
+}
+
+// nonDMLKeywords may not appear in a write: they change the schema or
+// privileges, or reach outside the transaction
+var nonDMLKeywords = map[string]bool{
+	"CREATE":   true,
+	"ALTER":    true,
+	"DROP":     true,
+	"TRUNCATE": true,
+	"RENAME":   true,
+	"GRANT":    true,
+	"REVOKE":   true,
+	"COPY":     true,
+	"CALL":     true,
+	"EXECUTE":  true,
+	"LOCK":     true,
+	"OUTFILE":  true,
+	"DUMPFILE": true,
+}
+
+// statement tokenizes query and returns its tokens and the upper-cased
+// keyword it starts with. It fails unless query is a single statement.
+func statement(query string, d Dialect) ([]token, string, int, error) {
+	toks, err := lex(query, d)
+	if err != nil {
+		return nil, "", 0, &Error{Reason: err.Error()}
+	}
+
+	// One statement, optionally followed by semicolons
+	end := len(toks)
+	for end > 0 && toks[end-1].kind == tokPunct && toks[end-1].text == ";" {
+		end--
+	}
+	toks = toks[:end]
+	for _, t := range toks {
+		if t.kind == tokPunct && t.text == ";" {
+			return nil, "", 0, reject("multiple statements are not allowed")
+		}
+	}
+
+	// Parenthesized queries start after the parentheses
+	first := 0
+	for first < len(toks) && toks[first].kind == tokPunct && toks[first].text == "(" {
+		first++
+	}
+	if first == len(toks) {
+		return nil, "", 0, reject("empty query")
+	}
+	if toks[first].kind != tokWord {
+		return nil, "", 0, reject("statements starting with %s are not allowed", toks[first].text)
+	}
+	return toks, strings.ToUpper(toks[first].text), first, nil
+}
+
+// CheckReadOnly returns an *Error if query is not a single read-only
+// statement in dialect d, or if it cannot be tokenized.
+func CheckReadOnly(query string, d Dialect) error {
+	toks, start, first, err := statement(query, d)
+	if err != nil {
+		return err
+	}
+	if !readStatements[start] {
+		return reject("statements starting with %s are not allowed", toks[first].text)
+	}
+
+	functions := sideEffectFunctions[d]
+	batch := batchKeywords[d]
+	for i, t := range toks {
+		if functions[calledFunction(toks, i, d)] {
+			return reject("function %s is not allowed", t.text)
+		}
+		if t.kind != tokWord {
+			continue
+		}
+		word := strings.ToUpper(t.text)
+		call := i+1 < len(toks) && toks[i+1].text == "("
+		qualified := i > 0 && toks[i-1].text == "."
+
+		if batch[word] && !qualified {
+			return reject("%s is not allowed", word)
+		}
+		if !writeKeywords[word] || qualified {
+			continue
+		}
+		switch {
+		case word == "REPLACE" && call:
+			// the string function
+		case word == "CREATE" && start == "SHOW" && i == first+1:
+			// SHOW CREATE TABLE
+		default:
+			return reject("%s is not allowed", word)
+		}
+	}
+	return nil
+}
+
+// calledFunction returns the lower-cased name of the function toks[i]
+// calls, or "" if it is not a call. Quoted identifiers name functions just
+// as bare words do: "dblink_exec"(...), `file`(...), [openrowset](...).
+func calledFunction(toks []token, i int, d Dialect) string {
+	if i+1 == len(toks) || toks[i+1].kind != tokPunct || toks[i+1].text != "(" {
+		return ""
+	}
+	switch t := toks[i]; t.kind {
+	case tokWord:
+		return strings.ToLower(t.text)
+	case tokQuoted:
+		return strings.ToLower(unquote(t.text, d))
+	}
+	return ""
+}
+
+// unquote returns the contents of a quoted identifier or string with its
+// escapes undone. Dollar-quoted and E'...' strings, which cannot name a
+// function, are returned as they are.
+func unquote(text string, d Dialect) string {
+	closing := text[0]
+	switch closing {
+	case '"', '\'', '`':
+	case '[':
+		closing = ']'
+	default:
+		return text
+	}
+	// MySQL does not escape backticks with backslashes
+	backslash := d == ClickHouse || d == MySQL && closing != '`'
+
+	inner := text[1 : len(text)-1]
+	var b strings.Builder
+	for i := 0; i < len(inner); i++ {
+		c := inner[i]
+		switch {
+		case c == '\\' && backslash && i+1 < len(inner):
+			i++
+			c = inner[i]
+		case c == closing && i+1 < len(inner) && inner[i+1] == closing:
+			i++
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// Identifiers returns the distinct lower-cased words and quoted names in
+// query: a superset of the schemas, tables, views and routines it names
+func Identifiers(query string, d Dialect) ([]string, error) {
+	toks, err := lex(query, d)
+	if err != nil {
+		return nil, &Error{Reason: err.Error()}
+	}
+	seen := map[string]bool{}
+	var names []string
+	for _, t := range toks {
+		var name string
+		switch t.kind {
+		case tokWord:
+			name = t.text
+		case tokQuoted:
+			name = unquote(t.text, d)
+		default:
+			continue
+		}
+		if name = strings.ToLower(name); !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// queryStatements are the read statements that can be used as a subquery
+var queryStatements = map[string]bool{
+	"SELECT": true,
+	"WITH":   true,
+	"VALUES": true,
+	"TABLE":  true,
+	"FROM":   true,
+}
+
+// Subquery returns query without trailing semicolons and comments, ready
+// to be used as a derived table, and whether it is a statement that can be
+// one. It assumes query passed CheckReadOnly. T-SQL derived tables can
+// only be SELECTs.
+func Subquery(query string, d Dialect) (string, bool) {
+	toks, start, _, err := statement(query, d)
+	if err != nil || !queryStatements[start] || d == MSSQL && start != "SELECT" {
+		return "", false
+	}
+	return query[:toks[len(toks)-1].end], true
+}
+
+// CheckWrite returns an *Error if query is not a single INSERT, UPDATE,
+// DELETE, REPLACE or MERGE statement, possibly with a WITH clause, in
+// dialect d. Such statements can be run in a transaction and rolled back.
+func CheckWrite(query string, d Dialect) error {
+	toks, start, first, err := statement(query, d)
+	if err != nil {
+		return err
+	}
+	if !writeStatements[start] || first > 0 {
+		return reject("statements starting with %s are not writes", toks[first].text)
+	}
+	if start == "WITH" {
+		if s := withStatement(toks); s != "INSERT" && s != "UPDATE" && s != "DELETE" && s != "MERGE" {
+			return reject("WITH must lead into an INSERT, UPDATE, DELETE or MERGE")
+		}
+	}
+
+	functions := sideEffectFunctions[d]
+	batch := batchKeywords[d]
+	writes, selects, intos, depth := 0, 0, 0, 0
+	// main is the statement's own keyword, after any WITH clause, and
+	// values is set once an INSERT has taken its rows from VALUES
+	main, values := "", false
+	for i, t := range toks {
+		if functions[calledFunction(toks, i, d)] {
+			return reject("function %s is not allowed", t.text)
+		}
+		if t.kind == tokPunct && t.text == "(" {
+			depth++
+		} else if t.kind == tokPunct && t.text == ")" {
+			depth--
+		}
+		if t.kind != tokWord {
+			continue
+		}
+		word := strings.ToUpper(t.text)
+		call := i+1 < len(toks) && toks[i+1].text == "("
+		qualified := i > 0 && toks[i-1].text == "."
+
+		if (nonDMLKeywords[word] || batch[word] && word != "SET") && !qualified {
+			return reject("%s is not allowed", word)
+		}
+		// A second write without a semicolon is another statement in
+		// T-SQL, except for the actions of a MERGE
+		if batch != nil && writeStatements[word] && word != "WITH" && !qualified && !call {
+			if writes++; writes > 1 && start != "MERGE" {
+				return reject("multiple statements are not allowed")
+			}
+			if main == "" && depth == 0 {
+				main = word
+			}
+		}
+		if batch == nil || depth > 0 || qualified {
+			continue
+		}
+		// So is a SELECT outside parentheses, except for the query an
+		// INSERT takes its rows from; and only INSERT and MERGE write
+		// INTO a table, where SELECT INTO would create one
+		switch word {
+		case "VALUES":
+			values = true
+		case "SELECT":
+			if main != "INSERT" || values || selects > 0 && !setOperators[strings.ToUpper(toks[i-1].text)] {
+				return reject("multiple statements are not allowed")
+			}
+			selects++
+		case "INTO":
+			if main != "INSERT" && main != "MERGE" || selects > 0 || intos > 0 {
+				return reject("INTO is only allowed after INSERT or MERGE")
+			}
+			intos++
+		}
+	}
+	return nil
+}
+
+// withStatement returns the upper-cased keyword of the statement a WITH
+// clause leads into: the first statement keyword outside parentheses
+func withStatement(toks []token) string {
+	depth := 0
+	for _, t := range toks[1:] {
+		switch {
+		case t.kind == tokPunct && t.text == "(":
+			depth++
+		case t.kind == tokPunct && t.text == ")":
+			depth--
+		case t.kind == tokWord && depth == 0:
+			if word := strings.ToUpper(t.text); word != "WITH" && (writeStatements[word] || readStatements[word]) {
+				return word
+			}
+		}
+	}
+	return ""
+}
+
+// setOperators join the SELECTs of a compound query
+var setOperators = map[string]bool{
+	"UNION":     true,
+	"ALL":       true,
+	"EXCEPT":    true,
+	"INTERSECT": true,
+}
@@ -0,0 +1,308 @@
+package sqlguard
+
+import (
+	"slices"
+	"testing"
+)
+
+// Side-effect functions are refused however their name is spelled: mixed
+// case, quoted as an identifier, qualified, or with comments around it
+func TestCheckReadOnlyFunctionBypasses(t *testing.T) {
+	tests := []struct {
+		d     Dialect
+		query string
+	}{
+		{Postgres, "SELECT dblink_exec('host=x', 'DROP TABLE t')"},
+		{Postgres, "SELECT dblink_connect('c', 'host=x')"},
+		{Postgres, "SELECT dblink_connect_u('c', 'host=x')"},
+		{Postgres, "SELECT dblink_open('c', 'cur', 'SELECT 1')"},
+		{Postgres, "SELECT DbLink_Exec('host=x', 'DROP TABLE t')"},
+		{Postgres, `SELECT "dblink_exec"('host=x', 'DROP TABLE t')`},
+		{Postgres, `SELECT public."dblink_exec"('host=x', 'DROP TABLE t')`},
+		{Postgres, `SELECT "pg_sleep"(10)`},
+		{Postgres, "SELECT pg_sleep /* wait */ (10)"},
+		{Postgres, "SELECT pg_sleep/* nested /* comment */ */(10)"},
+		{Postgres, "SELECT pg_sleep -- wait\n(10)"},
+		{Postgres, "SELECT * FROM (SELECT nextval('s')) AS t"},
+		{Postgres, `SELECT U&"pg_sleep"(10)`},
+		{Postgres, `SELECT U&"\0070g_sleep"(10)`},
+		{MySQL, "SELECT SLEEP(10)"},
+		{MySQL, "SELECT `sleep`(10)"},
+		{MySQL, `SELECT "sleep"(10)`},
+		{MySQL, "SELECT BeNcHmArK(1000000, MD5('x'))"},
+		{MySQL, "SELECT load_file /* read */ ('/etc/passwd')"},
+		{MySQL, "SELECT get_lock#comment\n('x', 10)"},
+		{SQLite, "SELECT load_extension('x')"},
+		{SQLite, `SELECT "load_extension"('x')`},
+		{SQLite, "SELECT `readfile`('x')"},
+		{SQLite, "SELECT [writefile]('x', 'y')"},
+		{SQLite, "SELECT 'load_extension'('x')"},
+		{DuckDB, "SELECT * FROM read_csv('/etc/passwd')"},
+		{DuckDB, `SELECT * FROM "read_csv"('/etc/passwd')`},
+		{DuckDB, "FROM Read_Parquet('s3://bucket/x')"},
+		{DuckDB, "SELECT * FROM query('DROP TABLE t')"},
+		{DuckDB, `SELECT U&"query"('DROP TABLE t')`},
+		{MSSQL, "SELECT * FROM OPENROWSET('SQLNCLI', 'x', 'SELECT 1')"},
+		{MSSQL, "SELECT * FROM [openrowset]('SQLNCLI', 'x', 'SELECT 1')"},
+		{MSSQL, `SELECT * FROM "OpenQuery"(srv, 'SELECT 1')`},
+		{MSSQL, "SELECT * FROM sys.[fn_get_audit_file]('x', default, default)"},
+		{ClickHouse, "SELECT * FROM file('/etc/passwd')"},
+		{ClickHouse, "SELECT * FROM `file`('/etc/passwd')"},
+		{ClickHouse, `SELECT * FROM "url"('http://x', CSV)`},
+		{ClickHouse, "SELECT * FROM RemoteSecure('host', db.t)"},
+		{ClickHouse, "SELECT sleepEachRow /* slow */ (1) FROM numbers(10)"},
+		{ClickHouse, "SELECT * FROM s3Cluster # comment\n('c', 'x')"},
+	}
+	for _, tt := range tests {
+		if err := CheckReadOnly(tt.query, tt.d); err == nil {
+			t.Errorf("%s: CheckReadOnly accepted %q", tt.d, tt.query)
+		}
+	}
+}
+
+// Writes and further statements are refused wherever they hide in a read
+func TestCheckReadOnlyStatementBypasses(t *testing.T) {
+	tests := []struct {
+		d     Dialect
+		query string
+	}{
+		{Postgres, "WITH x AS (DELETE FROM t RETURNING *) SELECT * FROM x"},
+		{Postgres, "WITH x AS (UPDATE t SET a = 1 RETURNING a) SELECT a FROM x"},
+		{Postgres, "SELECT 1; DROP TABLE t"},
+		{Postgres, "SELECT 1;;DROP TABLE t;"},
+		{Postgres, "SELECT 1 /* ; */; DELETE FROM t"},
+		{Postgres, "SELECT * INTO t2 FROM t"},
+		{Postgres, "SELECT * FROM t FOR UPDATE"},
+		{Postgres, "SELECT * FROM t FOR NO KEY UPDATE"},
+		{MySQL, "SELECT 1; DROP TABLE t"},
+		{MySQL, "SELECT * FROM t INTO OUTFILE '/tmp/t.csv'"},
+		{MySQL, "SELECT * FROM t INTO DUMPFILE '/tmp/t.bin'"},
+		{MySQL, "SELECT COUNT(*) INTO @v FROM t"},
+		{MySQL, "SELECT * FROM t FOR UPDATE"},
+		{MySQL, "SELECT * FROM t LOCK IN SHARE MODE"},
+		{MySQL, "SELECT 1 /*! , sleep(10) */"},
+		{MySQL, "SELECT 1 /*!50000 INTO OUTFILE '/tmp/x' */"},
+		// MySQL needs a space after --, so this subtracts rather than comments
+		{MySQL, "SELECT 1 --sleep(10)"},
+		{MySQL, "SELECT 1 --x\n; DROP TABLE t"},
+		{MSSQL, "SELECT * INTO t2 FROM t"},
+		{SQLite, "SELECT 1; ATTACH DATABASE 'x' AS y"},
+	}
+	for _, tt := range tests {
+		if err := CheckReadOnly(tt.query, tt.d); err == nil {
+			t.Errorf("%s: CheckReadOnly accepted %q", tt.d, tt.query)
+		}
+	}
+}
+
+// Statement keywords inside comments and strings are not statements
+func TestCheckReadOnlyAllowsHiddenKeywords(t *testing.T) {
+	tests := []struct {
+		d     Dialect
+		query string
+	}{
+		{Postgres, "SELECT 'DROP TABLE t; DELETE FROM t' AS note"},
+		{Postgres, "SELECT 1 /* DELETE FROM t; */ -- DROP TABLE t"},
+		{Postgres, "SELECT $$; DROP TABLE t$$"},
+		{Postgres, "SELECT 1 --sleep(10)"},
+		{MySQL, "SELECT 'it''s; DROP TABLE t', \"a\\\" ; INSERT\" FROM t # UPDATE t"},
+		{MySQL, "SELECT 1 -- ; DROP TABLE t"},
+		{MySQL, "SELECT `update`, `into` FROM `t`"},
+		{MSSQL, "SELECT 'EXEC xp_cmdshell' AS [drop] FROM t"},
+	}
+	for _, tt := range tests {
+		if err := CheckReadOnly(tt.query, tt.d); err != nil {
+			t.Errorf("%s: CheckReadOnly(%q) = %v", tt.d, tt.query, err)
+		}
+	}
+}
+
+// Quoted identifiers that are not calls of a denied function still pass
+func TestCheckReadOnlyAllowsQuotedNames(t *testing.T) {
+	tests := []struct {
+		d     Dialect
+		query string
+	}{
+		{Postgres, `SELECT "pg_sleep" FROM t`},
+		{Postgres, `SELECT "lower"(name), 'sleep' FROM "users"`},
+		{Postgres, `SELECT u & "mask" FROM t`},
+		{Postgres, `SELECT U&'caf\00e9'`},
+		{MySQL, "SELECT `sleep`, `file` FROM `jobs`"},
+		{MySQL, "SELECT COUNT(*) FROM `t` WHERE `sleep` > 1"},
+		{SQLite, "SELECT [readfile] FROM [files]"},
+		{DuckDB, `SELECT "read_csv" FROM "imports"`},
+		{MSSQL, "SELECT [openrowset], [name] FROM [dbo].[t]"},
+		{ClickHouse, "SELECT `file`, url FROM logs"},
+		{ClickHouse, "SELECT * FROM numbers(10)"},
+	}
+	for _, tt := range tests {
+		if err := CheckReadOnly(tt.query, tt.d); err != nil {
+			t.Errorf("%s: CheckReadOnly(%q) = %v", tt.d, tt.query, err)
+		}
+	}
+}
+
+func TestCheckWriteFunctionBypasses(t *testing.T) {
+	tests := []struct {
+		d     Dialect
+		query string
+	}{
+		{Postgres, `INSERT INTO t SELECT "dblink_exec"('x', 'DROP TABLE t')`},
+		{Postgres, "UPDATE t SET v = Pg_Sleep(10)"},
+		{MySQL, "UPDATE t SET v = `sleep`(10)"},
+		{MySQL, "DELETE FROM t WHERE id = get_lock /* x */ ('a', 1)"},
+		{MSSQL, "INSERT INTO t SELECT * FROM [openrowset]('x', 'y', 'z')"},
+		{ClickHouse, "INSERT INTO t SELECT * FROM `url`('http://x', CSV)"},
+	}
+	for _, tt := range tests {
+		if err := CheckWrite(tt.query, tt.d); err == nil {
+			t.Errorf("%s: CheckWrite accepted %q", tt.d, tt.query)
+		}
+	}
+}
+
+// A WITH clause has to lead into a write
+func TestCheckWriteWith(t *testing.T) {
+	tests := []struct {
+		d     Dialect
+		query string
+		ok    bool
+	}{
+		{Postgres, "WITH s AS (SELECT id FROM u) DELETE FROM t WHERE id IN (SELECT id FROM s)", true},
+		{Postgres, "WITH RECURSIVE s (n) AS (SELECT 1 UNION ALL SELECT n + 1 FROM s WHERE n < 5) INSERT INTO t SELECT n FROM s", true},
+		{Postgres, "WITH a AS MATERIALIZED (SELECT 1), b AS (SELECT 2) UPDATE t SET n = (SELECT * FROM b)", true},
+		{MySQL, "WITH s AS (SELECT 1 AS id) UPDATE t JOIN s ON s.id = t.id SET t.n = 1", true},
+		{Postgres, "WITH x AS (SELECT 1) SELECT * FROM x", false},
+		{Postgres, "WITH x AS (DELETE FROM t RETURNING *) SELECT * FROM x", false},
+		{Postgres, "WITH x AS (SELECT 1) VALUES (1)", false},
+		{Postgres, "WITH x AS (SELECT 1) TABLE x", false},
+		{MySQL, "WITH x AS (SELECT 1) SELECT * FROM x", false},
+		{Postgres, "WITH x AS (SELECT 1)", false},
+	}
+	for _, tt := range tests {
+		err := CheckWrite(tt.query, tt.d)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: CheckWrite(%q) = %v, want ok %v", tt.d, tt.query, err, tt.ok)
+		}
+	}
+}
+
+func TestUnquote(t *testing.T) {
+	tests := []struct {
+		d          Dialect
+		text, want string
+	}{
+		{Postgres, `"dblink_exec"`, "dblink_exec"},
+		{Postgres, `"a""b"`, `a"b`},
+		{Postgres, `'a''b'`, "a'b"},
+		{Postgres, `$$x$$`, "$$x$$"},
+		{Postgres, `E'x'`, "E'x'"},
+		{MySQL, "`a``b`", "a`b"},
+		{MySQL, "`a\\b`", "a\\b"},
+		{MySQL, `"a\"b"`, `a"b`},
+		{MSSQL, "[a]]b]", "a]b"},
+		{SQLite, "[a b]", "a b"},
+		{ClickHouse, "`fi\\le`", "file"},
+	}
+	for _, tt := range tests {
+		if got := unquote(tt.text, tt.d); got != tt.want {
+			t.Errorf("%s: unquote(%s) = %q, want %q", tt.d, tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestIdentifiers(t *testing.T) {
+	got, err := Identifiers("UPDATE `Shop`.`Orders` o JOIN users u ON u.id = o.user_id /* audit */ SET o.note = 'x' # done", MySQL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"update", "shop", "orders", "o", "join", "users", "u", "on", "id", "user_id", "set", "note", "x"}
+	if !slices.Equal(got, want) {
+		t.Errorf("Identifiers = %v, want %v", got, want)
+	}
+	if _, err := Identifiers("UPDATE t SET n = /*! 1 */ 2", MySQL); err == nil {
+		t.Error("Identifiers accepted an executable comment")
+	}
+}
+
+// T-SQL runs a batch of statements without semicolons between them, so a
+// statement keyword anywhere in the query starts another statement
+func TestCheckReadOnlyMSSQLBatch(t *testing.T) {
+	tests := []struct {
+		query string
+		ok    bool
+	}{
+		{"SELECT TOP (10) * FROM [dbo].[orders] ORDER BY [id]", true},
+		{"SELECT t.[kill], t.backup FROM t", true},
+		{"SELECT [exec], [set] FROM jobs", true},
+		{"SELECT 1 EXEC xp_cmdshell 'dir'", false},
+		{"SELECT 1 exec('DROP TABLE t')", false},
+		{"SELECT 1 WAITFOR DELAY '0:0:5'", false},
+		{"SELECT 1 SHUTDOWN", false},
+		{"SELECT 1 DECLARE @x INT", false},
+		{"SELECT 1 SET NOCOUNT ON", false},
+		{"SELECT 1 USE master", false},
+		{"SELECT 1 BEGIN TRAN", false},
+		{"SELECT * FROM t /* x */ KILL 52", false},
+		{"SELECT 1 DBCC DROPCLEANBUFFERS", false},
+		{"SELECT 1 UPDATE t SET a = 1", false},
+	}
+	for _, tt := range tests {
+		err := CheckReadOnly(tt.query, MSSQL)
+		if (err == nil) != tt.ok {
+			t.Errorf("CheckReadOnly(%q) = %v, want ok %v", tt.query, err, tt.ok)
+		}
+	}
+	// The words only start statements in T-SQL
+	if err := CheckReadOnly("SELECT 1 AS shutdown", Postgres); err != nil {
+		t.Errorf("CheckReadOnly on Postgres: %v", err)
+	}
+}
+
+func TestCheckWriteMSSQLBatch(t *testing.T) {
+	tests := []struct {
+		query string
+		ok    bool
+	}{
+		{"UPDATE t SET a = 1 WHERE id = 2", true},
+		{"UPDATE t SET a = REPLACE(a, 'x', 'y')", true},
+		{"DELETE TOP (10) FROM t", true},
+		{"INSERT INTO t (a) SELECT a FROM s", true},
+		{"MERGE INTO t USING s ON t.id = s.id WHEN MATCHED THEN UPDATE SET a = s.a WHEN NOT MATCHED THEN INSERT (id, a) VALUES (s.id, s.a);", true},
+		{"WITH s AS (SELECT 1 AS id) DELETE FROM t WHERE id IN (SELECT id FROM s)", true},
+		{"UPDATE t SET a = 1 DELETE FROM t", false},
+		{"INSERT INTO t VALUES (1) INSERT INTO t VALUES (2)", false},
+		{"INSERT INTO t EXEC sp_who", false},
+		{"UPDATE t SET a = 1 WAITFOR DELAY '0:0:5'", false},
+		{"DELETE FROM t DECLARE @x INT", false},
+		{"UPDATE t SET a = 1 COMMIT", false},
+		{"INSERT INTO t SELECT a FROM s UNION ALL SELECT a FROM u", true},
+		{"INSERT TOP (5) INTO t SELECT a FROM s", true},
+		{"UPDATE t SET a = (SELECT MAX(b) FROM s) WHERE id IN (SELECT id FROM u)", true},
+		{"UPDATE t SET a = 1 SELECT * INTO t2 FROM t", false},
+		{"UPDATE t SET a = 1 SELECT 1", false},
+		{"DELETE FROM t SELECT * FROM t", false},
+		{"INSERT INTO t VALUES (1) SELECT 1", false},
+		{"INSERT INTO t SELECT 1 SELECT 2", false},
+		{"INSERT INTO t SELECT * INTO t2 FROM s", false},
+		{"WITH s AS (SELECT 1 AS id) SELECT * INTO t2 FROM s", false},
+	}
+	for _, tt := range tests {
+		err := CheckWrite(tt.query, MSSQL)
+		if (err == nil) != tt.ok {
+			t.Errorf("CheckWrite(%q) = %v, want ok %v", tt.query, err, tt.ok)
+		}
+	}
+}
+
+func TestSubqueryMSSQL(t *testing.T) {
+	if got, ok := Subquery("SELECT a FROM t;", MSSQL); !ok || got != "SELECT a FROM t" {
+		t.Errorf("Subquery = %q, %v", got, ok)
+	}
+	// A CTE cannot be nested in a derived table in T-SQL
+	for _, query := range []string{"WITH s AS (SELECT 1 AS a) SELECT a FROM s", "VALUES (1)"} {
+		if _, ok := Subquery(query, MSSQL); ok {
+			t.Errorf("Subquery accepted %q", query)
+		}
+	}
+}
@@ -0,0 +1,10 @@
+-- Migration: 007_add_user_roles
+-- Description: Add role-based access control to users
+-- Version: 7
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS role VARCHAR(20) NOT NULL DEFAULT 'member';
+
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_role_check;
+ALTER TABLE users ADD CONSTRAINT users_role_check CHECK (role IN ('admin', 'member', 'viewer'));
+
+CREATE INDEX IF NOT EXISTS idx_users_role ON users(role);
@@ -0,0 +1,16 @@
+-- Migration: 008_add_prompt_ownership
+-- Description: Give prompts an owner and a visibility setting
+-- Version: 8
+
+ALTER TABLE prompts ADD COLUMN IF NOT EXISTS user_id INTEGER REFERENCES users(id) ON DELETE CASCADE;
+ALTER TABLE prompts ADD COLUMN IF NOT EXISTS visibility VARCHAR(20) NOT NULL DEFAULT 'private';
+
+ALTER TABLE prompts DROP CONSTRAINT IF EXISTS prompts_visibility_check;
+ALTER TABLE prompts ADD CONSTRAINT prompts_visibility_check CHECK (visibility IN ('private', 'team', 'public'));
+
+-- Prompts created before ownership existed were shared with everyone; keep
+-- them visible. Without an owner they can only be changed by admins.
+UPDATE prompts SET visibility = 'team' WHERE user_id IS NULL;
+
+CREATE INDEX IF NOT EXISTS idx_prompts_user_id ON prompts(user_id);
+CREATE INDEX IF NOT EXISTS idx_prompts_visibility ON prompts(visibility);
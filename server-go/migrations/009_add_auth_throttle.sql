@@ -0,0 +1,16 @@
+-- Migration: 009_add_auth_throttle
+-- Description: Track failed logins and registrations for rate limiting and lockout
+-- Version: 9
+
+-- One row per throttle key, e.g. 'login-user:alice' or 'login-ip:10.0.0.1'.
+-- failures counts attempts since window_start; a key whose count reaches
+-- its limit is locked until locked_until.
+CREATE TABLE IF NOT EXISTS auth_throttle (
+    key VARCHAR(200) PRIMARY KEY,
+    failures INTEGER NOT NULL DEFAULT 0,
+    window_start TIMESTAMP NOT NULL DEFAULT NOW(),
+    last_failure_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    locked_until TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_auth_throttle_last_failure ON auth_throttle(last_failure_at);
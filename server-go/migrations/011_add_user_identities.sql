@@ -0,0 +1,29 @@
+-- Migration: 011_add_user_identities
+-- Description: Link users to OpenID Connect identities and track SSO logins in progress
+-- Version: 11
+
+-- An identity is an (issuer, subject) pair from an ID token. A user can
+-- have several, and a local account can be linked to one after the fact.
+CREATE TABLE IF NOT EXISTS user_identities (
+    id BIGSERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    issuer VARCHAR(500) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    email VARCHAR(320),
+    created_at TIMESTAMP DEFAULT NOW(),
+    last_login_at TIMESTAMP,
+    UNIQUE (issuer, subject)
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_identities_user_id ON user_identities(user_id);
+
+-- State, nonce and PKCE verifier of a login between the redirect to the
+-- provider and its callback. link_user_id is set when an existing user is
+-- linking an identity instead of logging in.
+CREATE TABLE IF NOT EXISTS oidc_login_states (
+    state VARCHAR(64) PRIMARY KEY,
+    nonce VARCHAR(64) NOT NULL,
+    code_verifier VARCHAR(128) NOT NULL,
+    link_user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
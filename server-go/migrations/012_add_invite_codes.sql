@@ -0,0 +1,22 @@
+-- Migration: 012_add_invite_codes
+-- Description: Invite codes for controlled registration, and user emails
+-- Version: 12
+
+-- Codes are stored as SHA-256 hashes; prefix is shown to admins to tell
+-- them apart. A code is valid while uses < max_uses, it has not expired and
+-- it has not been revoked.
+CREATE TABLE IF NOT EXISTS invite_codes (
+    id BIGSERIAL PRIMARY KEY,
+    prefix VARCHAR(20) NOT NULL,
+    code_hash VARCHAR(64) NOT NULL UNIQUE,
+    note VARCHAR(200),
+    max_uses INTEGER NOT NULL DEFAULT 1 CHECK (max_uses > 0),
+    uses INTEGER NOT NULL DEFAULT 0,
+    expires_at TIMESTAMP NOT NULL,
+    created_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT NOW(),
+    revoked_at TIMESTAMP
+);
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email VARCHAR(320);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS invite_code_id BIGINT REFERENCES invite_codes(id) ON DELETE SET NULL;
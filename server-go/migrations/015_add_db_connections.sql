@@ -0,0 +1,23 @@
+-- Migration: 015_add_db_connections
+-- Description: Saved target database connections with encrypted passwords, per user or workspace
+-- Version: 15
+
+CREATE TABLE IF NOT EXISTS db_connections (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    workspace_id INTEGER REFERENCES workspaces(id) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    type VARCHAR(20) NOT NULL,
+    host VARCHAR(255) NOT NULL,
+    port INTEGER NOT NULL DEFAULT 0,
+    username VARCHAR(255) NOT NULL,
+    -- AES-256-GCM nonce followed by the sealed password; NULL for none
+    password_encrypted BYTEA,
+    database VARCHAR(255) NOT NULL DEFAULT '',
+    ssl BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMP DEFAULT NOW(),
+    updated_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_db_connections_user_id ON db_connections(user_id);
+CREATE INDEX IF NOT EXISTS idx_db_connections_workspace_id ON db_connections(workspace_id);
@@ -0,0 +1,19 @@
+-- Migration: 016_add_db_write_mode
+-- Description: Per-connection write permission and one-time confirmations for previewed writes
+-- Version: 16
+
+ALTER TABLE db_connections ADD COLUMN IF NOT EXISTS allow_writes BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- A previewed write waiting for its confirm call. Only the token hash is
+-- stored; a confirmation is deleted when used.
+CREATE TABLE IF NOT EXISTS db_write_confirmations (
+    token_hash VARCHAR(64) PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    connection_id INTEGER NOT NULL REFERENCES db_connections(id) ON DELETE CASCADE,
+    sql TEXT NOT NULL,
+    rows_affected BIGINT NOT NULL,
+    created_at TIMESTAMP DEFAULT NOW(),
+    expires_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_db_write_confirmations_expires_at ON db_write_confirmations(expires_at);